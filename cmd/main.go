@@ -5,11 +5,13 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/docopt/docopt-go"
@@ -24,9 +26,14 @@ import (
 )
 
 var args struct {
-	config string
-	create bool
-	repair bool
+	config    string
+	create    bool
+	repair    bool
+	loadrdb   string
+	replace   bool
+	restore   string
+	untilseq  uint64
+	untiltime time.Time
 }
 
 func init() {
@@ -61,13 +68,19 @@ func (c *Config) String() string {
 func main() {
 	usage := `
 Usage:
-	rpdb [--config=CONF] [--create|--repair] [--ncpu=N]
+	rpdb [--config=CONF] [--create|--repair] [--ncpu=N] [--load-rdb=FILE [--replace]]
+	rpdb [--config=CONF] [--ncpu=N] --restore=DIR [--until-seq=N|--until-time=TIME]
 
 Options:
 	-n N, --ncpu=N                    set runtime.GOMAXPROCS to N
 	-c CONF, --config=CONF            specify the config file
 	--create                          create if not exists
 	--repair                          repair database
+	--load-rdb=FILE                   load the rdb file before serving
+	--replace                         drop the existing data before loading the rdb file
+	--restore=DIR                     replace the database with the backup in DIR before serving
+	--until-seq=N                     replay the write ahead log up to the sequence N after restoring
+	--until-time=TIME                 replay the write ahead log up to TIME (unix seconds or "2006-01-02 15:04:05")
 `
 	d, err := docopt.Parse(usage, nil, true, "", false)
 	if err != nil {
@@ -86,6 +99,23 @@ Options:
 	args.config, _ = d["--config"].(string)
 	args.create, _ = d["--create"].(bool)
 	args.repair, _ = d["--repair"].(bool)
+	args.loadrdb, _ = d["--load-rdb"].(string)
+	args.replace, _ = d["--replace"].(bool)
+	args.restore, _ = d["--restore"].(string)
+	if s, ok := d["--until-seq"].(string); ok && len(s) != 0 {
+		if n, err := strconv.ParseUint(s, 10, 64); err != nil || n == 0 {
+			log.Panicf("parse --until-seq = '%s' failed", s)
+		} else {
+			args.untilseq = n
+		}
+	}
+	if s, ok := d["--until-time"].(string); ok && len(s) != 0 {
+		if t, err := parseTime(s); err != nil {
+			log.PanicErrorf(err, "parse --until-time failed")
+		} else {
+			args.untiltime = t
+		}
+	}
 
 	conf := &Config{
 		DBType:  "rocksdb",
@@ -103,18 +133,14 @@ Options:
 
 	log.Infof("load config\n%s\n\n", conf)
 
-	var db store.Database
-	switch t := strings.ToLower(conf.DBType); t {
-	default:
-		log.Panicf("unknown db type = '%s'", conf.DBType)
-	case "leveldb":
-		db, err = leveldb.Open(conf.DBPath, conf.LevelDB, args.create, args.repair)
-	case "rocksdb":
-		db, err = rocksdb.Open(conf.DBPath, conf.RocksDB, args.create, args.repair)
-	case "boltdb":
-		db, err = boltdb.Open(conf.DBPath, conf.BoltDB, args.create, args.repair)
+	if args.restore != "" {
+		log.Infof("restore database from backup '%s'", args.restore)
+		if err := restoreDatabase(conf, args.restore, conf.DBPath); err != nil {
+			log.PanicErrorf(err, "restore database failed")
+		}
 	}
 
+	db, err := openDatabase(conf, conf.DBPath, args.create, args.repair)
 	if err != nil {
 		log.PanicErrorf(err, "open database failed")
 	}
@@ -122,10 +148,26 @@ Options:
 	bl := rpdb.New(db)
 	defer bl.Close()
 
+	bl.SetOpener(conf.DBPath, func(path string, create bool) (store.Database, error) {
+		return openDatabase(conf, path, create, false)
+	})
+
 	if args.repair {
 		return
 	}
 
+	if args.restore != "" && conf.Service.WALPath != "" {
+		if err := replayWAL(bl, conf.Service.WALPath); err != nil {
+			log.PanicErrorf(err, "replay wal failed")
+		}
+	}
+
+	if args.loadrdb != "" {
+		if err := service.LoadRDBFile(bl, args.loadrdb, args.replace); err != nil {
+			log.PanicErrorf(err, "load rdb file failed")
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
@@ -141,3 +183,50 @@ Options:
 		log.ErrorErrorf(err, "service failed")
 	}
 }
+
+func openDatabase(conf *Config, path string, create, repair bool) (store.Database, error) {
+	switch t := strings.ToLower(conf.DBType); t {
+	default:
+		return nil, errors.Errorf("unknown db type = '%s'", conf.DBType)
+	case "leveldb":
+		return leveldb.Open(path, conf.LevelDB, create, repair)
+	case "rocksdb":
+		return rocksdb.Open(path, conf.RocksDB, create, repair)
+	case "boltdb":
+		return boltdb.Open(path, conf.BoltDB, create, repair)
+	}
+}
+
+func restoreDatabase(conf *Config, backup, path string) error {
+	switch t := strings.ToLower(conf.DBType); t {
+	default:
+		return errors.Errorf("unknown db type = '%s'", conf.DBType)
+	case "leveldb":
+		return leveldb.Restore(backup, path)
+	case "rocksdb":
+		return rocksdb.Restore(backup, path)
+	case "boltdb":
+		return boltdb.Restore(backup, path)
+	}
+}
+
+// replayWAL replays the write ahead log on the restored database. The log is
+// archived afterwards, since the records after the recovery point no longer
+// apply to the data, and a new log is started from there.
+func replayWAL(bl *rpdb.Rpdb, dir string) error {
+	seq, err := service.ReplayWAL(bl, dir, args.untilseq, args.untiltime)
+	if err != nil {
+		return err
+	}
+	archive := fmt.Sprintf("%s.%d", dir, time.Now().Unix())
+	log.Infof("recovered to seq = %d, archive wal to '%s'", seq, archive)
+	return errors.Trace(os.Rename(dir, archive))
+}
+
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local)
+	return t, errors.Trace(err)
+}
@@ -0,0 +1,105 @@
+#include "backup.h"
+
+#include <stdlib.h>
+#include <string.h>
+#include <string>
+#include <vector>
+
+#include "rocksdb/db.h"
+#include "rocksdb/env.h"
+#include "rocksdb/utilities/backupable_db.h"
+
+using rocksdb::BackupableDBOptions;
+using rocksdb::BackupEngine;
+using rocksdb::BackupInfo;
+using rocksdb::DB;
+using rocksdb::Env;
+using rocksdb::Status;
+
+// rocksdb_t is opaque outside of rocksdb/db/c.cc, it has to be declared the
+// same way here to reach the DB behind it.
+struct rocksdb_t { DB* rep; };
+
+struct gorocks_backup_engine_t { BackupEngine* rep; };
+
+static bool SaveError(char** errptr, const Status& s) {
+  if (s.ok()) {
+    return false;
+  }
+  if (*errptr != NULL) {
+    free(*errptr);
+  }
+  *errptr = strdup(s.ToString().c_str());
+  return true;
+}
+
+extern "C" {
+
+gorocks_backup_engine_t* gorocks_backup_engine_open(
+    const char* backup_dir, char** errptr) {
+  BackupEngine* be;
+  if (SaveError(errptr, BackupEngine::Open(
+          Env::Default(), BackupableDBOptions(std::string(backup_dir)), &be))) {
+    return NULL;
+  }
+  gorocks_backup_engine_t* result = new gorocks_backup_engine_t;
+  result->rep = be;
+  return result;
+}
+
+void gorocks_backup_engine_close(gorocks_backup_engine_t* be) {
+  delete be->rep;
+  delete be;
+}
+
+void gorocks_backup_engine_create_new_backup(
+    gorocks_backup_engine_t* be, rocksdb_t* db,
+    unsigned char flush_before_backup, char** errptr) {
+  SaveError(errptr, be->rep->CreateNewBackup(db->rep, flush_before_backup));
+}
+
+void gorocks_backup_engine_stop_backup(gorocks_backup_engine_t* be) {
+  be->rep->StopBackup();
+}
+
+void gorocks_backup_engine_purge_old_backups(
+    gorocks_backup_engine_t* be, uint32_t num_backups_to_keep, char** errptr) {
+  SaveError(errptr, be->rep->PurgeOldBackups(num_backups_to_keep));
+}
+
+void gorocks_backup_engine_delete_backup(
+    gorocks_backup_engine_t* be, uint32_t backup_id, char** errptr) {
+  SaveError(errptr, be->rep->DeleteBackup(backup_id));
+}
+
+gorocks_backup_info_t* gorocks_backup_engine_get_backup_info(
+    gorocks_backup_engine_t* be, int* count) {
+  std::vector<BackupInfo> infos;
+  be->rep->GetBackupInfo(&infos);
+  *count = static_cast<int>(infos.size());
+  gorocks_backup_info_t* result = static_cast<gorocks_backup_info_t*>(
+      malloc(sizeof(gorocks_backup_info_t) * (infos.size() + 1)));
+  for (size_t i = 0; i < infos.size(); i++) {
+    result[i].backup_id = infos[i].backup_id;
+    result[i].timestamp = infos[i].timestamp;
+    result[i].size = infos[i].size;
+    result[i].number_files = infos[i].number_files;
+  }
+  return result;
+}
+
+void gorocks_backup_engine_restore_db_from_latest_backup(
+    gorocks_backup_engine_t* be, const char* db_dir, const char* wal_dir,
+    char** errptr) {
+  SaveError(errptr, be->rep->RestoreDBFromLatestBackup(
+      std::string(db_dir), std::string(wal_dir)));
+}
+
+void gorocks_backup_engine_restore_db_from_backup(
+    gorocks_backup_engine_t* be, uint32_t backup_id, const char* db_dir,
+    const char* wal_dir, char** errptr) {
+  SaveError(errptr, be->rep->RestoreDBFromBackup(
+      backup_id, std::string(db_dir), std::string(wal_dir)));
+}
+
+}  // end extern "C"
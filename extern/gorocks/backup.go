@@ -0,0 +1,132 @@
+package gorocks
+
+/*
+#cgo LDFLAGS: -lrocksdb
+#cgo CXXFLAGS: -std=c++11
+#include <stdlib.h>
+#include "backup.h"
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// BackupEngine keeps the backups of rocksdb databases in a directory. The
+// table files are shared between the backups, so every new backup only
+// copies the files that are not in the directory yet.
+//
+// To prevent memory leaks, a BackupEngine must have Close called on it when
+// it is no longer needed by the program.
+type BackupEngine struct {
+	Engine *C.gorocks_backup_engine_t
+}
+
+// BackupInfo describes a backup kept by a BackupEngine, the timestamp is in
+// seconds.
+type BackupInfo struct {
+	ID          uint32
+	Timestamp   int64
+	Size        uint64
+	NumberFiles uint32
+}
+
+func saveError(errStr *C.char) error {
+	if errStr == nil {
+		return nil
+	}
+	gs := C.GoString(errStr)
+	C.free(unsafe.Pointer(errStr))
+	return DatabaseError(gs)
+}
+
+// OpenBackupEngine opens the backup directory dir, which is created if
+// missing.
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	var errStr *C.char
+	cdir := C.CString(dir)
+	defer C.free(unsafe.Pointer(cdir))
+
+	be := C.gorocks_backup_engine_open(cdir, &errStr)
+	if err := saveError(errStr); err != nil {
+		return nil, err
+	}
+	return &BackupEngine{be}, nil
+}
+
+// Close deallocates the BackupEngine, freeing the underlying struct.
+func (be *BackupEngine) Close() {
+	C.gorocks_backup_engine_close(be.Engine)
+}
+
+// CreateNewBackup takes a consistent backup of db. If flush is true, the
+// memtables are flushed first and the write ahead log is not copied.
+func (be *BackupEngine) CreateNewBackup(db *DB, flush bool) error {
+	var errStr *C.char
+	C.gorocks_backup_engine_create_new_backup(be.Engine, db.Ldb, boolToUchar(flush), &errStr)
+	return saveError(errStr)
+}
+
+// StopBackup makes a running CreateNewBackup return as soon as possible, it
+// is safe to call it from another goroutine.
+func (be *BackupEngine) StopBackup() {
+	C.gorocks_backup_engine_stop_backup(be.Engine)
+}
+
+// PurgeOldBackups deletes all but the newest keep backups.
+func (be *BackupEngine) PurgeOldBackups(keep uint32) error {
+	var errStr *C.char
+	C.gorocks_backup_engine_purge_old_backups(be.Engine, C.uint32_t(keep), &errStr)
+	return saveError(errStr)
+}
+
+// DeleteBackup deletes the backup id.
+func (be *BackupEngine) DeleteBackup(id uint32) error {
+	var errStr *C.char
+	C.gorocks_backup_engine_delete_backup(be.Engine, C.uint32_t(id), &errStr)
+	return saveError(errStr)
+}
+
+// GetBackupInfo returns the backups kept, from the oldest to the newest.
+func (be *BackupEngine) GetBackupInfo() []BackupInfo {
+	var n C.int
+	cinfos := C.gorocks_backup_engine_get_backup_info(be.Engine, &n)
+	defer C.free(unsafe.Pointer(cinfos))
+
+	infos := make([]BackupInfo, int(n))
+	size := unsafe.Sizeof(*cinfos)
+	for i := range infos {
+		c := (*C.gorocks_backup_info_t)(unsafe.Pointer(uintptr(unsafe.Pointer(cinfos)) + uintptr(i)*size))
+		infos[i] = BackupInfo{
+			ID:          uint32(c.backup_id),
+			Timestamp:   int64(c.timestamp),
+			Size:        uint64(c.size),
+			NumberFiles: uint32(c.number_files),
+		}
+	}
+	return infos
+}
+
+// RestoreDBFromLatestBackup restores the newest backup to dbDir and walDir,
+// the database must not be opened, its existing files are deleted.
+func (be *BackupEngine) RestoreDBFromLatestBackup(dbDir, walDir string) error {
+	var errStr *C.char
+	cdb, cwal := C.CString(dbDir), C.CString(walDir)
+	defer C.free(unsafe.Pointer(cdb))
+	defer C.free(unsafe.Pointer(cwal))
+
+	C.gorocks_backup_engine_restore_db_from_latest_backup(be.Engine, cdb, cwal, &errStr)
+	return saveError(errStr)
+}
+
+// RestoreDBFromBackup is like RestoreDBFromLatestBackup, but restores the
+// backup id.
+func (be *BackupEngine) RestoreDBFromBackup(id uint32, dbDir, walDir string) error {
+	var errStr *C.char
+	cdb, cwal := C.CString(dbDir), C.CString(walDir)
+	defer C.free(unsafe.Pointer(cdb))
+	defer C.free(unsafe.Pointer(cwal))
+
+	C.gorocks_backup_engine_restore_db_from_backup(be.Engine, C.uint32_t(id), cdb, cwal, &errStr)
+	return saveError(errStr)
+}
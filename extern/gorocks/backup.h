@@ -0,0 +1,56 @@
+/* C bindings of the rocksdb backup engine, which the C API of the vendored
+   rocksdb doesn't provide. They follow the conventions of rocksdb/c.h. */
+
+#ifndef GOROCKS_BACKUP_H_
+#define GOROCKS_BACKUP_H_
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+#include <stdint.h>
+#include "rocksdb/c.h"
+
+typedef struct gorocks_backup_engine_t gorocks_backup_engine_t;
+
+typedef struct gorocks_backup_info_t {
+  uint32_t backup_id;
+  int64_t timestamp;
+  uint64_t size;
+  uint32_t number_files;
+} gorocks_backup_info_t;
+
+extern gorocks_backup_engine_t* gorocks_backup_engine_open(
+    const char* backup_dir, char** errptr);
+
+extern void gorocks_backup_engine_close(gorocks_backup_engine_t* be);
+
+extern void gorocks_backup_engine_create_new_backup(
+    gorocks_backup_engine_t* be, rocksdb_t* db,
+    unsigned char flush_before_backup, char** errptr);
+
+extern void gorocks_backup_engine_stop_backup(gorocks_backup_engine_t* be);
+
+extern void gorocks_backup_engine_purge_old_backups(
+    gorocks_backup_engine_t* be, uint32_t num_backups_to_keep, char** errptr);
+
+extern void gorocks_backup_engine_delete_backup(
+    gorocks_backup_engine_t* be, uint32_t backup_id, char** errptr);
+
+/* Returns an array of *count elements that must be released with free(). */
+extern gorocks_backup_info_t* gorocks_backup_engine_get_backup_info(
+    gorocks_backup_engine_t* be, int* count);
+
+extern void gorocks_backup_engine_restore_db_from_latest_backup(
+    gorocks_backup_engine_t* be, const char* db_dir, const char* wal_dir,
+    char** errptr);
+
+extern void gorocks_backup_engine_restore_db_from_backup(
+    gorocks_backup_engine_t* be, uint32_t backup_id, const char* db_dir,
+    const char* wal_dir, char** errptr);
+
+#ifdef __cplusplus
+}  /* end extern "C" */
+#endif
+
+#endif  /* GOROCKS_BACKUP_H_ */
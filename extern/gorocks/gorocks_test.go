@@ -322,6 +322,72 @@ func TestIterationValidityLimits(t *testing.T) {
 	}
 }
 
+func TestBackupEngine(t *testing.T) {
+	dbname := tempDir(t)
+	defer deleteDBDirectory(t, dbname)
+	backupdir := tempDir(t)
+	defer deleteDBDirectory(t, backupdir)
+	options := NewOptions()
+	options.SetCreateIfMissing(true)
+	ro := NewReadOptions()
+	wo := NewWriteOptions()
+	_ = DestroyDatabase(dbname, options)
+	db, err := Open(dbname, options)
+	if err != nil {
+		t.Fatalf("Database could not be opened: %v", err)
+	}
+	be, err := OpenBackupEngine(backupdir)
+	if err != nil {
+		t.Fatalf("Backup engine could not be opened: %v", err)
+	}
+	defer be.Close()
+
+	db.Put(wo, []byte("foo"), []byte("a"))
+	if err := be.CreateNewBackup(db, true); err != nil {
+		t.Fatalf("CreateNewBackup failed: %v", err)
+	}
+	db.Put(wo, []byte("foo"), []byte("b"))
+	if err := be.CreateNewBackup(db, true); err != nil {
+		t.Fatalf("CreateNewBackup failed: %v", err)
+	}
+	db.Close()
+
+	infos := be.GetBackupInfo()
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 backups, got %d", len(infos))
+	}
+	if infos[0].ID >= infos[1].ID {
+		t.Errorf("backups are not ordered: %v", infos)
+	}
+
+	if err := be.RestoreDBFromBackup(infos[0].ID, dbname, dbname); err != nil {
+		t.Fatalf("RestoreDBFromBackup failed: %v", err)
+	}
+	db, err = Open(dbname, options)
+	if err != nil {
+		t.Fatalf("Database could not be opened: %v", err)
+	}
+	CheckGet(t, "restore first backup", db, ro, []byte("foo"), []byte("a"))
+	db.Close()
+
+	if err := be.RestoreDBFromLatestBackup(dbname, dbname); err != nil {
+		t.Fatalf("RestoreDBFromLatestBackup failed: %v", err)
+	}
+	db, err = Open(dbname, options)
+	if err != nil {
+		t.Fatalf("Database could not be opened: %v", err)
+	}
+	CheckGet(t, "restore latest backup", db, ro, []byte("foo"), []byte("b"))
+	db.Close()
+
+	if err := be.PurgeOldBackups(1); err != nil {
+		t.Errorf("PurgeOldBackups failed: %v", err)
+	}
+	if infos := be.GetBackupInfo(); len(infos) != 1 {
+		t.Errorf("expected 1 backup after purge, got %d", len(infos))
+	}
+}
+
 func CheckGet(t *testing.T, where string, db *DB, roptions *ReadOptions, key, expected []byte) {
 	getValue, err := db.Get(roptions, key)
 
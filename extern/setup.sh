@@ -20,5 +20,5 @@ CGO_CFLAGS="-I${BUILD}" CGO_LDFLAGS="-L${BUILD} -lleveldb -lsnappy -lstdc++" go
 cd .. || exit 1
 
 cd ./gorocks
-CGO_CFLAGS="-I${BUILD}" CGO_LDFLAGS="-L${BUILD} -lrocksdb -lsnappy -llz4 -lbz2 -lz -lm -lstdc++" go install ./
+CGO_CFLAGS="-I${BUILD}" CGO_CXXFLAGS="-I${BUILD}" CGO_LDFLAGS="-L${BUILD} -lrocksdb -lsnappy -llz4 -lbz2 -lz -lm -lstdc++" go install ./
 cd .. || exit 1
@@ -0,0 +1,220 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+)
+
+var (
+	ErrWALDisabled  = errors.Static("rpdb wal is disabled")
+	ErrCDCTruncated = errors.Static("cdc sequence is no longer retained")
+)
+
+// Keys returns the keys written by the record.
+func (r *WALRecord) Keys() [][]byte {
+	return r.Forward().Keys()
+}
+
+// ChangeStream tails the committed writes in the order of their sequence. It
+// reads the write ahead log, so a subscriber can resume from any sequence
+// still retained on the disk.
+type ChangeStream struct {
+	w    *WAL
+	next uint64
+
+	f    *os.File
+	name string
+	off  int64
+	done string
+}
+
+// Subscribe returns a stream of the writes committed after the sequence from,
+// which requires the write ahead log.
+func (b *Rpdb) Subscribe(from uint64) (*ChangeStream, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.release()
+	if b.wal == nil {
+		return nil, errors.Trace(ErrWALDisabled)
+	}
+	return &ChangeStream{w: b.wal, next: from + 1}, nil
+}
+
+// ChangeRange returns the sequences of the oldest and the newest records a
+// subscriber can still read.
+func (b *Rpdb) ChangeRange() (uint64, uint64, error) {
+	if err := b.acquire(); err != nil {
+		return 0, 0, err
+	}
+	defer b.release()
+	if b.wal == nil {
+		return 0, 0, errors.Trace(ErrWALDisabled)
+	}
+	first, err := b.wal.FirstSeq()
+	if err != nil {
+		return 0, 0, err
+	}
+	return first, b.wal.Seq(), nil
+}
+
+// Seq returns the sequence of the last record returned.
+func (s *ChangeStream) Seq() uint64 {
+	return s.next - 1
+}
+
+// Next returns the next record, waiting at most timeout for it to be
+// committed. It returns nil if there is none yet, or the error of the log if
+// it has stopped. ErrCDCTruncated means the records can't be read anymore.
+func (s *ChangeStream) Next(timeout time.Duration) (*WALRecord, error) {
+	var expire <-chan time.Time
+	for {
+		name, size, appended := s.w.tail()
+		r, err := s.read(name, size)
+		if err != nil || r != nil {
+			return r, err
+		}
+		// the log has stopped, no record is going to be appended
+		if err := s.w.Err(); err != nil {
+			return nil, err
+		}
+		if expire == nil {
+			if timeout <= 0 {
+				return nil, nil
+			}
+			expire = time.After(timeout)
+		}
+		select {
+		case <-appended:
+		case <-expire:
+			return nil, nil
+		}
+	}
+}
+
+// read returns the next record, or nil if it hasn't been written. The file
+// being written is only read up to size, which has been written completely.
+func (s *ChangeStream) read(name string, size int64) (*WALRecord, error) {
+	for {
+		if s.f == nil {
+			if ok, err := s.open(); err != nil || !ok {
+				return nil, err
+			}
+		}
+		limit := int64(-1)
+		if s.name == name {
+			limit = size
+		}
+		r, n, err := readWALRecordAt(s.f, s.off, limit)
+		switch {
+		case err != nil && !errors.Equal(err, io.EOF):
+			return nil, err
+		case err != nil:
+			if s.name == name {
+				return nil, nil
+			}
+			// the file is complete, continue with the next one
+			s.done = s.name
+			s.Close()
+			continue
+		}
+		s.off += n
+		if r.Seq < s.next {
+			continue
+		}
+		if r.Seq != s.next {
+			// the log skipped the records of the writes it missed, e.g. the
+			// data was replaced before a crash, so the subscriber must resync
+			log.Warnf("cdc wal has a gap, seq = %d, expect = %d", r.Seq, s.next)
+			return nil, errors.Trace(ErrCDCTruncated)
+		}
+		s.next++
+		return r, nil
+	}
+}
+
+// open opens the file that holds the next record, it returns false if the
+// record hasn't been written yet.
+func (s *ChangeStream) open() (bool, error) {
+	names, seqs, err := walFiles(s.w.Dir())
+	if err != nil {
+		return false, err
+	}
+	i := len(seqs) - 1
+	for i >= 0 && seqs[i] > s.next {
+		i--
+	}
+	if i < 0 {
+		if s.next > s.w.Seq() {
+			return false, nil
+		}
+		return false, errors.Trace(ErrCDCTruncated)
+	}
+	if names[i] == s.done {
+		if i++; i == len(names) {
+			return false, nil
+		}
+	}
+	f, err := os.Open(names[i])
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	s.f, s.name, s.off = f, names[i], 0
+	return true, nil
+}
+
+// Close closes the file being read, the stream reopens it on the next read.
+func (s *ChangeStream) Close() {
+	if s.f != nil {
+		s.f.Close()
+		s.f, s.name = nil, ""
+	}
+}
+
+// readWALRecordAt reads the record at off, and returns io.EOF if the record
+// isn't complete before limit or the end of the file. A negative limit means
+// no limit.
+func readWALRecordAt(f *os.File, off, limit int64) (*WALRecord, int64, error) {
+	var h [8]byte
+	if limit >= 0 && off+int64(len(h)) > limit {
+		return nil, 0, io.EOF
+	}
+	if _, err := f.ReadAt(h[:], off); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errors.Trace(err)
+	}
+	n := binary.LittleEndian.Uint32(h[0:])
+	if n > walMaxRecordSize {
+		return nil, 0, errors.Trace(ErrWALCorrupted)
+	}
+	end := off + int64(len(h)) + int64(n)
+	if limit >= 0 && end > limit {
+		return nil, 0, io.EOF
+	}
+	p := make([]byte, n)
+	if _, err := f.ReadAt(p, off+int64(len(h))); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errors.Trace(err)
+	}
+	if crc32.ChecksumIEEE(p) != binary.LittleEndian.Uint32(h[4:]) {
+		return nil, 0, errors.Trace(ErrWALCorrupted)
+	}
+	r, err := decodeWALRecord(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, end - off, nil
+}
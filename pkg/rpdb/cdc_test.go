@@ -0,0 +1,81 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/store/rocksdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+)
+
+func TestChangeStream(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-cdc"
+	const dir = "/tmp/testdb-wal-cdc"
+	os.RemoveAll(path)
+	os.RemoveAll(dir)
+	db, err := rocksdb.Open(path, rocksdb.NewDefaultConfig(), true, false)
+	checkerror(t, err, true)
+	bl := New(db)
+	defer bl.Close()
+
+	_, err = bl.Subscribe(0)
+	checkerror(t, nil, errors.Equal(err, ErrWALDisabled))
+
+	w, err := OpenWAL(dir, 1, 3)
+	checkerror(t, err, true)
+	checkerror(t, bl.SetWAL(w), true)
+
+	s, err := bl.Subscribe(0)
+	checkerror(t, err, true)
+	defer s.Close()
+	r, err := s.Next(0)
+	checkerror(t, err, r == nil)
+	r, err = s.Next(time.Millisecond * 10)
+	checkerror(t, err, r == nil)
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		bl.Set(1, "a", "1")
+	}()
+	r, err = s.Next(time.Second * 5)
+	checkerror(t, err, r != nil && r.Seq == 1 && r.DB == 1 && r.Op == "Set")
+	keys := r.Keys()
+	checkerror(t, nil, len(keys) == 1 && string(keys[0]) == "a")
+
+	for seq := uint64(2); seq <= 5; seq++ {
+		checkerror(t, bl.Set(0, "b", "2"), true)
+		r, err = s.Next(0)
+		checkerror(t, err, r != nil && r.Seq == seq)
+	}
+	_, err = bl.Del(0, "a", "b")
+	checkerror(t, err, true)
+	r, err = s.Next(0)
+	checkerror(t, err, r != nil && r.Seq == 6 && r.Op == "Del" && len(r.Keys()) == 2)
+	checkerror(t, nil, s.Seq() == 6)
+	r, err = s.Next(0)
+	checkerror(t, err, r == nil)
+
+	first, last, err := bl.ChangeRange()
+	checkerror(t, err, first == 4 && last == 6)
+
+	s2, err := bl.Subscribe(first - 1)
+	checkerror(t, err, true)
+	defer s2.Close()
+	r, err = s2.Next(0)
+	checkerror(t, err, r != nil && r.Seq == first)
+
+	s3, err := bl.Subscribe(0)
+	checkerror(t, err, true)
+	defer s3.Close()
+	_, err = s3.Next(0)
+	checkerror(t, nil, errors.Equal(err, ErrCDCTruncated))
+
+	w.skipTo(10)
+	checkerror(t, bl.Set(0, "c", "3"), true)
+	_, err = s.Next(0)
+	checkerror(t, nil, errors.Equal(err, ErrCDCTruncated))
+}
@@ -0,0 +1,423 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+var (
+	ErrKeyRestoring = errors.Static("key is being restored in chunks")
+	ErrNotRestoring = errors.Static("key is not being restored in chunks")
+)
+
+const DefaultMigrateChunkSize = 1024
+
+// restoringTTL is how long a key restored in chunks waits for its next chunk.
+// A restore left unfinished, e.g. when the link to the source breaks before
+// SLOTSRESTOREABORT is sent, expires and the key is dropped.
+var restoringTTL = time.Minute
+
+// restoringCode marks the meta row of a key restored in chunks, until
+// SLOTSRESTORECOMMIT replaces it with the meta row of the object.
+const restoringCode ObjectCode = '~'
+
+// restoringRow is the meta row of a key being restored in chunks. The chunks
+// are stored as the data rows of the object, which can't be read before the
+// meta row of the object is written.
+type restoringRow struct {
+	*rpdbRowHelper
+
+	Object uint64
+	Seq    uint64
+	Size   int64
+}
+
+func newRestoringRow(db uint32, key []byte) *restoringRow {
+	o := &restoringRow{}
+	o.lazyInit(newRpdbRowHelper(db, key, restoringCode))
+	return o
+}
+
+func (o *restoringRow) lazyInit(h *rpdbRowHelper) {
+	o.rpdbRowHelper = h
+	o.metaValueRefs = []interface{}{&o.Object, &o.Seq, &o.Size}
+}
+
+func (o *restoringRow) deleteObject(b *Rpdb, bt *store.Batch) error {
+	it := b.getIterator()
+	defer b.putIterator(it)
+	for pfx := it.SeekTo(o.DataKeyPrefix()); it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, pfx) {
+			break
+		}
+		bt.Del(key)
+	}
+	bt.Del(o.MetaKey())
+	return it.Error()
+}
+
+func (o *restoringRow) storeObject(b *Rpdb, bt *store.Batch, expireat uint64, obj interface{}) error {
+	return errors.Trace(ErrKeyRestoring)
+}
+
+func (o *restoringRow) loadObjectValue(r rpdbReader) (interface{}, error) {
+	return nil, errors.Trace(ErrKeyRestoring)
+}
+
+// SetMigrateChunkSize makes SLOTSMGRT* send the objects with more than n
+// elements in chunks of n elements, a non-positive n means the default.
+func (b *Rpdb) SetMigrateChunkSize(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.chunkSize = int64(n)
+}
+
+func (b *Rpdb) migrateChunkSize() int64 {
+	if b.chunkSize <= 0 {
+		return DefaultMigrateChunkSize
+	}
+	return b.chunkSize
+}
+
+// SLOTSRESTORECHUNK key seq value
+func (b *Rpdb) SlotsRestoreChunk(db uint32, args ...interface{}) error {
+	if len(args) != 3 {
+		return errArguments("len(args) = %d, expect = 3", len(args))
+	}
+
+	var key, value []byte
+	var seq uint64
+	for i, ref := range []interface{}{&key, &seq, &value} {
+		if err := parseArgument(args[i], ref); err != nil {
+			return errArguments("parse args[%d] failed, %s", i, err)
+		}
+	}
+	obj, err := rdb.DecodeDump(value)
+	if err != nil {
+		return errArguments("decode args[%d] failed, %s", 2, err)
+	}
+
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+
+	o, err := loadRpdbRow(b, db, key)
+	if err != nil {
+		return err
+	}
+	bt := store.NewBatch()
+	x, ok := o.(*restoringRow)
+	switch {
+	case seq == 0:
+		// the first chunk replaces the key, or an unfinished restore of it
+		if o != nil {
+			if err := o.deleteObject(b, bt); err != nil {
+				return err
+			}
+		}
+		x = newRestoringRow(db, key)
+	case !ok || x.IsExpired():
+		return errors.Trace(ErrNotRestoring)
+	case x.Seq != seq:
+		return errors.Errorf("chunk seq = %d, expect = %d", seq, x.Seq)
+	}
+
+	code, n, err := storeChunk(bt, db, key, x.Size, obj)
+	if err != nil {
+		return err
+	}
+	if x.Object != 0 && x.Object != uint64(code) {
+		return errors.Errorf("chunk of %s, expect %s", code, ObjectCode(x.Object))
+	}
+	x.Object, x.Seq, x.Size = uint64(code), seq+1, x.Size+n
+	x.ExpireAt = nowms() + uint64(restoringTTL/time.Millisecond)
+	bt.Set(x.MetaKey(), x.MetaValue())
+	fw := &Forward{DB: db, Op: "SlotsRestoreChunk", Args: args}
+	return b.commit(bt, fw)
+}
+
+// SLOTSRESTORECOMMIT key ttlms
+func (b *Rpdb) SlotsRestoreCommit(db uint32, args ...interface{}) error {
+	if len(args) != 2 {
+		return errArguments("len(args) = %d, expect = 2", len(args))
+	}
+
+	var key []byte
+	var ttlms int64
+	for i, ref := range []interface{}{&key, &ttlms} {
+		if err := parseArgument(args[i], ref); err != nil {
+			return errArguments("parse args[%d] failed, %s", i, err)
+		}
+	}
+	expireat := uint64(0)
+	if ttlms != 0 {
+		if v, ok := TTLmsToExpireAt(ttlms); ok && v > 0 {
+			expireat = v
+		} else {
+			return errArguments("parse args[%d] ttlms = %d", 1, ttlms)
+		}
+	}
+
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+
+	o, err := loadRpdbRow(b, db, key)
+	if err != nil {
+		return err
+	}
+	x, ok := o.(*restoringRow)
+	if !ok || x.IsExpired() {
+		return errors.Trace(ErrNotRestoring)
+	}
+
+	var meta rpdbRow
+	switch ObjectCode(x.Object) {
+	default:
+		return errors.Trace(ErrObjectCode)
+	case HashCode:
+		y := newHashRow(db, key)
+		y.Size = x.Size
+		meta = y
+	case ListCode:
+		y := newListRow(db, key)
+		y.Lindex, y.Rindex = 0, x.Size
+		meta = y
+	case ZSetCode:
+		y := newZSetRow(db, key)
+		y.Size = x.Size
+		meta = y
+	case SetCode:
+		y := newSetRow(db, key)
+		y.Size = x.Size
+		meta = y
+	}
+	meta.SetExpireAt(expireat)
+
+	bt := store.NewBatch()
+	bt.Set(meta.MetaKey(), meta.MetaValue())
+	fw := &Forward{DB: db, Op: "SlotsRestoreCommit", Args: args, ExpireAt: []uint64{expireat}}
+	return b.commit(bt, fw)
+}
+
+// SLOTSRESTOREABORT key
+func (b *Rpdb) SlotsRestoreAbort(db uint32, args ...interface{}) (int64, error) {
+	if len(args) != 1 {
+		return 0, errArguments("len(args) = %d, expect = 1", len(args))
+	}
+
+	var key []byte
+	if err := parseArgument(args[0], &key); err != nil {
+		return 0, errArguments("parse args[%d] failed, %s", 0, err)
+	}
+
+	if err := b.acquire(); err != nil {
+		return 0, err
+	}
+	defer b.release()
+
+	o, err := loadRpdbRow(b, db, key)
+	if err != nil {
+		return 0, err
+	}
+	x, ok := o.(*restoringRow)
+	if !ok {
+		return 0, nil
+	}
+	bt := store.NewBatch()
+	if err := x.deleteObject(b, bt); err != nil {
+		return 0, err
+	}
+	fw := &Forward{DB: db, Op: "SlotsRestoreAbort", Args: args}
+	return 1, b.commit(bt, fw)
+}
+
+// storeChunk stores the elements of the partial object obj as data rows of
+// key, the elements of a list are stored from index size. It returns the
+// kind of the object and the number of elements stored.
+func storeChunk(bt *store.Batch, db uint32, key []byte, size int64, obj interface{}) (ObjectCode, int64, error) {
+	switch x := obj.(type) {
+	default:
+		return 0, 0, errors.Trace(ErrObjectValue)
+	case rdb.Hash:
+		o := newHashRow(db, key)
+		ms := &markSet{}
+		for i, e := range x {
+			if e == nil || len(e.Field) == 0 || len(e.Value) == 0 {
+				return 0, 0, errArguments("hash[%d] is invalid", i)
+			}
+			o.Field, o.Value = e.Field, e.Value
+			ms.Set(o.Field)
+			bt.Set(o.DataKey(), o.DataValue())
+		}
+		return HashCode, ms.Len(), nil
+	case rdb.List:
+		o := newListRow(db, key)
+		for i, v := range x {
+			if len(v) == 0 {
+				return 0, 0, errArguments("list[%d], len(value) = %d", i, len(v))
+			}
+			o.Index, o.Value = size+int64(i), v
+			bt.Set(o.DataKey(), o.DataValue())
+		}
+		return ListCode, int64(len(x)), nil
+	case rdb.ZSet:
+		o := newZSetRow(db, key)
+		ms := &markSet{}
+		for i, e := range x {
+			if e == nil || len(e.Member) == 0 {
+				return 0, 0, errArguments("zset[%d] is invalid", i)
+			}
+			o.Member, o.Score = e.Member, e.Score
+			ms.Set(o.Member)
+			bt.Set(o.DataKey(), o.DataValue())
+		}
+		return ZSetCode, ms.Len(), nil
+	case rdb.Set:
+		o := newSetRow(db, key)
+		ms := &markSet{}
+		for i, m := range x {
+			if len(m) == 0 {
+				return 0, 0, errArguments("set[%d], len(member) = %d", i, len(m))
+			}
+			o.Member = m
+			ms.Set(o.Member)
+			bt.Set(o.DataKey(), o.DataValue())
+		}
+		return SetCode, ms.Len(), nil
+	}
+}
+
+// rowElements returns the number of elements of o, or 0 for a string.
+func rowElements(o rpdbRow) int64 {
+	switch x := o.(type) {
+	case *hashRow:
+		return x.Size
+	case *listRow:
+		return x.Rindex - x.Lindex
+	case *zsetRow:
+		return x.Size
+	case *setRow:
+		return x.Size
+	}
+	return 0
+}
+
+// loadChunks calls fn with the elements of o in chunks of at most n, each of
+// them is a partial object of the same kind as o.
+func loadChunks(r rpdbReader, o rpdbRow, n int64, fn func(obj interface{}) error) error {
+	if x, ok := o.(*listRow); ok {
+		var list rdb.List
+		for x.Index = x.Lindex; x.Index < x.Rindex; x.Index++ {
+			if _, err := x.LoadDataValue(r); err != nil {
+				return err
+			}
+			list = append(list, x.Value)
+			if int64(len(list)) == n {
+				if err := fn(list); err != nil {
+					return err
+				}
+				list = nil
+			}
+		}
+		if len(list) != 0 {
+			return fn(list)
+		}
+		return nil
+	}
+
+	var prefix []byte
+	var add func(sfx, value []byte) error
+	var flush func() error
+	switch x := o.(type) {
+	default:
+		return errors.Trace(ErrObjectCode)
+	case *hashRow:
+		prefix = x.DataKeyPrefix()
+		var hash rdb.Hash
+		add = func(sfx, value []byte) error {
+			if err := x.ParseDataKeySuffix(sfx); err != nil {
+				return err
+			}
+			if err := x.ParseDataValue(value); err != nil {
+				return err
+			}
+			hash = append(hash, &rdb.HashElement{Field: x.Field, Value: x.Value})
+			return nil
+		}
+		flush = func() error {
+			err := fn(hash)
+			hash = nil
+			return err
+		}
+	case *zsetRow:
+		prefix = x.DataKeyPrefix()
+		var zset rdb.ZSet
+		add = func(sfx, value []byte) error {
+			if err := x.ParseDataKeySuffix(sfx); err != nil {
+				return err
+			}
+			if err := x.ParseDataValue(value); err != nil {
+				return err
+			}
+			zset = append(zset, &rdb.ZSetElement{Member: x.Member, Score: x.Score})
+			return nil
+		}
+		flush = func() error {
+			err := fn(zset)
+			zset = nil
+			return err
+		}
+	case *setRow:
+		prefix = x.DataKeyPrefix()
+		var set rdb.Set
+		add = func(sfx, value []byte) error {
+			if err := x.ParseDataKeySuffix(sfx); err != nil {
+				return err
+			}
+			set = append(set, x.Member)
+			return nil
+		}
+		flush = func() error {
+			err := fn(set)
+			set = nil
+			return err
+		}
+	}
+
+	it := r.getIterator()
+	defer r.putIterator(it)
+	var m int64
+	for pfx := it.SeekTo(prefix); it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, pfx) {
+			break
+		}
+		if err := add(key[len(pfx):], it.Value()); err != nil {
+			return err
+		}
+		if m++; m == n {
+			if err := flush(); err != nil {
+				return err
+			}
+			m = 0
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if m != 0 {
+		return flush()
+	}
+	return nil
+}
@@ -3,8 +3,200 @@
 
 package rpdb
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
 type Forward struct {
 	DB   uint32
 	Op   string
 	Args []interface{}
+
+	// ExpireAt is the expire time in ms of every key of SetEX, Restore,
+	// SlotsRestore and SlotsRestoreCommit, whose arguments have ttls relative
+	// to the commit.
+	ExpireAt []uint64
+}
+
+func (fw *Forward) Keys() [][]byte {
+	var step = 1
+	switch fw.Op {
+	case "Del", "Expired":
+	case "MSet":
+		step = 2
+	case "SlotsRestore", "SlotsRestoreAt":
+		step = 3
+	default:
+		if len(fw.Args) == 0 {
+			return nil
+		}
+		return [][]byte{FormatArgument(fw.Args[0])}
+	}
+	var keys [][]byte
+	for i := 0; i < len(fw.Args); i += step {
+		keys = append(keys, FormatArgument(fw.Args[i]))
+	}
+	return keys
+}
+
+func FormatArgument(arg interface{}) []byte {
+	switch x := Num64(arg).(type) {
+	case []byte:
+		return x
+	case string:
+		return []byte(x)
+	case int64:
+		return FormatInt(x)
+	case uint64:
+		return FormatUint(x)
+	case float64:
+		return FormatFloat(x)
+	default:
+		return []byte(fmt.Sprint(x))
+	}
+}
+
+// Commands translates fw into the redis commands that replay it on a replica.
+// Each command is returned as its name followed by its arguments.
+func (fw *Forward) Commands() [][][]byte {
+	switch fw.Op {
+	case "Reset":
+		return [][][]byte{newCommand("FLUSHALL")}
+	case "Expired":
+		return [][][]byte{newCommand("DEL", fw.Args...)}
+	case "Restore", "SlotsRestore":
+		return restoreCommands(fw.Args)
+	case "SetEXAt":
+		if len(fw.Args) != 3 {
+			return nil
+		}
+		return [][][]byte{
+			newCommand("SET", fw.Args[0], fw.Args[2]),
+			newCommand("PEXPIREAT", fw.Args[0], fw.Args[1]),
+		}
+	case "RestoreAt", "SlotsRestoreAt":
+		return restoreAtCommands(fw.Args)
+	case "SlotsRestoreChunk":
+		return restoreChunkCommands(fw.Args)
+	case "SlotsRestoreCommit":
+		if len(fw.Args) != 2 || string(FormatArgument(fw.Args[1])) == "0" {
+			return nil
+		}
+		return [][][]byte{newCommand("PEXPIRE", fw.Args...)}
+	case "SlotsRestoreCommitAt":
+		if len(fw.Args) != 2 || string(FormatArgument(fw.Args[1])) == "0" {
+			return nil
+		}
+		return [][][]byte{newCommand("PEXPIREAT", fw.Args...)}
+	case "SlotsRestoreAbort":
+		return [][][]byte{newCommand("DEL", fw.Args...)}
+	case "":
+		return nil
+	default:
+		return [][][]byte{newCommand(strings.ToUpper(fw.Op), fw.Args...)}
+	}
+}
+
+// absolute returns fw with the ttls of its arguments replaced by the expire
+// times of ExpireAt, as SetEXAt, RestoreAt, SlotsRestoreAt or
+// SlotsRestoreCommitAt, so it gives the same keys whenever it is replayed.
+func (fw *Forward) absolute() *Forward {
+	var op string
+	switch fw.Op {
+	case "SetEX":
+		op = "SetEXAt"
+	case "Restore":
+		op = "RestoreAt"
+	case "SlotsRestore":
+		op = "SlotsRestoreAt"
+	case "SlotsRestoreCommit":
+		op = "SlotsRestoreCommitAt"
+	default:
+		return fw
+	}
+	if len(fw.ExpireAt) != (len(fw.Args)+1)/3 {
+		return fw
+	}
+	args := make([]interface{}, len(fw.Args))
+	copy(args, fw.Args)
+	for i, expireat := range fw.ExpireAt {
+		args[i*3+1] = expireat
+	}
+	return &Forward{DB: fw.DB, Op: op, Args: args}
+}
+
+func newCommand(name string, args ...interface{}) [][]byte {
+	cmd := [][]byte{[]byte(name)}
+	for _, arg := range args {
+		cmd = append(cmd, FormatArgument(arg))
+	}
+	return cmd
+}
+
+func restoreCommands(args []interface{}) [][][]byte {
+	var cmds [][][]byte
+	for i := 0; i+2 < len(args); i += 3 {
+		cmds = append(cmds, newCommand("DEL", args[i]))
+		cmds = append(cmds, newCommand("RESTORE", args[i], args[i+1], args[i+2]))
+	}
+	return cmds
+}
+
+func restoreAtCommands(args []interface{}) [][][]byte {
+	var cmds [][][]byte
+	for i := 0; i+2 < len(args); i += 3 {
+		cmds = append(cmds, newCommand("DEL", args[i]))
+		cmds = append(cmds, newCommand("RESTORE", args[i], 0, args[i+2]))
+		if expireat := FormatArgument(args[i+1]); string(expireat) != "0" {
+			cmds = append(cmds, newCommand("PEXPIREAT", args[i], expireat))
+		}
+	}
+	return cmds
+}
+
+// restoreChunkCommands adds the elements of a chunk to the key with the
+// commands of its kind, a replica builds the key as the chunks arrive. The
+// first chunk replaces the key.
+func restoreChunkCommands(args []interface{}) [][][]byte {
+	if len(args) != 3 {
+		return nil
+	}
+	var cmds [][][]byte
+	if string(FormatArgument(args[1])) == "0" {
+		cmds = append(cmds, newCommand("DEL", args[0]))
+	}
+	obj, err := rdb.DecodeDump(FormatArgument(args[2]))
+	if err != nil {
+		return cmds
+	}
+	var name string
+	var cmd = []interface{}{args[0]}
+	switch x := obj.(type) {
+	default:
+		return cmds
+	case rdb.Hash:
+		name = "HMSET"
+		for _, e := range x {
+			cmd = append(cmd, e.Field, e.Value)
+		}
+	case rdb.List:
+		name = "RPUSH"
+		for _, v := range x {
+			cmd = append(cmd, v)
+		}
+	case rdb.ZSet:
+		name = "ZADD"
+		for _, e := range x {
+			cmd = append(cmd, e.Score, e.Member)
+		}
+	case rdb.Set:
+		name = "SADD"
+		for _, m := range x {
+			cmd = append(cmd, m)
+		}
+	}
+	return append(cmds, newCommand(name, cmd...))
 }
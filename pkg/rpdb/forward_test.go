@@ -0,0 +1,90 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func TestForwardKeys(t *testing.T) {
+	fw := &Forward{DB: 0, Op: "MSet", Args: []interface{}{"a", "1", "b", "2"}}
+	keys := fw.Keys()
+	checkerror(t, nil, len(keys) == 2 && string(keys[0]) == "a" && string(keys[1]) == "b")
+
+	fw = &Forward{DB: 0, Op: "Del", Args: []interface{}{[]byte("a"), []byte("b"), []byte("c")}}
+	checkerror(t, nil, len(fw.Keys()) == 3)
+
+	fw = &Forward{DB: 0, Op: "HSet", Args: []interface{}{"a", "field", "value"}}
+	keys = fw.Keys()
+	checkerror(t, nil, len(keys) == 1 && string(keys[0]) == "a")
+}
+
+func TestForwardCommands(t *testing.T) {
+	fw := &Forward{DB: 0, Op: "IncrBy", Args: []interface{}{[]byte("a"), int64(-1)}}
+	cmds := fw.Commands()
+	checkerror(t, nil, len(cmds) == 1 && len(cmds[0]) == 3)
+	checkerror(t, nil, string(cmds[0][0]) == "INCRBY" && string(cmds[0][2]) == "-1")
+
+	fw = &Forward{DB: 0, Op: "SlotsRestore", Args: []interface{}{"a", 0, "x", "b", 100, "y"}}
+	cmds = fw.Commands()
+	checkerror(t, nil, len(cmds) == 4)
+	checkerror(t, nil, string(cmds[0][0]) == "DEL" && string(cmds[0][1]) == "a")
+	checkerror(t, nil, string(cmds[3][0]) == "RESTORE" && string(cmds[3][2]) == "100")
+
+	fw = &Forward{DB: 0, Op: "SlotsRestore", Args: []interface{}{"a", 0, "x", "b", 100, "y"}, ExpireAt: []uint64{0, 12345}}
+	fw = fw.absolute()
+	cmds = fw.Commands()
+	checkerror(t, nil, fw.Op == "SlotsRestoreAt" && len(fw.Keys()) == 2 && len(cmds) == 5)
+	checkerror(t, nil, string(cmds[3][0]) == "RESTORE" && string(cmds[3][2]) == "0")
+	checkerror(t, nil, string(cmds[4][0]) == "PEXPIREAT" && string(cmds[4][2]) == "12345")
+
+	fw = &Forward{DB: 0, Op: "SetEX", Args: []interface{}{"a", 10, "x"}, ExpireAt: []uint64{12345}}
+	cmds = fw.absolute().Commands()
+	checkerror(t, nil, len(cmds) == 2 && string(cmds[0][0]) == "SET" && string(cmds[0][2]) == "x")
+	checkerror(t, nil, string(cmds[1][0]) == "PEXPIREAT" && string(cmds[1][2]) == "12345")
+
+	dump, err := rdb.EncodeDump(rdb.ZSet{&rdb.ZSetElement{Member: []byte("m"), Score: 1}})
+	checkerror(t, err, true)
+	fw = &Forward{DB: 0, Op: "SlotsRestoreChunk", Args: []interface{}{"a", 0, dump}}
+	cmds = fw.Commands()
+	checkerror(t, nil, len(cmds) == 2 && string(cmds[0][0]) == "DEL")
+	checkerror(t, nil, string(cmds[1][0]) == "ZADD" && string(cmds[1][2]) == "1" && string(cmds[1][3]) == "m")
+	fw = &Forward{DB: 0, Op: "SlotsRestoreCommit", Args: []interface{}{"a", 100}, ExpireAt: []uint64{12345}}
+	cmds = fw.absolute().Commands()
+	checkerror(t, nil, len(cmds) == 1 && string(cmds[0][0]) == "PEXPIREAT" && string(cmds[0][2]) == "12345")
+
+	fw = &Forward{Op: "Reset"}
+	cmds = fw.Commands()
+	checkerror(t, nil, len(cmds) == 1 && string(cmds[0][0]) == "FLUSHALL")
+}
+
+func TestOnCommit(t *testing.T) {
+	var fws []*Forward
+	defer testbl.OnCommit(func(fw *Forward) {
+		fws = append(fws, fw)
+	})()
+
+	xset(t, 0, "key", "value")
+	kpexpire(t, 0, "key", 10, 1)
+	sleepms(20)
+	kexists(t, 0, "key", 0)
+
+	checkerror(t, nil, len(fws) == 3)
+	checkerror(t, nil, fws[0].Op == "Set")
+	checkerror(t, nil, fws[1].Op == "PExpireAt")
+	checkerror(t, nil, fws[2].Op == "Expired")
+}
+
+func TestOnCommitRemove(t *testing.T) {
+	var n int
+	remove := testbl.OnCommit(func(fw *Forward) {
+		n++
+	})
+	xset(t, 0, "key", "value")
+	remove()
+	kdel(t, 1, 0, "key")
+	checkerror(t, nil, n == 1)
+}
@@ -5,6 +5,7 @@ package rpdb
 
 import (
 	"bytes"
+	"context"
 
 	"github.com/wandoulabs/rpdb/pkg/store"
 	"github.com/wandoulabs/redis-port/pkg/libs/errors"
@@ -167,6 +168,11 @@ func (b *Rpdb) loadHashRow(db uint32, key []byte, deleteIfExpired bool) (*hashRo
 
 // HGETALL key
 func (b *Rpdb) HGetAll(db uint32, args ...interface{}) ([][]byte, error) {
+	return b.HGetAllContext(context.Background(), db, args...)
+}
+
+// HGetAllContext is HGetAll, but it stops once ctx is done.
+func (b *Rpdb) HGetAllContext(ctx context.Context, db uint32, args ...interface{}) ([][]byte, error) {
 	if len(args) != 1 {
 		return nil, errArguments("len(args) = %d, expect = 1", len(args))
 	}
@@ -178,11 +184,15 @@ func (b *Rpdb) HGetAll(db uint32, args ...interface{}) ([][]byte, error) {
 		}
 	}
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return nil, err
 	}
 	defer b.release()
 
+	return b.hgetall(db, key)
+}
+
+func (b *Rpdb) hgetall(db uint32, key []byte) ([][]byte, error) {
 	o, err := b.loadHashRow(db, key, true)
 	if err != nil || o == nil {
 		return nil, err
@@ -223,6 +233,10 @@ func (b *Rpdb) HDel(db uint32, args ...interface{}) (int64, error) {
 	}
 	defer b.release()
 
+	return b.hdel(db, key, fields...)
+}
+
+func (b *Rpdb) hdel(db uint32, key []byte, fields ...[]byte) (int64, error) {
 	o, err := b.loadHashRow(db, key, true)
 	if err != nil || o == nil {
 		return 0, err
@@ -251,7 +265,10 @@ func (b *Rpdb) HDel(db uint32, args ...interface{}) (int64, error) {
 			bt.Del(o.MetaKey())
 		}
 	}
-	fw := &Forward{DB: db, Op: "HDel", Args: args}
+	fw := &Forward{DB: db, Op: "HDel", Args: []interface{}{key}}
+	for _, field := range fields {
+		fw.Args = append(fw.Args, field)
+	}
 	return n, b.commit(bt, fw)
 }
 
@@ -305,17 +322,22 @@ func (b *Rpdb) HGet(db uint32, args ...interface{}) ([]byte, error) {
 	}
 	defer b.release()
 
+	v, _, err := b.hget(db, key, field)
+	return v, err
+}
+
+func (b *Rpdb) hget(db uint32, key, field []byte) ([]byte, bool, error) {
 	o, err := b.loadHashRow(db, key, true)
 	if err != nil || o == nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	o.Field = field
 	exists, err := o.LoadDataValue(b)
 	if err != nil || !exists {
-		return nil, err
+		return nil, false, err
 	} else {
-		return o.Value, nil
+		return o.Value, true, nil
 	}
 }
 
@@ -452,6 +474,11 @@ func (b *Rpdb) HIncrByFloat(db uint32, args ...interface{}) (float64, error) {
 
 // HKEYS key
 func (b *Rpdb) HKeys(db uint32, args ...interface{}) ([][]byte, error) {
+	return b.HKeysContext(context.Background(), db, args...)
+}
+
+// HKeysContext is HKeys, but it stops once ctx is done.
+func (b *Rpdb) HKeysContext(ctx context.Context, db uint32, args ...interface{}) ([][]byte, error) {
 	if len(args) != 1 {
 		return nil, errArguments("len(args) = %d, expect = 1", len(args))
 	}
@@ -463,7 +490,7 @@ func (b *Rpdb) HKeys(db uint32, args ...interface{}) ([][]byte, error) {
 		}
 	}
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return nil, err
 	}
 	defer b.release()
@@ -477,6 +504,11 @@ func (b *Rpdb) HKeys(db uint32, args ...interface{}) ([][]byte, error) {
 
 // HVALS key
 func (b *Rpdb) HVals(db uint32, args ...interface{}) ([][]byte, error) {
+	return b.HValsContext(context.Background(), db, args...)
+}
+
+// HValsContext is HVals, but it stops once ctx is done.
+func (b *Rpdb) HValsContext(ctx context.Context, db uint32, args ...interface{}) ([][]byte, error) {
 	if len(args) != 1 {
 		return nil, errArguments("len(args) = %d, expect = 1", len(args))
 	}
@@ -488,7 +520,7 @@ func (b *Rpdb) HVals(db uint32, args ...interface{}) ([][]byte, error) {
 		}
 	}
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return nil, err
 	}
 	defer b.release()
@@ -518,6 +550,10 @@ func (b *Rpdb) HSet(db uint32, args ...interface{}) (int64, error) {
 	}
 	defer b.release()
 
+	return b.hset(db, key, field, value)
+}
+
+func (b *Rpdb) hset(db uint32, key, field, value []byte) (int64, error) {
 	o, err := b.loadHashRow(db, key, true)
 	if err != nil {
 		return 0, err
@@ -547,7 +583,7 @@ func (b *Rpdb) HSet(db uint32, args ...interface{}) (int64, error) {
 		bt.Set(o.DataKey(), o.DataValue())
 		bt.Set(o.MetaKey(), o.MetaValue())
 	}
-	fw := &Forward{DB: db, Op: "HSet", Args: args}
+	fw := &Forward{DB: db, Op: "HSet", Args: []interface{}{key, field, value}}
 	return n, b.commit(bt, fw)
 }
 
@@ -4,6 +4,8 @@
 package rpdb
 
 import (
+	"bytes"
+	"context"
 	"time"
 
 	"github.com/wandoulabs/rpdb/pkg/store"
@@ -18,22 +20,32 @@ const (
 
 func (b *Rpdb) loadRpdbRow(db uint32, key []byte, deleteIfExpired bool) (rpdbRow, error) {
 	o, err := loadRpdbRow(b, db, key)
-	if err != nil || o == nil {
+	if err != nil {
 		return nil, err
 	}
+	if o == nil {
+		return nil, b.checkMigrated(key)
+	}
+	// an expired restore has been abandoned, it's deleted like a key
+	if _, ok := o.(*restoringRow); ok && (!deleteIfExpired || !o.IsExpired()) {
+		return nil, errors.Trace(ErrKeyRestoring)
+	}
 	if deleteIfExpired && o.IsExpired() {
 		bt := store.NewBatch()
 		if err := o.deleteObject(b, bt); err != nil {
 			return nil, err
 		}
-		fw := &Forward{DB: db, Op: "Del", Args: []interface{}{key}}
-		return nil, b.commit(bt, fw)
+		fw := &Forward{DB: db, Op: "Expired", Args: []interface{}{key}}
+		if err := b.commit(bt, fw); err != nil {
+			return nil, err
+		}
+		return nil, b.checkMigrated(key)
 	}
 	return o, nil
 }
 
 func (b *Rpdb) deleteIfExists(bt *store.Batch, db uint32, key []byte) (bool, error) {
-	o, err := b.loadRpdbRow(db, key, false)
+	o, err := loadRpdbRow(b, db, key)
 	if err != nil || o == nil {
 		return false, err
 	}
@@ -42,6 +54,11 @@ func (b *Rpdb) deleteIfExists(bt *store.Batch, db uint32, key []byte) (bool, err
 
 // DEL key [key ...]
 func (b *Rpdb) Del(db uint32, args ...interface{}) (int64, error) {
+	return b.DelContext(context.Background(), db, args...)
+}
+
+// DelContext is Del, but it stops once ctx is done.
+func (b *Rpdb) DelContext(ctx context.Context, db uint32, args ...interface{}) (int64, error) {
 	if len(args) == 0 {
 		return 0, errArguments("len(args) = %d, expect != 0", len(args))
 	}
@@ -53,11 +70,15 @@ func (b *Rpdb) Del(db uint32, args ...interface{}) (int64, error) {
 		}
 	}
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return 0, err
 	}
 	defer b.release()
 
+	return b.del(db, keys...)
+}
+
+func (b *Rpdb) del(db uint32, keys ...[]byte) (int64, error) {
 	for _, key := range keys {
 		_, err := b.loadRpdbRow(db, key, true)
 		if err != nil {
@@ -78,7 +99,10 @@ func (b *Rpdb) Del(db uint32, args ...interface{}) (int64, error) {
 			}
 		}
 	}
-	fw := &Forward{DB: db, Op: "Del", Args: args}
+	fw := &Forward{DB: db, Op: "Del"}
+	for _, key := range keys {
+		fw.Args = append(fw.Args, key)
+	}
 	return ms.Len(), b.commit(bt, fw)
 }
 
@@ -427,7 +451,7 @@ func (b *Rpdb) Restore(db uint32, args ...interface{}) error {
 	}
 	defer b.release()
 
-	fw := &Forward{DB: db, Op: "Restore", Args: args}
+	fw := &Forward{DB: db, Op: "Restore", Args: args, ExpireAt: []uint64{expireat}}
 	bt := store.NewBatch()
 	if err := b.restore(bt, db, key, expireat, obj); err != nil {
 		return err
@@ -465,7 +489,13 @@ func (b *Rpdb) restore(bt *store.Batch, db uint32, key []byte, expireat uint64,
 }
 
 func (b *Rpdb) CompactAll() error {
-	if err := b.acquire(); err != nil {
+	return b.CompactAllContext(context.Background())
+}
+
+// CompactAllContext is CompactAll, but it stops once ctx is done. A range
+// being compacted can't be interrupted, ctx is checked between the ranges.
+func (b *Rpdb) CompactAllContext(ctx context.Context) error {
+	if err := b.acquireContext(ctx); err != nil {
 		return err
 	}
 	defer b.release()
@@ -473,6 +503,10 @@ func (b *Rpdb) CompactAll() error {
 	if err := b.compact([]byte{MetaCode}, []byte{MetaCode + 1}); err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		log.Infof("rpdb compaction is canceled")
+		return errors.Trace(err)
+	}
 	if err := b.compact([]byte{DataCode}, []byte{DataCode + 1}); err != nil {
 		return err
 	}
@@ -525,3 +559,107 @@ func TTLmsToExpireAt(ttlms int64) (uint64, bool) {
 	}
 	return expireat, true
 }
+
+// FLUSHDB
+func (b *Rpdb) FlushDB(db uint32) (int64, error) {
+	return b.deleteKeysWhere(db, nil)
+}
+
+// DelPrefix deletes the keys starting with prefix from all dbs.
+func (b *Rpdb) DelPrefix(prefix []byte) (int64, error) {
+	if len(prefix) == 0 {
+		return 0, errArguments("len(prefix) = %d, expect != 0", len(prefix))
+	}
+	dbs, err := b.ListDBs()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, db := range dbs {
+		c, err := b.FlushDBPrefix(db, prefix)
+		if n += c; err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// FlushDBPrefix deletes the keys of db starting with prefix.
+func (b *Rpdb) FlushDBPrefix(db uint32, prefix []byte) (int64, error) {
+	if len(prefix) == 0 {
+		return 0, errArguments("len(prefix) = %d, expect != 0", len(prefix))
+	}
+	return b.deleteKeysWhere(db, func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	})
+}
+
+// ListDBs returns the dbs that hold keys.
+func (b *Rpdb) ListDBs() ([]uint32, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.release()
+	return allDBs(b)
+}
+
+// FlushDBWhere deletes the keys of db accepted by match, see deleteKeysWhere.
+func (b *Rpdb) FlushDBWhere(db uint32, match func(key []byte) bool) (int64, error) {
+	return b.deleteKeysWhere(db, match)
+}
+
+// deleteKeysWhere deletes the keys of db accepted by match, or all of them
+// if match is nil. Keys are deleted in small batches, so the lock is never
+// held for long.
+func (b *Rpdb) deleteKeysWhere(db uint32, match func(key []byte) bool) (int64, error) {
+	return b.deleteKeysUnder(context.Background(), db, EncodeMetaKeyPrefixDB(db), match)
+}
+
+// deleteKeysUnder is deleteKeysWhere for the keys whose meta key has prefix pfx.
+// It stops once ctx is done, between two batches.
+func (b *Rpdb) deleteKeysUnder(ctx context.Context, db uint32, pfx []byte, match func(key []byte) bool) (int64, error) {
+	var n int64
+	for cursor := pfx; cursor != nil; {
+		if err := ctx.Err(); err != nil {
+			return n, errors.Trace(err)
+		}
+		c, next, err := b.deleteKeysStep(db, pfx, cursor, match)
+		if n += c; err != nil {
+			return n, err
+		}
+		cursor = next
+	}
+	return n, nil
+}
+
+func (b *Rpdb) deleteKeysStep(db uint32, pfx, cursor []byte, match func(key []byte) bool) (int64, []byte, error) {
+	if err := b.acquire(); err != nil {
+		return 0, nil, err
+	}
+	defer b.release()
+
+	keys, next, err := keysUnderPrefix(b, pfx, cursor, 1024)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	fw := &Forward{DB: db, Op: "Del"}
+	bt := store.NewBatch()
+	for _, key := range keys {
+		if match != nil && !match(key) {
+			continue
+		}
+		o, err := loadRpdbRow(b, db, key)
+		if err != nil {
+			return 0, nil, err
+		}
+		if o == nil {
+			continue
+		}
+		if err := o.deleteObject(b, bt); err != nil {
+			return 0, nil, err
+		}
+		fw.Args = append(fw.Args, key)
+	}
+	return int64(len(fw.Args)), next, b.commit(bt, fw)
+}
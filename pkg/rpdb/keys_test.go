@@ -258,3 +258,28 @@ func TestRestore(t *testing.T) {
 // TODO
 func (b *Rpdb) Restore(db uint32, args ...interface{}) error {
 */
+
+func TestFlushDB(t *testing.T) {
+	xset(t, 0, "a", "a")
+	xset(t, 0, "b", "b")
+	xset(t, 1, "a", "a")
+	n, err := testbl.FlushDB(0)
+	checkerror(t, err, n == 2)
+	kexists(t, 0, "a", 0)
+	kexists(t, 1, "a", 1)
+	kdel(t, 1, 1, "a")
+	checkempty(t)
+}
+
+func TestDelPrefix(t *testing.T) {
+	xset(t, 0, "p:a", "a")
+	xset(t, 0, "q:a", "a")
+	xset(t, 3, "p:b", "b")
+	n, err := testbl.DelPrefix([]byte("p:"))
+	checkerror(t, err, n == 2)
+	kexists(t, 0, "p:a", 0)
+	kexists(t, 3, "p:b", 0)
+	kexists(t, 0, "q:a", 1)
+	kdel(t, 1, 0, "q:a")
+	checkempty(t)
+}
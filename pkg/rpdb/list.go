@@ -5,6 +5,7 @@ package rpdb
 
 import (
 	"bytes"
+	"context"
 
 	"github.com/wandoulabs/rpdb/pkg/store"
 	"github.com/wandoulabs/redis-port/pkg/libs/errors"
@@ -158,6 +159,11 @@ func (b *Rpdb) LLen(db uint32, args ...interface{}) (int64, error) {
 
 // LRANGE key beg end
 func (b *Rpdb) LRange(db uint32, args ...interface{}) ([][]byte, error) {
+	return b.LRangeContext(context.Background(), db, args...)
+}
+
+// LRangeContext is LRange, but it stops once ctx is done.
+func (b *Rpdb) LRangeContext(ctx context.Context, db uint32, args ...interface{}) ([][]byte, error) {
 	if len(args) != 3 {
 		return nil, errArguments("len(args) = %d, expect = 2", len(args))
 	}
@@ -170,11 +176,15 @@ func (b *Rpdb) LRange(db uint32, args ...interface{}) ([][]byte, error) {
 		}
 	}
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return nil, err
 	}
 	defer b.release()
 
+	return b.lrange(db, key, beg, end)
+}
+
+func (b *Rpdb) lrange(db uint32, key []byte, beg, end int64) ([][]byte, error) {
 	o, err := b.loadListRow(db, key, true)
 	if err != nil || o == nil {
 		return nil, err
@@ -305,14 +315,19 @@ func (b *Rpdb) LPop(db uint32, args ...interface{}) ([]byte, error) {
 	}
 	defer b.release()
 
+	v, _, err := b.lpop(db, key)
+	return v, err
+}
+
+func (b *Rpdb) lpop(db uint32, key []byte) ([]byte, bool, error) {
 	o, err := b.loadListRow(db, key, true)
 	if err != nil || o == nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	o.Index = o.Lindex
 	if _, err := o.LoadDataValue(b); err != nil {
-		return nil, err
+		return nil, false, err
 	} else {
 		bt := store.NewBatch()
 		bt.Del(o.DataKey())
@@ -321,8 +336,8 @@ func (b *Rpdb) LPop(db uint32, args ...interface{}) ([]byte, error) {
 		} else {
 			bt.Del(o.MetaKey())
 		}
-		fw := &Forward{DB: db, Op: "LPop", Args: args}
-		return o.Value, b.commit(bt, fw)
+		fw := &Forward{DB: db, Op: "LPop", Args: []interface{}{key}}
+		return o.Value, true, b.commit(bt, fw)
 	}
 }
 
@@ -344,14 +359,19 @@ func (b *Rpdb) RPop(db uint32, args ...interface{}) ([]byte, error) {
 	}
 	defer b.release()
 
+	v, _, err := b.rpop(db, key)
+	return v, err
+}
+
+func (b *Rpdb) rpop(db uint32, key []byte) ([]byte, bool, error) {
 	o, err := b.loadListRow(db, key, true)
 	if err != nil || o == nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	o.Index = o.Rindex - 1
 	if _, err := o.LoadDataValue(b); err != nil {
-		return nil, err
+		return nil, false, err
 	} else {
 		bt := store.NewBatch()
 		bt.Del(o.DataKey())
@@ -360,8 +380,8 @@ func (b *Rpdb) RPop(db uint32, args ...interface{}) ([]byte, error) {
 		} else {
 			bt.Del(o.MetaKey())
 		}
-		fw := &Forward{DB: db, Op: "RPop", Args: args}
-		return o.Value, b.commit(bt, fw)
+		fw := &Forward{DB: db, Op: "RPop", Args: []interface{}{key}}
+		return o.Value, true, b.commit(bt, fw)
 	}
 }
 
@@ -0,0 +1,134 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+// mergeBatchKeys is the max number of keys copied by Merge at a time.
+const mergeBatchKeys = 256
+
+// NewScratch creates an empty rpdb named name next to b. Unlike a staging
+// rpdb it doesn't take the place of b, it's merged into b with Merge, so b
+// keeps accepting writes while it is filled.
+func (b *Rpdb) NewScratch(name string) (*Rpdb, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.release()
+	if b.open == nil {
+		return nil, errors.Trace(ErrStagingDisabled)
+	}
+	path := fmt.Sprintf("%s.scratch.%s", b.path, name)
+	if err := os.RemoveAll(path); err != nil {
+		return nil, errors.Trace(err)
+	}
+	db, err := b.open(path, true)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("rpdb create scratch database, path = %s", path)
+	return &Rpdb{rpdbCore: &rpdbCore{db: db, path: path}}, nil
+}
+
+// Merge makes the keys of sp the keys of b accepted by match: the keys of sp
+// are copied into b, replacing the existing ones, and then the other keys of
+// b accepted by match are deleted. sp is discarded afterwards. The keys are
+// moved in small batches, so b is served meanwhile.
+func (b *Rpdb) Merge(sp *Rpdb, match func(db uint32, key []byte) bool) error {
+	defer b.DiscardStaging(sp)
+
+	dbs, err := sp.ListDBs()
+	if err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		pfx := EncodeMetaKeyPrefixDB(db)
+		for cursor := pfx; cursor != nil; {
+			args, next, err := sp.dumpKeys(db, pfx, cursor, mergeBatchKeys)
+			if err != nil {
+				return err
+			}
+			if len(args) != 0 {
+				if err := b.SlotsRestore(db, args...); err != nil {
+					return err
+				}
+			}
+			cursor = next
+		}
+	}
+
+	if dbs, err = b.ListDBs(); err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		var failure error
+		_, err := b.FlushDBWhere(db, func(key []byte) bool {
+			if failure != nil || !match(db, key) {
+				return false
+			}
+			exists, err := sp.hasKey(db, key)
+			if err != nil {
+				failure = err
+			}
+			return err == nil && !exists
+		})
+		if err != nil {
+			return err
+		}
+		if failure != nil {
+			return failure
+		}
+	}
+	return nil
+}
+
+// dumpKeys returns the arguments of SLOTSRESTORE for at most count keys of
+// db, from cursor on, and the cursor of the next keys.
+func (b *Rpdb) dumpKeys(db uint32, pfx, cursor []byte, count int) ([]interface{}, []byte, error) {
+	if err := b.acquire(); err != nil {
+		return nil, nil, err
+	}
+	defer b.release()
+
+	keys, next, err := keysUnderPrefix(b, pfx, cursor, count)
+	if err != nil {
+		return nil, nil, err
+	}
+	var args []interface{}
+	for _, key := range keys {
+		o, err := b.loadRpdbRow(db, key, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if o == nil || o.IsExpired() {
+			continue
+		}
+		x, err := o.loadObjectValue(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		dump, err := rdb.EncodeDump(x)
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, key, migrateTTLms(o.GetExpireAt()), dump)
+	}
+	return args, next, nil
+}
+
+func (b *Rpdb) hasKey(db uint32, key []byte) (bool, error) {
+	if err := b.acquire(); err != nil {
+		return false, err
+	}
+	defer b.release()
+	o, err := loadRpdbRow(b, db, key)
+	return o != nil, err
+}
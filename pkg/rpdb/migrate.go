@@ -6,6 +6,7 @@ package rpdb
 import (
 	"bufio"
 	"container/list"
+	"context"
 	"fmt"
 	"net"
 	"sync"
@@ -17,6 +18,9 @@ import (
 	"github.com/wandoulabs/redis-port/pkg/redis"
 )
 
+// migrateCommandBytes bounds the size of a SLOTSRESTORE command sent
+const migrateCommandBytes = 1024 * 1024
+
 var poolmap struct {
 	m map[string]*list.List
 	sync.Mutex
@@ -86,6 +90,47 @@ func (c *conn) DoMustOK(cmd *redis.Array, timeout time.Duration) error {
 	}
 }
 
+// DoAllMustOK pipelines cmds, it sends all of them before reading the
+// replies, which must all be OK.
+func (c *conn) DoAllMustOK(cmds []*redis.Array, timeout time.Duration) error {
+	if c.err != nil {
+		return c.err
+	}
+	if err := c.sock.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		if err := redis.Encode(c.w, cmd); err != nil {
+			c.err = err
+			log.WarnErrorf(err, "encode resp failed")
+			return c.err
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		c.err = errors.Trace(err)
+		log.WarnErrorf(err, "encode resp failed")
+		return c.err
+	}
+	for range cmds {
+		rsp, err := c.decodeResp(timeout)
+		if err != nil {
+			c.err = err
+			log.WarnErrorf(err, "decode resp failed")
+			return c.err
+		}
+		if s, ok := rsp.(*redis.String); !ok {
+			c.err = errors.Errorf("not string response, got %v", rsp.Type())
+		} else if s.Value != "OK" {
+			c.err = errors.Errorf("not OK, got %s", s.Value)
+		}
+		if c.err != nil {
+			return c.err
+		}
+	}
+	c.last = time.Now()
+	return nil
+}
+
 func init() {
 	poolmap.m = make(map[string]*list.List)
 	go func() {
@@ -151,41 +196,103 @@ func putSockConn(addr string, c *conn) {
 	}
 }
 
-func doMigrate(addr string, timeout time.Duration, db uint32, bins []*rdb.BinEntry) error {
+// watchContext breaks the io of c once ctx is done, until the returned func
+// is called. The conn is closed rather than put back into the pool then.
+func watchContext(ctx context.Context, c *conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan int)
+	done := make(chan int)
+	go func() {
+		defer close(done)
+		select {
+		case <-stop:
+		case <-ctx.Done():
+			c.sock.SetDeadline(time.Now())
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		if err := ctx.Err(); err != nil && c.err == nil {
+			c.err = errors.Trace(err)
+		}
+	}
+}
+
+// migrateConn returns a conn to addr that has selected db, and the timeout
+// of the commands on it, which is bounded by the deadline of ctx. The conn
+// must be given back by calling the returned func.
+func migrateConn(ctx context.Context, addr string, timeout time.Duration, db uint32) (*conn, time.Duration, func(), error) {
+	if d, ok := ctx.Deadline(); ok && time.Until(d) < timeout {
+		timeout = time.Until(d)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, nil, errors.Trace(err)
+	}
 	c, err := getSockConn(addr, timeout)
 	if err != nil {
 		log.WarnErrorf(err, "connect to %s failed, timeout = %d", addr, timeout)
-		return err
+		return nil, 0, nil, err
 	}
-	defer putSockConn(addr, c)
 
-	cmd1 := redis.NewArray()
-	cmd1.AppendBulkBytes([]byte("select"))
-	cmd1.AppendBulkBytes([]byte(FormatUint(uint64(db))))
+	unwatch := watchContext(ctx, c)
+	done := func() {
+		unwatch()
+		putSockConn(addr, c)
+	}
 
-	if err := c.DoMustOK(cmd1, timeout); err != nil {
+	cmd := redis.NewArray()
+	cmd.AppendBulkBytes([]byte("select"))
+	cmd.AppendBulkBytes([]byte(FormatUint(uint64(db))))
+
+	if err := c.DoMustOK(cmd, timeout); err != nil {
 		log.WarnErrorf(err, "command select failed, addr = %s, db = %d", addr, db)
-		return err
+		done()
+		return nil, 0, nil, err
 	}
 	log.Debugf("command select ok, addr = %s, db = %d", addr, db)
+	return c, timeout, done, nil
+}
+
+// migrateTTLms returns the ttlms sent for an object that expires at expireat,
+// one about to expire is sent with 1ms left rather than no ttl.
+func migrateTTLms(expireat uint64) int64 {
+	if expireat == 0 {
+		return 0
+	}
+	if v, ok := ExpireAtToTTLms(expireat); ok && v > 0 {
+		return v
+	}
+	return 1
+}
 
-	cmd2 := redis.NewArray()
-	cmd2.AppendBulkBytes([]byte("slotsrestore"))
+func doMigrate(ctx context.Context, addr string, timeout time.Duration, db uint32, bins []*rdb.BinEntry) error {
+	c, timeout, done, err := migrateConn(ctx, addr, timeout, db)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// a batch is split into commands of about migrateCommandBytes, which
+	// are pipelined
+	var cmds []*redis.Array
+	var cmd *redis.Array
+	var size int
 	for _, bin := range bins {
-		cmd2.AppendBulkBytes(bin.Key)
-		ttlms := int64(0)
-		if bin.ExpireAt != 0 {
-			if v, ok := ExpireAtToTTLms(bin.ExpireAt); ok && v > 0 {
-				ttlms = v
-			} else {
-				ttlms = 1
-			}
+		if cmd == nil || size >= migrateCommandBytes {
+			cmd, size = redis.NewArray(), 0
+			cmd.AppendBulkBytes([]byte("slotsrestore"))
+			cmds = append(cmds, cmd)
 		}
-		cmd2.AppendBulkBytes([]byte(FormatInt(ttlms)))
-		cmd2.AppendBulkBytes(bin.Value)
+		cmd.AppendBulkBytes(bin.Key)
+		cmd.AppendBulkBytes([]byte(FormatInt(migrateTTLms(bin.ExpireAt))))
+		cmd.AppendBulkBytes(bin.Value)
+		size += len(bin.Key) + len(bin.Value)
 	}
 
-	if err := c.DoMustOK(cmd2, timeout); err != nil {
+	if err := c.DoAllMustOK(cmds, timeout); err != nil {
 		log.WarnErrorf(err, "command restore failed, addr = %s, db = %d, len(bins) = %d", addr, db, len(bins))
 		return err
 	} else {
@@ -193,3 +300,87 @@ func doMigrate(addr string, timeout time.Duration, db uint32, bins []*rdb.BinEnt
 		return nil
 	}
 }
+
+// doMigrateDel deletes the keys on addr. It sends ASKING first, as the slot
+// may be importing on the target, and ignores its reply, some servers don't
+// know it.
+func doMigrateDel(ctx context.Context, addr string, timeout time.Duration, db uint32, keys [][]byte) error {
+	c, timeout, done, err := migrateConn(ctx, addr, timeout, db)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	asking := redis.NewArray()
+	asking.AppendBulkBytes([]byte("asking"))
+	if _, err := c.Do(asking, timeout); err != nil {
+		return err
+	}
+
+	cmd := redis.NewArray()
+	cmd.AppendBulkBytes([]byte("del"))
+	for _, key := range keys {
+		cmd.AppendBulkBytes(key)
+	}
+	rsp, err := c.Do(cmd, timeout)
+	if err != nil {
+		log.WarnErrorf(err, "command del failed, addr = %s, db = %d, len(keys) = %d", addr, db, len(keys))
+		return err
+	}
+	if _, ok := rsp.(*redis.Int); !ok {
+		c.err = errors.Errorf("not integer response, got %v", rsp.Type())
+		return c.err
+	}
+	return nil
+}
+
+// doMigrateChunks restores the object o of key on addr in chunks of at most n
+// elements, and returns the bytes sent. The target stages the chunks, and the object appears there at
+// once when SLOTSRESTORECOMMIT succeeds. If a chunk fails the target is asked
+// to drop the staged ones, a restore left over is replaced by the next one.
+func doMigrateChunks(ctx context.Context, addr string, timeout time.Duration, r rpdbReader, db uint32, key []byte, o rpdbRow, n int64) (int64, error) {
+	c, timeout, done, err := migrateConn(ctx, addr, timeout, db)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	var seq uint64
+	var nbytes int64
+	err = loadChunks(r, o, n, func(obj interface{}) error {
+		dump, err := rdb.EncodeDump(obj)
+		if err != nil {
+			return err
+		}
+		cmd := redis.NewArray()
+		cmd.AppendBulkBytes([]byte("slotsrestorechunk"))
+		cmd.AppendBulkBytes(key)
+		cmd.AppendBulkBytes([]byte(FormatUint(seq)))
+		cmd.AppendBulkBytes(dump)
+		if err := c.DoMustOK(cmd, timeout); err != nil {
+			return err
+		}
+		seq, nbytes = seq+1, nbytes+int64(len(dump))
+		return nil
+	})
+	if err == nil {
+		cmd := redis.NewArray()
+		cmd.AppendBulkBytes([]byte("slotsrestorecommit"))
+		cmd.AppendBulkBytes(key)
+		cmd.AppendBulkBytes([]byte(FormatInt(migrateTTLms(o.GetExpireAt()))))
+		err = c.DoMustOK(cmd, timeout)
+	}
+
+	if err != nil {
+		log.WarnErrorf(err, "command restore chunk failed, addr = %s, db = %d, key = %v, seq = %d", addr, db, key, seq)
+		if c.err == nil {
+			cmd := redis.NewArray()
+			cmd.AppendBulkBytes([]byte("slotsrestoreabort"))
+			cmd.AppendBulkBytes(key)
+			c.Do(cmd, timeout)
+		}
+		return 0, err
+	}
+	log.Debugf("command restore chunks ok, addr = %s, db = %d, key = %v, chunks = %d", addr, db, key, seq)
+	return nbytes, nil
+}
@@ -0,0 +1,289 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"sync"
+
+	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+)
+
+var (
+	ErrKeyMigrated = errors.Static("key has been migrated")
+)
+
+// slotOwnerPrefix is the prefix of the rows of the slots not owned, it sorts
+// after all the meta and data rows, so scans never see them. The rows are not
+// written to the wal, ownership belongs to the server and not to its data.
+var slotOwnerPrefix = []byte("@slotowner:")
+
+// SlotState is the state of a slot in the ownership table.
+type SlotState byte
+
+const (
+	// SlotOwned slots are served here, which is the default.
+	SlotOwned SlotState = iota
+	// SlotForeign slots are served by another server, which clients are
+	// redirected to.
+	SlotForeign
+	// SlotMigrating slots are being moved to another server, the keys that
+	// are still here are served here.
+	SlotMigrating
+	// SlotImporting slots are being moved from another server, the keys are
+	// only served here to clients redirected by it.
+	SlotImporting
+)
+
+func (s SlotState) String() string {
+	switch s {
+	case SlotOwned:
+		return "owned"
+	case SlotForeign:
+		return "node"
+	case SlotMigrating:
+		return "migrating"
+	case SlotImporting:
+		return "importing"
+	}
+	return "unknown"
+}
+
+// ParseSlotState parses the name of a state returned by SlotState.String.
+func ParseSlotState(name string) (SlotState, error) {
+	for _, s := range []SlotState{SlotOwned, SlotForeign, SlotMigrating, SlotImporting} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, errors.Errorf("invalid slot state = %s", name)
+}
+
+// SlotOwner is the entry of a slot in the ownership table, Addr is the other
+// server of a slot not owned, or being migrated.
+type SlotOwner struct {
+	State SlotState
+	Addr  string
+}
+
+// slotOwners holds the ownership table, which is replaced and never modified,
+// so it can be read without the lock once loaded.
+type slotOwners struct {
+	mu    sync.RWMutex
+	table *[MaxSlotNum]SlotOwner
+}
+
+func encodeSlotOwnerKey(slot uint32) []byte {
+	w := NewBufWriter(nil)
+	if err := w.WriteBytes(slotOwnerPrefix); err != nil {
+		log.PanicErrorf(err, "encode slot owner failed")
+	}
+	encodeRawBytes(w, &slot)
+	return w.Bytes()
+}
+
+func decodeSlotOwner(key, value []byte) (uint32, SlotOwner, error) {
+	var slot uint32
+	r := NewBufReader(key[len(slotOwnerPrefix):])
+	err := decodeRawBytes(r, nil, &slot)
+	err = decodeRawBytes(r, err)
+	if err != nil {
+		return 0, SlotOwner{}, err
+	}
+	if len(value) == 0 || slot >= MaxSlotNum {
+		return 0, SlotOwner{}, errors.Trace(ErrNotMatched)
+	}
+	return slot, SlotOwner{State: SlotState(value[0]), Addr: string(value[1:])}, nil
+}
+
+func (o SlotOwner) encode() []byte {
+	return append([]byte{byte(o.State)}, o.Addr...)
+}
+
+// loadSlotOwners loads the ownership table, it's called with the rpdb lock.
+func (b *Rpdb) loadSlotOwners() error {
+	b.owners.mu.Lock()
+	defer b.owners.mu.Unlock()
+	if b.owners.table != nil {
+		return nil
+	}
+	table := &[MaxSlotNum]SlotOwner{}
+	if err := b.scanRows(slotOwnerPrefix, func(key, value []byte) error {
+		slot, o, err := decodeSlotOwner(key, value)
+		if err != nil {
+			return err
+		}
+		table[slot] = o
+		return nil
+	}); err != nil {
+		return err
+	}
+	b.owners.table = table
+	return nil
+}
+
+// storeSlotOwners writes the whole ownership table, once the database has
+// been cleared or replaced. It's called with the rpdb lock.
+func (b *Rpdb) storeSlotOwners() {
+	b.owners.mu.RLock()
+	defer b.owners.mu.RUnlock()
+	if b.owners.table == nil {
+		return
+	}
+	bt := store.NewBatch()
+	for slot, o := range b.owners.table {
+		if o.State != SlotOwned {
+			bt.Set(encodeSlotOwnerKey(uint32(slot)), o.encode())
+		}
+	}
+	if bt.Len() == 0 {
+		return
+	}
+	if err := b.db.Commit(bt); err != nil {
+		log.WarnErrorf(err, "rpdb store slot owners failed")
+	}
+}
+
+func (b *Rpdb) slotOwnersTable() (*[MaxSlotNum]SlotOwner, error) {
+	b.owners.mu.RLock()
+	table := b.owners.table
+	b.owners.mu.RUnlock()
+	if table != nil {
+		return table, nil
+	}
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.release()
+	if err := b.loadSlotOwners(); err != nil {
+		return nil, err
+	}
+	return b.owners.table, nil
+}
+
+// SlotOwner returns the entry of slot in the ownership table. It doesn't wait
+// for the rpdb lock once the table is loaded.
+func (b *Rpdb) SlotOwner(slot uint32) (SlotOwner, error) {
+	if slot >= MaxSlotNum {
+		return SlotOwner{}, errArguments("slot = %d", slot)
+	}
+	table, err := b.slotOwnersTable()
+	if err != nil {
+		return SlotOwner{}, err
+	}
+	return table[slot], nil
+}
+
+// SlotOwners returns a copy of the ownership table.
+func (b *Rpdb) SlotOwners() ([]SlotOwner, error) {
+	table, err := b.slotOwnersTable()
+	if err != nil {
+		return nil, err
+	}
+	return append([]SlotOwner{}, table[:]...), nil
+}
+
+// SetSlotOwner sets the entry of the slots [first, last] in the ownership
+// table, and stores it in the database.
+func (b *Rpdb) SetSlotOwner(first, last uint32, o SlotOwner) error {
+	if first > last || last >= MaxSlotNum {
+		return errArguments("slots = [%d,%d]", first, last)
+	}
+	if o.State == SlotOwned {
+		o.Addr = ""
+	} else if o.Addr == "" {
+		return errArguments("slot state = %s, addr is empty", o.State)
+	}
+
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+
+	if err := b.loadSlotOwners(); err != nil {
+		return err
+	}
+	bt := store.NewBatch()
+	for slot := first; slot <= last; slot++ {
+		if o.State == SlotOwned {
+			bt.Del(encodeSlotOwnerKey(slot))
+		} else {
+			bt.Set(encodeSlotOwnerKey(slot), o.encode())
+		}
+	}
+	if err := b.db.Commit(bt); err != nil {
+		log.WarnErrorf(err, "rpdb store slot owners failed")
+		return err
+	}
+
+	b.owners.mu.Lock()
+	defer b.owners.mu.Unlock()
+	table := *b.owners.table
+	for slot := first; slot <= last; slot++ {
+		table[slot] = o
+	}
+	b.owners.table = &table
+	log.Infof("rpdb set owner of slots [%d,%d], state = %s, addr = %s", first, last, o.State, o.Addr)
+	return nil
+}
+
+// checkMigrated fails with ErrKeyMigrated if key, which isn't here, belongs to
+// a slot being migrated. The key may have been migrated after the command was
+// checked, so reads of it must be redirected to the target as well. It's
+// called with the rpdb lock, like checkMigrating.
+func (b *Rpdb) checkMigrated(key []byte) error {
+	if err := b.loadSlotOwners(); err != nil {
+		return err
+	}
+	_, slot := HashKeyToSlot(key)
+	b.owners.mu.RLock()
+	state := b.owners.table[slot].State
+	b.owners.mu.RUnlock()
+
+	if state == SlotMigrating {
+		return errors.Trace(ErrKeyMigrated)
+	}
+	return nil
+}
+
+// checkMigrating fails bt with ErrKeyMigrated if it creates a key of a slot
+// being migrated. Such a key is served by the target, a command on it was
+// redirected before its tag was migrated, and must be redirected again. It's
+// called with the rpdb lock, so no migration is in flight meanwhile.
+func (b *Rpdb) checkMigrating(bt *store.Batch) error {
+	if err := b.loadSlotOwners(); err != nil {
+		return err
+	}
+	b.owners.mu.RLock()
+	table := b.owners.table
+	b.owners.mu.RUnlock()
+
+	for e := bt.OpList.Front(); e != nil; e = e.Next() {
+		op, ok := e.Value.(*store.BatchOpSet)
+		if !ok || len(op.Key) == 0 || op.Key[0] != MetaCode {
+			continue
+		}
+		_, slot, err := decodeMetaKeySlot(op.Key)
+		if err != nil {
+			return err
+		}
+		if table[slot].State != SlotMigrating {
+			continue
+		}
+		db, key, err := DecodeMetaKey(op.Key)
+		if err != nil {
+			return err
+		}
+		o, err := loadRpdbRow(b, db, key)
+		if err != nil {
+			return err
+		}
+		if o == nil || o.IsExpired() {
+			log.Debugf("rpdb reject key of migrating slot, db = %d, slot = %d, key = %v", db, slot, key)
+			return errors.Trace(ErrKeyMigrated)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+)
+
+func checkslotowner(t *testing.T, slot uint32, state SlotState, addr string) {
+	o, err := testbl.SlotOwner(slot)
+	checkerror(t, err, o.State == state && o.Addr == addr)
+}
+
+func TestSlotOwner(t *testing.T) {
+	checkslotowner(t, 0, SlotOwned, "")
+	checkerror(t, testbl.SetSlotOwner(0, 9, SlotOwner{SlotForeign, "127.0.0.1:7000"}), true)
+	checkerror(t, testbl.SetSlotOwner(5, 5, SlotOwner{SlotMigrating, "127.0.0.1:7001"}), true)
+	checkerror(t, testbl.SetSlotOwner(6, 6, SlotOwner{SlotImporting, "127.0.0.1:7002"}), true)
+	checkerror(t, nil, testbl.SetSlotOwner(7, 7, SlotOwner{SlotForeign, ""}) != nil)
+	checkerror(t, nil, testbl.SetSlotOwner(9, 8, SlotOwner{}) != nil)
+	checkerror(t, nil, testbl.SetSlotOwner(0, MaxSlotNum, SlotOwner{}) != nil)
+
+	for i := 0; i < 2; i++ {
+		checkslotowner(t, 0, SlotForeign, "127.0.0.1:7000")
+		checkslotowner(t, 5, SlotMigrating, "127.0.0.1:7001")
+		checkslotowner(t, 6, SlotImporting, "127.0.0.1:7002")
+		checkslotowner(t, 9, SlotForeign, "127.0.0.1:7000")
+		checkslotowner(t, 10, SlotOwned, "")
+
+		// reload the table from the database
+		testbl.owners.table = nil
+	}
+
+	owners, err := testbl.SlotOwners()
+	checkerror(t, err, len(owners) == MaxSlotNum)
+	n := 0
+	for _, o := range owners {
+		if o.State != SlotOwned {
+			n++
+		}
+	}
+	checkerror(t, nil, n == 10)
+
+	checkerror(t, testbl.SetSlotOwner(0, MaxSlotNum-1, SlotOwner{SlotOwned, "127.0.0.1:7000"}), true)
+	checkslotowner(t, 0, SlotOwned, "")
+	checkempty(t)
+}
+
+func TestSlotMigrating(t *testing.T) {
+	xset(t, 0, "{migrating}1", "a")
+	xset(t, 0, "{migrating}2", "b")
+	slot := HashTagToSlot([]byte("migrating"))
+	checkerror(t, testbl.SetSlotOwner(slot, slot, SlotOwner{SlotMigrating, "127.0.0.1:7001"}), true)
+
+	// the keys here are written here, the others are created on the target
+	xset(t, 0, "{migrating}1", "c")
+	err := testbl.Set(0, []byte("{migrating}3"), []byte("d"))
+	checkerror(t, nil, errors.Equal(err, ErrKeyMigrated))
+
+	// the reads of the keys not here are redirected as well
+	xget(t, 0, "{migrating}1", "c")
+	_, err = testbl.Get(0, []byte("{migrating}3"))
+	checkerror(t, nil, errors.Equal(err, ErrKeyMigrated))
+	_, err = testbl.Exists(0, []byte("{migrating}3"))
+	checkerror(t, nil, errors.Equal(err, ErrKeyMigrated))
+
+	kpexpire(t, 0, "{migrating}2", 10, 1)
+	sleepms(20)
+	err = testbl.Set(0, []byte("{migrating}2"), []byte("e"))
+	checkerror(t, nil, errors.Equal(err, ErrKeyMigrated))
+	_, err = testbl.Exists(0, []byte("{migrating}2"))
+	checkerror(t, nil, errors.Equal(err, ErrKeyMigrated))
+
+	kdel(t, 1, 0, "{migrating}1")
+	checkerror(t, testbl.SetSlotOwner(slot, slot, SlotOwner{}), true)
+	checkempty(t)
+}
@@ -5,14 +5,37 @@ package rpdb
 
 import (
 	"bytes"
+	"context"
+	"math"
 
 	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
 	"github.com/wandoulabs/redis-port/pkg/rdb"
 )
 
 type rpdbIterator struct {
 	store.Iterator
 	serial uint64
+
+	ctx context.Context
+}
+
+// Valid turns false once ctx is done, so a loop over the iterator stops and
+// finds the error of ctx in Error.
+func (it *rpdbIterator) Valid() bool {
+	if it.ctx != nil && it.ctx.Err() != nil {
+		return false
+	}
+	return it.Iterator.Valid()
+}
+
+func (it *rpdbIterator) Error() error {
+	if it.ctx != nil {
+		if err := it.ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return it.Iterator.Error()
 }
 
 type rpdbReader interface {
@@ -26,7 +49,7 @@ func loadObjEntry(r rpdbReader, db uint32, key []byte) (rpdbRow, *rdb.ObjEntry,
 	if err != nil || o == nil {
 		return o, nil, err
 	}
-	if o.IsExpired() {
+	if _, ok := o.(*restoringRow); ok || o.IsExpired() {
 		return o, nil, nil
 	}
 	if val, err := o.loadObjectValue(r); err != nil {
@@ -93,3 +116,56 @@ func allKeysWithTag(r rpdbReader, db uint32, tag []byte) ([][]byte, error) {
 	}
 	return keys, nil
 }
+
+func allDBs(r rpdbReader) ([]uint32, error) {
+	it := r.getIterator()
+	defer r.putIterator(it)
+	var dbs []uint32
+	pfx := []byte{byte(MetaCode)}
+	for it.SeekTo(pfx); it.Valid(); {
+		metaKey := it.Key()
+		if !bytes.HasPrefix(metaKey, pfx) {
+			break
+		}
+		db, _, err := DecodeMetaKey(metaKey)
+		if err != nil {
+			return nil, err
+		}
+		dbs = append(dbs, db)
+		if db == math.MaxUint32 {
+			break
+		}
+		it.SeekTo(EncodeMetaKeyPrefixDB(db + 1))
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return dbs, nil
+}
+
+// keysUnderPrefix returns at most count keys whose meta key has prefix pfx,
+// starting from the meta key cursor, and the cursor to continue with.
+func keysUnderPrefix(r rpdbReader, pfx, cursor []byte, count int) ([][]byte, []byte, error) {
+	it := r.getIterator()
+	defer r.putIterator(it)
+	var keys [][]byte
+	for it.SeekTo(cursor); it.Valid() && len(keys) < count; it.Next() {
+		metaKey := it.Key()
+		if !bytes.HasPrefix(metaKey, pfx) {
+			return keys, nil, it.Error()
+		}
+		_, key, err := DecodeMetaKey(metaKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		cursor = append(append([]byte{}, metaKey...), 0)
+	}
+	if err := it.Error(); err != nil {
+		return nil, nil, err
+	}
+	if !it.Valid() {
+		cursor = nil
+	}
+	return keys, cursor, nil
+}
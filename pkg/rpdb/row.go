@@ -58,6 +58,12 @@ func DecodeMetaKey(p []byte) (db uint32, key []byte, err error) {
 	return
 }
 
+func EncodeMetaKeyPrefixDB(db uint32) []byte {
+	w := NewBufWriter(nil)
+	encodeRawBytes(w, MetaCode, &db)
+	return w.Bytes()
+}
+
 func EncodeMetaKeyPrefixSlot(db uint32, slot uint32) []byte {
 	w := NewBufWriter(nil)
 	encodeRawBytes(w, MetaCode, &db, &slot)
@@ -140,6 +146,8 @@ func loadRpdbRow(r rpdbReader, db uint32, key []byte) (rpdbRow, error) {
 		o = new(zsetRow)
 	case SetCode:
 		o = new(setRow)
+	case restoringCode:
+		o = new(restoringRow)
 	}
 	o.lazyInit(&rpdbRowHelper{
 		code:          code,
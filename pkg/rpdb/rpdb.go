@@ -5,7 +5,12 @@ package rpdb
 
 import (
 	"container/list"
+	"context"
+	"fmt"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/wandoulabs/rpdb/pkg/store"
 	"github.com/wandoulabs/redis-port/pkg/libs/errors"
@@ -13,23 +18,92 @@ import (
 )
 
 var (
-	ErrClosed = errors.Static("rpdb has been closed")
+	ErrClosed            = errors.Static("rpdb has been closed")
+	ErrStagingDisabled   = errors.Static("rpdb staging is disabled")
+	ErrStagingBusy       = errors.Static("rpdb staging is in progress")
+	ErrReadOnly          = errors.Static("rpdb is read-only while a staging database is loaded")
+	ErrBackupUnsupported = errors.Static("rpdb engine doesn't support incremental backups")
 )
 
+// Opener opens the database stored at path, creating it if create is set.
+type Opener func(path string, create bool) (store.Database, error)
+
+// Rpdb is a view of a database. The views made by SyncView and Group share
+// all the state of the database, but store more rows with the writes
+// committed through them, or commit them together.
 type Rpdb struct {
+	*rpdbCore
+
+	// attach adds rows to the batches committed through this view
+	attach func(bt *store.Batch, fw *Forward)
+
+	// group collects the writes committed through this view, see Group
+	group *rpdbGroup
+}
+
+// rpdbGroup is the batch of the writes of a Group, committed once it ends.
+type rpdbGroup struct {
+	bt     *store.Batch
+	fws    []*Forward
+	deltas slotKeysCounters
+
+	// exists tells whether the meta rows written by the group exist
+	exists map[string]bool
+}
+
+type rpdbCore struct {
 	mu sync.Mutex
 	db store.Database
 
+	// ctx is the context of the call holding the lock, if it can be canceled
+	ctx context.Context
+
 	splist list.List
 	itlist list.List
 	serial uint64
+	writes uint64
+
+	hooks []*func(fw *Forward)
+
+	// watches see the writes to the slots migrated without the lock
+	watches []*slotWatch
+
+	backups sync.WaitGroup
+
+	wal *WAL
+
+	// objects with more elements are migrated in chunks of chunkSize
+	chunkSize int64
+
+	// slotKeys mirrors the counters of keys of the slots, nil until loaded
+	slotKeys slotKeysCounters
+
+	// metas tells if the meta rows read by the call holding the lock are
+	// keys, so the counters are updated without reading them again
+	metas map[string]bool
+
+	owners slotOwners
+
+	// staging is the database that replaces this one, writes are rejected
+	// until it is swapped in or discarded, since they would be lost
+	staging *Rpdb
+
+	path string
+	open Opener
 }
 
 func New(db store.Database) *Rpdb {
-	return &Rpdb{db: db}
+	return &Rpdb{rpdbCore: &rpdbCore{db: db}}
 }
 
 func (b *Rpdb) acquire() error {
+	if b.group != nil {
+		// the lock is held by Group for the whole call
+		if b.db != nil {
+			return nil
+		}
+		return errors.Trace(ErrClosed)
+	}
 	b.mu.Lock()
 	if b.db != nil {
 		return nil
@@ -38,38 +112,194 @@ func (b *Rpdb) acquire() error {
 	return errors.Trace(ErrClosed)
 }
 
+// acquireContext is acquire for a call that stops once ctx is done, the
+// iterators it uses become invalid and report the error of ctx.
+func (b *Rpdb) acquireContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	b.ctx = ctx
+	return nil
+}
+
 func (b *Rpdb) release() {
-	b.mu.Unlock()
+	b.ctx = nil
+	if b.group == nil {
+		b.metas = nil
+		b.mu.Unlock()
+	}
+}
+
+// context returns the context of the call holding the lock.
+func (b *Rpdb) context() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
 }
 
 func (b *Rpdb) commit(bt *store.Batch, fw *Forward) error {
 	if bt.Len() == 0 {
 		return nil
 	}
+	if b.staging != nil && fw.Op != "Expired" {
+		return errors.Trace(ErrReadOnly)
+	}
+	if err := b.checkMigrating(bt); err != nil {
+		return err
+	}
+	rows := metaRowsAfter(bt)
+	deltas, err := b.countSlotKeys(bt, rows)
+	if err != nil {
+		return err
+	}
+	if b.attach != nil {
+		b.attach(bt, fw)
+	}
+	if g := b.group; g != nil {
+		for key, after := range rows {
+			g.exists[key] = after
+		}
+		for db, a := range deltas {
+			for slot, delta := range a {
+				if delta != 0 {
+					g.deltas.add(db, uint32(slot), delta)
+				}
+			}
+		}
+		g.bt.OpList.PushBackList(&bt.OpList)
+		g.fws = append(g.fws, fw)
+		return nil
+	}
+	if err := b.commitBatch(bt, []*Forward{fw}, deltas); err != nil {
+		return err
+	}
+	if b.metas == nil {
+		b.metas = make(map[string]bool)
+	}
+	for key, after := range rows {
+		b.metas[key] = after
+	}
+	return nil
+}
+
+// lookup tells whether the meta row key exists after the writes of g, ok is
+// false if g doesn't write it.
+func (g *rpdbGroup) lookup(key string) (exists, ok bool) {
+	if g == nil {
+		return false, false
+	}
+	exists, ok = g.exists[key]
+	return
+}
+
+// commitBatch commits bt, which holds the writes of fws in order.
+func (b *Rpdb) commitBatch(bt *store.Batch, fws []*Forward, deltas slotKeysCounters) error {
+	if b.wal != nil {
+		seq, err := b.wal.Append(fws)
+		if err != nil {
+			return err
+		}
+		bt.Set(walSeqKey, FormatUint(seq))
+	}
 	if err := b.db.Commit(bt); err != nil {
 		log.WarnErrorf(err, "rpdb commit failed")
+		if b.wal != nil {
+			b.wal.Revert()
+		}
 		return err
 	}
+	if b.wal != nil {
+		b.wal.Commit()
+	}
+	b.applySlotKeys(deltas)
 	for i := b.itlist.Len(); i != 0; i-- {
 		v := b.itlist.Remove(b.itlist.Front()).(*rpdbIterator)
 		v.Close()
 	}
 	b.serial++
+	atomic.AddUint64(&b.writes, uint64(len(fws)))
+	for _, fw := range fws {
+		for _, w := range b.watches {
+			w.observe(fw)
+		}
+		for _, fn := range b.hooks {
+			(*fn)(fw)
+		}
+	}
 	return nil
 }
 
+// Group calls fn with a view of b, that holds the lock of b for the whole
+// call and commits all the writes made through it in a single batch once fn
+// returns. The writes are not read back before they are committed, so the
+// calls made through the view must be on keys of their own. If the batch
+// fails, none of the writes is committed, although the calls succeeded.
+func (b *Rpdb) Group(fn func(g *Rpdb)) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+
+	g := &rpdbGroup{bt: store.NewBatch(), deltas: make(slotKeysCounters), exists: make(map[string]bool)}
+	fn(&Rpdb{rpdbCore: b.rpdbCore, attach: b.attach, group: g})
+	if len(g.fws) == 0 {
+		return nil
+	}
+	return b.commitBatch(g.bt, g.fws, g.deltas)
+}
+
+// OnCommit registers fn to be called with the Forward record of every
+// committed write. fn runs with the rpdb lock held, so it must not block
+// or call back into Rpdb. The returned func unregisters fn.
+func (b *Rpdb) OnCommit(fn func(fw *Forward)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hook := &fn
+	b.hooks = append(b.hooks, hook)
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		for i, x := range b.hooks {
+			if x == hook {
+				b.hooks = append(b.hooks[:i:i], b.hooks[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Writes returns the number of writes committed since the database was opened.
+// It can be called without the rpdb lock.
+func (b *Rpdb) Writes() uint64 {
+	return atomic.LoadUint64(&b.writes)
+}
+
 func (b *Rpdb) getRowValue(key []byte) ([]byte, error) {
-	return b.db.Get(key)
+	v, err := b.db.Get(key)
+	if err == nil && len(key) != 0 && key[0] == MetaCode {
+		if b.metas == nil {
+			b.metas = make(map[string]bool)
+		}
+		b.metas[string(key)] = isKeyRow(v)
+	}
+	return v, err
 }
 
 func (b *Rpdb) getIterator() (it *rpdbIterator) {
 	if e := b.itlist.Front(); e != nil {
-		return b.itlist.Remove(e).(*rpdbIterator)
-	}
-	return &rpdbIterator{
-		Iterator: b.db.NewIterator(),
-		serial:   b.serial,
+		it = b.itlist.Remove(e).(*rpdbIterator)
+	} else {
+		it = &rpdbIterator{
+			Iterator: b.db.NewIterator(),
+			serial:   b.serial,
+		}
 	}
+	it.ctx = b.ctx
+	return it
 }
 
 func (b *Rpdb) putIterator(it *rpdbIterator) {
@@ -95,9 +325,13 @@ func (b *Rpdb) Close() {
 		v.Close()
 	}
 	if b.db != nil {
+		b.backups.Wait()
 		b.db.Close()
 		b.db = nil
 	}
+	if b.wal != nil {
+		b.wal.Close()
+	}
 	log.Infof("rpdb is closed")
 }
 
@@ -112,6 +346,20 @@ func (b *Rpdb) NewSnapshot() (*RpdbSnapshot, error) {
 	return sp, nil
 }
 
+// NewSnapshotFunc is like NewSnapshot, but also calls fn while the rpdb lock
+// is held, so fn observes exactly the commits visible in the snapshot.
+func (b *Rpdb) NewSnapshotFunc(fn func()) (*RpdbSnapshot, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.release()
+	sp := &RpdbSnapshot{sp: b.db.NewSnapshot()}
+	b.splist.PushBack(sp)
+	fn()
+	log.Infof("rpdb create new snapshot, address = %p", sp)
+	return sp, nil
+}
+
 func (b *Rpdb) ReleaseSnapshot(sp *RpdbSnapshot) {
 	if err := b.acquire(); err != nil {
 		return
@@ -132,6 +380,9 @@ func (b *Rpdb) Reset() error {
 		return err
 	}
 	defer b.release()
+	if b.staging != nil {
+		return errors.Trace(ErrReadOnly)
+	}
 	log.Infof("rpdb is reseting...")
 	for i := b.splist.Len(); i != 0; i-- {
 		v := b.splist.Remove(b.splist.Front()).(*RpdbSnapshot)
@@ -141,18 +392,248 @@ func (b *Rpdb) Reset() error {
 		v := b.itlist.Remove(b.itlist.Front()).(*rpdbIterator)
 		v.Close()
 	}
+	if err := b.loadSlotOwners(); err != nil {
+		return err
+	}
+	var seq uint64
+	if b.wal != nil {
+		var err error
+		if seq, err = b.wal.Append([]*Forward{{Op: "Reset"}}); err != nil {
+			return err
+		}
+	}
 	if err := b.db.Clear(); err != nil {
 		b.db.Close()
 		b.db = nil
+		if b.wal != nil {
+			b.wal.Revert()
+		}
 		log.ErrorErrorf(err, "rpdb reset failed")
 		return err
 	} else {
 		b.serial++
+		b.slotKeys = nil
+		b.storeSlotOwners()
+		if b.wal != nil {
+			if err := b.putWALSeq(seq); err != nil {
+				log.WarnErrorf(err, "rpdb store wal seq failed")
+			}
+			b.wal.Commit()
+		}
+		for _, w := range b.watches {
+			w.observe(&Forward{Op: "Reset"})
+		}
+		for _, fn := range b.hooks {
+			(*fn)(&Forward{Op: "Reset"})
+		}
 		log.Infof("rpdb is reset")
 		return nil
 	}
 }
 
+// SetOpener tells rpdb where its database lives and how to open another one
+// of the same kind, which enables NewStaging and Replace.
+func (b *Rpdb) SetOpener(path string, open Opener) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.path, b.open = path, open
+}
+
+// NewStaging creates an empty rpdb next to b. It can be filled while b keeps
+// serving its data, and then swapped in with Replace. The writes to b are
+// rejected with ErrReadOnly until Replace or DiscardStaging.
+func (b *Rpdb) NewStaging() (*Rpdb, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.release()
+	if b.open == nil {
+		return nil, errors.Trace(ErrStagingDisabled)
+	}
+	if b.staging != nil {
+		return nil, errors.Trace(ErrStagingBusy)
+	}
+	path := b.path + ".staging"
+	if err := os.RemoveAll(path); err != nil {
+		return nil, errors.Trace(err)
+	}
+	db, err := b.open(path, true)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("rpdb create staging database, path = %s", path)
+	b.staging = &Rpdb{rpdbCore: &rpdbCore{db: db, path: path}}
+	return b.staging, nil
+}
+
+// DiscardStaging closes a staging rpdb that will not be used and removes its
+// files in the background, b accepts writes again.
+func (b *Rpdb) DiscardStaging(sp *Rpdb) {
+	b.mu.Lock()
+	if b.staging == sp {
+		b.staging = nil
+	}
+	b.mu.Unlock()
+	sp.Close()
+	go removeDatabase(sp.path)
+}
+
+// Replace makes the data of staging the data of b. The old database is moved
+// aside and removed in the background, staging must not be used afterwards.
+func (b *Rpdb) Replace(staging *Rpdb) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+	if b.open == nil {
+		return errors.Trace(ErrStagingDisabled)
+	}
+	if b.staging == staging {
+		b.staging = nil
+	}
+	if b.wal != nil {
+		if err := b.wal.Err(); err != nil {
+			return err
+		}
+	}
+	if err := staging.acquire(); err != nil {
+		return err
+	}
+	// a crash before the replace is logged leaves a gap in the log, rather
+	// than a replace that isn't in the data
+	if b.wal != nil {
+		if err := staging.putWALSeq(b.wal.Seq() + 1); err != nil {
+			staging.release()
+			return err
+		}
+	}
+	staging.db.Close()
+	staging.db = nil
+	staging.release()
+	if err := b.loadSlotOwners(); err != nil {
+		return err
+	}
+
+	log.Infof("rpdb is replacing with %s ...", staging.path)
+	for i := b.splist.Len(); i != 0; i-- {
+		v := b.splist.Remove(b.splist.Front()).(*RpdbSnapshot)
+		v.Close()
+	}
+	for i := b.itlist.Len(); i != 0; i-- {
+		v := b.itlist.Remove(b.itlist.Front()).(*rpdbIterator)
+		v.Close()
+	}
+	b.backups.Wait()
+	b.db.Close()
+	b.db = nil
+
+	old := fmt.Sprintf("%s.old.%d", b.path, time.Now().UnixNano())
+	if err := os.Rename(b.path, old); err != nil {
+		log.ErrorErrorf(err, "rpdb replace failed")
+		return b.reopen(errors.Trace(err))
+	}
+	if err := os.Rename(staging.path, b.path); err != nil {
+		log.ErrorErrorf(err, "rpdb replace failed")
+		if err := os.Rename(old, b.path); err != nil {
+			log.ErrorErrorf(err, "rpdb restore old database failed")
+		}
+		return b.reopen(errors.Trace(err))
+	}
+	if err := b.reopen(nil); err != nil {
+		return err
+	}
+	b.serial++
+	b.storeSlotOwners()
+	b.logWAL(&Forward{Op: "Replace"})
+	for _, w := range b.watches {
+		w.observe(&Forward{Op: "Replace"})
+	}
+	go removeDatabase(old)
+	log.Infof("rpdb is replaced")
+	return nil
+}
+
+// Backup takes a backup of the database into the directory path, see
+// store.Database. The rpdb lock is only held to pin the database, so writes
+// go on during the backup, while Close and Replace wait for it to finish.
+func (b *Rpdb) Backup(path string) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	db := b.db
+	b.backups.Add(1)
+	b.release()
+	defer b.backups.Done()
+
+	log.Infof("rpdb is backing up to %s ...", path)
+	if err := db.Backup(path); err != nil {
+		log.WarnErrorf(err, "rpdb backup failed")
+		return err
+	}
+	log.Infof("rpdb is backed up to %s", path)
+	return nil
+}
+
+func (b *Rpdb) backupManager() (store.BackupManager, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.release()
+	if m, ok := b.db.(store.BackupManager); ok {
+		return m, nil
+	}
+	return nil, errors.Trace(ErrBackupUnsupported)
+}
+
+// ListBackups returns the incremental backups in the directory path, if the
+// engine supports them.
+func (b *Rpdb) ListBackups(path string) ([]*store.BackupInfo, error) {
+	m, err := b.backupManager()
+	if err != nil {
+		return nil, err
+	}
+	return m.ListBackups(path)
+}
+
+// VerifyBackups checks the backups ids in path, or all of them if ids is
+// empty, without restoring them.
+func (b *Rpdb) VerifyBackups(path string, ids []uint32) error {
+	m, err := b.backupManager()
+	if err != nil {
+		return err
+	}
+	return m.VerifyBackups(path, ids)
+}
+
+// PurgeBackups deletes the old backups in path, see store.BackupManager.
+func (b *Rpdb) PurgeBackups(path string, keep int, age time.Duration) error {
+	m, err := b.backupManager()
+	if err != nil {
+		return err
+	}
+	log.Infof("rpdb is purging backups in %s, keep = %d, age = %s", path, keep, age)
+	return m.PurgeBackups(path, keep, age)
+}
+
+func (b *Rpdb) reopen(cause error) error {
+	db, err := b.open(b.path, false)
+	if err != nil {
+		log.ErrorErrorf(err, "rpdb reopen failed")
+		return err
+	}
+	b.db = db
+	b.slotKeys = nil
+	return cause
+}
+
+func removeDatabase(path string) {
+	if err := os.RemoveAll(path); err != nil {
+		log.WarnErrorf(err, "remove database '%s' failed", path)
+	} else {
+		log.Infof("remove database '%s'", path)
+	}
+}
+
 func (b *Rpdb) compact(start, limit []byte) error {
 	if err := b.db.Compact(start, limit); err != nil {
 		log.ErrorErrorf(err, "rpdb compact failed")
@@ -4,11 +4,16 @@
 package rpdb
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/wandoulabs/rpdb/pkg/store"
 	"github.com/wandoulabs/rpdb/pkg/store/rocksdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
 	"github.com/wandoulabs/redis-port/pkg/libs/log"
 	"github.com/wandoulabs/redis-port/pkg/libs/testing/assert"
 )
@@ -56,6 +61,11 @@ func checkcompact(t *testing.T) {
 func checkempty(t *testing.T) {
 	it := testbl.getIterator()
 	it.SeekToFirst()
+	// the marker of the slot key counters is the only row left, a counter
+	// left behind is miscounted
+	if it.Valid() && bytes.Equal(it.Key(), slotKeysMarker) {
+		it.Next()
+	}
 	empty, err := !it.Valid(), it.Error()
 	testbl.putIterator(it)
 	checkerror(t, err, empty)
@@ -64,3 +74,199 @@ func checkempty(t *testing.T) {
 func sleepms(n int) {
 	time.Sleep(time.Millisecond * time.Duration(n))
 }
+
+func TestReplace(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-replace"
+	os.RemoveAll(path)
+	open := func(path string, create bool) (store.Database, error) {
+		return rocksdb.Open(path, rocksdb.NewDefaultConfig(), create, false)
+	}
+	db, err := open(path, true)
+	checkerror(t, err, true)
+	bl := New(db)
+	defer bl.Close()
+
+	_, err = bl.NewStaging()
+	checkerror(t, nil, errors.Equal(err, ErrStagingDisabled))
+
+	bl.SetOpener(path, open)
+	checkerror(t, bl.Set(0, "a", "1"), true)
+
+	sp, err := bl.NewStaging()
+	checkerror(t, err, true)
+	checkerror(t, sp.Set(0, "b", "2"), true)
+
+	v, err := bl.Get(0, "a")
+	checkerror(t, err, string(v) == "1")
+	checkerror(t, nil, errors.Equal(bl.Set(0, "c", "3"), ErrReadOnly))
+	_, err = bl.NewStaging()
+	checkerror(t, nil, errors.Equal(err, ErrStagingBusy))
+
+	checkerror(t, bl.Replace(sp), true)
+	v, err = bl.Get(0, "a")
+	checkerror(t, err, v == nil)
+	v, err = bl.Get(0, "b")
+	checkerror(t, err, string(v) == "2")
+	v, err = bl.Get(0, "c")
+	checkerror(t, err, v == nil)
+
+	sp, err = bl.NewStaging()
+	checkerror(t, err, true)
+	bl.DiscardStaging(sp)
+	checkerror(t, bl.Set(0, "c", "3"), true)
+}
+
+func TestMerge(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-merge"
+	os.RemoveAll(path)
+	open := func(path string, create bool) (store.Database, error) {
+		return rocksdb.Open(path, rocksdb.NewDefaultConfig(), create, false)
+	}
+	db, err := open(path, true)
+	checkerror(t, err, true)
+	bl := New(db)
+	defer bl.Close()
+	bl.SetOpener(path, open)
+
+	checkerror(t, bl.Set(0, "p:a", "1"), true)
+	checkerror(t, bl.Set(0, "p:b", "2"), true)
+	checkerror(t, bl.Set(0, "q:c", "3"), true)
+
+	sp, err := bl.NewScratch("test")
+	checkerror(t, err, true)
+	checkerror(t, sp.Set(0, "p:a", "4"), true)
+	checkerror(t, sp.Set(1, "p:d", "5"), true)
+	checkerror(t, bl.Set(0, "q:e", "6"), true)
+
+	checkerror(t, bl.Merge(sp, func(db uint32, key []byte) bool {
+		return bytes.HasPrefix(key, []byte("p:"))
+	}), true)
+	for _, x := range []struct {
+		db         uint32
+		key, value string
+	}{{0, "p:a", "4"}, {0, "p:b", ""}, {0, "q:c", "3"}, {1, "p:d", "5"}, {0, "q:e", "6"}} {
+		v, err := bl.Get(x.db, x.key)
+		checkerror(t, err, string(v) == x.value)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-backup"
+	const dbpath = "/tmp/testdb-rocksdb-restore"
+	os.RemoveAll(path)
+	os.RemoveAll(dbpath)
+
+	xset(t, 0, "a", "1")
+	checkerror(t, testbl.Backup(path), true)
+	xset(t, 0, "a", "2")
+	checkerror(t, testbl.Backup(path), true)
+	kdel(t, 1, 0, "a")
+	checkempty(t)
+
+	checkerror(t, rocksdb.Restore(path, dbpath), true)
+	db, err := rocksdb.Open(dbpath, rocksdb.NewDefaultConfig(), false, false)
+	checkerror(t, err, true)
+	bl := New(db)
+	defer bl.Close()
+	v, err := bl.Get(0, "a")
+	checkerror(t, err, string(v) == "2")
+}
+
+func TestBackupManifest(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-backup-incr"
+	os.RemoveAll(path)
+
+	xset(t, 0, "a", "1")
+	checkerror(t, testbl.Backup(path), true)
+	xset(t, 0, "b", "2")
+	checkerror(t, testbl.Backup(path), true)
+	kdel(t, 2, 0, "a", "b")
+	checkempty(t)
+
+	infos, err := testbl.ListBackups(path)
+	checkerror(t, err, len(infos) == 2)
+	checkerror(t, nil, infos[0].ID < infos[1].ID && len(infos[1].Files) != 0)
+	shared := make(map[string]bool)
+	for _, f := range infos[0].Files {
+		shared[f.Name] = true
+	}
+	var n int
+	for _, f := range infos[1].Files {
+		if shared[f.Name] {
+			n++
+		}
+	}
+	checkerror(t, nil, n != 0)
+	checkerror(t, testbl.VerifyBackups(path, nil), true)
+
+	f := infos[1].Files[0]
+	checkerror(t, ioutil.WriteFile(path+"/"+f.Name, []byte("corrupted"), 0600), true)
+	checkerror(t, nil, testbl.VerifyBackups(path, []uint32{infos[1].ID}) != nil)
+
+	checkerror(t, testbl.PurgeBackups(path, 1, 0), true)
+	infos, err = testbl.ListBackups(path)
+	checkerror(t, err, len(infos) == 1)
+}
+
+func TestWrites(t *testing.T) {
+	n := testbl.Writes()
+	xset(t, 0, "a", "a")
+	checkerror(t, nil, testbl.Writes() == n+1)
+	kdel(t, 0, 0, "b")
+	checkerror(t, nil, testbl.Writes() == n+1)
+	kdel(t, 1, 0, "a")
+	checkerror(t, nil, testbl.Writes() == n+2)
+	checkempty(t)
+}
+
+func TestGroup(t *testing.T) {
+	xset(t, 0, "a", "1")
+	kpexpire(t, 0, "a", 10, 1)
+	sleepms(20)
+
+	n := testbl.Writes()
+	checkerror(t, testbl.Group(func(g *Rpdb) {
+		checkerror(t, g.Set(0, "a", "2"), true)
+		checkerror(t, g.Set(0, "b", "3"), true)
+		v, err := g.Get(0, "b")
+		checkerror(t, err, v == nil)
+	}), true)
+	checkerror(t, nil, testbl.Writes() == n+3)
+	xget(t, 0, "a", "2")
+	xget(t, 0, "b", "3")
+	slotsinfo(t, 0, 2)
+	kdel(t, 2, 0, "a", "b")
+	checkempty(t)
+}
+
+func TestContext(t *testing.T) {
+	hset(t, 0, "hash", "field", "value", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a, err := testbl.HGetAllContext(ctx, 0, "hash")
+	checkerror(t, err, len(a) == 2)
+
+	checkerror(t, testbl.acquireContext(ctx), true)
+	it := testbl.getIterator()
+	it.SeekToFirst()
+	checkerror(t, it.Error(), it.Valid())
+	cancel()
+	checkerror(t, nil, !it.Valid() && errors.Equal(it.Error(), context.Canceled))
+	testbl.putIterator(it)
+	testbl.release()
+	checkerror(t, nil, testbl.itlist.Len() == 0)
+
+	_, err = testbl.HGetAllContext(ctx, 0, "hash")
+	checkerror(t, nil, errors.Equal(err, context.Canceled))
+	_, err = testbl.DelContext(ctx, 0, "hash")
+	checkerror(t, nil, errors.Equal(err, context.Canceled))
+
+	s, err := testbl.NewSnapshot()
+	checkerror(t, err, true)
+	_, _, err = s.LoadObjCronContext(ctx, time.Hour, 4, 4096)
+	checkerror(t, nil, errors.Equal(err, context.Canceled))
+	testbl.ReleaseSnapshot(s)
+
+	kdel(t, 1, 0, "hash")
+	checkempty(t)
+}
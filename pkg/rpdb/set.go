@@ -5,6 +5,7 @@ package rpdb
 
 import (
 	"bytes"
+	"context"
 
 	"github.com/wandoulabs/rpdb/pkg/store"
 	"github.com/wandoulabs/redis-port/pkg/libs/errors"
@@ -161,6 +162,10 @@ func (b *Rpdb) SAdd(db uint32, args ...interface{}) (int64, error) {
 	}
 	defer b.release()
 
+	return b.sadd(db, key, members...)
+}
+
+func (b *Rpdb) sadd(db uint32, key []byte, members ...[]byte) (int64, error) {
 	o, err := b.loadSetRow(db, key, true)
 	if err != nil {
 		return 0, err
@@ -188,7 +193,10 @@ func (b *Rpdb) SAdd(db uint32, args ...interface{}) (int64, error) {
 		o.Size += n
 		bt.Set(o.MetaKey(), o.MetaValue())
 	}
-	fw := &Forward{DB: db, Op: "SAdd", Args: args}
+	fw := &Forward{DB: db, Op: "SAdd", Args: []interface{}{key}}
+	for _, member := range members {
+		fw.Args = append(fw.Args, member)
+	}
 	return n, b.commit(bt, fw)
 }
 
@@ -235,6 +243,10 @@ func (b *Rpdb) SIsMember(db uint32, args ...interface{}) (int64, error) {
 	}
 	defer b.release()
 
+	return b.sismember(db, key, member)
+}
+
+func (b *Rpdb) sismember(db uint32, key, member []byte) (int64, error) {
 	o, err := b.loadSetRow(db, key, true)
 	if err != nil || o == nil {
 		return 0, err
@@ -251,6 +263,11 @@ func (b *Rpdb) SIsMember(db uint32, args ...interface{}) (int64, error) {
 
 // SMEMBERS key
 func (b *Rpdb) SMembers(db uint32, args ...interface{}) ([][]byte, error) {
+	return b.SMembersContext(context.Background(), db, args...)
+}
+
+// SMembersContext is SMembers, but it stops once ctx is done.
+func (b *Rpdb) SMembersContext(ctx context.Context, db uint32, args ...interface{}) ([][]byte, error) {
 	if len(args) != 1 {
 		return nil, errArguments("len(args) = %d, expect = 1", len(args))
 	}
@@ -262,11 +279,15 @@ func (b *Rpdb) SMembers(db uint32, args ...interface{}) ([][]byte, error) {
 		}
 	}
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return nil, err
 	}
 	defer b.release()
 
+	return b.smembers(db, key)
+}
+
+func (b *Rpdb) smembers(db uint32, key []byte) ([][]byte, error) {
 	o, err := b.loadSetRow(db, key, true)
 	if err != nil || o == nil {
 		return nil, err
@@ -374,6 +395,10 @@ func (b *Rpdb) SRem(db uint32, args ...interface{}) (int64, error) {
 	}
 	defer b.release()
 
+	return b.srem(db, key, members...)
+}
+
+func (b *Rpdb) srem(db uint32, key []byte, members ...[]byte) (int64, error) {
 	o, err := b.loadSetRow(db, key, true)
 	if err != nil || o == nil {
 		return 0, err
@@ -402,6 +427,9 @@ func (b *Rpdb) SRem(db uint32, args ...interface{}) (int64, error) {
 			bt.Del(o.MetaKey())
 		}
 	}
-	fw := &Forward{DB: db, Op: "SRem", Args: args}
+	fw := &Forward{DB: db, Op: "SRem", Args: []interface{}{key}}
+	for _, member := range members {
+		fw.Args = append(fw.Args, member)
+	}
 	return n, b.commit(bt, fw)
 }
@@ -5,11 +5,14 @@ package rpdb
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"hash/crc32"
 	"time"
 
 	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
 	"github.com/wandoulabs/redis-port/pkg/libs/log"
 	"github.com/wandoulabs/redis-port/pkg/rdb"
 )
@@ -43,40 +46,109 @@ func HashKeyToSlot(key []byte) ([]byte, uint32) {
 
 // SLOTSINFO [start] [count]
 func (b *Rpdb) SlotsInfo(db uint32, args ...interface{}) (map[uint32]int64, error) {
-	if len(args) > 2 {
-		return nil, errArguments("len(args) = %d, expect <= 2", len(args))
+	start, limit, err := parseSlotsRange(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.acquire(); err != nil {
+		return nil, err
 	}
+	defer b.release()
 
-	var start, count uint32 = 0, MaxSlotNum
-	switch len(args) {
-	case 2:
-		if err := parseArgument(args[1], &count); err != nil {
-			return nil, errArguments("parse args[%d] failed, %s", 1, err)
+	if err := b.loadSlotKeys(); err != nil {
+		return nil, err
+	}
+	m := make(map[uint32]int64)
+	for slot := start; slot < limit && slot < MaxSlotNum; slot++ {
+		m[slot] = b.slotKeys.get(db, slot)
+	}
+	return m, nil
+}
+
+// SLOTSSCAN slot cursor [count]
+//
+// The cursor is "0" to start, and the returned one is "0" once the keys of the
+// slot are exhausted. Keys written during the iteration may or may not be
+// returned, as with SCAN.
+func (b *Rpdb) SlotsScan(db uint32, args ...interface{}) ([]byte, [][]byte, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, nil, errArguments("len(args) = %d, expect = 2 or 3", len(args))
+	}
+
+	var slot uint32
+	var cursor []byte
+	var count uint32 = 10
+	for i, ref := range []interface{}{&slot, &cursor, &count}[:len(args)] {
+		if err := parseArgument(args[i], ref); err != nil {
+			return nil, nil, errArguments("parse args[%d] failed, %s", i, err)
 		}
-		fallthrough
-	case 1:
-		if err := parseArgument(args[0], &start); err != nil {
-			return nil, errArguments("parse args[%d] failed, %s", 0, err)
+	}
+	if slot >= MaxSlotNum {
+		return nil, nil, errArguments("slot = %d", slot)
+	}
+	if count == 0 {
+		return nil, nil, errArguments("count = %d", count)
+	}
+
+	pfx := EncodeMetaKeyPrefixSlot(db, slot)
+	seek := pfx
+	if string(cursor) != "0" {
+		p, err := hex.DecodeString(string(cursor))
+		if err != nil || !bytes.HasPrefix(p, pfx) {
+			return nil, nil, errArguments("invalid cursor = %s", cursor)
 		}
+		seek = p
 	}
-	limit := start + count
 
 	if err := b.acquire(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer b.release()
 
-	m := make(map[uint32]int64)
-	for slot := start; slot < limit && slot < MaxSlotNum; slot++ {
-		if key, err := firstKeyUnderSlot(b, db, slot); err != nil {
-			return nil, err
-		} else if key != nil {
-			m[slot] = 1
-		} else {
-			m[slot] = 0
+	keys, next, err := keysUnderPrefix(b, pfx, seek, int(count))
+	if err != nil {
+		return nil, nil, err
+	}
+	if next == nil {
+		return []byte("0"), keys, nil
+	}
+	return []byte(hex.EncodeToString(next)), keys, nil
+}
+
+// SLOTSDEL slot [slot ...]
+//
+// The keys are deleted in small batches, so the lock is never held for long,
+// and the keys written to the slots meanwhile may survive.
+func (b *Rpdb) SlotsDel(db uint32, args ...interface{}) (int64, error) {
+	return b.SlotsDelContext(context.Background(), db, args...)
+}
+
+// SlotsDelContext is SlotsDel, but it stops once ctx is done.
+func (b *Rpdb) SlotsDelContext(ctx context.Context, db uint32, args ...interface{}) (int64, error) {
+	if len(args) == 0 {
+		return 0, errArguments("len(args) = %d, expect != 0", len(args))
+	}
+
+	slots := make([]uint32, len(args))
+	for i := 0; i < len(slots); i++ {
+		if err := parseArgument(args[i], &slots[i]); err != nil {
+			return 0, errArguments("parse args[%d] failed, %s", i, err)
+		}
+		if slots[i] >= MaxSlotNum {
+			return 0, errArguments("slot = %d", slots[i])
 		}
 	}
-	return m, nil
+
+	var n int64
+	for _, slot := range slots {
+		c, err := b.deleteKeysUnder(ctx, db, EncodeMetaKeyPrefixSlot(db, slot), nil)
+		if n += c; err != nil {
+			return n, err
+		}
+		log.Debugf("delete slot, db = %d, slot = %d, keys = %d", db, slot, c)
+	}
+	return n, nil
 }
 
 // SLOTSRESTORE key ttlms value [key ttlms value ...]
@@ -135,12 +207,20 @@ func (b *Rpdb) SlotsRestore(db uint32, args ...interface{}) error {
 		}
 		ms.Set(e.Key)
 	}
-	fw := &Forward{DB: db, Op: "SlotsRestore", Args: args}
+	fw := &Forward{DB: db, Op: "SlotsRestore", Args: args, ExpireAt: make([]uint64, len(objs))}
+	for i, e := range objs {
+		fw.ExpireAt[i] = e.ExpireAt
+	}
 	return b.commit(bt, fw)
 }
 
 // SLOTSMGRTSLOT host port timeout slot
 func (b *Rpdb) SlotsMgrtSlot(db uint32, args ...interface{}) (int64, error) {
+	return b.SlotsMgrtSlotContext(context.Background(), db, args...)
+}
+
+// SlotsMgrtSlotContext is SlotsMgrtSlot, but it stops once ctx is done.
+func (b *Rpdb) SlotsMgrtSlotContext(ctx context.Context, db uint32, args ...interface{}) (int64, error) {
 	if len(args) != 4 {
 		return 0, errArguments("len(args) = %d, expect = 4", len(args))
 	}
@@ -163,7 +243,7 @@ func (b *Rpdb) SlotsMgrtSlot(db uint32, args ...interface{}) (int64, error) {
 	}
 	addr := fmt.Sprintf("%s:%d", host, port)
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return 0, err
 	}
 	defer b.release()
@@ -179,6 +259,11 @@ func (b *Rpdb) SlotsMgrtSlot(db uint32, args ...interface{}) (int64, error) {
 
 // SLOTSMGRTTAGSLOT host port timeout slot
 func (b *Rpdb) SlotsMgrtTagSlot(db uint32, args ...interface{}) (int64, error) {
+	return b.SlotsMgrtTagSlotContext(context.Background(), db, args...)
+}
+
+// SlotsMgrtTagSlotContext is SlotsMgrtTagSlot, but it stops once ctx is done.
+func (b *Rpdb) SlotsMgrtTagSlotContext(ctx context.Context, db uint32, args ...interface{}) (int64, error) {
 	if len(args) != 4 {
 		return 0, errArguments("len(args) = %d, expect = 4", len(args))
 	}
@@ -201,7 +286,7 @@ func (b *Rpdb) SlotsMgrtTagSlot(db uint32, args ...interface{}) (int64, error) {
 	}
 	addr := fmt.Sprintf("%s:%d", host, port)
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return 0, err
 	}
 	defer b.release()
@@ -222,6 +307,11 @@ func (b *Rpdb) SlotsMgrtTagSlot(db uint32, args ...interface{}) (int64, error) {
 
 // SLOTSMGRTONE host port timeout key
 func (b *Rpdb) SlotsMgrtOne(db uint32, args ...interface{}) (int64, error) {
+	return b.SlotsMgrtOneContext(context.Background(), db, args...)
+}
+
+// SlotsMgrtOneContext is SlotsMgrtOne, but it stops once ctx is done.
+func (b *Rpdb) SlotsMgrtOneContext(ctx context.Context, db uint32, args ...interface{}) (int64, error) {
 	if len(args) != 4 {
 		return 0, errArguments("len(args) = %d, expect = 4", len(args))
 	}
@@ -241,7 +331,7 @@ func (b *Rpdb) SlotsMgrtOne(db uint32, args ...interface{}) (int64, error) {
 	}
 	addr := fmt.Sprintf("%s:%d", host, port)
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return 0, err
 	}
 	defer b.release()
@@ -253,6 +343,11 @@ func (b *Rpdb) SlotsMgrtOne(db uint32, args ...interface{}) (int64, error) {
 
 // SLOTSMGRTTAGONE host port timeout key
 func (b *Rpdb) SlotsMgrtTagOne(db uint32, args ...interface{}) (int64, error) {
+	return b.SlotsMgrtTagOneContext(context.Background(), db, args...)
+}
+
+// SlotsMgrtTagOneContext is SlotsMgrtTagOne, but it stops once ctx is done.
+func (b *Rpdb) SlotsMgrtTagOneContext(ctx context.Context, db uint32, args ...interface{}) (int64, error) {
 	if len(args) != 4 {
 		return 0, errArguments("len(args) = %d, expect = 4", len(args))
 	}
@@ -272,7 +367,7 @@ func (b *Rpdb) SlotsMgrtTagOne(db uint32, args ...interface{}) (int64, error) {
 	}
 	addr := fmt.Sprintf("%s:%d", host, port)
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return 0, err
 	}
 	defer b.release()
@@ -309,47 +404,325 @@ func (b *Rpdb) migrateTag(addr string, timeout time.Duration, db uint32, tag []b
 }
 
 func (b *Rpdb) migrate(addr string, timeout time.Duration, db uint32, keys ...[]byte) (int64, error) {
-	var rows []rpdbRow
-	var bins []*rdb.BinEntry
+	m, err := loadMigrateSet(b, db, keys, b.migrateChunkSize())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := m.send(b.context(), addr, timeout, b, db); err != nil {
+		abortMigrate(b.context(), addr, timeout, db, keys)
+		return 0, err
+	}
 
+	if len(m.rows) == 0 {
+		return 0, nil
+	}
+
+	bt := store.NewBatch()
+	for _, o := range m.rows {
+		if err := o.deleteObject(b, bt); err != nil {
+			return 0, err
+		}
+	}
+	fw := &Forward{DB: db, Op: "Del"}
+	for _, key := range keys {
+		fw.Args = append(fw.Args, key)
+	}
+	return int64(len(m.rows)), b.commit(bt, fw)
+}
+
+// migrateSet is the keys of a migration read from r, the expired ones are
+// not sent but deleted with the others.
+type migrateSet struct {
+	rows  []rpdbRow
+	bins  []*rdb.BinEntry
+	chunk int64
+
+	huge     []rpdbRow
+	hugeKeys [][]byte
+}
+
+func loadMigrateSet(r rpdbReader, db uint32, keys [][]byte, chunk int64) (*migrateSet, error) {
+	m := &migrateSet{chunk: chunk}
 	for i, key := range keys {
-		o, bin, err := loadBinEntry(b, db, key)
+		o, err := loadRpdbRow(r, db, key)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
 		if o == nil {
 			log.Debugf("[%d] missing, db = %d, key = %v", i, db, key)
 			continue
 		}
+		if _, ok := o.(*restoringRow); ok {
+			return nil, errors.Trace(ErrKeyRestoring)
+		}
 
-		rows = append(rows, o)
-		if bin != nil {
-			log.Debugf("[%d] migrate, db = %d, key = %v, expireat = %d", i, db, key, o.GetExpireAt())
-			bins = append(bins, bin)
-		} else {
+		m.rows = append(m.rows, o)
+		switch {
+		case o.IsExpired():
 			log.Debugf("[%d] expired, db = %d, key = %v, expireat = %d", i, db, key, o.GetExpireAt())
+		case rowElements(o) > chunk:
+			log.Debugf("[%d] migrate in chunks, db = %d, key = %v, expireat = %d", i, db, key, o.GetExpireAt())
+			m.huge, m.hugeKeys = append(m.huge, o), append(m.hugeKeys, key)
+		default:
+			log.Debugf("[%d] migrate, db = %d, key = %v, expireat = %d", i, db, key, o.GetExpireAt())
+			_, bin, err := loadBinEntry(r, db, key)
+			if err != nil {
+				return nil, err
+			}
+			m.bins = append(m.bins, bin)
 		}
 	}
+	return m, nil
+}
 
-	if len(bins) != 0 {
-		if err := doMigrate(addr, timeout, db, bins); err != nil {
+// send restores the keys on addr, and returns the bytes sent.
+func (m *migrateSet) send(ctx context.Context, addr string, timeout time.Duration, r rpdbReader, db uint32) (int64, error) {
+	var nbytes int64
+	if len(m.bins) != 0 {
+		if err := doMigrate(ctx, addr, timeout, db, m.bins); err != nil {
+			return 0, err
+		}
+		for _, bin := range m.bins {
+			nbytes += int64(len(bin.Key) + len(bin.Value))
+		}
+	}
+	for i, o := range m.huge {
+		n, err := doMigrateChunks(ctx, addr, timeout, r, db, m.hugeKeys[i], o, m.chunk)
+		if err != nil {
 			return 0, err
 		}
+		nbytes += n
 	}
+	return nbytes, nil
+}
 
-	if len(rows) == 0 {
-		return 0, nil
+// abortMigrateTimeout bounds the time spent to abort a migration with the rpdb
+// lock held, the target has usually just failed.
+const abortMigrateTimeout = time.Millisecond * 100
+
+// abortMigrate deletes the keys sent on addr by a migration that failed. The
+// keys are still here, a copy left on the target would be served to a client
+// redirected there once they are deleted here.
+func abortMigrate(ctx context.Context, addr string, timeout time.Duration, db uint32, keys [][]byte) {
+	if timeout > abortMigrateTimeout {
+		timeout = abortMigrateTimeout
+	}
+	if err := doMigrateDel(ctx, addr, timeout, db, keys); err != nil {
+		log.WarnErrorf(err, "abort migration failed, addr = %s, db = %d, len(keys) = %d", addr, db, len(keys))
+	}
+}
+
+// slotWatch records the keys of a slot written while a batch of the slot is
+// migrated without the lock.
+type slotWatch struct {
+	db   uint32
+	slot uint32
+	keys map[string]bool
+	all  bool
+}
+
+func (w *slotWatch) observe(fw *Forward) {
+	switch fw.Op {
+	case "Reset", "Replace":
+		w.all = true
+		return
+	}
+	if fw.DB != w.db {
+		return
+	}
+	for _, key := range fw.Keys() {
+		if _, slot := HashKeyToSlot(key); slot == w.slot {
+			w.keys[string(key)] = true
+		}
+	}
+}
+
+func (w *slotWatch) written(key []byte) bool {
+	return w.all || w.keys[string(key)]
+}
+
+// MigrateSlotBatch migrates at most n keys of the slot to addr, and returns
+// the number of keys migrated and the bytes sent, 0 keys once the slot is
+// empty. The keys are read from a snapshot and sent without the lock, so the
+// writes go on meanwhile. The keys written before the batch is acknowledged
+// are sent again with the lock held, then the batch is deleted. A batch holds
+// whole tag groups, it exceeds n keys rather than splitting one.
+func (b *Rpdb) MigrateSlotBatch(ctx context.Context, addr string, timeout time.Duration, db, slot uint32, n int) (int64, int64, error) {
+	if slot >= MaxSlotNum {
+		return 0, 0, errArguments("slot = %d", slot)
+	}
+	if err := b.acquireContext(ctx); err != nil {
+		return 0, 0, err
+	}
+	sp := &RpdbSnapshot{sp: b.db.NewSnapshot()}
+	b.splist.PushBack(sp)
+	w := &slotWatch{db: db, slot: slot, keys: make(map[string]bool)}
+	b.watches = append(b.watches, w)
+	chunk := b.migrateChunkSize()
+	b.release()
+
+	keys, nbytes, err := migrateSnapshot(ctx, addr, timeout, sp, db, slot, n, chunk)
+
+	// the lock is taken even if ctx is done, to drop the watch and snapshot
+	if err := b.acquire(); err != nil {
+		return 0, 0, err
+	}
+	b.ctx = ctx
+	defer b.release()
+
+	for i, x := range b.watches {
+		if x == w {
+			b.watches = append(b.watches[:i], b.watches[i+1:]...)
+			break
+		}
+	}
+	for e := b.splist.Front(); e != nil; e = e.Next() {
+		if e.Value == sp {
+			b.splist.Remove(e)
+			sp.Close()
+			break
+		}
+	}
+	if err != nil || len(keys) == 0 {
+		if len(keys) != 0 {
+			abortMigrate(ctx, addr, timeout, db, keys)
+		}
+		return 0, 0, err
 	}
 
+	// the keys created in the tag groups of the batch since the snapshot are
+	// migrated with them, so the groups are never split
+	extra, err := keysAddedToTags(b, db, keys)
+	if err == nil {
+		nbytes, err = b.commitSlotBatch(ctx, addr, timeout, w, db, keys, extra, nbytes, chunk)
+	}
+	if err != nil {
+		abortMigrate(ctx, addr, timeout, db, append(keys, extra...))
+		return 0, 0, err
+	}
+	return int64(len(keys) + len(extra)), nbytes, nil
+}
+
+// commitSlotBatch deletes the keys of a batch sent from a snapshot, once the
+// keys written meanwhile and the extra keys are sent. It's called with the
+// rpdb lock, and returns the bytes sent.
+func (b *Rpdb) commitSlotBatch(ctx context.Context, addr string, timeout time.Duration, w *slotWatch, db uint32, keys, extra [][]byte, nbytes int64, chunk int64) (int64, error) {
+	written := append([][]byte{}, extra...)
+	fw := &Forward{DB: db, Op: "Del"}
 	bt := store.NewBatch()
-	for _, o := range rows {
+	for _, key := range keys {
+		if w.written(key) {
+			written = append(written, key)
+			continue
+		}
+		o, err := loadRpdbRow(b, db, key)
+		if err != nil {
+			return 0, err
+		}
+		if o == nil {
+			continue
+		}
 		if err := o.deleteObject(b, bt); err != nil {
 			return 0, err
 		}
+		fw.Args = append(fw.Args, key)
 	}
-	fw := &Forward{DB: db, Op: "Del"}
+	if len(written) != 0 {
+		log.Debugf("migrate slot batch, db = %d, slot = %d, %d keys written during the batch", db, w.slot, len(written))
+		// the target may hold a copy of a key deleted since the snapshot
+		if err := doMigrateDel(ctx, addr, timeout, db, written); err != nil {
+			return 0, err
+		}
+		m, err := loadMigrateSet(b, db, written, chunk)
+		if err != nil {
+			return 0, err
+		}
+		n, err := m.send(ctx, addr, timeout, b, db)
+		if err != nil {
+			return 0, err
+		}
+		for _, o := range m.rows {
+			if err := o.deleteObject(b, bt); err != nil {
+				return 0, err
+			}
+		}
+		for _, key := range written {
+			fw.Args = append(fw.Args, key)
+		}
+		nbytes += n
+	}
+	return nbytes, b.commit(bt, fw)
+}
+
+// keysAddedToTags returns the keys of the tag groups of keys that are not in
+// keys.
+func keysAddedToTags(r rpdbReader, db uint32, keys [][]byte) ([][]byte, error) {
+	batch := make(map[string]bool)
 	for _, key := range keys {
-		fw.Args = append(fw.Args, key)
+		batch[string(key)] = true
+	}
+	var extra [][]byte
+	tags := make(map[string]bool)
+	for _, key := range keys {
+		tag := HashTag(key)
+		if tags[string(tag)] {
+			continue
+		}
+		tags[string(tag)] = true
+		group, err := allKeysWithTag(r, db, tag)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range group {
+			if !batch[string(k)] {
+				extra = append(extra, k)
+			}
+		}
+	}
+	return extra, nil
+}
+
+// appendTagGroup completes the tag group of the last of keys, which are in
+// the order of the meta rows, so the keys of a tag group are contiguous.
+func appendTagGroup(r rpdbReader, db uint32, keys [][]byte) ([][]byte, error) {
+	tag := HashTag(keys[len(keys)-1])
+	group, err := allKeysWithTag(r, db, tag)
+	if err != nil {
+		return nil, err
+	}
+	i := len(keys)
+	for i != 0 && bytes.Equal(HashTag(keys[i-1]), tag) {
+		i--
+	}
+	return append(keys[:i], group...), nil
+}
+
+// migrateSnapshot sends at most n keys of the slot in sp to addr, but whole
+// tag groups, and returns the keys and the bytes sent. The keys are returned
+// with the error if they may have been sent in part.
+func migrateSnapshot(ctx context.Context, addr string, timeout time.Duration, sp *RpdbSnapshot, db, slot uint32, n int, chunk int64) ([][]byte, int64, error) {
+	r := sp.getReader()
+	r.ctx = ctx
+	defer func() {
+		r.ctx = nil
+		sp.putReader(r)
+	}()
+
+	pfx := EncodeMetaKeyPrefixSlot(db, slot)
+	keys, _, err := keysUnderPrefix(r, pfx, pfx, n)
+	if err != nil || len(keys) == 0 {
+		return nil, 0, err
+	}
+	if keys, err = appendTagGroup(r, db, keys); err != nil {
+		return nil, 0, err
+	}
+	m, err := loadMigrateSet(r, db, keys, chunk)
+	if err != nil {
+		return nil, 0, err
+	}
+	nbytes, err := m.send(ctx, addr, timeout, r, db)
+	if err != nil {
+		return keys, 0, err
 	}
-	return int64(len(rows)), b.commit(bt, fw)
+	return keys, nbytes, nil
 }
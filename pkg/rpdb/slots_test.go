@@ -6,6 +6,8 @@ package rpdb
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"math"
 	"math/rand"
@@ -97,6 +99,61 @@ func TestSlotsRestore(t *testing.T) {
 	checkempty(t)
 }
 
+func xslotsrestorechunk(t *testing.T, db uint32, key string, seq uint64, obj interface{}) {
+	dump, err := rdb.EncodeDump(obj)
+	checkerror(t, err, true)
+	err = testbl.SlotsRestoreChunk(db, key, seq, dump)
+	checkerror(t, err, true)
+}
+
+func TestSlotsRestoreChunk(t *testing.T) {
+	xslotsrestorechunk(t, 0, "hash", 0, rdb.Hash{
+		&rdb.HashElement{Field: []byte("a"), Value: []byte("1")},
+		&rdb.HashElement{Field: []byte("b"), Value: []byte("2")},
+	})
+	xslotsrestorechunk(t, 0, "hash", 1, rdb.Hash{
+		&rdb.HashElement{Field: []byte("c"), Value: []byte("3")},
+	})
+	_, err := testbl.HGetAll(0, "hash")
+	checkerror(t, nil, errors.Equal(err, ErrKeyRestoring))
+	dump, err := rdb.EncodeDump(rdb.Hash{&rdb.HashElement{Field: []byte("d"), Value: []byte("4")}})
+	checkerror(t, err, true)
+	checkerror(t, nil, testbl.SlotsRestoreChunk(0, "hash", 3, dump) != nil)
+
+	checkerror(t, testbl.SlotsRestoreCommit(0, "hash", 1000), true)
+	hgetall(t, 0, "hash", "a", "1", "b", "2", "c", "3")
+	kpttl(t, 0, "hash", 1000)
+	err = testbl.SlotsRestoreCommit(0, "hash", 0)
+	checkerror(t, nil, errors.Equal(err, ErrNotRestoring))
+
+	xslotsrestorechunk(t, 0, "list", 0, rdb.List{[]byte("a"), []byte("b")})
+	xslotsrestorechunk(t, 0, "list", 1, rdb.List{[]byte("c")})
+	checkerror(t, testbl.SlotsRestoreCommit(0, "list", 0), true)
+	lrange(t, 0, "list", 0, -1, "a", "b", "c")
+	kpttl(t, 0, "list", -1)
+
+	xset(t, 0, "key", "hello")
+	xslotsrestorechunk(t, 0, "key", 0, rdb.Set{[]byte("a"), []byte("b")})
+	_, err = testbl.Exists(0, "key")
+	checkerror(t, nil, errors.Equal(err, ErrKeyRestoring))
+	n, err := testbl.SlotsRestoreAbort(0, "key")
+	checkerror(t, err, n == 1)
+	kexists(t, 0, "key", 0)
+	n, err = testbl.SlotsRestoreAbort(0, "key")
+	checkerror(t, err, n == 0)
+
+	restoringTTL = time.Millisecond * 10
+	xslotsrestorechunk(t, 0, "key", 0, rdb.Set{[]byte("a"), []byte("b")})
+	restoringTTL = time.Minute
+	sleepms(20)
+	err = testbl.SlotsRestoreCommit(0, "key", 0)
+	checkerror(t, nil, errors.Equal(err, ErrNotRestoring))
+	kexists(t, 0, "key", 0)
+
+	kdel(t, 2, 0, "hash", "list")
+	checkempty(t)
+}
+
 func checkconn(t *testing.T) (*net.TCPAddr, net.Conn) {
 	l, err := net.Listen("tcp4", ":0")
 	checkerror(t, err, true)
@@ -292,7 +349,7 @@ func TestSlotsMgrtTagSlot(t *testing.T) {
 
 	r, w := bufio.NewReader(c), bufio.NewWriter(c)
 
-	slotsinfo(t, 0, 1)
+	slotsinfo(t, 0, 32)
 	checkslotsmgrt(t, r, w, slotsmgrttagslot(addr, 0, "tag", 0))
 	checkslotsmgrt(t, r, w, slotsmgrttagslot(addr, 0, "", 32), args...)
 	checkslotsmgrt(t, r, w, slotsmgrttagslot(addr, 0, "", 0))
@@ -315,7 +372,7 @@ func TestSlotsMgrtOne(t *testing.T) {
 	checkslotsmgrt(t, r, w, slotsmgrtone(addr, 0, "key{tag}", 1), "key{tag}", 0, "hello")
 	slotsinfo(t, 0, 0)
 
-	slotsinfo(t, 1, 1)
+	slotsinfo(t, 1, 2)
 	checkslotsmgrt(t, r, w, slotsmgrtone(addr, 1, "key{tag}1", 1), "key{tag}1", 0, "hello")
 	slotsinfo(t, 1, 1)
 	checkslotsmgrt(t, r, w, slotsmgrtone(addr, 1, "key{tag}2", 1), "key{tag}2", 0, "world")
@@ -335,13 +392,13 @@ func TestSlotsMgrtTagOne(t *testing.T) {
 
 	r, w := bufio.NewReader(c), bufio.NewWriter(c)
 
-	slotsinfo(t, 0, 1)
+	slotsinfo(t, 0, 2)
 	checkslotsmgrt(t, r, w, slotsmgrttagone(addr, 0, "tag", 1), "tag", 0, "xxxx")
 	slotsinfo(t, 0, 1)
 	checkslotsmgrt(t, r, w, slotsmgrttagone(addr, 0, "key{tag}", 1), "key{tag}", 0, "hello")
 	slotsinfo(t, 0, 0)
 
-	slotsinfo(t, 1, 1)
+	slotsinfo(t, 1, 2)
 	checkslotsmgrt(t, r, w, slotsmgrttagone(addr, 1, "key{tag}1", 2), "key{tag}1", 0, "hello", "key{tag}2", 0, "world")
 	slotsinfo(t, 1, 0)
 	checkslotsmgrt(t, r, w, slotsmgrttagone(addr, 1, "key{tag}2", 0))
@@ -354,3 +411,177 @@ func TestSlotsMgrtTagOne(t *testing.T) {
 
 	checkempty(t)
 }
+
+func checkcommand(t *testing.T, r *bufio.Reader, w *bufio.Writer, rsp redis.Resp, expect string, nargs int) [][]byte {
+	req, err := redis.Decode(r)
+	checkerror(t, err, true)
+	cmd, args, err := redis.ParseArgs(req)
+	checkerror(t, err, cmd == expect && len(args) == nargs)
+	checkerror(t, redis.Encode(w, rsp), true)
+	checkerror(t, w.Flush(), true)
+	return args
+}
+
+func TestMigrateSlotBatch(t *testing.T) {
+	xset(t, 0, "{batch}1", "a")
+	xset(t, 0, "{batch}2", "b")
+	slot := HashTagToSlot([]byte("batch"))
+
+	addr, c := checkconn(t)
+	defer c.Close()
+
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+
+	type result struct {
+		keys, bytes int64
+		err         error
+	}
+	x := make(chan result, 1)
+	go func() {
+		keys, nbytes, err := testbl.MigrateSlotBatch(context.Background(), addr.String(), time.Second, 0, slot, 100)
+		x <- result{keys, nbytes, err}
+	}()
+
+	ok := redis.NewString("OK")
+	checkcommand(t, r, w, ok, "select", 1)
+	req, err := redis.Decode(r)
+	checkerror(t, err, true)
+	cmd, args, err := redis.ParseArgs(req)
+	checkerror(t, err, cmd == "slotsrestore" && len(args) == 6)
+
+	// the batch is sent without the lock, a key written meanwhile is sent again
+	xset(t, 0, "{batch}1", "c")
+	checkerror(t, redis.Encode(w, ok), true)
+	checkerror(t, w.Flush(), true)
+
+	checkcommand(t, r, w, ok, "select", 1)
+	checkcommand(t, r, w, ok, "asking", 0)
+	args = checkcommand(t, r, w, redis.NewInt(1), "del", 1)
+	checkerror(t, nil, string(args[0]) == "{batch}1")
+	checkcommand(t, r, w, ok, "select", 1)
+	args = checkcommand(t, r, w, ok, "slotsrestore", 3)
+	v, err := rdb.DecodeDump(args[2])
+	checkerror(t, err, string(args[0]) == "{batch}1" && string(v.(rdb.String)) == "c")
+
+	select {
+	case res := <-x:
+		checkerror(t, res.err, res.keys == 2 && res.bytes != 0)
+	case <-time.After(time.Second):
+		checkerror(t, nil, false)
+	}
+	kexists(t, 0, "{batch}1", 0)
+	kexists(t, 0, "{batch}2", 0)
+
+	keys, _, err := testbl.MigrateSlotBatch(context.Background(), addr.String(), time.Second, 0, slot, 100)
+	checkerror(t, err, keys == 0)
+
+	checkempty(t)
+}
+
+func TestMigrateSlotBatchTag(t *testing.T) {
+	xset(t, 0, "{group}1", "a")
+	xset(t, 0, "{group}2", "b")
+	xset(t, 0, "{group}3", "c")
+	slot := HashTagToSlot([]byte("group"))
+
+	addr, c := checkconn(t)
+	defer c.Close()
+
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+
+	type result struct {
+		keys int64
+		err  error
+	}
+	x := make(chan result, 1)
+	go func() {
+		keys, _, err := testbl.MigrateSlotBatch(context.Background(), addr.String(), time.Second, 0, slot, 1)
+		x <- result{keys, err}
+	}()
+
+	// the batch holds the whole tag group
+	ok := redis.NewString("OK")
+	checkcommand(t, r, w, ok, "select", 1)
+	req, err := redis.Decode(r)
+	checkerror(t, err, true)
+	cmd, args, err := redis.ParseArgs(req)
+	checkerror(t, err, cmd == "slotsrestore" && len(args) == 9)
+
+	// a key created in the group meanwhile is migrated with it
+	xset(t, 0, "{group}4", "d")
+	checkerror(t, redis.Encode(w, ok), true)
+	checkerror(t, w.Flush(), true)
+
+	checkcommand(t, r, w, ok, "select", 1)
+	checkcommand(t, r, w, ok, "asking", 0)
+	args = checkcommand(t, r, w, redis.NewInt(0), "del", 1)
+	checkerror(t, nil, string(args[0]) == "{group}4")
+	checkcommand(t, r, w, ok, "select", 1)
+	args = checkcommand(t, r, w, ok, "slotsrestore", 3)
+	checkerror(t, nil, string(args[0]) == "{group}4")
+
+	select {
+	case res := <-x:
+		checkerror(t, res.err, res.keys == 4)
+	case <-time.After(time.Second):
+		checkerror(t, nil, false)
+	}
+	slotsinfo(t, 0, 0)
+	checkempty(t)
+}
+
+func TestSlotsScan(t *testing.T) {
+	_, slot := HashKeyToSlot([]byte("{scan}"))
+	keys := make(map[string]bool)
+	for i := 0; i < 25; i++ {
+		key := "{scan}_" + strconv.Itoa(i)
+		xset(t, 0, key, "value")
+		keys[key] = true
+	}
+	xset(t, 1, "{scan}_db1", "value")
+
+	cursor, calls := []byte("0"), 0
+	for {
+		next, a, err := testbl.SlotsScan(0, slot, cursor, 10)
+		checkerror(t, err, len(a) <= 10)
+		for _, key := range a {
+			checkerror(t, nil, keys[string(key)])
+			delete(keys, string(key))
+		}
+		calls++
+		if cursor = next; string(cursor) == "0" {
+			break
+		}
+	}
+	checkerror(t, nil, len(keys) == 0 && calls == 3)
+
+	_, _, err := testbl.SlotsScan(0, slot, "xyz")
+	checkerror(t, nil, err != nil)
+	_, _, err = testbl.SlotsScan(0, slot+1, hex.EncodeToString(EncodeMetaKeyPrefixSlot(0, slot)))
+	checkerror(t, nil, err != nil)
+
+	n, err := testbl.SlotsDel(0, slot)
+	checkerror(t, err, n == 25)
+	n, err = testbl.SlotsDel(1, slot)
+	checkerror(t, err, n == 1)
+	checkempty(t)
+}
+
+func TestSlotsDel(t *testing.T) {
+	_, slot1 := HashKeyToSlot([]byte("{del1}"))
+	_, slot2 := HashKeyToSlot([]byte("{del2}"))
+	for i := 0; i < 1500; i++ {
+		xset(t, 0, "{del1}_"+strconv.Itoa(i), "value")
+	}
+	hset(t, 0, "{del2}_hash", "field", "value", 1)
+	xset(t, 0, "{del3}", "value")
+
+	n, err := testbl.SlotsDel(0, slot1, slot2)
+	checkerror(t, err, n == 1501)
+	slotsinfo(t, 0, 1)
+	hgetall(t, 0, "{del2}_hash")
+	xget(t, 0, "{del3}", "value")
+
+	kdel(t, 1, 0, "{del3}")
+	checkempty(t)
+}
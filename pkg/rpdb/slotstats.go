@@ -0,0 +1,346 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"bytes"
+
+	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+)
+
+// The number of keys of every slot is kept in a counter row, which is updated
+// in the batch that creates or deletes the meta rows. The counters are rebuilt
+// from the meta rows once, if slotKeysMarker is missing. Like walSeqKey, they
+// sort after all the meta and data rows, so scans never see them.
+var (
+	slotKeysMarker = []byte("@slotkeys")
+	slotKeysPrefix = []byte("@slotkeys:")
+)
+
+// slotSizeSampleKeys is the number of keys whose data rows are measured to
+// estimate the size of a slot, the data rows are ordered by key, not by slot.
+const slotSizeSampleKeys = 256
+
+// SlotStats is the number of keys of a slot, and the approximate size in bytes
+// of their rows on disk, which is 0 if the engine can't estimate it. Keys
+// expired but not deleted yet are counted.
+type SlotStats struct {
+	Slot  uint32
+	Keys  int64
+	Bytes int64
+}
+
+type slotKeysCounters map[uint32]*[MaxSlotNum]int64
+
+func encodeSlotKeysKey(db, slot uint32) []byte {
+	w := NewBufWriter(nil)
+	if err := w.WriteBytes(slotKeysPrefix); err != nil {
+		log.PanicErrorf(err, "encode slot keys counter failed")
+	}
+	encodeRawBytes(w, &db, &slot)
+	return w.Bytes()
+}
+
+func decodeSlotKeysKey(p []byte) (db, slot uint32, err error) {
+	r := NewBufReader(p[len(slotKeysPrefix):])
+	err = decodeRawBytes(r, err, &db, &slot)
+	err = decodeRawBytes(r, err)
+	return
+}
+
+// decodeMetaKeySlot returns the db and the slot of a meta key.
+func decodeMetaKeySlot(p []byte) (db, slot uint32, err error) {
+	r := NewBufReader(p)
+	err = decodeRawBytes(r, err, MetaCode, &db, &slot)
+	return
+}
+
+// prefixLimit returns the first key after all the keys with prefix pfx.
+func prefixLimit(pfx []byte) []byte {
+	for i := len(pfx) - 1; i >= 0; i-- {
+		if pfx[i] != 0xff {
+			limit := append([]byte{}, pfx[:i+1]...)
+			limit[i]++
+			return limit
+		}
+	}
+	return nil
+}
+
+func (c slotKeysCounters) get(db, slot uint32) int64 {
+	if a := c[db]; a != nil {
+		return a[slot]
+	}
+	return 0
+}
+
+func (c slotKeysCounters) add(db, slot uint32, delta int64) {
+	a := c[db]
+	if a == nil {
+		a = &[MaxSlotNum]int64{}
+		c[db] = a
+	}
+	a[slot] += delta
+}
+
+// loadSlotKeys loads the counters of keys, or rebuilds them if they have never
+// been stored in the database.
+func (b *Rpdb) loadSlotKeys() error {
+	if b.slotKeys != nil {
+		return nil
+	}
+	marker, err := b.db.Get(slotKeysMarker)
+	if err != nil {
+		return err
+	}
+	counters := make(slotKeysCounters)
+	if marker != nil {
+		if err := b.scanRows(slotKeysPrefix, func(key, value []byte) error {
+			db, slot, err := decodeSlotKeysKey(key)
+			if err != nil {
+				return err
+			}
+			n, err := ParseInt(value)
+			if err != nil {
+				return err
+			}
+			counters.add(db, slot, n)
+			return nil
+		}); err != nil {
+			return err
+		}
+		b.slotKeys = counters
+		return nil
+	}
+
+	log.Infof("rpdb is rebuilding slot key counters ...")
+	var total int64
+	if err := b.scanRows([]byte{MetaCode}, func(key, value []byte) error {
+		if !isKeyRow(value) {
+			return nil
+		}
+		db, slot, err := decodeMetaKeySlot(key)
+		if err != nil {
+			return err
+		}
+		counters.add(db, slot, 1)
+		total++
+		return nil
+	}); err != nil {
+		return err
+	}
+	bt := store.NewBatch()
+	for db, a := range counters {
+		for slot, n := range a {
+			if n != 0 {
+				bt.Set(encodeSlotKeysKey(db, uint32(slot)), FormatInt(n))
+			}
+		}
+	}
+	bt.Set(slotKeysMarker, []byte{})
+	if err := b.db.Commit(bt); err != nil {
+		log.WarnErrorf(err, "rpdb store slot key counters failed")
+		return err
+	}
+	b.slotKeys = counters
+	log.Infof("rpdb rebuilt slot key counters, keys = %d", total)
+	return nil
+}
+
+// scanRows calls fn with the rows whose key has prefix pfx.
+func (b *Rpdb) scanRows(pfx []byte, fn func(key, value []byte) error) error {
+	it := b.getIterator()
+	defer b.putIterator(it)
+	for it.SeekTo(pfx); it.Valid(); it.Next() {
+		key := it.Key()
+		if !bytes.HasPrefix(key, pfx) {
+			break
+		}
+		if err := fn(key, it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+// isKeyRow tells if the meta row v is a key, the rows of the keys being
+// restored in chunks are not.
+func isKeyRow(v []byte) bool {
+	return len(v) != 0 && ObjectCode(v[0]) != restoringCode
+}
+
+// metaRowsAfter tells whether the meta rows written by bt are keys after it.
+func metaRowsAfter(bt *store.Batch) map[string]bool {
+	exists := make(map[string]bool)
+	for e := bt.OpList.Front(); e != nil; e = e.Next() {
+		switch op := e.Value.(type) {
+		case *store.BatchOpSet:
+			if len(op.Key) != 0 && op.Key[0] == MetaCode {
+				exists[string(op.Key)] = isKeyRow(op.Value)
+			}
+		case *store.BatchOpDel:
+			if len(op.Key) != 0 && op.Key[0] == MetaCode {
+				exists[string(op.Key)] = false
+			}
+		}
+	}
+	return exists
+}
+
+// countSlotKeys adds the updates of the counters of keys to bt, for the meta
+// rows it creates and deletes, rows is metaRowsAfter(bt). The returned deltas
+// are applied to b.slotKeys once bt is committed. The rows written by the
+// group of b, not committed yet, are taken into account. The write paths load
+// the rows they write, so the rows are only read here if they were not.
+func (b *Rpdb) countSlotKeys(bt *store.Batch, rows map[string]bool) (slotKeysCounters, error) {
+	if err := b.loadSlotKeys(); err != nil {
+		return nil, err
+	}
+	var pending slotKeysCounters
+	deltas := make(slotKeysCounters)
+	for key, after := range rows {
+		before, ok := b.group.lookup(key)
+		if !ok {
+			before, ok = b.metas[key]
+		}
+		if !ok {
+			v, err := b.db.Get([]byte(key))
+			if err != nil {
+				return nil, err
+			}
+			before = isKeyRow(v)
+		}
+		if before == after {
+			continue
+		}
+		db, slot, err := decodeMetaKeySlot([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+		if after {
+			deltas.add(db, slot, 1)
+		} else {
+			deltas.add(db, slot, -1)
+		}
+	}
+	if b.group != nil {
+		pending = b.group.deltas
+	}
+	for db, a := range deltas {
+		for slot, delta := range a {
+			if delta == 0 {
+				continue
+			}
+			key := encodeSlotKeysKey(db, uint32(slot))
+			if n := b.slotKeys.get(db, uint32(slot)) + pending.get(db, uint32(slot)) + delta; n > 0 {
+				bt.Set(key, FormatInt(n))
+			} else {
+				bt.Del(key)
+			}
+		}
+	}
+	return deltas, nil
+}
+
+func (b *Rpdb) applySlotKeys(deltas slotKeysCounters) {
+	for db, a := range deltas {
+		for slot, delta := range a {
+			if delta != 0 {
+				b.slotKeys.add(db, uint32(slot), delta)
+			}
+		}
+	}
+}
+
+// slotBytes estimates the size of the rows of a slot that holds n keys, it
+// measures the meta rows of the slot, and the data rows of at most
+// slotSizeSampleKeys of its keys.
+func slotBytes(r rpdbReader, est store.SizeEstimator, db, slot uint32, n int64) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	pfx := EncodeMetaKeyPrefixSlot(db, slot)
+	keys, _, err := keysUnderPrefix(r, pfx, pfx, slotSizeSampleKeys)
+	if err != nil {
+		return 0, err
+	}
+	ranges := []store.Range{{pfx, prefixLimit(pfx)}}
+	for _, key := range keys {
+		p := EncodeDataKeyPrefix(db, key)
+		ranges = append(ranges, store.Range{p, prefixLimit(p)})
+	}
+	sizes := est.ApproximateSizes(ranges)
+	var data int64
+	for _, v := range sizes[1:] {
+		data += int64(v)
+	}
+	if len(keys) != 0 && int64(len(keys)) < n {
+		data = data * n / int64(len(keys))
+	}
+	return int64(sizes[0]) + data, nil
+}
+
+// SLOTSSTATS [start] [count]
+//
+// The keys are counted with the rpdb lock held, the bytes are estimated once
+// it's released, from a snapshot taken with the counters. Like Backup, the
+// database is pinned meanwhile.
+func (b *Rpdb) SlotsStats(db uint32, args ...interface{}) ([]*SlotStats, error) {
+	start, limit, err := parseSlotsRange(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	if err := b.loadSlotKeys(); err != nil {
+		b.release()
+		return nil, err
+	}
+	var stats []*SlotStats
+	for slot := start; slot < limit && slot < MaxSlotNum; slot++ {
+		stats = append(stats, &SlotStats{Slot: slot, Keys: b.slotKeys.get(db, slot)})
+	}
+	est, ok := b.db.(store.SizeEstimator)
+	if !ok {
+		b.release()
+		return stats, nil
+	}
+	sp := b.db.NewSnapshot()
+	b.backups.Add(1)
+	b.release()
+	defer b.backups.Done()
+	defer sp.Close()
+
+	r := &snapshotReader{sp: sp}
+	defer r.cleanup()
+	for _, s := range stats {
+		if s.Bytes, err = slotBytes(r, est, db, s.Slot, s.Keys); err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+func parseSlotsRange(args []interface{}) (uint32, uint32, error) {
+	if len(args) > 2 {
+		return 0, 0, errArguments("len(args) = %d, expect <= 2", len(args))
+	}
+
+	var start, count uint32 = 0, MaxSlotNum
+	switch len(args) {
+	case 2:
+		if err := parseArgument(args[1], &count); err != nil {
+			return 0, 0, errArguments("parse args[%d] failed, %s", 1, err)
+		}
+		fallthrough
+	case 1:
+		if err := parseArgument(args[0], &start); err != nil {
+			return 0, 0, errArguments("parse args[%d] failed, %s", 0, err)
+		}
+	}
+	return start, start + count, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+func checkslotstats(t *testing.T, db, slot uint32, keys int64) {
+	stats, err := testbl.SlotsStats(db, slot, 1)
+	checkerror(t, err, len(stats) == 1)
+	s := stats[0]
+	checkerror(t, nil, s.Slot == slot && s.Keys == keys && s.Bytes >= 0)
+	if keys == 0 {
+		checkerror(t, nil, s.Bytes == 0)
+	}
+	m, err := testbl.SlotsInfo(db, slot, 1)
+	checkerror(t, err, len(m) == 1 && m[slot] == keys)
+}
+
+func TestSlotsStats(t *testing.T) {
+	_, slot := HashKeyToSlot([]byte("{stats}"))
+	checkslotstats(t, 0, slot, 0)
+
+	var keys []string
+	for i := 0; i < 16; i++ {
+		key := "{stats}_" + strconv.Itoa(i)
+		xset(t, 0, key, "value")
+		xset(t, 0, key, "value2")
+		keys = append(keys, key)
+	}
+	hset(t, 0, "{stats}_hash", "field1", "value", 1)
+	hset(t, 0, "{stats}_hash", "field2", "value", 1)
+	checkslotstats(t, 0, slot, 17)
+	checkslotstats(t, 1, slot, 0)
+
+	kdel(t, 2, 0, keys[0], "{stats}_hash")
+	checkslotstats(t, 0, slot, 15)
+
+	kpexpire(t, 0, keys[1], 10, 1)
+	sleepms(20)
+	checkslotstats(t, 0, slot, 15)
+	kdel(t, 0, 0, keys[1])
+	checkslotstats(t, 0, slot, 14)
+
+	xslotsrestorechunk(t, 0, "{stats}_chunk", 0, rdb.Set{[]byte("a")})
+	checkslotstats(t, 0, slot, 14)
+
+	bt := store.NewBatch()
+	bt.Del(slotKeysMarker)
+	checkerror(t, testbl.db.Commit(bt), true)
+	testbl.slotKeys = nil
+	checkslotstats(t, 0, slot, 14)
+
+	checkerror(t, testbl.SlotsRestoreCommit(0, "{stats}_chunk", 0), true)
+	checkslotstats(t, 0, slot, 15)
+	kdel(t, 1, 0, "{stats}_chunk")
+
+	kdel(t, 14, 0, keys[2:]...)
+	checkslotstats(t, 0, slot, 0)
+	checkempty(t)
+}
@@ -5,6 +5,7 @@ package rpdb
 
 import (
 	"container/list"
+	"context"
 	"sync"
 	"time"
 
@@ -82,6 +83,8 @@ func (s *RpdbSnapshot) putReader(r *snapshotReader) {
 type snapshotReader struct {
 	sp store.Snapshot
 	it *rpdbIterator
+
+	ctx context.Context
 }
 
 func (s *snapshotReader) getRowValue(key []byte) ([]byte, error) {
@@ -92,11 +95,12 @@ func (s *snapshotReader) getIterator() (it *rpdbIterator) {
 	if s.it != nil {
 		it, s.it = s.it, nil
 		if it.Error() == nil {
+			it.ctx = s.ctx
 			return it
 		}
 		it.Close()
 	}
-	return &rpdbIterator{Iterator: s.sp.NewIterator()}
+	return &rpdbIterator{Iterator: s.sp.NewIterator(), ctx: s.ctx}
 }
 
 func (s *snapshotReader) putIterator(it *rpdbIterator) {
@@ -117,6 +121,15 @@ func (s *snapshotReader) cleanup() {
 }
 
 func (s *RpdbSnapshot) LoadObjCron(wait time.Duration, ncpu, step int) ([]*rdb.ObjEntry, bool, error) {
+	return s.LoadObjCronContext(context.Background(), wait, ncpu, step)
+}
+
+// LoadObjCronContext is LoadObjCron, but it stops once ctx is done, even in
+// the middle of a huge object.
+func (s *RpdbSnapshot) LoadObjCronContext(ctx context.Context, wait time.Duration, ncpu, step int) ([]*rdb.ObjEntry, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, errors.Trace(err)
+	}
 	if err := s.acquire(); err != nil {
 		return nil, false, err
 	}
@@ -140,7 +153,7 @@ func (s *RpdbSnapshot) LoadObjCron(wait time.Duration, ncpu, step int) ([]*rdb.O
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			objs, more, err := s.loadObjCron(ctrl, exit)
+			objs, more, err := s.loadObjCron(ctx, ctrl, exit)
 			rets.Lock()
 			if len(objs) != 0 {
 				rets.objs = append(rets.objs, objs...)
@@ -161,6 +174,8 @@ func (s *RpdbSnapshot) LoadObjCron(wait time.Duration, ncpu, step int) ([]*rdb.O
 		case ctrl <- 0:
 		case <-exit:
 			stop = true
+		case <-ctx.Done():
+			stop = true
 		}
 		if time.Now().After(deadline) {
 			stop = true
@@ -168,6 +183,9 @@ func (s *RpdbSnapshot) LoadObjCron(wait time.Duration, ncpu, step int) ([]*rdb.O
 	}
 	close(ctrl)
 	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, false, errors.Trace(err)
+	}
 	return rets.objs, rets.more, rets.err
 }
 
@@ -191,9 +209,13 @@ func (s *RpdbSnapshot) scanMetaKey() (metaKey []byte, err error) {
 	return metaKey, it.Error()
 }
 
-func (s *RpdbSnapshot) loadObjCron(ctrl <-chan int, exit chan<- int) (objs []*rdb.ObjEntry, more bool, err error) {
+func (s *RpdbSnapshot) loadObjCron(ctx context.Context, ctrl <-chan int, exit chan<- int) (objs []*rdb.ObjEntry, more bool, err error) {
 	r := s.getReader()
-	defer s.putReader(r)
+	r.ctx = ctx
+	defer func() {
+		r.ctx = nil
+		s.putReader(r)
+	}()
 	defer func() {
 		exit <- 0
 	}()
@@ -86,15 +86,20 @@ func (b *Rpdb) Get(db uint32, args ...interface{}) ([]byte, error) {
 	}
 	defer b.release()
 
+	v, _, err := b.get(db, key)
+	return v, err
+}
+
+func (b *Rpdb) get(db uint32, key []byte) ([]byte, bool, error) {
 	o, err := b.loadStringRow(db, key, true)
 	if err != nil || o == nil {
-		return nil, err
+		return nil, false, err
 	} else {
 		_, err := o.LoadDataValue(b)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		return o.Value, nil
+		return o.Value, true, nil
 	}
 }
 
@@ -156,6 +161,10 @@ func (b *Rpdb) Set(db uint32, args ...interface{}) error {
 	}
 	defer b.release()
 
+	return b.set(db, key, value)
+}
+
+func (b *Rpdb) set(db uint32, key, value []byte) error {
 	bt := store.NewBatch()
 	_, err := b.deleteIfExists(bt, db, key)
 	if err != nil {
@@ -165,7 +174,7 @@ func (b *Rpdb) Set(db uint32, args ...interface{}) error {
 	o.Value = value
 	bt.Set(o.DataKey(), o.DataValue())
 	bt.Set(o.MetaKey(), o.MetaValue())
-	fw := &Forward{DB: db, Op: "Set", Args: args}
+	fw := &Forward{DB: db, Op: "Set", Args: []interface{}{key, value}}
 	return b.commit(bt, fw)
 }
 
@@ -207,7 +216,7 @@ func (b *Rpdb) SetEX(db uint32, args ...interface{}) error {
 		o.ExpireAt, o.Value = expireat, value
 		bt.Set(o.DataKey(), o.DataValue())
 		bt.Set(o.MetaKey(), o.MetaValue())
-		fw := &Forward{DB: db, Op: "SetEX", Args: args}
+		fw := &Forward{DB: db, Op: "SetEX", Args: args, ExpireAt: []uint64{expireat}}
 		return b.commit(bt, fw)
 	} else {
 		fw := &Forward{DB: db, Op: "Del", Args: []interface{}{key}}
@@ -296,6 +305,7 @@ func (b *Rpdb) incrInt(db uint32, key []byte, delta int64) (int64, error) {
 		return 0, err
 	}
 
+	fw := &Forward{DB: db, Op: "IncrBy", Args: []interface{}{key, delta}}
 	bt := store.NewBatch()
 	if o != nil {
 		_, err := o.LoadDataValue(b)
@@ -313,7 +323,6 @@ func (b *Rpdb) incrInt(db uint32, key []byte, delta int64) (int64, error) {
 	}
 	o.Value = FormatInt(delta)
 	bt.Set(o.DataKey(), o.DataValue())
-	fw := &Forward{DB: db, Op: "IncrBy", Args: []interface{}{key, delta}}
 	return delta, b.commit(bt, fw)
 }
 
@@ -323,6 +332,7 @@ func (b *Rpdb) incrFloat(db uint32, key []byte, delta float64) (float64, error)
 		return 0, err
 	}
 
+	fw := &Forward{DB: db, Op: "IncrByFloat", Args: []interface{}{key, delta}}
 	bt := store.NewBatch()
 	if o != nil {
 		_, err := o.LoadDataValue(b)
@@ -340,7 +350,6 @@ func (b *Rpdb) incrFloat(db uint32, key []byte, delta float64) (float64, error)
 	}
 	o.Value = FormatFloat(delta)
 	bt.Set(o.DataKey(), o.DataValue())
-	fw := &Forward{DB: db, Op: "IncrByFloat", Args: []interface{}{key, delta}}
 	return delta, b.commit(bt, fw)
 }
 
@@ -0,0 +1,169 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+)
+
+// The position of the stream of a master is stored in the batches of the
+// writes applied from it, so it never disagrees with the data after a crash.
+// Like walSeqKey, the rows sort after all the meta and data rows.
+var (
+	syncStatePrefix = []byte("@syncstate:")
+	syncSlotPrefix  = []byte("@syncslot:")
+)
+
+// SyncSerialSlot is the slot of Applied of the commands that are not on the
+// keys of a single slot.
+const SyncSerialSlot = MaxSlotNum
+
+// SyncState is the position of the stream of a master applied here. All the
+// commands before Offset are applied, the ones after it may be applied too:
+// Applied has the end offset of the last command applied of every slot.
+type SyncState struct {
+	ReplID string
+	Offset int64
+	Filter string
+
+	Applied map[uint32]int64
+}
+
+// SyncPos is the position of a command of the stream of a master, stored
+// with the writes of the command by a view made by SyncView. Resume returns
+// the offset to resume from, and Slots are the slots of the keys of the
+// command, or nil if they are not in a single slot.
+type SyncPos struct {
+	ReplID string
+	Filter string
+	Resume func() int64
+
+	Slots []uint32
+	End   int64
+}
+
+func encodeSyncStateKey(name string) []byte {
+	return append(append([]byte{}, syncStatePrefix...), name...)
+}
+
+func encodeSyncSlotPrefix(name string) []byte {
+	w := NewBufWriter(nil)
+	if err := w.WriteBytes(syncSlotPrefix); err != nil {
+		log.PanicErrorf(err, "encode sync slot failed")
+	}
+	p := []byte(name)
+	encodeRawBytes(w, &p)
+	return w.Bytes()
+}
+
+func encodeSyncSlotKey(name string, slot uint32) []byte {
+	w := NewBufWriter(encodeSyncSlotPrefix(name))
+	encodeRawBytes(w, &slot)
+	return w.Bytes()
+}
+
+func encodeSyncState(replid string, offset int64, filter string) []byte {
+	return []byte(fmt.Sprintf("%s %d\n%s", replid, offset, filter))
+}
+
+// SyncView returns a view of b, whose commits store pos as the position of
+// the stream of the master name.
+func (b *Rpdb) SyncView(name string, pos *SyncPos) *Rpdb {
+	return &Rpdb{rpdbCore: b.rpdbCore, group: b.group, attach: func(bt *store.Batch, fw *Forward) {
+		// the key is deleted before the command runs, in a batch of its own
+		if fw.Op == "Expired" {
+			return
+		}
+		bt.Set(encodeSyncStateKey(name), encodeSyncState(pos.ReplID, pos.Resume(), pos.Filter))
+		if pos.Slots == nil {
+			bt.Set(encodeSyncSlotKey(name, SyncSerialSlot), FormatInt(pos.End))
+		}
+		for _, slot := range pos.Slots {
+			bt.Set(encodeSyncSlotKey(name, slot), FormatInt(pos.End))
+		}
+	}}
+}
+
+// SyncState loads the position of the stream of the master name, it's empty
+// if nothing has been applied.
+func (b *Rpdb) SyncState(name string) (*SyncState, error) {
+	if err := b.acquire(); err != nil {
+		return nil, err
+	}
+	defer b.release()
+
+	s := &SyncState{Applied: make(map[uint32]int64)}
+	v, err := b.db.Get(encodeSyncStateKey(name))
+	if err != nil || v == nil {
+		return s, err
+	}
+	lines := strings.SplitN(string(v), "\n", 2)
+	if _, err := fmt.Sscanf(lines[0], "%s %d", &s.ReplID, &s.Offset); err != nil {
+		log.WarnErrorf(err, "rpdb invalid sync state of %s, ignore it", name)
+		return &SyncState{Applied: s.Applied}, nil
+	}
+	if len(lines) == 2 {
+		s.Filter = lines[1]
+	}
+	pfx := encodeSyncSlotPrefix(name)
+	if err := b.scanRows(pfx, func(key, value []byte) error {
+		var slot uint32
+		r := NewBufReader(key[len(pfx):])
+		err := decodeRawBytes(r, nil, &slot)
+		if err = decodeRawBytes(r, err); err != nil {
+			return err
+		}
+		n, err := ParseInt(value)
+		if err != nil {
+			return err
+		}
+		s.Applied[slot] = n
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetSyncState stores the position of the stream of the master name, once
+// its rdb is loaded or when the offset of the commands applied moves on. The
+// end offsets of Applied are replaced, unless Applied is nil. An empty
+// ReplID drops the position.
+func (b *Rpdb) SetSyncState(name string, s *SyncState) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+	if b.staging != nil {
+		return errors.Trace(ErrReadOnly)
+	}
+
+	bt := store.NewBatch()
+	if s.ReplID == "" {
+		bt.Del(encodeSyncStateKey(name))
+	} else {
+		bt.Set(encodeSyncStateKey(name), encodeSyncState(s.ReplID, s.Offset, s.Filter))
+	}
+	if s.Applied != nil || s.ReplID == "" {
+		if err := b.scanRows(encodeSyncSlotPrefix(name), func(key, value []byte) error {
+			bt.Del(append([]byte{}, key...))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for slot, end := range s.Applied {
+			bt.Set(encodeSyncSlotKey(name, slot), FormatInt(end))
+		}
+	}
+	if err := b.db.Commit(bt); err != nil {
+		log.WarnErrorf(err, "rpdb store sync state of %s failed", name)
+		return err
+	}
+	return nil
+}
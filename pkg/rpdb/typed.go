@@ -0,0 +1,377 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"time"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+)
+
+var (
+	ErrWrongType = errors.Static("operation against a key holding the wrong kind of value")
+	ErrNotFound  = errors.Static("key or member not found")
+)
+
+// IsWrongType tells if err is caused by a key holding another kind of value,
+// which is ErrWrongType for the typed API, or one of ErrNotString, ErrNotHash,
+// ErrNotList, ErrNotSet and ErrNotZSet for the variadic one.
+func IsWrongType(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, e := range []error{ErrWrongType, ErrNotString, ErrNotHash, ErrNotList, ErrNotSet, ErrNotZSet} {
+		if errors.Equal(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsNotFound tells if err is ErrNotFound.
+func IsNotFound(err error) bool {
+	return err != nil && errors.Equal(err, ErrNotFound)
+}
+
+// Typed is the typed API of an Rpdb for the programs embedding it. Keys,
+// members and values are byte slices, which are passed through without
+// conversion. A missing key or member is reported as ErrNotFound, and a key
+// holding another kind of value as ErrWrongType.
+type Typed struct {
+	b *Rpdb
+}
+
+// Typed returns the typed API of b.
+func (b *Rpdb) Typed() *Typed {
+	return &Typed{b: b}
+}
+
+func typedError(err error) error {
+	if err != nil && IsWrongType(err) {
+		return errors.Trace(ErrWrongType)
+	}
+	return err
+}
+
+// Get returns the value of the string key.
+func (t *Typed) Get(db uint32, key []byte) ([]byte, error) {
+	if err := t.b.acquire(); err != nil {
+		return nil, err
+	}
+	defer t.b.release()
+
+	v, ok, err := t.b.get(db, key)
+	if err != nil {
+		return nil, typedError(err)
+	}
+	if !ok {
+		return nil, errors.Trace(ErrNotFound)
+	}
+	return v, nil
+}
+
+// Set sets the value of the string key, and clears its ttl.
+func (t *Typed) Set(db uint32, key, value []byte) error {
+	if err := t.b.acquire(); err != nil {
+		return err
+	}
+	defer t.b.release()
+
+	return typedError(t.b.set(db, key, value))
+}
+
+// IncrBy adds delta to the integer stored at the string key.
+func (t *Typed) IncrBy(db uint32, key []byte, delta int64) (int64, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	v, err := t.b.incrInt(db, key, delta)
+	return v, typedError(err)
+}
+
+// Del deletes the keys and returns the number of keys deleted.
+func (t *Typed) Del(db uint32, keys ...[]byte) (int64, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	return t.b.del(db, keys...)
+}
+
+// Exists tells if the key exists.
+func (t *Typed) Exists(db uint32, key []byte) (bool, error) {
+	if err := t.b.acquire(); err != nil {
+		return false, err
+	}
+	defer t.b.release()
+
+	o, err := t.b.loadRpdbRow(db, key, true)
+	return o != nil, err
+}
+
+// Type returns the kind of value held by the key.
+func (t *Typed) Type(db uint32, key []byte) (ObjectCode, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	o, err := t.b.loadRpdbRow(db, key, true)
+	if err != nil {
+		return 0, err
+	}
+	if o == nil {
+		return 0, errors.Trace(ErrNotFound)
+	}
+	return o.Code(), nil
+}
+
+// PExpire sets the ttl of the key, it returns false if the key doesn't exist.
+func (t *Typed) PExpire(db uint32, key []byte, ttl time.Duration) (bool, error) {
+	expireat, ok := TTLmsToExpireAt(int64(ttl / time.Millisecond))
+	if !ok || expireat == 0 {
+		return false, errArguments("invalid ttl = %v", ttl)
+	}
+
+	if err := t.b.acquire(); err != nil {
+		return false, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.setExpireAt(db, key, expireat)
+	return n != 0, err
+}
+
+// PTTL returns the ttl of the key, or a negative duration if it has none.
+func (t *Typed) PTTL(db uint32, key []byte) (time.Duration, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	ttlms, err := t.b.getExpireTTLms(db, key)
+	if err != nil {
+		return 0, err
+	}
+	if ttlms == -2 {
+		return 0, errors.Trace(ErrNotFound)
+	}
+	if ttlms < 0 {
+		return -1, nil
+	}
+	return time.Duration(ttlms) * time.Millisecond, nil
+}
+
+// HGet returns the value of the field of the hash key.
+func (t *Typed) HGet(db uint32, key, field []byte) ([]byte, error) {
+	if err := t.b.acquire(); err != nil {
+		return nil, err
+	}
+	defer t.b.release()
+
+	v, ok, err := t.b.hget(db, key, field)
+	if err != nil {
+		return nil, typedError(err)
+	}
+	if !ok {
+		return nil, errors.Trace(ErrNotFound)
+	}
+	return v, nil
+}
+
+// HSet sets the field of the hash key, it returns true if the field is new.
+func (t *Typed) HSet(db uint32, key, field, value []byte) (bool, error) {
+	if err := t.b.acquire(); err != nil {
+		return false, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.hset(db, key, field, value)
+	return n != 0, typedError(err)
+}
+
+// HDel deletes the fields of the hash key and returns the number deleted.
+func (t *Typed) HDel(db uint32, key []byte, fields ...[]byte) (int64, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.hdel(db, key, fields...)
+	return n, typedError(err)
+}
+
+// HGetAll returns the fields and values of the hash key.
+func (t *Typed) HGetAll(db uint32, key []byte) (map[string][]byte, error) {
+	if err := t.b.acquire(); err != nil {
+		return nil, err
+	}
+	defer t.b.release()
+
+	a, err := t.b.hgetall(db, key)
+	if err != nil {
+		return nil, typedError(err)
+	}
+	m := make(map[string][]byte, len(a)/2)
+	for i := 0; i+1 < len(a); i += 2 {
+		m[string(a[i])] = a[i+1]
+	}
+	return m, nil
+}
+
+// LPush prepends the values to the list key and returns its length.
+func (t *Typed) LPush(db uint32, key []byte, values ...[]byte) (int64, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.lpush(db, key, true, values...)
+	return n, typedError(err)
+}
+
+// RPush appends the values to the list key and returns its length.
+func (t *Typed) RPush(db uint32, key []byte, values ...[]byte) (int64, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.rpush(db, key, true, values...)
+	return n, typedError(err)
+}
+
+// LPop removes and returns the first element of the list key.
+func (t *Typed) LPop(db uint32, key []byte) ([]byte, error) {
+	if err := t.b.acquire(); err != nil {
+		return nil, err
+	}
+	defer t.b.release()
+
+	v, ok, err := t.b.lpop(db, key)
+	if err != nil {
+		return nil, typedError(err)
+	}
+	if !ok {
+		return nil, errors.Trace(ErrNotFound)
+	}
+	return v, nil
+}
+
+// RPop removes and returns the last element of the list key.
+func (t *Typed) RPop(db uint32, key []byte) ([]byte, error) {
+	if err := t.b.acquire(); err != nil {
+		return nil, err
+	}
+	defer t.b.release()
+
+	v, ok, err := t.b.rpop(db, key)
+	if err != nil {
+		return nil, typedError(err)
+	}
+	if !ok {
+		return nil, errors.Trace(ErrNotFound)
+	}
+	return v, nil
+}
+
+// LRange returns the elements of the list key between beg and end, both
+// inclusive, negative indexes count from the end.
+func (t *Typed) LRange(db uint32, key []byte, beg, end int64) ([][]byte, error) {
+	if err := t.b.acquire(); err != nil {
+		return nil, err
+	}
+	defer t.b.release()
+
+	a, err := t.b.lrange(db, key, beg, end)
+	return a, typedError(err)
+}
+
+// SAdd adds the members to the set key and returns the number added.
+func (t *Typed) SAdd(db uint32, key []byte, members ...[]byte) (int64, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.sadd(db, key, members...)
+	return n, typedError(err)
+}
+
+// SRem removes the members from the set key and returns the number removed.
+func (t *Typed) SRem(db uint32, key []byte, members ...[]byte) (int64, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.srem(db, key, members...)
+	return n, typedError(err)
+}
+
+// SIsMember tells if member is in the set key.
+func (t *Typed) SIsMember(db uint32, key, member []byte) (bool, error) {
+	if err := t.b.acquire(); err != nil {
+		return false, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.sismember(db, key, member)
+	return n != 0, typedError(err)
+}
+
+// SMembers returns the members of the set key.
+func (t *Typed) SMembers(db uint32, key []byte) ([][]byte, error) {
+	if err := t.b.acquire(); err != nil {
+		return nil, err
+	}
+	defer t.b.release()
+
+	a, err := t.b.smembers(db, key)
+	return a, typedError(err)
+}
+
+// ZAdd sets the score of member in the zset key, it returns true if the
+// member is new.
+func (t *Typed) ZAdd(db uint32, key []byte, score float64, member []byte) (bool, error) {
+	if err := t.b.acquire(); err != nil {
+		return false, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.zadd(db, key, &rdb.ZSetElement{Member: member, Score: score})
+	return n != 0, typedError(err)
+}
+
+// ZScore returns the score of member in the zset key.
+func (t *Typed) ZScore(db uint32, key, member []byte) (float64, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	score, ok, err := t.b.zscore(db, key, member)
+	if err != nil {
+		return 0, typedError(err)
+	}
+	if !ok {
+		return 0, errors.Trace(ErrNotFound)
+	}
+	return score, nil
+}
+
+// ZRem removes the members from the zset key and returns the number removed.
+func (t *Typed) ZRem(db uint32, key []byte, members ...[]byte) (int64, error) {
+	if err := t.b.acquire(); err != nil {
+		return 0, err
+	}
+	defer t.b.release()
+
+	n, err := t.b.zrem(db, key, members...)
+	return n, typedError(err)
+}
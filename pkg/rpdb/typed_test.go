@@ -0,0 +1,79 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTyped(t *testing.T) {
+	x := testbl.Typed()
+	k, h, l, s, z := []byte("typed_k"), []byte("typed_h"), []byte("typed_l"), []byte("typed_s"), []byte("typed_z")
+
+	_, err := x.Get(0, k)
+	checkerror(t, nil, IsNotFound(err))
+	checkerror(t, x.Set(0, k, []byte("1")), true)
+	v, err := x.Get(0, k)
+	checkerror(t, err, string(v) == "1")
+	n, err := x.IncrBy(0, k, 9)
+	checkerror(t, err, n == 10)
+	code, err := x.Type(0, k)
+	checkerror(t, err, code == StringCode)
+	ok, err := x.PExpire(0, k, time.Minute)
+	checkerror(t, err, ok)
+	ttl, err := x.PTTL(0, k)
+	checkerror(t, err, ttl > 0 && ttl <= time.Minute)
+
+	ok, err = x.HSet(0, h, []byte("f"), []byte("v"))
+	checkerror(t, err, ok)
+	_, err = x.HGet(0, h, []byte("g"))
+	checkerror(t, nil, IsNotFound(err))
+	m, err := x.HGetAll(0, h)
+	checkerror(t, err, len(m) == 1 && string(m["f"]) == "v")
+	_, err = x.HGet(0, k, []byte("f"))
+	checkerror(t, nil, IsWrongType(err))
+	_, err = x.Get(0, h)
+	checkerror(t, nil, IsWrongType(err))
+	_, err = testbl.Get(0, h)
+	checkerror(t, nil, IsWrongType(err) && !IsNotFound(err))
+
+	n, err = x.RPush(0, l, []byte("a"), []byte("b"), []byte("c"))
+	checkerror(t, err, n == 3)
+	a, err := x.LRange(0, l, 0, -1)
+	checkerror(t, err, len(a) == 3 && string(a[2]) == "c")
+	v, err = x.LPop(0, l)
+	checkerror(t, err, string(v) == "a")
+
+	n, err = x.SAdd(0, s, []byte("a"), []byte("b"))
+	checkerror(t, err, n == 2)
+	ok, err = x.SIsMember(0, s, []byte("b"))
+	checkerror(t, err, ok)
+
+	ok, err = x.ZAdd(0, z, 1.5, []byte("m"))
+	checkerror(t, err, ok)
+	score, err := x.ZScore(0, z, []byte("m"))
+	checkerror(t, err, score == 1.5)
+	_, err = x.ZScore(0, z, []byte("n"))
+	checkerror(t, nil, IsNotFound(err))
+
+	e := []byte("typed_e")
+	checkerror(t, x.Set(0, e, []byte{}), true)
+	v, err = x.Get(0, e)
+	checkerror(t, err, len(v) == 0)
+	_, err = x.HSet(0, h, []byte{}, []byte{})
+	checkerror(t, err, true)
+	v, err = x.HGet(0, h, []byte{})
+	checkerror(t, err, len(v) == 0)
+	n, err = x.RPush(0, l, []byte{})
+	checkerror(t, err, n == 3)
+	v, err = x.RPop(0, l)
+	checkerror(t, err, len(v) == 0)
+
+	n, err = x.Del(0, k, h, l, s, z, e)
+	checkerror(t, err, n == 6)
+	_, err = x.Type(0, k)
+	checkerror(t, nil, IsNotFound(err))
+	checkempty(t)
+}
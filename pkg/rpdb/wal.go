@@ -0,0 +1,673 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+)
+
+var (
+	ErrWALCorrupted = errors.Static("wal is corrupted")
+)
+
+// walSeqKey stores the sequence of the last write committed to the database.
+// It sorts after all the meta and data rows, so scans never see it.
+var walSeqKey = []byte("@walseq")
+
+// walStepKey stores the last command committed of the record being replayed,
+// if the record turns into several commands, see WALView.
+var walStepKey = []byte("@walstep")
+
+const (
+	walFilePrefix = "wal-"
+	walFileSuffix = ".log"
+
+	walMaxRecordSize = 1024 * 1024 * 1024
+)
+
+// WALRecord is a committed Forward and its sequence, the time is in ms.
+type WALRecord struct {
+	Seq  uint64
+	Time int64
+	DB   uint32
+	Op   string
+	Args [][]byte
+}
+
+func (r *WALRecord) Forward() *Forward {
+	args := make([]interface{}, len(r.Args))
+	for i, arg := range r.Args {
+		args[i] = arg
+	}
+	return &Forward{DB: r.DB, Op: r.Op, Args: args}
+}
+
+// WALSync is the policy of flushing the log to the disk.
+type WALSync byte
+
+const (
+	// WALSyncAlways flushes every append before its writes are committed,
+	// which is the default.
+	WALSyncAlways WALSync = iota
+	// WALSyncEverySec leaves the flushes to Sync, called every second, a
+	// crash loses the last second of the log at most.
+	WALSyncEverySec
+	// WALSyncNo leaves the flushes to the operating system.
+	WALSyncNo
+)
+
+func (p WALSync) String() string {
+	switch p {
+	case WALSyncAlways:
+		return "always"
+	case WALSyncEverySec:
+		return "everysec"
+	case WALSyncNo:
+		return "no"
+	}
+	return "unknown"
+}
+
+// ParseWALSync parses the name of a policy returned by WALSync.String.
+func ParseWALSync(name string) (WALSync, error) {
+	for _, p := range []WALSync{WALSyncAlways, WALSyncEverySec, WALSyncNo} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, errors.Errorf("invalid wal sync policy %s", name)
+}
+
+// WAL is a log of the committed Forward records, numbered by a sequence that
+// keeps increasing across restarts. It is written to files named after the
+// sequence of their first record, a new file is started once the current
+// one exceeds size and only the newest keep files are retained.
+type WAL struct {
+	mu   sync.Mutex
+	dir  string
+	size int64
+	keep int
+
+	f    *os.File
+	name string
+	n    int64
+	seq  uint64
+	err  error
+
+	pend int64
+	pseq uint64
+
+	sync WALSync
+
+	buf bytes.Buffer
+
+	appended chan int
+}
+
+// OpenWAL opens the log in dir, a torn record at the end of the last file is
+// truncated.
+func OpenWAL(dir string, size int64, keep int) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Trace(err)
+	}
+	w := &WAL{dir: dir, size: size, keep: keep, appended: make(chan int)}
+	names, seqs, err := walFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return w, nil
+	}
+	name := names[len(names)-1]
+	w.seq = seqs[len(seqs)-1] - 1
+
+	var valid int64
+	err = readWALFile(name, func(r *WALRecord, end int64) (bool, error) {
+		w.seq, valid = r.Seq, end
+		return true, nil
+	})
+	if err != nil && !errors.Equal(err, ErrWALCorrupted) {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, errors.Trace(err)
+	}
+	if _, err := f.Seek(valid, 0); err != nil {
+		f.Close()
+		return nil, errors.Trace(err)
+	}
+	w.f, w.name, w.n = f, name, valid
+	w.pseq = w.seq
+	log.Infof("open wal '%s', seq = %d", dir, w.seq)
+	return w, nil
+}
+
+// SetSync sets the policy of flushing the appends to the disk.
+func (w *WAL) SetSync(p WALSync) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sync = p
+}
+
+func (w *WAL) Dir() string {
+	return w.dir
+}
+
+// Seq returns the sequence of the last record.
+func (w *WAL) Seq() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.seq
+}
+
+// FirstSeq returns the sequence of the oldest record retained, or the next
+// one if the log is empty.
+func (w *WAL) FirstSeq() (uint64, error) {
+	_, seqs, err := walFiles(w.dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(seqs) == 0 {
+		return w.Seq() + 1, nil
+	}
+	return seqs[0], nil
+}
+
+// tail returns the file being written and its size, and a channel that is
+// closed once the next record is appended.
+func (w *WAL) tail() (string, int64, <-chan int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.name, w.n, w.appended
+}
+
+// skipTo moves the sequence forward to seq, the next record starts a new file.
+func (w *WAL) skipTo(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq <= w.seq {
+		return
+	}
+	w.seq, w.pseq = seq, seq
+	w.closeFile()
+}
+
+// Append writes fws with the next sequences and flushes them to the disk with
+// WALSyncAlways, it returns the sequence of the last one. The records are not read until they
+// are made visible by Commit, or dropped by Revert if their writes fail to
+// commit. Once a record fails to be written, every append fails, so the log
+// never misses a committed write.
+func (w *WAL) Append(fws []*Forward) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.append(fws); err != nil {
+		log.ErrorErrorf(err, "wal append failed, seq = %d", w.seq+1)
+		w.err = err
+		if w.f != nil {
+			w.f.Truncate(w.n)
+		}
+		w.closeFile()
+		return 0, err
+	}
+	return w.pseq, nil
+}
+
+func (w *WAL) append(fws []*Forward) error {
+	if w.f == nil || w.n >= w.size {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	w.buf.Reset()
+	seq := w.seq
+	for _, fw := range fws {
+		fw = fw.absolute()
+		seq++
+		r := &WALRecord{Seq: seq, Time: now, DB: fw.DB, Op: fw.Op}
+		for _, arg := range fw.Args {
+			r.Args = append(r.Args, FormatArgument(arg))
+		}
+		encodeWALRecord(&w.buf, r)
+	}
+	if _, err := w.f.Write(w.buf.Bytes()); err != nil {
+		return errors.Trace(err)
+	}
+	if w.sync == WALSyncAlways {
+		if err := w.f.Sync(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	w.pend, w.pseq = w.n+int64(w.buf.Len()), seq
+	return nil
+}
+
+// Commit makes the records of the last Append visible, once their writes are
+// committed to the database.
+func (w *WAL) Commit() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pseq <= w.seq {
+		return
+	}
+	w.n, w.seq = w.pend, w.pseq
+	close(w.appended)
+	w.appended = make(chan int)
+}
+
+// Revert drops the records of the last Append, whose writes failed to commit.
+func (w *WAL) Revert() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pseq <= w.seq {
+		return
+	}
+	w.pseq = w.seq
+	if w.f == nil {
+		return
+	}
+	err := w.f.Truncate(w.n)
+	if err == nil {
+		_, err = w.f.Seek(w.n, 0)
+	}
+	if err != nil {
+		log.ErrorErrorf(err, "wal revert failed, seq = %d", w.seq+1)
+		w.err = errors.Trace(err)
+		w.closeFile()
+	}
+}
+
+// Sync flushes the file being written to the disk, it's called every second
+// with WALSyncEverySec. Once it fails, every append fails, as the records
+// written may be lost.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.f == nil {
+		return nil
+	}
+	if err := w.f.Sync(); err != nil {
+		log.ErrorErrorf(err, "wal sync failed, seq = %d", w.seq)
+		w.err = errors.Trace(err)
+		w.closeFile()
+		return w.err
+	}
+	return nil
+}
+
+// Err returns the error that stopped the log, if any.
+func (w *WAL) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *WAL) rotate() error {
+	w.closeFile()
+	name := filepath.Join(w.dir, fmt.Sprintf("%s%020d%s", walFilePrefix, w.seq+1, walFileSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	w.f, w.name, w.n = f, name, 0
+	if w.keep > 0 {
+		names, _, err := walFiles(w.dir)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(names)-w.keep; i++ {
+			log.Infof("remove wal file '%s'", names[i])
+			if err := os.Remove(names[i]); err != nil {
+				log.WarnErrorf(err, "remove wal file '%s' failed", names[i])
+			}
+		}
+	}
+	return nil
+}
+
+func (w *WAL) closeFile() {
+	if w.f == nil {
+		return
+	}
+	if err := w.f.Sync(); err != nil {
+		log.WarnErrorf(err, "wal sync failed")
+	}
+	w.f.Close()
+	w.f, w.name = nil, ""
+}
+
+func (w *WAL) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeFile()
+}
+
+func encodeWALRecord(w *bytes.Buffer, r *WALRecord) {
+	var p bytes.Buffer
+	var b [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		p.Write(b[:binary.PutUvarint(b[:], v)])
+	}
+	putUvarint(r.Seq)
+	p.Write(b[:binary.PutVarint(b[:], r.Time)])
+	putUvarint(uint64(r.DB))
+	putUvarint(uint64(len(r.Op)))
+	p.WriteString(r.Op)
+	putUvarint(uint64(len(r.Args)))
+	for _, arg := range r.Args {
+		putUvarint(uint64(len(arg)))
+		p.Write(arg)
+	}
+	var h [8]byte
+	binary.LittleEndian.PutUint32(h[0:], uint32(p.Len()))
+	binary.LittleEndian.PutUint32(h[4:], crc32.ChecksumIEEE(p.Bytes()))
+	w.Write(h[:])
+	w.Write(p.Bytes())
+}
+
+func decodeWALRecord(p []byte) (*WALRecord, error) {
+	r := bytes.NewReader(p)
+	uvarint := func() uint64 {
+		v, _ := binary.ReadUvarint(r)
+		return v
+	}
+	readBytes := func(n uint64) []byte {
+		if n > uint64(r.Len()) {
+			return nil
+		}
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		return b
+	}
+	rec := &WALRecord{Seq: uvarint()}
+	var err error
+	if rec.Time, err = binary.ReadVarint(r); err != nil {
+		return nil, errors.Trace(ErrWALCorrupted)
+	}
+	rec.DB = uint32(uvarint())
+	rec.Op = string(readBytes(uvarint()))
+	nargs := uvarint()
+	if nargs > uint64(len(p)) {
+		return nil, errors.Trace(ErrWALCorrupted)
+	}
+	for i := uint64(0); i < nargs; i++ {
+		n := uvarint()
+		arg := readBytes(n)
+		if arg == nil && n != 0 {
+			return nil, errors.Trace(ErrWALCorrupted)
+		}
+		rec.Args = append(rec.Args, arg)
+	}
+	if r.Len() != 0 || rec.Op == "" {
+		return nil, errors.Trace(ErrWALCorrupted)
+	}
+	return rec, nil
+}
+
+// readWALFile calls fn with every record of the file and the offset it ends
+// at, until fn returns false. A torn or corrupted record is reported as
+// ErrWALCorrupted.
+func readWALFile(name string, fn func(r *WALRecord, end int64) (bool, error)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	br := bufio.NewReaderSize(f, 1024*1024)
+	var h [8]byte
+	var end int64
+	for {
+		if _, err := io.ReadFull(br, h[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Trace(ErrWALCorrupted)
+		}
+		n := binary.LittleEndian.Uint32(h[0:])
+		if n > walMaxRecordSize {
+			return errors.Trace(ErrWALCorrupted)
+		}
+		p := make([]byte, n)
+		if _, err := io.ReadFull(br, p); err != nil {
+			return errors.Trace(ErrWALCorrupted)
+		}
+		if crc32.ChecksumIEEE(p) != binary.LittleEndian.Uint32(h[4:]) {
+			return errors.Trace(ErrWALCorrupted)
+		}
+		r, err := decodeWALRecord(p)
+		if err != nil {
+			return err
+		}
+		end += int64(len(h) + len(p))
+		if more, err := fn(r, end); err != nil || !more {
+			return err
+		}
+	}
+}
+
+// walFiles returns the log files in dir and the sequence of their first
+// record, in order.
+func walFiles(dir string) ([]string, []uint64, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.IsDir() && strings.HasPrefix(name, walFilePrefix) && strings.HasSuffix(name, walFileSuffix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var paths []string
+	var seqs []uint64
+	for _, name := range names {
+		s := strings.TrimSuffix(strings.TrimPrefix(name, walFilePrefix), walFileSuffix)
+		seq, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, name))
+		seqs = append(seqs, seq)
+	}
+	return paths, seqs, nil
+}
+
+// ReadWAL calls fn with the records in dir whose sequence is after from, in
+// order, until fn returns false. It fails if the log doesn't continue right
+// after from or has a gap, while a torn record at the end of the last file is
+// taken as the end of the log.
+func ReadWAL(dir string, from uint64, fn func(r *WALRecord) (bool, error)) error {
+	names, seqs, err := walFiles(dir)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(seqs), func(i int) bool {
+		return seqs[i] > from+1
+	})
+	if i != 0 {
+		i--
+	}
+	if len(seqs) != 0 && seqs[i] > from+1 {
+		return errors.Errorf("wal starts at seq = %d, expect <= %d", seqs[i], from+1)
+	}
+	next := from + 1
+	for ; i < len(names); i++ {
+		stop := false
+		err := readWALFile(names[i], func(r *WALRecord, end int64) (bool, error) {
+			if r.Seq < next {
+				return true, nil
+			}
+			if r.Seq != next {
+				return false, errors.Errorf("wal has a gap, seq = %d, expect = %d", r.Seq, next)
+			}
+			next++
+			more, err := fn(r)
+			stop = !more
+			return more, err
+		})
+		if err != nil {
+			if errors.Equal(err, ErrWALCorrupted) && i == len(names)-1 {
+				return nil
+			}
+			return err
+		}
+		if stop {
+			return nil
+		}
+	}
+	return nil
+}
+
+// SetWAL starts to log every committed write to w, the sequence of the last
+// write is stored with the data. If the database is ahead of the log, e.g. the
+// log has been archived after a recovery, the log skips to its sequence. If
+// the log is ahead, its last records must be replayed on the database first.
+func (b *Rpdb) SetWAL(w *WAL) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+	seq, err := b.getWALSeq()
+	if err != nil {
+		return err
+	}
+	switch last := w.Seq(); {
+	case last < seq:
+		log.Infof("wal skips to seq = %d, last = %d", seq, last)
+		w.skipTo(seq)
+	case last > seq:
+		return errors.Errorf("wal is ahead of the database, seq = %d, last = %d", seq, last)
+	}
+	b.wal = w
+	return nil
+}
+
+// WALSeq returns the sequence of the last write in the database, a restored
+// backup continues from there when the log is replayed.
+func (b *Rpdb) WALSeq() (uint64, error) {
+	if err := b.acquire(); err != nil {
+		return 0, err
+	}
+	defer b.release()
+	return b.getWALSeq()
+}
+
+// SetWALSeq stores seq as the sequence of the last write, once a record of
+// the log has been replayed.
+func (b *Rpdb) SetWALSeq(seq uint64) error {
+	if err := b.acquire(); err != nil {
+		return err
+	}
+	defer b.release()
+	bt := store.NewBatch()
+	bt.Set(walSeqKey, FormatUint(seq))
+	bt.Del(walStepKey)
+	return b.db.Commit(bt)
+}
+
+// WALStep is the position of a command of a record being replayed, which is
+// the Step of the Steps commands the record turns into.
+type WALStep struct {
+	Seq   uint64
+	Step  int
+	Steps int
+}
+
+// WALView returns a view of b, whose commits store pos with the writes of the
+// command, so the commands of a record are replayed once, even if the replay
+// is interrupted. The commit of the last command stores the sequence of the
+// record instead. b must have no wal, which would store a sequence of its own.
+func (b *Rpdb) WALView(pos *WALStep) *Rpdb {
+	return &Rpdb{rpdbCore: b.rpdbCore, group: b.group, attach: func(bt *store.Batch, fw *Forward) {
+		// the key is deleted before the command runs, in a batch of its own
+		if fw.Op == "Expired" {
+			return
+		}
+		if pos.Step == pos.Steps-1 {
+			bt.Set(walSeqKey, FormatUint(pos.Seq))
+			bt.Del(walStepKey)
+		} else {
+			bt.Set(walStepKey, []byte(fmt.Sprintf("%d %d", pos.Seq, pos.Step)))
+		}
+	}}
+}
+
+// WALReplayed returns the last command committed by a WALView of the record
+// seq, or -1 if none has been.
+func (b *Rpdb) WALReplayed(seq uint64) (int, error) {
+	if err := b.acquire(); err != nil {
+		return 0, err
+	}
+	defer b.release()
+	v, err := b.db.Get(walStepKey)
+	if err != nil || v == nil {
+		return -1, err
+	}
+	var x uint64
+	var step int
+	if _, err := fmt.Sscanf(string(v), "%d %d", &x, &step); err != nil {
+		return 0, errors.Errorf("invalid wal step %q", v)
+	}
+	if x != seq {
+		return -1, nil
+	}
+	return step, nil
+}
+
+func (b *Rpdb) getWALSeq() (uint64, error) {
+	v, err := b.db.Get(walSeqKey)
+	if err != nil || v == nil {
+		return 0, err
+	}
+	return ParseUint(v)
+}
+
+func (b *Rpdb) putWALSeq(seq uint64) error {
+	bt := store.NewBatch()
+	bt.Set(walSeqKey, FormatUint(seq))
+	return b.db.Commit(bt)
+}
+
+// logWAL logs a write that has been committed already with the sequence
+// stored by the caller, like a replace.
+func (b *Rpdb) logWAL(fw *Forward) {
+	if b.wal == nil {
+		return
+	}
+	if _, err := b.wal.Append([]*Forward{fw}); err != nil {
+		log.WarnErrorf(err, "rpdb log %s failed", fw.Op)
+		return
+	}
+	b.wal.Commit()
+}
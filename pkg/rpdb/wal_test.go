@@ -0,0 +1,162 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rpdb
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/wandoulabs/rpdb/pkg/store/rocksdb"
+)
+
+func readwal(t *testing.T, dir string, from uint64) []*WALRecord {
+	var rs []*WALRecord
+	err := ReadWAL(dir, from, func(r *WALRecord) (bool, error) {
+		rs = append(rs, r)
+		return true, nil
+	})
+	checkerror(t, err, true)
+	return rs
+}
+
+func TestWAL(t *testing.T) {
+	const dir = "/tmp/testdb-wal"
+	os.RemoveAll(dir)
+
+	w, err := OpenWAL(dir, 64, 0)
+	checkerror(t, err, w.Seq() == 0)
+	for i := 0; i < 10; i++ {
+		seq, err := w.Append([]*Forward{{DB: 1, Op: "Set", Args: []interface{}{"key", i}}})
+		checkerror(t, err, seq == uint64(i+1) && w.Seq() == uint64(i))
+		w.Commit()
+	}
+	checkerror(t, nil, w.Seq() == 10)
+	_, err = w.Append([]*Forward{{DB: 1, Op: "Set", Args: []interface{}{"key", "x"}}})
+	checkerror(t, err, w.Seq() == 10)
+	w.Revert()
+	w.Close()
+
+	names, _, err := walFiles(dir)
+	checkerror(t, err, len(names) > 1)
+
+	rs := readwal(t, dir, 0)
+	checkerror(t, nil, len(rs) == 10)
+	for i, r := range rs {
+		checkerror(t, nil, r.Seq == uint64(i+1) && r.DB == 1 && r.Op == "Set")
+		checkerror(t, nil, string(r.Args[1]) == strconv.Itoa(i))
+	}
+	rs = readwal(t, dir, 5)
+	checkerror(t, nil, len(rs) == 5 && rs[0].Seq == 6)
+
+	f, err := os.OpenFile(names[len(names)-1], os.O_WRONLY|os.O_APPEND, 0600)
+	checkerror(t, err, true)
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+	checkerror(t, nil, len(readwal(t, dir, 0)) == 10)
+
+	w, err = OpenWAL(dir, 1, 2)
+	checkerror(t, err, w.Seq() == 10)
+	seq, err := w.Append([]*Forward{{Op: "Reset"}})
+	checkerror(t, err, seq == 11)
+	w.Commit()
+	w.Close()
+	rs = readwal(t, dir, 9)
+	checkerror(t, nil, len(rs) == 2 && rs[1].Seq == 11 && rs[1].Op == "Reset")
+
+	names, _, err = walFiles(dir)
+	checkerror(t, err, len(names) == 2)
+	checkerror(t, nil, ReadWAL(dir, 0, func(r *WALRecord) (bool, error) {
+		return true, nil
+	}) != nil)
+}
+
+func TestWALSync(t *testing.T) {
+	const dir = "/tmp/testdb-wal-sync"
+	os.RemoveAll(dir)
+
+	for _, name := range []string{"always", "everysec", "no"} {
+		p, err := ParseWALSync(name)
+		checkerror(t, err, p.String() == name)
+	}
+	_, err := ParseWALSync("sometimes")
+	checkerror(t, nil, err != nil)
+
+	w, err := OpenWAL(dir, 1024*1024, 0)
+	checkerror(t, err, true)
+	defer w.Close()
+	w.SetSync(WALSyncEverySec)
+	checkerror(t, w.Sync(), true)
+	seq, err := w.Append([]*Forward{{Op: "Set", Args: []interface{}{"a", "1"}}})
+	checkerror(t, err, seq == 1)
+	w.Commit()
+	checkerror(t, w.Sync(), true)
+	rs := readwal(t, dir, 0)
+	checkerror(t, nil, len(rs) == 1 && rs[0].Op == "Set")
+}
+
+func TestWALView(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-walview"
+	os.RemoveAll(path)
+	db, err := rocksdb.Open(path, rocksdb.NewDefaultConfig(), true, false)
+	checkerror(t, err, true)
+	bl := New(db)
+	defer bl.Close()
+
+	pos := &WALStep{Seq: 5, Steps: 2}
+	checkerror(t, bl.WALView(pos).Set(0, "a", "1"), true)
+	step, err := bl.WALReplayed(5)
+	checkerror(t, err, step == 0)
+	step, err = bl.WALReplayed(6)
+	checkerror(t, err, step == -1)
+	seq, err := bl.WALSeq()
+	checkerror(t, err, seq == 0)
+
+	pos.Step = 1
+	checkerror(t, bl.WALView(pos).Set(0, "b", "2"), true)
+	step, err = bl.WALReplayed(5)
+	checkerror(t, err, step == -1)
+	seq, err = bl.WALSeq()
+	checkerror(t, err, seq == 5)
+}
+
+func TestWALSeq(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-wal"
+	const dir = "/tmp/testdb-wal-seq"
+	os.RemoveAll(path)
+	os.RemoveAll(dir)
+	db, err := rocksdb.Open(path, rocksdb.NewDefaultConfig(), true, false)
+	checkerror(t, err, true)
+	bl := New(db)
+	defer bl.Close()
+
+	w, err := OpenWAL(dir, 1024*1024, 0)
+	checkerror(t, err, true)
+	checkerror(t, bl.SetWAL(w), true)
+
+	checkerror(t, bl.Set(0, "a", "1"), true)
+	checkerror(t, bl.Set(0, "b", "2"), true)
+	seq, err := bl.WALSeq()
+	checkerror(t, err, seq == 2 && w.Seq() == 2)
+
+	checkerror(t, bl.Reset(), true)
+	seq, err = bl.WALSeq()
+	checkerror(t, err, seq == 3)
+
+	rs := readwal(t, dir, 0)
+	checkerror(t, nil, len(rs) == 3 && rs[0].Op == "Set" && rs[2].Op == "Reset")
+
+	checkerror(t, bl.SetEX(0, "c", 100, "3"), true)
+	rs = readwal(t, dir, 3)
+	expireat, err := ParseUint(rs[0].Args[1])
+	checkerror(t, err, len(rs) == 1 && rs[0].Op == "SetEXAt" && expireat > 100000)
+
+	w.Close()
+	w, err = OpenWAL(dir, 1024*1024, 0)
+	checkerror(t, err, w.Seq() == 4)
+	_, err = w.Append([]*Forward{{Op: "Set", Args: []interface{}{"d", "4"}}})
+	checkerror(t, err, true)
+	w.Commit()
+	checkerror(t, nil, bl.SetWAL(w) != nil)
+}
@@ -5,6 +5,7 @@ package rpdb
 
 import (
 	"bytes"
+	"context"
 
 	"github.com/wandoulabs/rpdb/pkg/store"
 	"github.com/wandoulabs/redis-port/pkg/libs/errors"
@@ -114,6 +115,11 @@ func (b *Rpdb) loadZSetRow(db uint32, key []byte, deleteIfExpired bool) (*zsetRo
 
 // ZGETALL key
 func (b *Rpdb) ZGetAll(db uint32, args ...interface{}) ([][]byte, error) {
+	return b.ZGetAllContext(context.Background(), db, args...)
+}
+
+// ZGetAllContext is ZGetAll, but it stops once ctx is done.
+func (b *Rpdb) ZGetAllContext(ctx context.Context, db uint32, args ...interface{}) ([][]byte, error) {
 	if len(args) != 1 {
 		return nil, errArguments("len(args) = %d, expect = 1", len(args))
 	}
@@ -125,7 +131,7 @@ func (b *Rpdb) ZGetAll(db uint32, args ...interface{}) ([][]byte, error) {
 		}
 	}
 
-	if err := b.acquire(); err != nil {
+	if err := b.acquireContext(ctx); err != nil {
 		return nil, err
 	}
 	defer b.release()
@@ -200,6 +206,10 @@ func (b *Rpdb) ZAdd(db uint32, args ...interface{}) (int64, error) {
 	}
 	defer b.release()
 
+	return b.zadd(db, key, eles...)
+}
+
+func (b *Rpdb) zadd(db uint32, key []byte, eles ...*rdb.ZSetElement) (int64, error) {
 	o, err := b.loadZSetRow(db, key, true)
 	if err != nil {
 		return 0, err
@@ -228,7 +238,10 @@ func (b *Rpdb) ZAdd(db uint32, args ...interface{}) (int64, error) {
 		o.Size += n
 		bt.Set(o.MetaKey(), o.MetaValue())
 	}
-	fw := &Forward{DB: db, Op: "ZAdd", Args: args}
+	fw := &Forward{DB: db, Op: "ZAdd", Args: []interface{}{key}}
+	for _, e := range eles {
+		fw.Args = append(fw.Args, e.Score, e.Member)
+	}
 	return n, b.commit(bt, fw)
 }
 
@@ -254,6 +267,10 @@ func (b *Rpdb) ZRem(db uint32, args ...interface{}) (int64, error) {
 	}
 	defer b.release()
 
+	return b.zrem(db, key, members...)
+}
+
+func (b *Rpdb) zrem(db uint32, key []byte, members ...[]byte) (int64, error) {
 	o, err := b.loadZSetRow(db, key, true)
 	if err != nil || o == nil {
 		return 0, err
@@ -282,7 +299,10 @@ func (b *Rpdb) ZRem(db uint32, args ...interface{}) (int64, error) {
 			bt.Del(o.MetaKey())
 		}
 	}
-	fw := &Forward{DB: db, Op: "ZRem", Args: args}
+	fw := &Forward{DB: db, Op: "ZRem", Args: []interface{}{key}}
+	for _, member := range members {
+		fw.Args = append(fw.Args, member)
+	}
 	return n, b.commit(bt, fw)
 }
 
@@ -304,6 +324,10 @@ func (b *Rpdb) ZScore(db uint32, args ...interface{}) (float64, bool, error) {
 	}
 	defer b.release()
 
+	return b.zscore(db, key, member)
+}
+
+func (b *Rpdb) zscore(db uint32, key, member []byte) (float64, bool, error) {
 	o, err := b.loadZSetRow(db, key, true)
 	if err != nil || o == nil {
 		return 0, false, err
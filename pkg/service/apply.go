@@ -0,0 +1,440 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"container/list"
+	"context"
+	"encoding/base64"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+// applyGroupSize is the max number of commands committed together.
+const applyGroupSize = 256
+
+type applySession struct {
+	db uint32
+	bl *rpdb.Rpdb
+}
+
+func (s *applySession) DB() uint32 {
+	return s.db
+}
+
+func (s *applySession) SetDB(db uint32) {
+	s.db = db
+}
+
+func (s *applySession) Rpdb() *rpdb.Rpdb {
+	return s.bl
+}
+
+func (s *applySession) Context() context.Context {
+	return context.Background()
+}
+
+type applyTask struct {
+	s    *applySession
+	f    redis.HandlerFunc
+	args [][]byte
+	keys [][]byte
+	pos  *rpdb.SyncPos
+
+	request redis.Resp
+
+	end   int64
+	since time.Time
+	done  bool
+}
+
+// applier executes the command stream of a master on several workers. Commands
+// are partitioned by the slot of their keys, so commands on the same key keep
+// their order, while commands that can't be partitioned wait for all workers
+// to drain and run alone.
+//
+// The rpdb lock serializes the writes, so a worker takes all the commands
+// queued to it, up to applyGroupSize on distinct keys, and commits their
+// writes in a single batch, see rpdb.Group.
+//
+// The writes of every command are committed with its end offset, stored as the
+// last one applied of the slots of its keys, so the commands applied before a
+// crash but after the offset resumed from are skipped.
+type applier struct {
+	h   *Handler
+	src *syncSource
+
+	replid  string
+	skip    map[uint32]int64
+	skipEnd int64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	tasks   list.List
+	offset  int64
+	applied int64
+
+	// err stops the apply, once the writes of a group failed
+	err error
+
+	workers []chan *applyTask
+	wg      sync.WaitGroup
+
+	onApplied func(offset int64)
+}
+
+func newApplier(h *Handler, src *syncSource, offset int64, nworker int) *applier {
+	if nworker <= 0 {
+		nworker = runtime.GOMAXPROCS(0)
+	}
+	a := &applier{h: h, src: src, offset: offset, applied: offset}
+	a.cond = sync.NewCond(&a.mu)
+	for i := 0; i < nworker; i++ {
+		ch := make(chan *applyTask, 1024)
+		a.workers = append(a.workers, ch)
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			var next *applyTask
+			for {
+				t, ok := next, true
+				if t == nil {
+					if t, ok = <-ch; !ok {
+						return
+					}
+				}
+				var group []*applyTask
+				group, next = a.group(ch, t)
+				a.executeGroup(group)
+			}
+		}()
+	}
+	return a
+}
+
+func (a *applier) close() {
+	for _, ch := range a.workers {
+		close(ch)
+	}
+	a.wg.Wait()
+	a.updateCounters()
+}
+
+// group returns t and the tasks queued in ch after it, up to applyGroupSize
+// of them on distinct keys. The first task on a key already in the group is
+// returned as next.
+func (a *applier) group(ch <-chan *applyTask, t *applyTask) (group []*applyTask, next *applyTask) {
+	keys := make(map[string]bool)
+	for {
+		for _, key := range t.keys {
+			if keys[string(key)] {
+				return group, t
+			}
+		}
+		for _, key := range t.keys {
+			keys[string(key)] = true
+		}
+		if group = append(group, t); len(group) == applyGroupSize {
+			return group, nil
+		}
+		select {
+		case x, ok := <-ch:
+			if !ok {
+				return group, nil
+			}
+			t = x
+		default:
+			return group, nil
+		}
+	}
+}
+
+// executeGroup runs the tasks of group and commits their writes together.
+// If the commit fails none of them is applied, and the apply stops.
+func (a *applier) executeGroup(group []*applyTask) {
+	if a.failure() != nil {
+		return
+	}
+	bl := group[0].s.bl
+	if err := bl.Group(func(g *rpdb.Rpdb) {
+		for _, t := range group {
+			a.bind(t, g)
+			a.execute(t)
+		}
+	}); err != nil {
+		log.WarnErrorf(err, "apply commands failed, commands = %d", len(group))
+		a.mu.Lock()
+		if a.err == nil {
+			a.err = err
+		}
+		a.cond.Broadcast()
+		a.mu.Unlock()
+		return
+	}
+	for _, t := range group {
+		a.complete(t)
+	}
+}
+
+// failure returns the error that stopped the apply, if any.
+func (a *applier) failure() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// syncPos returns the position of the command ending at end on the keys of
+// slots, nil if the stream can't be resumed.
+func (a *applier) syncPos(slots []uint32, end int64) *rpdb.SyncPos {
+	if a.replid == "" {
+		return nil
+	}
+	return &rpdb.SyncPos{
+		ReplID: a.replid, Filter: a.src.filter.String(), Resume: a.appliedOffset,
+		Slots: slots, End: end,
+	}
+}
+
+// bind makes the writes of t go through bl, with the offset of t stored in
+// their batches.
+func (a *applier) bind(t *applyTask, bl *rpdb.Rpdb) {
+	if t.pos != nil {
+		bl = bl.SyncView(a.src.name, t.pos)
+	}
+	t.s.bl = bl
+}
+
+// waitAlone waits until t is the only task pending, and reports the error
+// that stopped the apply, if any.
+func (a *applier) waitAlone(t *applyTask) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for a.err == nil && a.tasks.Front().Value.(*applyTask) != t {
+		a.cond.Wait()
+	}
+	return a.err
+}
+
+func (a *applier) track(size int64, request redis.Resp) *applyTask {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.offset += size
+	t := &applyTask{request: request, end: a.offset, since: time.Now()}
+	a.tasks.PushBack(t)
+	a.updateCountersLocked()
+	return t
+}
+
+func (a *applier) complete(t *applyTask) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t.done = true
+	var advanced bool
+	for e := a.tasks.Front(); e != nil && e.Value.(*applyTask).done; e = a.tasks.Front() {
+		a.applied = a.tasks.Remove(e).(*applyTask).end
+		advanced = true
+	}
+	if advanced {
+		if a.onApplied != nil {
+			a.onApplied(a.applied)
+		}
+		a.cond.Broadcast()
+	}
+	a.updateCountersLocked()
+}
+
+func (a *applier) appliedOffset() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.applied
+}
+
+// skipped reports whether the command ending at end on the keys of slots, or
+// on no single slot if slots is nil, was applied before the link restarted.
+// A command is applied if any later one on the same slots is, since they run
+// on the same worker in order, or any later one that ran alone.
+func (a *applier) skipped(slots []uint32, end int64) bool {
+	if a.skip == nil {
+		return false
+	}
+	if a.skipEnd == 0 {
+		for _, n := range a.skip {
+			if n > a.skipEnd {
+				a.skipEnd = n
+			}
+		}
+	}
+	if end > a.skipEnd {
+		a.skip = nil
+		return false
+	}
+	if slots == nil {
+		return true
+	}
+	max := a.skip[rpdb.SyncSerialSlot]
+	for _, slot := range slots {
+		if n := a.skip[slot]; n > max {
+			max = n
+		}
+	}
+	return end <= max
+}
+
+func (a *applier) updateCounters() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.updateCountersLocked()
+}
+
+func (a *applier) updateCountersLocked() {
+	c := &a.src.counters
+	c.applyQueue.Set(int64(a.tasks.Len()))
+	c.applyLagBytes.Set(a.offset - a.applied)
+	if e := a.tasks.Front(); e != nil {
+		c.applyLagMs.Set(int64(time.Since(e.Value.(*applyTask).since) / time.Millisecond))
+	} else {
+		c.applyLagMs.Set(0)
+	}
+}
+
+func (a *applier) execute(t *applyTask) {
+	a.h.counters.commands.Add(1)
+	if _, err := t.f(t.s, t.args...); err != nil {
+		a.h.counters.commandsFailed.Add(1)
+		b, _ := redis.EncodeToBytes(t.request)
+		log.WarnErrorf(err, "apply command failed, db = %d, request = '%s'", t.s.db, base64.StdEncoding.EncodeToString(b))
+	}
+}
+
+// dispatch runs a command of the stream, size is the number of bytes it took.
+// cur is the session of the stream, which is updated by SELECT. It returns
+// the error that stops the apply.
+func (a *applier) dispatch(cur *applySession, request redis.Resp, size int64) error {
+	if err := a.failure(); err != nil {
+		return err
+	}
+	t := a.track(size, request)
+	cmd, args, err := redis.ParseArgs(request)
+	if err != nil {
+		log.WarnErrorf(err, "parse command failed")
+		a.complete(t)
+		return nil
+	}
+	if t.f = a.h.htable[cmd]; t.f == nil {
+		log.Warnf("apply unknown command %s", cmd)
+		a.complete(t)
+		return nil
+	}
+	t.args = args
+
+	switch cmd {
+	case "ping":
+		a.complete(t)
+		return nil
+	case "select":
+		t.s = cur
+		a.execute(t)
+		a.complete(t)
+		return nil
+	}
+	if keylessWrites[cmd] {
+		return a.applyKeyless(cur, t, cmd)
+	}
+
+	db := cur.db
+	if f := a.src.filter; f != nil {
+		var ok bool
+		if db, args, ok = f.command(cmd, db, args); !ok {
+			a.complete(t)
+			return nil
+		}
+		t.args = args
+	}
+
+	i, slots := -1, []uint32(nil)
+	if keys, ok := commandKeys(cmd, args); ok {
+		for _, key := range keys {
+			_, slot := rpdb.HashKeyToSlot(key)
+			if j := int(slot) % len(a.workers); i == -1 {
+				i = j
+			} else if i != j {
+				i = -2
+				break
+			}
+			slots = append(slots, slot)
+		}
+		t.keys = keys
+	}
+	if i < 0 {
+		slots = nil
+	}
+	if a.skipped(slots, t.end) {
+		a.complete(t)
+		return nil
+	}
+
+	t.pos = a.syncPos(slots, t.end)
+	t.s = &applySession{db: db, bl: cur.bl}
+	if i >= 0 {
+		a.workers[i] <- t
+		return nil
+	}
+
+	// t is counted as pending, so wait until it is the only task left
+	if err := a.waitAlone(t); err != nil {
+		return err
+	}
+	a.bind(t, cur.bl)
+	a.execute(t)
+	a.complete(t)
+	return nil
+}
+
+// applyKeyless runs a write without keys alone. FLUSHDB and FLUSHALL run
+// without storing the offset, they may run twice after a crash, which is
+// harmless. A filtered source deletes the keys it replicates only, and can't
+// apply the other writes, so its link is stopped to resync it.
+func (a *applier) applyKeyless(cur *applySession, t *applyTask, cmd string) error {
+	if a.skipped(nil, t.end) {
+		a.complete(t)
+		return nil
+	}
+	f := a.src.filter
+	if f != nil && cmd != "flushdb" && cmd != "flushall" {
+		log.Warnf("can't apply %s under filter [%s], resync", cmd, f)
+		return errors.Trace(ErrSyncUnfiltered)
+	}
+	if err := a.waitAlone(t); err != nil {
+		return err
+	}
+	switch {
+	case f == nil && (cmd == "flushdb" || cmd == "flushall"):
+		t.s = &applySession{db: cur.db, bl: cur.bl}
+	case f == nil:
+		t.s, t.pos = &applySession{db: cur.db}, a.syncPos(nil, t.end)
+		a.bind(t, cur.bl)
+	default:
+		a.h.counters.commands.Add(1)
+		db := &cur.db
+		if cmd == "flushall" {
+			db = nil
+		}
+		if _, err := f.flush(cur.bl, db); err != nil {
+			a.h.counters.commandsFailed.Add(1)
+			log.WarnErrorf(err, "apply %s failed, db = %d", cmd, cur.db)
+		}
+		a.complete(t)
+		return nil
+	}
+	a.execute(t)
+	a.complete(t)
+	return nil
+}
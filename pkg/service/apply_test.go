@@ -0,0 +1,98 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func TestCommandKeys(t *testing.T) {
+	keys, ok := commandKeys("mset", [][]byte{[]byte("a"), []byte("1"), []byte("b"), []byte("2")})
+	checkerror(t, nil, ok && len(keys) == 2 && string(keys[0]) == "a" && string(keys[1]) == "b")
+	keys, ok = commandKeys("hset", [][]byte{[]byte("a"), []byte("f"), []byte("v")})
+	checkerror(t, nil, ok && len(keys) == 1 && string(keys[0]) == "a")
+	_, ok = commandKeys("ping", nil)
+	checkerror(t, nil, !ok)
+}
+
+func TestApplier(t *testing.T) {
+	h := newPubSubHandler(t)
+	k := random(t)
+
+	src := &syncSource{}
+	a := newApplier(h, src, 100, 4)
+	var applied int64
+	a.onApplied = func(offset int64) {
+		applied = offset
+	}
+
+	offset := int64(100)
+	s := &applySession{bl: testbl}
+	dispatch := func(cmd string, args ...interface{}) {
+		r := request(cmd, args...)
+		b, err := redis.EncodeToBytes(r)
+		checkerror(t, err, true)
+		offset += int64(len(b))
+		checkerror(t, a.dispatch(s, r, int64(len(b))), true)
+	}
+
+	dispatch("select", 1)
+	for i := 0; i < 100; i++ {
+		dispatch("incr", k+strconv.Itoa(i%10))
+	}
+	dispatch("mset", k+"a", 1, k+"b", 2, k+"c", 3)
+	dispatch("del", k+"0", k+"1")
+	dispatch("ping")
+	dispatch("select", 0)
+	dispatch("set", k, "db0")
+	a.close()
+
+	checkerror(t, nil, applied == offset)
+	checkerror(t, nil, src.counters.applyQueue.Get() == 0)
+
+	c := client(t)
+	checkstring(t, "db0", c, "get", k)
+	checkok(t, c, "select", 1)
+	checkint(t, 0, c, "exists", k+"0")
+	checkstring(t, "10", c, "get", k+"9")
+	checkstring(t, "3", c, "get", k+"c")
+}
+
+func TestApplierKeyless(t *testing.T) {
+	h := newPubSubHandler(t)
+	k := random(t)
+
+	filter, err := parseSyncFilter(bargs("db", "9", "match", k+"*"))
+	checkerror(t, err, true)
+	a := newApplier(h, &syncSource{filter: filter}, 0, 4)
+
+	s := &applySession{bl: testbl}
+	dispatch := func(cmd string, args ...interface{}) error {
+		r := request(cmd, args...)
+		b, err := redis.EncodeToBytes(r)
+		checkerror(t, err, true)
+		return a.dispatch(s, r, int64(len(b)))
+	}
+
+	c := client(t)
+	checkok(t, c, "select", 9)
+	checkok(t, c, "set", k+"a", 1)
+	checkok(t, c, "set", "x"+k, 2)
+
+	checkerror(t, dispatch("select", 9), true)
+	checkerror(t, dispatch("flushdb"), true)
+	checkerror(t, dispatch("set", k+"b", 3), true)
+	err = dispatch("slotsdel", 0)
+	checkerror(t, nil, errors.Equal(err, ErrSyncUnfiltered))
+	a.close()
+
+	checkint(t, 0, c, "exists", k+"a")
+	checkstring(t, "3", c, "get", k+"b")
+	checkstring(t, "2", c, "get", "x"+k)
+	checkint(t, 2, c, "del", k+"b", "x"+k)
+}
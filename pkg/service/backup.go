@@ -0,0 +1,196 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+// backupState tracks the engine backup started by BACKUP, and the result of
+// the last one.
+type backupState struct {
+	mu      sync.Mutex
+	running bool
+	path    string
+	since   time.Time
+
+	lastBackup time.Time
+	lastStatus string
+	lastTime   time.Duration
+}
+
+func (b *backupState) start(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running {
+		return errors.Errorf("backup is busy, path = %s", b.path)
+	}
+	b.running, b.path, b.since = true, path, time.Now()
+	return nil
+}
+
+func (b *backupState) finish(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.running = false
+	b.lastTime = time.Since(b.since)
+	if err != nil {
+		b.lastStatus = "err"
+		log.WarnErrorf(err, "backup to '%s' failed", b.path)
+	} else {
+		b.lastStatus = "ok"
+		b.lastBackup = time.Now()
+		log.Infof("backup to '%s' done", b.path)
+	}
+}
+
+func (b *backupState) info(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running {
+		fmt.Fprintf(w, "backup_in_progress:1\n")
+		fmt.Fprintf(w, "backup_current_path:%s\n", b.path)
+		fmt.Fprintf(w, "backup_current_time_sec:%d\n", int64(time.Since(b.since)/time.Second))
+	} else {
+		fmt.Fprintf(w, "backup_in_progress:0\n")
+	}
+	if b.lastStatus != "" {
+		fmt.Fprintf(w, "backup_last_status:%s\n", b.lastStatus)
+		fmt.Fprintf(w, "backup_last_time_sec:%d\n", int64(b.lastTime/time.Second))
+	}
+	if !b.lastBackup.IsZero() {
+		fmt.Fprintf(w, "backup_last_backup_time:%d\n", b.lastBackup.Unix())
+	}
+}
+
+// startBackup takes an engine backup of bl into path on a background
+// goroutine, the returned channel is closed once it is done. The old
+// incremental backups are purged after a successful one, as configured.
+func (h *Handler) startBackup(bl *rpdb.Rpdb, path string) (<-chan int, error) {
+	if err := h.backup.start(path); err != nil {
+		return nil, err
+	}
+	done := make(chan int)
+	go func() {
+		defer close(done)
+		err := bl.Backup(path)
+		h.backup.finish(err)
+		if err == nil {
+			h.purgeBackups(bl, path)
+		}
+	}()
+	return done, nil
+}
+
+func (h *Handler) purgeBackups(bl *rpdb.Rpdb, path string) {
+	if h.config == nil {
+		return
+	}
+	keep := h.config.BackupRetainCount
+	age := time.Duration(h.config.BackupRetainAge) * time.Second
+	if keep <= 0 && age <= 0 {
+		return
+	}
+	if err := bl.PurgeBackups(path, keep, age); err != nil && !errors.Equal(err, rpdb.ErrBackupUnsupported) {
+		log.WarnErrorf(err, "purge backups in '%s' failed", path)
+	}
+}
+
+// BACKUP path
+func (h *Handler) Backup(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 1 {
+		return toRespErrorf("len(args) = %d, expect = 1", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if _, err := h.startBackup(s.Rpdb(), string(args[0])); err != nil {
+		return toRespError(err)
+	}
+	return redis.NewString("Background backup started"), nil
+}
+
+// BACKUPINFO path [id] / BACKUPINFO path VERIFY [id ...]
+func (h *Handler) BackupInfo(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	path, args := string(args[0]), args[1:]
+
+	if len(args) != 0 && strings.ToLower(string(args[0])) == "verify" {
+		ids, err := parseBackupIDs(args[1:])
+		if err != nil {
+			return toRespError(err)
+		}
+		if err := s.Rpdb().VerifyBackups(path, ids); err != nil {
+			return toRespError(err)
+		}
+		return redis.NewString("OK"), nil
+	}
+
+	if len(args) > 1 {
+		return toRespErrorf("len(args) = %d, expect <= 2", len(args)+1)
+	}
+	ids, err := parseBackupIDs(args)
+	if err != nil {
+		return toRespError(err)
+	}
+	infos, err := s.Rpdb().ListBackups(path)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	resp := redis.NewArray()
+	if len(ids) == 0 {
+		for _, info := range infos {
+			resp.AppendBulkBytes([]byte(fmt.Sprintf("id=%d,timestamp=%d,sequence=%d,size=%d,files=%d",
+				info.ID, info.Timestamp, info.Sequence, info.Size, len(info.Files))))
+		}
+		return resp, nil
+	}
+	for _, info := range infos {
+		if info.ID != ids[0] {
+			continue
+		}
+		for _, f := range info.Files {
+			resp.AppendBulkBytes([]byte(fmt.Sprintf("%s,size=%d,crc32=%d", f.Name, f.Size, f.Checksum)))
+		}
+		return resp, nil
+	}
+	return toRespErrorf("backup %d doesn't exist", ids[0])
+}
+
+func parseBackupIDs(args [][]byte) ([]uint32, error) {
+	var ids []uint32
+	for _, arg := range args {
+		id, err := rpdb.ParseUint(arg)
+		if err != nil {
+			return nil, err
+		}
+		if id > math.MaxUint32 {
+			return nil, errors.Errorf("parse backup id = %d", id)
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBackupState(t *testing.T) {
+	var b backupState
+	checkerror(t, b.start("/tmp/testdb-backup"), true)
+	checkerror(t, nil, b.start("/tmp/testdb-backup") != nil)
+
+	var w bytes.Buffer
+	b.info(&w)
+	checkerror(t, nil, strings.Contains(w.String(), "backup_in_progress:1\n"))
+
+	b.finish(nil)
+	w.Reset()
+	b.info(&w)
+	checkerror(t, nil, strings.Contains(w.String(), "backup_in_progress:0\n"))
+	checkerror(t, nil, strings.Contains(w.String(), "backup_last_status:ok\n"))
+}
+
+func TestBackup(t *testing.T) {
+	c := client(t)
+	k := random(t)
+	checkok(t, c, "set", k, "backup")
+
+	const path = "/tmp/testdb-backup"
+	os.RemoveAll(path)
+	h := &Handler{}
+	done, err := h.startBackup(testbl, path)
+	checkerror(t, err, true)
+	<-done
+	checkerror(t, nil, h.backup.lastStatus == "ok")
+	_, err = os.Stat(path)
+	checkerror(t, err, true)
+
+	a := checkbytesarray(t, c, "backupinfo", path)
+	checkerror(t, nil, len(a) == 1 && strings.HasPrefix(string(a[0]), "id=1,"))
+	checkerror(t, nil, len(checkbytesarray(t, c, "backupinfo", path, 1)) != 0)
+	checkok(t, c, "backupinfo", path, "verify")
+	checkok(t, c, "backupinfo", path, "verify", 1)
+	_, err = server.Dispatch(c, request("backupinfo", path, 2))
+	checkerror(t, nil, err != nil)
+}
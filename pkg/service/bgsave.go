@@ -0,0 +1,286 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/counter"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/io/ioutils"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+var (
+	ErrBgsaveCanceled = errors.Static("bgsave has been canceled")
+)
+
+// bgsaveJob is a dump of a snapshot in progress, it can be canceled between
+// two chunks of objects.
+type bgsaveJob struct {
+	path   string
+	since  time.Time
+	writes uint64
+
+	keys  counter.Int64
+	bytes counter.Int64
+
+	stop chan int
+	done chan int
+	err  error
+}
+
+// bgsaveState tracks the running dump and the result of the last one, and
+// the number of writes committed when the last successful dump started.
+type bgsaveState struct {
+	mu  sync.Mutex
+	job *bgsaveJob
+
+	lastSave   time.Time
+	lastStatus string
+	lastTime   time.Duration
+	lastWrites uint64
+}
+
+func (b *bgsaveState) init(writes uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastSave = time.Now()
+	b.lastWrites = writes
+}
+
+func (b *bgsaveState) start(path string, writes uint64) (*bgsaveJob, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.job != nil {
+		return nil, errors.Errorf("bgsave is busy, path = %s", b.job.path)
+	}
+	b.job = &bgsaveJob{
+		path: path, since: time.Now(), writes: writes,
+		stop: make(chan int), done: make(chan int),
+	}
+	return b.job, nil
+}
+
+func (b *bgsaveState) finish(job *bgsaveJob, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.job = nil
+	b.lastTime = time.Since(job.since)
+	if err != nil {
+		b.lastStatus = "err"
+		log.WarnErrorf(err, "bgsave to '%s' failed", job.path)
+	} else {
+		b.lastStatus = "ok"
+		b.lastSave = time.Now()
+		b.lastWrites = job.writes
+		log.Infof("bgsave to '%s' done, keys = %d, bytes = %d", job.path, job.keys.Get(), job.bytes.Get())
+	}
+	job.err = err
+	close(job.done)
+}
+
+func (b *bgsaveState) cancel() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.job == nil {
+		return false
+	}
+	select {
+	case <-b.job.stop:
+	default:
+		close(b.job.stop)
+	}
+	return true
+}
+
+func (b *bgsaveState) info(w io.Writer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if job := b.job; job != nil {
+		fmt.Fprintf(w, "rdb_bgsave_in_progress:1\n")
+		fmt.Fprintf(w, "rdb_current_bgsave_path:%s\n", job.path)
+		fmt.Fprintf(w, "rdb_current_bgsave_time_sec:%d\n", int64(time.Since(job.since)/time.Second))
+		fmt.Fprintf(w, "rdb_current_bgsave_keys:%d\n", job.keys.Get())
+		fmt.Fprintf(w, "rdb_current_bgsave_bytes:%d\n", job.bytes.Get())
+	} else {
+		fmt.Fprintf(w, "rdb_bgsave_in_progress:0\n")
+		fmt.Fprintf(w, "rdb_current_bgsave_time_sec:-1\n")
+	}
+	fmt.Fprintf(w, "rdb_last_save_time:%d\n", b.lastSave.Unix())
+	fmt.Fprintf(w, "rdb_last_save_writes:%d\n", b.lastWrites)
+	if b.lastStatus != "" {
+		fmt.Fprintf(w, "rdb_last_bgsave_status:%s\n", b.lastStatus)
+		fmt.Fprintf(w, "rdb_last_bgsave_time_sec:%d\n", int64(b.lastTime/time.Second))
+	} else {
+		fmt.Fprintf(w, "rdb_last_bgsave_status:ok\n")
+		fmt.Fprintf(w, "rdb_last_bgsave_time_sec:-1\n")
+	}
+}
+
+// startBgsave dumps a snapshot to path on a background goroutine.
+func (h *Handler) startBgsave(bl *rpdb.Rpdb, path string) (*bgsaveJob, error) {
+	job, err := h.bgsave.start(path, bl.Writes())
+	if err != nil {
+		return nil, err
+	}
+	sp, err := bl.NewSnapshot()
+	if err != nil {
+		h.bgsave.finish(job, err)
+		return nil, err
+	}
+	h.counters.bgsave.Add(1)
+	go func() {
+		defer h.counters.bgsave.Sub(1)
+		defer bl.ReleaseSnapshot(sp)
+		h.bgsave.finish(job, h.bgsaveTo(h.context(), sp, path, job))
+	}()
+	return job, nil
+}
+
+// BGSAVE [CANCEL]
+func (h *Handler) Bgsave(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) > 1 {
+		return toRespErrorf("len(args) = %d, expect <= 1", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if len(args) == 1 {
+		if opt := strings.ToLower(string(args[0])); opt != "cancel" {
+			return toRespErrorf("unknown option %s", opt)
+		}
+		if !h.bgsave.cancel() {
+			return toRespErrorf("no bgsave in progress")
+		}
+		return redis.NewString("OK"), nil
+	}
+
+	if _, err := h.startBgsave(s.Rpdb(), h.config.DumpPath); err != nil {
+		return toRespError(err)
+	}
+	return redis.NewString("Background saving started"), nil
+}
+
+// BGSAVETO path
+func (h *Handler) BgsaveTo(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 1 {
+		return toRespErrorf("len(args) = %d, expect = 1", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	job, err := h.startBgsave(s.Rpdb(), string(args[0]))
+	if err != nil {
+		return toRespError(err)
+	}
+	<-job.done
+
+	if err := job.err; err != nil {
+		return toRespError(err)
+	} else {
+		return redis.NewString("OK"), nil
+	}
+}
+
+// LASTSAVE
+func (h *Handler) LastSave(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 0 {
+		return toRespErrorf("len(args) = %d, expect = 0", len(args))
+	}
+
+	_, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	h.bgsave.mu.Lock()
+	defer h.bgsave.mu.Unlock()
+	if h.bgsave.lastSave.IsZero() {
+		return redis.NewInt(0), nil
+	}
+	return redis.NewInt(h.bgsave.lastSave.Unix()), nil
+}
+
+// bgsaveTo dumps sp to path until ctx is done, job is optional and tracks the
+// progress. The rdb is written to a temporary file first, so an existing dump
+// is replaced only once the new one is complete.
+func (h *Handler) bgsaveTo(ctx context.Context, sp *rpdb.RpdbSnapshot, path string, job *bgsaveJob) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := ioutils.NewCountWriter(f, nil)
+	buf := bufio.NewWriterSize(w, 1024*1024)
+	enc := rdb.NewEncoder(buf)
+
+	if err := enc.EncodeHeader(); err != nil {
+		return err
+	}
+
+	ncpu := runtime.GOMAXPROCS(0)
+	cron := time.Millisecond * time.Duration(100)
+	for {
+		if job != nil {
+			select {
+			case <-job.stop:
+				return errors.Trace(ErrBgsaveCanceled)
+			default:
+			}
+		}
+		objs, more, err := sp.LoadObjCronContext(ctx, cron, ncpu, 1024)
+		if err != nil {
+			return err
+		} else {
+			for _, obj := range objs {
+				if err := enc.EncodeObject(obj.DB, obj.Key, obj.ExpireAt, obj.Value); err != nil {
+					return err
+				}
+			}
+		}
+		if job != nil {
+			job.keys.Add(int64(len(objs)))
+			job.bytes.Set(w.Count())
+		}
+		if !more {
+			break
+		}
+	}
+
+	if err := enc.EncodeFooter(); err != nil {
+		return err
+	}
+
+	if err := errors.Trace(buf.Flush()); err != nil {
+		return err
+	}
+	if job != nil {
+		job.bytes.Set(w.Count())
+	}
+	if err := errors.Trace(f.Close()); err != nil {
+		return err
+	}
+	return errors.Trace(os.Rename(tmp, path))
+}
@@ -0,0 +1,48 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+)
+
+func TestBgsaveState(t *testing.T) {
+	var b bgsaveState
+	b.init(0)
+	checkerror(t, nil, !b.cancel())
+
+	job, err := b.start("/tmp/testdb-bgsave.rdb", 1)
+	checkerror(t, err, job != nil)
+	_, err = b.start("/tmp/testdb-bgsave.rdb", 1)
+	checkerror(t, nil, err != nil)
+
+	job.keys.Set(10)
+	var w bytes.Buffer
+	b.info(&w)
+	checkerror(t, nil, strings.Contains(w.String(), "rdb_bgsave_in_progress:1\n"))
+	checkerror(t, nil, strings.Contains(w.String(), "rdb_current_bgsave_keys:10\n"))
+
+	checkerror(t, nil, b.cancel())
+	<-job.stop
+	b.finish(job, errors.Trace(ErrBgsaveCanceled))
+	<-job.done
+	checkerror(t, nil, errors.Equal(job.err, ErrBgsaveCanceled))
+
+	w.Reset()
+	b.info(&w)
+	checkerror(t, nil, strings.Contains(w.String(), "rdb_bgsave_in_progress:0\n"))
+	checkerror(t, nil, strings.Contains(w.String(), "rdb_last_bgsave_status:err\n"))
+
+	job, err = b.start("/tmp/testdb-bgsave.rdb", 2)
+	checkerror(t, err, true)
+	b.finish(job, nil)
+	checkerror(t, nil, b.lastWrites == 2)
+	w.Reset()
+	b.info(&w)
+	checkerror(t, nil, strings.Contains(w.String(), "rdb_last_bgsave_status:ok\n"))
+}
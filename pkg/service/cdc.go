@@ -0,0 +1,160 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+const (
+	cdcDefaultCount = 100
+	cdcMaxBlock     = time.Minute
+)
+
+// cdcStream returns a stream of the writes after the sequence from. A conn
+// keeps its stream, so a client tailing the log doesn't search the files on
+// every read. The returned bool tells if the stream should be closed after use.
+func cdcStream(s Session, from uint64) (*rpdb.ChangeStream, bool, error) {
+	c, _ := s.(*conn)
+	if c != nil && c.cdc != nil {
+		if c.cdc.Seq() == from {
+			return c.cdc, false, nil
+		}
+		c.cdc.Close()
+		c.cdc = nil
+	}
+	cs, err := s.Rpdb().Subscribe(from)
+	if err != nil {
+		return nil, false, err
+	}
+	if c != nil {
+		c.cdc = cs
+		return cs, false, nil
+	}
+	return cs, true, nil
+}
+
+// CDC READ from [COUNT n] [BLOCK ms] / CDC INFO
+func (h *Handler) Cdc(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	sub, args := strings.ToLower(string(args[0])), args[1:]
+	switch sub {
+	default:
+		return toRespErrorf("unknown sub-command %s", sub)
+	case "info":
+		if len(args) != 0 {
+			return toRespErrorf("len(args) = %d, expect = 1", len(args)+1)
+		}
+		first, last, err := s.Rpdb().ChangeRange()
+		if err != nil {
+			return toRespError(err)
+		}
+		resp := redis.NewArray()
+		resp.AppendInt(int64(first))
+		resp.AppendInt(int64(last))
+		return resp, nil
+	case "read":
+		if len(args) != 1 && len(args) != 3 && len(args) != 5 {
+			return toRespErrorf("len(args) = %d, expect = 2 or 4 or 6", len(args)+1)
+		}
+		from, err := rpdb.ParseUint(args[0])
+		if err != nil {
+			return toRespError(err)
+		}
+		count, block := uint64(cdcDefaultCount), time.Duration(0)
+		for i := 1; i < len(args); i += 2 {
+			v, err := rpdb.ParseUint(args[i+1])
+			if err != nil {
+				return toRespError(err)
+			}
+			switch opt := strings.ToLower(string(args[i])); opt {
+			default:
+				return toRespErrorf("unknown option %s", opt)
+			case "count":
+				if v == 0 {
+					return toRespErrorf("invalid count = %d", v)
+				}
+				count = v
+			case "block":
+				block = time.Duration(v) * time.Millisecond
+				if block > cdcMaxBlock {
+					block = cdcMaxBlock
+				}
+			}
+		}
+		records, err := h.cdcRead(s, from, count, block)
+		if err != nil {
+			return toRespError(err)
+		}
+		resp := redis.NewArray()
+		for _, r := range records {
+			resp.Append(cdcRecordResp(r))
+		}
+		return resp, nil
+	}
+}
+
+// cdcRead returns at most count records after the sequence from, it waits at
+// most block for the first one.
+func (h *Handler) cdcRead(s Session, from, count uint64, block time.Duration) ([]*rpdb.WALRecord, error) {
+	cs, closing, err := cdcStream(s, from)
+	if err != nil {
+		return nil, err
+	}
+	if closing {
+		defer cs.Close()
+	}
+	var records []*rpdb.WALRecord
+	for uint64(len(records)) < count {
+		timeout := block
+		if len(records) != 0 {
+			timeout = 0
+		}
+		r, err := cs.Next(timeout)
+		if err != nil {
+			// return the records read, the error is seen by the next read
+			if len(records) != 0 {
+				break
+			}
+			return nil, err
+		}
+		if r == nil {
+			break
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// cdcRecordResp encodes a record as [seq, time, db, op, [key ...], [arg ...]].
+func cdcRecordResp(r *rpdb.WALRecord) redis.Resp {
+	keys := redis.NewArray()
+	for _, key := range r.Keys() {
+		keys.AppendBulkBytes(key)
+	}
+	args := redis.NewArray()
+	for _, arg := range r.Args {
+		args.AppendBulkBytes(arg)
+	}
+	resp := redis.NewArray()
+	resp.AppendInt(int64(r.Seq))
+	resp.AppendInt(r.Time)
+	resp.AppendInt(int64(r.DB))
+	resp.AppendBulkBytes([]byte(r.Op))
+	resp.Append(keys)
+	resp.Append(args)
+	return resp
+}
@@ -0,0 +1,57 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"os"
+	"testing"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/rpdb/pkg/store/rocksdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func TestCdc(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-cdc-service"
+	const dir = "/tmp/testdb-wal-cdc-service"
+	os.RemoveAll(path)
+	os.RemoveAll(dir)
+	db, err := rocksdb.Open(path, rocksdb.NewDefaultConfig(), true, false)
+	checkerror(t, err, true)
+	bl := rpdb.New(db)
+	defer bl.Close()
+
+	s := &applySession{bl: bl}
+	_, err = server.Dispatch(s, request("cdc", "read", 0))
+	checkerror(t, nil, err != nil)
+
+	w, err := rpdb.OpenWAL(dir, 1024*1024, 0)
+	checkerror(t, err, true)
+	checkerror(t, bl.SetWAL(w), true)
+
+	checkerror(t, bl.Set(0, "a", "1"), true)
+	checkerror(t, bl.Set(1, "b", "2"), true)
+	checkerror(t, bl.Set(0, "c", "3"), true)
+	checkintarray(t, []int64{1, 3}, s, "cdc", "info")
+
+	a := cdcread(t, s, 0, "count", 2)
+	checkerror(t, nil, len(a) == 2)
+	r := a[1].(*redis.Array).Value
+	checkerror(t, nil, len(r) == 6 && r[0].(*redis.Int).Value == 2 && r[2].(*redis.Int).Value == 1)
+	checkerror(t, nil, string(r[3].(*redis.BulkBytes).Value) == "Set")
+	keys := r[4].(*redis.Array).Value
+	checkerror(t, nil, len(keys) == 1 && string(keys[0].(*redis.BulkBytes).Value) == "b")
+
+	a = cdcread(t, s, 2, "block", 10)
+	checkerror(t, nil, len(a) == 1 && a[0].(*redis.Array).Value[0].(*redis.Int).Value == 3)
+	checkerror(t, nil, len(cdcread(t, s, 3, "block", 10)) == 0)
+}
+
+func cdcread(t *testing.T, s Session, from uint64, args ...interface{}) []redis.Resp {
+	rsp, err := server.Dispatch(s, request("cdc", append([]interface{}{"read", from}, args...)...))
+	checkerror(t, err, rsp != nil)
+	x, ok := rsp.(*redis.Array)
+	checkerror(t, nil, ok)
+	return x.Value
+}
@@ -0,0 +1,408 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+var (
+	ErrClusterDisabled = errors.Static("This instance has cluster support disabled")
+)
+
+// ClusterSlotNum is the number of slots of Redis Cluster, the cluster clients
+// hash a key to one of them with crc16, while rpdb hashes it to one of its
+// MaxSlotNum slots with crc32.
+const ClusterSlotNum = 16384
+
+// clusterNode is a server of the emulated cluster, its id is derived from its
+// address, so all the servers agree on it.
+type clusterNode struct {
+	id   string
+	addr string
+	self bool
+}
+
+func newClusterNode(addr string, self bool) *clusterNode {
+	sum := sha1.Sum([]byte(addr))
+	return &clusterNode{id: hex.EncodeToString(sum[:]), addr: addr, self: self}
+}
+
+func (n *clusterNode) hostPort() (string, int64) {
+	host, port, err := net.SplitHostPort(n.addr)
+	if err != nil {
+		return n.addr, 0
+	}
+	p, _ := strconv.ParseInt(port, 10, 64)
+	return host, p
+}
+
+// clusterTopology assigns the cluster slots to the servers, a slot not served
+// by any server is nil.
+type clusterTopology struct {
+	nodes []*clusterNode
+	slots [ClusterSlotNum]*clusterNode
+}
+
+type clusterRange struct {
+	first, last int
+	node        *clusterNode
+}
+
+func newClusterTopology(self string) *clusterTopology {
+	return &clusterTopology{nodes: []*clusterNode{newClusterNode(self, true)}}
+}
+
+func (t *clusterTopology) node(addr string) *clusterNode {
+	for _, n := range t.nodes {
+		if n.addr == addr {
+			return n
+		}
+	}
+	n := newClusterNode(addr, false)
+	t.nodes = append(t.nodes, n)
+	return n
+}
+
+// ranges returns the consecutive slots served by the same server.
+func (t *clusterTopology) ranges() []*clusterRange {
+	var ranges []*clusterRange
+	for i, n := range t.slots {
+		if n == nil {
+			continue
+		}
+		if k := len(ranges); k != 0 && ranges[k-1].node == n && ranges[k-1].last == i-1 {
+			ranges[k-1].last = i
+		} else {
+			ranges = append(ranges, &clusterRange{i, i, n})
+		}
+	}
+	return ranges
+}
+
+// parseClusterTopology parses a static topology, which has a line for every
+// server with its address and the cluster slots it serves, e.g.
+//   10.0.0.1:6380 0-8191
+//   10.0.0.2:6380 8192-16383
+// Empty lines and the ones starting with # are skipped.
+func parseClusterTopology(r io.Reader, self string) (*clusterTopology, error) {
+	t := newClusterTopology(self)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(fields[0]); err != nil {
+			return nil, errors.Errorf("line %d: invalid address %s", line, fields[0])
+		}
+		n := t.node(fields[0])
+		for _, f := range fields[1:] {
+			first, last, err := parseClusterRange(f)
+			if err != nil {
+				return nil, errors.Errorf("line %d: %s", line, err)
+			}
+			for i := first; i <= last; i++ {
+				if t.slots[i] != nil {
+					return nil, errors.Errorf("line %d: slot %d is assigned twice", line, i)
+				}
+				t.slots[i] = n
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return t, nil
+}
+
+func parseClusterRange(s string) (int, int, error) {
+	p := strings.SplitN(s, "-", 2)
+	first, err := strconv.Atoi(p[0])
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid slots %s", s)
+	}
+	last := first
+	if len(p) == 2 {
+		if last, err = strconv.Atoi(p[1]); err != nil {
+			return 0, 0, errors.Errorf("invalid slots %s", s)
+		}
+	}
+	if first < 0 || first > last || last >= ClusterSlotNum {
+		return 0, 0, errors.Errorf("invalid slots %s", s)
+	}
+	return first, last, nil
+}
+
+func loadClusterTopology(path, self string) (*clusterTopology, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	return parseClusterTopology(f, self)
+}
+
+// ownerTopology maps the ownership table onto the cluster slots. The clients
+// hash a key to another slot than rpdb does, so the cluster slots can't be
+// split among the servers by the table, it fails unless every slot is owned
+// here, the static topology is required otherwise.
+func ownerTopology(owners []rpdb.SlotOwner, self string) (*clusterTopology, error) {
+	t := newClusterTopology(self)
+	for i, o := range owners {
+		if o.State != rpdb.SlotOwned {
+			return nil, errors.Errorf("CLUSTERDOWN slot %d is %s %s, cluster_topology_file is required", i, o.State, o.Addr)
+		}
+	}
+	for i := range t.slots {
+		t.slots[i] = t.nodes[0]
+	}
+	return t, nil
+}
+
+// clusterKeySlot returns the cluster slot of key, as the cluster clients do.
+func clusterKeySlot(key []byte) uint32 {
+	if i := bytes.IndexByte(key, '{'); i != -1 {
+		if j := bytes.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return uint32(crc16(key)) % ClusterSlotNum
+}
+
+// crc16 is CRC-16/XMODEM used by Redis Cluster.
+func crc16(p []byte) uint16 {
+	var crc uint16
+	for _, b := range p {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func (h *Handler) clusterEnabled() bool {
+	return h.config != nil && h.config.ClusterEnabled
+}
+
+// clusterAddr returns the address announced to the cluster clients.
+func (h *Handler) clusterAddr() string {
+	if h.config.ClusterAnnounce != "" {
+		return h.config.ClusterAnnounce
+	}
+	host, port, err := net.SplitHostPort(h.config.Listen)
+	if err != nil {
+		return h.config.Listen
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// topology returns the static topology if configured, or the single server
+// of the ownership table.
+func (h *Handler) topology(bl *rpdb.Rpdb) (*clusterTopology, error) {
+	if h.cluster != nil {
+		return h.cluster, nil
+	}
+	owners, err := bl.SlotOwners()
+	if err != nil {
+		return nil, err
+	}
+	return ownerTopology(owners, h.clusterAddr())
+}
+
+// CLUSTER SLOTS / NODES / SHARDS / INFO / MYID / KEYSLOT key
+func (h *Handler) Cluster(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+	if !h.clusterEnabled() {
+		return toRespError(errors.Trace(ErrClusterDisabled))
+	}
+
+	sub, args := strings.ToLower(string(args[0])), args[1:]
+	if sub == "keyslot" {
+		if len(args) != 1 {
+			return toRespErrorf("len(args) = %d, expect = 2", len(args)+1)
+		}
+		return redis.NewInt(int64(clusterKeySlot(args[0]))), nil
+	}
+	if len(args) != 0 {
+		return toRespErrorf("len(args) = %d, expect = 1", len(args)+1)
+	}
+
+	t, err := h.topology(s.Rpdb())
+	if err != nil {
+		return toRespError(err)
+	}
+	switch sub {
+	default:
+		return toRespErrorf("unknown sub-command %s", sub)
+	case "myid":
+		return redis.NewBulkBytes([]byte(t.nodes[0].id)), nil
+	case "info":
+		return redis.NewBulkBytes(clusterInfo(t)), nil
+	case "nodes":
+		return redis.NewBulkBytes(clusterNodes(t)), nil
+	case "slots":
+		resp := redis.NewArray()
+		for _, r := range t.ranges() {
+			host, port := r.node.hostPort()
+			n := redis.NewArray()
+			n.AppendBulkBytes([]byte(host))
+			n.AppendInt(port)
+			n.AppendBulkBytes([]byte(r.node.id))
+			x := redis.NewArray()
+			x.AppendInt(int64(r.first))
+			x.AppendInt(int64(r.last))
+			x.Append(n)
+			resp.Append(x)
+		}
+		return resp, nil
+	case "shards":
+		return clusterShards(t), nil
+	}
+}
+
+func clusterInfo(t *clusterTopology) []byte {
+	var assigned int
+	for _, n := range t.slots {
+		if n != nil {
+			assigned++
+		}
+	}
+	size := make(map[*clusterNode]bool)
+	for _, r := range t.ranges() {
+		size[r.node] = true
+	}
+	state := "ok"
+	if assigned != ClusterSlotNum {
+		state = "fail"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "cluster_enabled:1\r\n")
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_pfail:0\r\n")
+	fmt.Fprintf(&b, "cluster_slots_fail:0\r\n")
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(t.nodes))
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", len(size))
+	fmt.Fprintf(&b, "cluster_current_epoch:1\r\n")
+	fmt.Fprintf(&b, "cluster_my_epoch:1\r\n")
+	return b.Bytes()
+}
+
+// clusterNodes formats the topology as CLUSTER NODES does, every server is a
+// master with no replicas.
+func clusterNodes(t *clusterTopology) []byte {
+	ranges := t.ranges()
+	var b bytes.Buffer
+	for _, n := range t.nodes {
+		host, port := n.hostPort()
+		flags := "master"
+		if n.self {
+			flags = "myself,master"
+		}
+		fmt.Fprintf(&b, "%s %s:%d@%d %s - 0 0 1 connected", n.id, host, port, port+10000, flags)
+		for _, r := range ranges {
+			if r.node != n {
+				continue
+			}
+			if r.first == r.last {
+				fmt.Fprintf(&b, " %d", r.first)
+			} else {
+				fmt.Fprintf(&b, " %d-%d", r.first, r.last)
+			}
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	return b.Bytes()
+}
+
+func clusterShards(t *clusterTopology) redis.Resp {
+	ranges := t.ranges()
+	resp := redis.NewArray()
+	for _, n := range t.nodes {
+		slots := redis.NewArray()
+		for _, r := range ranges {
+			if r.node == n {
+				slots.AppendInt(int64(r.first))
+				slots.AppendInt(int64(r.last))
+			}
+		}
+		host, port := n.hostPort()
+		node := redis.NewArray()
+		for _, kv := range [][2]string{{"id", n.id}, {"port", ""}, {"ip", host}, {"endpoint", host}, {"role", "master"}, {"replication-offset", ""}, {"health", "online"}} {
+			node.AppendBulkBytes([]byte(kv[0]))
+			switch kv[0] {
+			case "port":
+				node.AppendInt(port)
+			case "replication-offset":
+				node.AppendInt(0)
+			default:
+				node.AppendBulkBytes([]byte(kv[1]))
+			}
+		}
+		nodes := redis.NewArray()
+		nodes.Append(node)
+		shard := redis.NewArray()
+		shard.AppendBulkBytes([]byte("slots"))
+		shard.Append(slots)
+		shard.AppendBulkBytes([]byte("nodes"))
+		shard.Append(nodes)
+		resp.Append(shard)
+	}
+	return resp
+}
+
+// READONLY
+func (h *Handler) ReadOnly(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	return h.clusterNoop(arg0, args)
+}
+
+// READWRITE
+func (h *Handler) ReadWrite(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	return h.clusterNoop(arg0, args)
+}
+
+// clusterNoop accepts READONLY and READWRITE, every server is a master, so
+// they don't change what a connection is served.
+func (h *Handler) clusterNoop(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 0 {
+		return toRespErrorf("len(args) = %d, expect = 0", len(args))
+	}
+	if _, err := session(arg0, args); err != nil {
+		return toRespError(err)
+	}
+	if !h.clusterEnabled() {
+		return toRespError(errors.Trace(ErrClusterDisabled))
+	}
+	return redis.NewString("OK"), nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func TestClusterKeySlot(t *testing.T) {
+	checkerror(t, nil, crc16([]byte("123456789")) == 0x31c3)
+	checkerror(t, nil, clusterKeySlot([]byte("foo")) == 12182)
+	checkerror(t, nil, clusterKeySlot([]byte("bar")) == 5061)
+	checkerror(t, nil, clusterKeySlot([]byte("{user1000}.following")) == clusterKeySlot([]byte("{user1000}.followers")))
+	checkerror(t, nil, clusterKeySlot([]byte("{}foo")) != clusterKeySlot([]byte("foo")))
+}
+
+func TestClusterTopology(t *testing.T) {
+	const s = `
+# two servers
+127.0.0.1:7000 0-8191
+127.0.0.1:7001 8192-16000 16001 16002-16383
+`
+	c, err := parseClusterTopology(strings.NewReader(s), "127.0.0.1:7000")
+	checkerror(t, err, c != nil && len(c.nodes) == 2)
+	checkerror(t, nil, c.nodes[0].self && !c.nodes[1].self)
+	r := c.ranges()
+	checkerror(t, nil, len(r) == 2 && r[0].first == 0 && r[0].last == 8191 && r[1].first == 8192 && r[1].last == 16383)
+
+	for _, s := range []string{"127.0.0.1 0-10", "127.0.0.1:7000 10-0", "127.0.0.1:7000 0-16384", "127.0.0.1:7000 0-10 10"} {
+		_, err := parseClusterTopology(strings.NewReader(s), "127.0.0.1:7000")
+		checkerror(t, nil, err != nil)
+	}
+
+	owners := make([]rpdb.SlotOwner, rpdb.MaxSlotNum)
+	c, err = ownerTopology(owners, "127.0.0.1:7000")
+	checkerror(t, err, c != nil)
+	r = c.ranges()
+	checkerror(t, nil, len(r) == 1 && r[0].node.self && r[0].first == 0 && r[0].last == ClusterSlotNum-1)
+
+	for _, o := range []rpdb.SlotOwner{{rpdb.SlotForeign, "127.0.0.1:7001"}, {rpdb.SlotMigrating, "127.0.0.1:7001"}, {rpdb.SlotImporting, "127.0.0.1:7001"}} {
+		owners[2] = o
+		_, err = ownerTopology(owners, "127.0.0.1:7000")
+		checkerror(t, nil, err != nil)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	nc1, nc2 := net.Pipe()
+	defer nc1.Close()
+	c := newConn(context.Background(), nc2, testbl, 0)
+	defer c.Close()
+
+	h := &Handler{config: NewDefaultConfig()}
+	htable, err := redis.NewHandlerTable(h)
+	checkerror(t, err, true)
+	h.htable = htable
+
+	rsp, err := c.dispatch(h, request("cluster", "slots"))
+	checkerror(t, nil, err != nil && rsp != nil)
+	_, ok := rsp.(*redis.Error)
+	checkerror(t, nil, ok)
+
+	h.config.ClusterEnabled = true
+	rsp, err = c.dispatch(h, request("cluster", "keyslot", "foo"))
+	checkerror(t, err, rsp != nil)
+	i, ok := rsp.(*redis.Int)
+	checkerror(t, nil, ok && i.Value == 12182)
+
+	rsp, err = c.dispatch(h, request("cluster", "slots"))
+	checkerror(t, err, rsp != nil)
+	x, ok := rsp.(*redis.Array)
+	checkerror(t, nil, ok && len(x.Value) == 1)
+	r, ok := x.Value[0].(*redis.Array)
+	checkerror(t, nil, ok && len(r.Value) == 3)
+	checkerror(t, nil, r.Value[0].(*redis.Int).Value == 0 && r.Value[1].(*redis.Int).Value == ClusterSlotNum-1)
+	n, ok := r.Value[2].(*redis.Array)
+	checkerror(t, nil, ok && string(n.Value[0].(*redis.BulkBytes).Value) == "127.0.0.1" && n.Value[1].(*redis.Int).Value == 6380)
+
+	rsp, err = c.dispatch(h, request("cluster", "nodes"))
+	checkerror(t, err, rsp != nil)
+	b, ok := rsp.(*redis.BulkBytes)
+	checkerror(t, nil, ok && strings.Contains(string(b.Value), " 127.0.0.1:6380@16380 myself,master - 0 0 1 connected 0-16383\n"))
+
+	rsp, err = c.dispatch(h, request("cluster", "shards"))
+	checkerror(t, err, rsp != nil)
+	x, ok = rsp.(*redis.Array)
+	checkerror(t, nil, ok && len(x.Value) == 1)
+
+	rsp, err = c.dispatch(h, request("readonly"))
+	checkerror(t, err, rsp != nil)
+	_, ok = rsp.(*redis.String)
+	checkerror(t, nil, ok)
+
+	h.cluster, err = parseClusterTopology(strings.NewReader("127.0.0.1:7001 0-8191"), h.clusterAddr())
+	checkerror(t, err, true)
+	checkredirect(t, h, c, "MOVED 5061 127.0.0.1:7001", "get", "bar")
+	checkredirect(t, h, c, "CLUSTERDOWN Hash slot not served", "get", "foo")
+	h.cluster = nil
+
+	k := "{cluster}" + random(t)
+	slot := rpdb.HashTagToSlot([]byte("cluster"))
+	checkok(t, c, "slotsowner", "set", slot, slot, "node", "127.0.0.1:7000")
+	checkredirect(t, h, c, fmt.Sprintf("MOVED %d 127.0.0.1:7000", clusterKeySlot([]byte(k))), "get", k)
+	rsp, err = c.dispatch(h, request("cluster", "slots"))
+	checkerror(t, nil, err != nil && rsp != nil)
+	_, ok = rsp.(*redis.Error)
+	checkerror(t, nil, ok)
+	checkok(t, c, "slotsowner", "set", slot, slot, "owned")
+}
@@ -15,9 +15,37 @@ type Config struct {
 	DumpPath    string `toml:"dump_filepath"`
 	ConnTimeout int    `toml:"conn_timeout"`
 
+	CommandTimeout int `toml:"command_timeout"`
+
+	MigrateChunkSize int `toml:"migrate_chunk_size"`
+
+	Save            string `toml:"save"`
+	SaveRetainCount int    `toml:"save_retain_count"`
+	SaveRetainAge   int    `toml:"save_retain_age"`
+
+	BackupRetainCount int `toml:"backup_retain_count"`
+	BackupRetainAge   int `toml:"backup_retain_age"`
+
+	WALPath        string `toml:"wal_path"`
+	WALFileSize    int    `toml:"wal_file_size"`
+	WALRetainFiles int    `toml:"wal_retain_files"`
+	WALFsync       string `toml:"wal_fsync"`
+
 	SyncFilePath string `toml:"sync_file_path"`
 	SyncFileSize int    `toml:"sync_file_size"`
 	SyncBuffSize int    `toml:"sync_memory_buffer"`
+
+	SyncApplyWorkers int `toml:"sync_apply_workers"`
+
+	PubSubBuffSize int `toml:"pubsub_output_buffer"`
+
+	ReplBacklogSize int `toml:"repl_backlog_size"`
+
+	NotifyKeyspaceEvents string `toml:"notify_keyspace_events"`
+
+	ClusterEnabled  bool   `toml:"cluster_enabled"`
+	ClusterAnnounce string `toml:"cluster_announce_address"`
+	ClusterTopology string `toml:"cluster_topology_file"`
 }
 
 func NewDefaultConfig() *Config {
@@ -26,9 +54,23 @@ func NewDefaultConfig() *Config {
 		DumpPath:    "dump.rdb",
 		ConnTimeout: 900,
 
+		MigrateChunkSize: 1024,
+
+		SaveRetainCount: 24,
+
+		WALFileSize:    bytesize.MB * 256,
+		WALRetainFiles: 64,
+		WALFsync:       "everysec",
+
 		SyncFilePath: "sync.pipe",
 		SyncFileSize: bytesize.GB * 32,
 		SyncBuffSize: bytesize.MB * 32,
+
+		SyncApplyWorkers: 8,
+
+		PubSubBuffSize: bytesize.MB * 32,
+
+		ReplBacklogSize: bytesize.MB * 32,
 	}
 }
 
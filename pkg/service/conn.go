@@ -5,6 +5,7 @@ package service
 
 import (
 	"bufio"
+	"context"
 	"encoding/base64"
 	"fmt"
 	"net"
@@ -28,13 +29,30 @@ type conn struct {
 
 	summ    string
 	timeout time.Duration
+
+	ps    *subscriber
+	slave *replSlave
+	lport string
+
+	cdc *rpdb.ChangeStream
+
+	// asking is set by ASKING, for the next command only
+	asking bool
+
+	// quit is set by QUIT, the connection is closed once it's answered
+	quit bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	cmdctx context.Context
 }
 
-func newConn(nc net.Conn, bl *rpdb.Rpdb, timeout int) *conn {
+func newConn(ctx context.Context, nc net.Conn, bl *rpdb.Rpdb, timeout int) *conn {
 	c := &conn{
 		nc: nc,
 		bl: bl,
 	}
+	c.ctx, c.cancel = context.WithCancel(ctx)
 	c.r = bufio.NewReader(nc)
 	c.w = bufio.NewWriter(nc)
 	c.summ = fmt.Sprintf("<local> %s -- %s <remote>", nc.LocalAddr(), nc.RemoteAddr())
@@ -43,8 +61,11 @@ func newConn(nc net.Conn, bl *rpdb.Rpdb, timeout int) *conn {
 }
 
 func (c *conn) serve(h *Handler) error {
+	defer h.detachSubscriber(c)
+	defer h.detachReplica(c)
+	defer c.closeStream()
 	for {
-		if c.timeout != 0 {
+		if c.timeout != 0 && !c.isSubscribed() && c.slave == nil {
 			deadline := time.Now().Add(c.timeout)
 			if err := c.nc.SetReadDeadline(deadline); err != nil {
 				return errors.Trace(err)
@@ -61,7 +82,16 @@ func (c *conn) serve(h *Handler) error {
 			b, _ := redis.EncodeToBytes(request)
 			log.WarnErrorf(err, "handle commands failed, conn = %s, request = '%s'", c.summ, base64.StdEncoding.EncodeToString(b))
 		}
-		if response == nil {
+		if response == nil || c.slave != nil {
+			continue
+		}
+		if c.ps != nil {
+			if c.quit {
+				return c.ps.quit(response)
+			}
+			if err := c.ps.pushResp(response); err != nil {
+				return err
+			}
 			continue
 		}
 		if c.timeout != 0 {
@@ -76,6 +106,9 @@ func (c *conn) serve(h *Handler) error {
 		if err := errors.Trace(c.w.Flush()); err != nil {
 			return err
 		}
+		if c.quit {
+			return nil
+		}
 	}
 }
 
@@ -86,9 +119,105 @@ func (c *conn) dispatch(h *Handler, request redis.Resp) (redis.Resp, error) {
 	}
 	if f := h.htable[cmd]; f == nil {
 		return toRespErrorf("unknown command %s", cmd)
+	} else if c.isSubscribed() && !isSubscriberCommand(cmd) {
+		return toRespErrorf("command %s is not allowed in subscriber mode", cmd)
 	} else {
-		return f(c, args...)
+		asking := c.asking
+		c.asking = false
+		if rsp := h.redirect(c, cmd, args, asking); rsp != nil {
+			return rsp, nil
+		}
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if h.config != nil && h.config.CommandTimeout > 0 && !untimedCommands[cmd] {
+			ctx, cancel = context.WithTimeout(c.ctx, time.Duration(h.config.CommandTimeout)*time.Millisecond)
+		} else {
+			ctx, cancel = context.WithCancel(c.ctx)
+		}
+		defer cancel()
+		if cancelableCommands[cmd] {
+			defer c.watchClose(cancel)()
+		}
+		c.cmdctx = ctx
+		defer func() {
+			c.cmdctx = nil
+		}()
+		rsp, err := f(c, args...)
+		if err != nil && errors.Equal(err, rpdb.ErrKeyMigrated) {
+			// the keys have been migrated since they were checked
+			if x := h.redirect(c, cmd, args, asking); x != nil {
+				return x, nil
+			}
+		}
+		return rsp, err
+	}
+}
+
+// untimedCommands are not aborted by command_timeout, the client would get an
+// error once part of the work is done, which can't be undone.
+var untimedCommands = map[string]bool{
+	"slotsdel": true,
+}
+
+// cancelableCommands may run long on huge keys, they stop once the client is
+// disconnected.
+var cancelableCommands = map[string]bool{
+	"del":              true,
+	"hgetall":          true,
+	"hkeys":            true,
+	"hvals":            true,
+	"lrange":           true,
+	"smembers":         true,
+	"zgetall":          true,
+	"compactall":       true,
+	"slotsmgrtslot":    true,
+	"slotsmgrttagslot": true,
+	"slotsmgrtone":     true,
+	"slotsmgrttagone":  true,
+}
+
+// watchClose calls cancel if the client is disconnected before the returned
+// func is called. It peeks at the next request, so nothing is consumed.
+func (c *conn) watchClose(cancel context.CancelFunc) func() {
+	if c.r.Buffered() != 0 {
+		return func() {}
+	}
+	if err := c.nc.SetReadDeadline(time.Time{}); err != nil {
+		return func() {}
 	}
+	done := make(chan int)
+	go func() {
+		defer close(done)
+		if _, err := c.r.Peek(1); err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return
+			}
+			log.Infof("connection lost while running a command: %s", c.summ)
+			cancel()
+		}
+	}()
+	return func() {
+		c.nc.SetReadDeadline(time.Now())
+		<-done
+		c.nc.SetReadDeadline(time.Time{})
+	}
+}
+
+func (c *conn) isSubscribed() bool {
+	return c.ps != nil && c.ps.count() != 0
+}
+
+func (c *conn) writeBytes(b []byte) error {
+	if c.timeout != 0 {
+		deadline := time.Now().Add(c.timeout)
+		if err := c.nc.SetWriteDeadline(deadline); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if _, err := c.w.Write(b); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(c.w.Flush())
 }
 
 func (c *conn) ping() error {
@@ -122,35 +251,44 @@ func (c *conn) ping() error {
 	}
 }
 
-func (c *conn) presync() (int64, error) {
+func (c *conn) sendCommand(args ...string) error {
 	deadline := time.Now().Add(time.Second * 15)
 	if err := c.nc.SetDeadline(deadline); err != nil {
-		return 0, errors.Trace(err)
-	}
-	if _, err := c.w.WriteString("*1\r\n$4\r\nsync\r\n"); err != nil {
-		return 0, errors.Trace(err)
+		return errors.Trace(err)
 	}
-	if err := c.w.Flush(); err != nil {
-		return 0, errors.Trace(err)
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
 	}
+	return errors.Trace(c.w.Flush())
+}
+
+func (c *conn) readLine() (string, error) {
 	var rsp string
 	for !strings.HasSuffix(rsp, "\r\n") {
 		deadline := time.Now().Add(time.Second * 15)
 		if err := c.nc.SetDeadline(deadline); err != nil {
-			return 0, errors.Trace(err)
+			return "", errors.Trace(err)
 		}
 		b := []byte{0}
 		if _, err := c.r.Read(b); err != nil {
-			return 0, errors.Trace(err)
+			return "", errors.Trace(err)
 		}
 		if len(rsp) == 0 && b[0] == '\n' {
 			continue
 		}
 		rsp += string(b)
 	}
-	rsp = rsp[:len(rsp)-2]
+	return rsp[:len(rsp)-2], nil
+}
 
-	if rsp[0] != '$' {
+func (c *conn) readBulkSize() (int64, error) {
+	rsp, err := c.readLine()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(rsp) == 0 || rsp[0] != '$' {
 		return 0, errors.Errorf("invalid sync response, rsp = '%s'", rsp)
 	}
 
@@ -161,7 +299,60 @@ func (c *conn) presync() (int64, error) {
 	return int64(n), nil
 }
 
+// psync asks the master to continue from offset, and returns the replid and
+// offset the replication stream starts at, and whether an rdb follows.
+func (c *conn) psync(replid string, offset int64) (string, int64, bool, error) {
+	if replid == "" {
+		replid, offset = "?", -2
+	}
+	if err := c.sendCommand("psync", replid, strconv.FormatInt(offset+1, 10)); err != nil {
+		return "", 0, false, err
+	}
+	rsp, err := c.readLine()
+	if err != nil {
+		return "", 0, false, err
+	}
+	switch fields := strings.Fields(rsp); {
+	case len(fields) == 0:
+		return "", 0, false, errors.Errorf("invalid psync response, rsp = '%s'", rsp)
+	case fields[0] == "+FULLRESYNC" && len(fields) == 3:
+		n, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return "", 0, false, errors.Errorf("invalid psync response, rsp = '%s'", rsp)
+		}
+		return fields[1], n, true, nil
+	case fields[0] == "+CONTINUE":
+		if len(fields) == 2 {
+			replid = fields[1]
+		}
+		return replid, offset, false, nil
+	case strings.HasPrefix(rsp, "-"):
+		return "", 0, false, errors.Trace(ErrPSyncRejected)
+	default:
+		return "", 0, false, errors.Errorf("invalid psync response, rsp = '%s'", rsp)
+	}
+}
+
+func (c *conn) sendAck(offset int64) error {
+	s := strconv.FormatInt(offset, 10)
+	b := fmt.Sprintf("*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%s\r\n", len(s), s)
+	deadline := time.Now().Add(time.Second * 5)
+	if err := c.nc.SetWriteDeadline(deadline); err != nil {
+		return errors.Trace(err)
+	}
+	_, err := c.nc.Write([]byte(b))
+	return errors.Trace(err)
+}
+
+func (c *conn) closeStream() {
+	if c.cdc != nil {
+		c.cdc.Close()
+		c.cdc = nil
+	}
+}
+
 func (c *conn) Close() {
+	c.cancel()
 	c.nc.Close()
 }
 
@@ -176,3 +367,10 @@ func (c *conn) SetDB(db uint32) {
 func (c *conn) Rpdb() *rpdb.Rpdb {
 	return c.bl
 }
+
+func (c *conn) Context() context.Context {
+	if c.cmdctx != nil {
+		return c.cmdctx
+	}
+	return c.ctx
+}
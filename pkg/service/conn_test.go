@@ -0,0 +1,56 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func TestWatchClose(t *testing.T) {
+	nc1, nc2 := net.Pipe()
+	c := newConn(context.Background(), nc2, testbl, 0)
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	stop := c.watchClose(cancel)
+	w := bufio.NewWriter(nc1)
+	checkerror(t, redis.Encode(w, request("ping")), true)
+	checkerror(t, w.Flush(), true)
+	stop()
+	checkerror(t, nil, ctx.Err() == nil)
+	rsp, err := redis.Decode(c.r)
+	checkerror(t, err, rsp != nil)
+
+	stop = c.watchClose(cancel)
+	nc1.Close()
+	<-ctx.Done()
+	stop()
+}
+
+func TestCommandContext(t *testing.T) {
+	nc1, nc2 := net.Pipe()
+	defer nc1.Close()
+	c := newConn(context.Background(), nc2, testbl, 0)
+	defer c.Close()
+
+	h := &Handler{config: NewDefaultConfig()}
+	htable, err := redis.NewHandlerTable(h)
+	checkerror(t, err, true)
+	h.htable = htable
+
+	k := random(t)
+	checkint(t, 1, c, "hset", k, "field", "value")
+	_, err = c.dispatch(h, request("hgetall", k))
+	checkerror(t, err, c.cmdctx == nil)
+
+	c.cancel()
+	_, err = c.dispatch(h, request("hgetall", k))
+	checkerror(t, nil, err != nil)
+	checkint(t, 1, client(t), "del", k)
+}
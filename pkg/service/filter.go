@@ -0,0 +1,301 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+)
+
+// syncFilter selects and rewrites the data replicated from a master, it is
+// applied to both the rdb entries and the command stream. If into is set, all
+// the accepted dbs are loaded into that single db.
+type syncFilter struct {
+	dbs       map[uint32]bool
+	excludedb map[uint32]bool
+	match     [][]byte
+	exclude   [][]byte
+	mapdb     map[uint32]uint32
+	prefix    []byte
+	into      *uint32
+}
+
+func parseDB(arg []byte) (uint32, error) {
+	db, err := rpdb.ParseUint(arg)
+	if err != nil {
+		return 0, err
+	}
+	if db > math.MaxUint32 {
+		return 0, errors.Errorf("parse db = %d", db)
+	}
+	return uint32(db), nil
+}
+
+// parseSyncFilter parses the options of SLAVEOF, which are
+//   DB db | EXCLUDEDB db | MATCH pattern | EXCLUDE pattern | MAPDB src dst | PREFIX prefix
+// All of them but PREFIX can be given more than once. It returns nil if there
+// are no options.
+func parseSyncFilter(args [][]byte) (*syncFilter, error) {
+	if len(args) == 0 {
+		return nil, nil
+	}
+	f := &syncFilter{}
+	for len(args) != 0 {
+		opt := strings.ToLower(string(args[0]))
+		nargs := 1
+		if opt == "mapdb" {
+			nargs = 2
+		}
+		if len(args) < nargs+1 {
+			return nil, errors.Errorf("option %s expects %d arguments", opt, nargs)
+		}
+		switch opt {
+		default:
+			return nil, errors.Errorf("unknown option %s", opt)
+		case "db", "excludedb":
+			db, err := parseDB(args[1])
+			if err != nil {
+				return nil, err
+			}
+			if opt == "db" {
+				if f.dbs == nil {
+					f.dbs = make(map[uint32]bool)
+				}
+				f.dbs[db] = true
+			} else {
+				if f.excludedb == nil {
+					f.excludedb = make(map[uint32]bool)
+				}
+				f.excludedb[db] = true
+			}
+		case "match":
+			f.match = append(f.match, args[1])
+		case "exclude":
+			f.exclude = append(f.exclude, args[1])
+		case "mapdb":
+			src, err := parseDB(args[1])
+			if err != nil {
+				return nil, err
+			}
+			dst, err := parseDB(args[2])
+			if err != nil {
+				return nil, err
+			}
+			if f.mapdb == nil {
+				f.mapdb = make(map[uint32]uint32)
+			}
+			f.mapdb[src] = dst
+		case "prefix":
+			if f.prefix != nil {
+				return nil, errors.Errorf("option prefix is given more than once")
+			}
+			f.prefix = args[1]
+		}
+		args = args[nargs+1:]
+	}
+	return f, nil
+}
+
+func (f *syncFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	var opts []string
+	for _, x := range []struct {
+		name string
+		m    map[uint32]bool
+	}{{"db", f.dbs}, {"excludedb", f.excludedb}} {
+		var dbs []int
+		for db := range x.m {
+			dbs = append(dbs, int(db))
+		}
+		sort.Ints(dbs)
+		for _, db := range dbs {
+			opts = append(opts, fmt.Sprintf("%s %d", x.name, db))
+		}
+	}
+	for _, p := range f.match {
+		opts = append(opts, fmt.Sprintf("match %q", p))
+	}
+	for _, p := range f.exclude {
+		opts = append(opts, fmt.Sprintf("exclude %q", p))
+	}
+	var srcs []int
+	for src := range f.mapdb {
+		srcs = append(srcs, int(src))
+	}
+	sort.Ints(srcs)
+	for _, src := range srcs {
+		opts = append(opts, fmt.Sprintf("mapdb %d %d", src, f.mapdb[uint32(src)]))
+	}
+	if f.prefix != nil {
+		opts = append(opts, fmt.Sprintf("prefix %q", f.prefix))
+	}
+	if f.into != nil {
+		opts = append(opts, fmt.Sprintf("into %d", *f.into))
+	}
+	return strings.Join(opts, " ")
+}
+
+func (f *syncFilter) acceptDB(db uint32) bool {
+	if f.dbs != nil && !f.dbs[db] {
+		return false
+	}
+	return !f.excludedb[db]
+}
+
+func (f *syncFilter) acceptKey(key []byte) bool {
+	if len(f.match) != 0 {
+		var ok bool
+		for _, p := range f.match {
+			if matchPattern(p, key) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, p := range f.exclude {
+		if matchPattern(p, key) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *syncFilter) mapDB(db uint32) uint32 {
+	if f.into != nil {
+		return *f.into
+	}
+	if dst, ok := f.mapdb[db]; ok {
+		return dst
+	}
+	return db
+}
+
+func (f *syncFilter) mapKey(key []byte) []byte {
+	if f.prefix == nil {
+		return key
+	}
+	return append(append([]byte{}, f.prefix...), key...)
+}
+
+// receives tells whether the keys of the db dst are replicated from a db
+// accepted by the filter.
+func (f *syncFilter) receives(dst uint32) bool {
+	if f.into != nil {
+		return dst == *f.into
+	}
+	for src, x := range f.mapdb {
+		if x == dst && f.acceptDB(src) {
+			return true
+		}
+	}
+	_, mapped := f.mapdb[dst]
+	return !mapped && f.acceptDB(dst)
+}
+
+// acceptTarget tells whether key, as stored here, is replicated under the
+// filter.
+func (f *syncFilter) acceptTarget(key []byte) bool {
+	if !bytes.HasPrefix(key, f.prefix) {
+		return false
+	}
+	return f.acceptKey(key[len(f.prefix):])
+}
+
+// replicated tells whether key of the db dst is replicated under the filter.
+func (f *syncFilter) replicated(dst uint32, key []byte) bool {
+	return f.receives(dst) && f.acceptTarget(key)
+}
+
+// flush deletes the keys replicated from the db of the master, or from all
+// of its dbs if db is nil, which is how FLUSHDB and FLUSHALL apply under the
+// filter.
+func (f *syncFilter) flush(bl *rpdb.Rpdb, db *uint32) (int64, error) {
+	var dsts []uint32
+	if db != nil {
+		if !f.acceptDB(*db) {
+			return 0, nil
+		}
+		dsts = append(dsts, f.mapDB(*db))
+	} else {
+		dbs, err := bl.ListDBs()
+		if err != nil {
+			return 0, err
+		}
+		for _, dst := range dbs {
+			if f.receives(dst) {
+				dsts = append(dsts, dst)
+			}
+		}
+	}
+	match := f.acceptTarget
+	if len(f.match) == 0 && len(f.exclude) == 0 && f.prefix == nil {
+		match = nil
+	}
+	var n int64
+	for _, dst := range dsts {
+		c, err := bl.FlushDBWhere(dst, match)
+		if n += c; err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// entry filters and rewrites an rdb entry.
+func (f *syncFilter) entry(db uint32, key []byte) (uint32, []byte, bool) {
+	if !f.acceptDB(db) || !f.acceptKey(key) {
+		return 0, nil, false
+	}
+	return f.mapDB(db), f.mapKey(key), true
+}
+
+// command filters and rewrites a command of the stream. Multi-key commands
+// keep only the accepted keys, commands without keys are dropped, except for
+// keylessWrites which the applier handles.
+func (f *syncFilter) command(cmd string, db uint32, args [][]byte) (uint32, [][]byte, bool) {
+	if !f.acceptDB(db) {
+		return 0, nil, false
+	}
+	spec, ok := keySpecs[cmd]
+	if !ok {
+		return 0, nil, false
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	out := append([][]byte{}, args[:spec.first]...)
+	var n int
+	i := spec.first
+	for ; i <= last && i < len(args); i += spec.step {
+		if !f.acceptKey(args[i]) {
+			continue
+		}
+		end := i + spec.step
+		if end > len(args) {
+			end = len(args)
+		}
+		out = append(out, f.mapKey(args[i]))
+		out = append(out, args[i+1:end]...)
+		n++
+	}
+	if n == 0 {
+		return 0, nil, false
+	}
+	if i < len(args) {
+		out = append(out, args[i:]...)
+	}
+	return f.mapDB(db), out, true
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"testing"
+)
+
+func bargs(args ...string) [][]byte {
+	b := make([][]byte, len(args))
+	for i, arg := range args {
+		b[i] = []byte(arg)
+	}
+	return b
+}
+
+func TestParseSyncFilter(t *testing.T) {
+	f, err := parseSyncFilter(nil)
+	checkerror(t, err, f == nil)
+
+	f, err = parseSyncFilter(bargs("mapdb", "1", "2", "DB", "1", "match", "user:*", "prefix", "s1:", "excludedb", "3"))
+	checkerror(t, err, f != nil)
+	checkerror(t, nil, f.String() == `db 1 excludedb 3 match "user:*" mapdb 1 2 prefix "s1:"`)
+
+	_, err = parseSyncFilter(bargs("mapdb", "1"))
+	checkerror(t, nil, err != nil)
+	_, err = parseSyncFilter(bargs("db", "x"))
+	checkerror(t, nil, err != nil)
+	_, err = parseSyncFilter(bargs("unknown", "1"))
+	checkerror(t, nil, err != nil)
+	_, err = parseSyncFilter(bargs("prefix", "a", "prefix", "b"))
+	checkerror(t, nil, err != nil)
+}
+
+func TestSyncFilterEntry(t *testing.T) {
+	f, err := parseSyncFilter(bargs("excludedb", "2", "match", "a*", "exclude", "ab*", "mapdb", "1", "5", "prefix", "p:"))
+	checkerror(t, err, true)
+
+	db, key, ok := f.entry(1, []byte("a1"))
+	checkerror(t, nil, ok && db == 5 && string(key) == "p:a1")
+	db, key, ok = f.entry(0, []byte("a1"))
+	checkerror(t, nil, ok && db == 0 && string(key) == "p:a1")
+	_, _, ok = f.entry(2, []byte("a1"))
+	checkerror(t, nil, !ok)
+	_, _, ok = f.entry(1, []byte("ab"))
+	checkerror(t, nil, !ok)
+	_, _, ok = f.entry(1, []byte("b"))
+	checkerror(t, nil, !ok)
+}
+
+func TestSyncFilterCommand(t *testing.T) {
+	f, err := parseSyncFilter(bargs("db", "0", "match", "a*", "mapdb", "0", "3", "prefix", "p:"))
+	checkerror(t, err, true)
+
+	check := func(cmd string, args []string, expect []string) {
+		db, out, ok := f.command(cmd, 0, bargs(args...))
+		if expect == nil {
+			checkerror(t, nil, !ok)
+			return
+		}
+		checkerror(t, nil, ok && db == 3 && len(out) == len(expect))
+		for i := range expect {
+			checkerror(t, nil, string(out[i]) == expect[i])
+		}
+	}
+	check("set", []string{"a1", "v"}, []string{"p:a1", "v"})
+	check("set", []string{"b1", "v"}, nil)
+	check("mset", []string{"a1", "1", "b1", "2", "a2", "3"}, []string{"p:a1", "1", "p:a2", "3"})
+	check("del", []string{"b1", "a1"}, []string{"p:a1"})
+	check("slotsrestore", []string{"a1", "0", "x", "b1", "0", "y"}, []string{"p:a1", "0", "x"})
+	check("flushall", nil, nil)
+
+	_, _, ok := f.command("set", 1, bargs("a1", "v"))
+	checkerror(t, nil, !ok)
+}
+
+func TestSyncFilterInto(t *testing.T) {
+	f, err := parseSyncFilter(bargs("excludedb", "1"))
+	checkerror(t, err, true)
+	into := uint32(7)
+	f.into = &into
+	checkerror(t, nil, f.String() == "excludedb 1 into 7")
+
+	db, key, ok := f.entry(3, []byte("a"))
+	checkerror(t, nil, ok && db == 7 && string(key) == "a")
+	_, _, ok = f.entry(1, []byte("a"))
+	checkerror(t, nil, !ok)
+	db, _, ok = f.command("set", 0, bargs("a", "v"))
+	checkerror(t, nil, ok && db == 7)
+}
+
+func TestSyncFilterReplicated(t *testing.T) {
+	f, err := parseSyncFilter(bargs("excludedb", "2", "match", "a*", "mapdb", "1", "5", "prefix", "p:"))
+	checkerror(t, err, true)
+	checkerror(t, nil, f.replicated(0, []byte("p:a1")) && f.replicated(5, []byte("p:a1")))
+	checkerror(t, nil, !f.replicated(0, []byte("a1")) && !f.replicated(0, []byte("p:b1")))
+	checkerror(t, nil, !f.replicated(1, []byte("p:a1")) && !f.replicated(2, []byte("p:a1")))
+}
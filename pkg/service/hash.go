@@ -19,7 +19,7 @@ func (h *Handler) HGetAll(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 		return toRespError(err)
 	}
 
-	if a, err := s.Rpdb().HGetAll(s.DB(), iconvert(args)...); err != nil {
+	if a, err := s.Rpdb().HGetAllContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		resp := redis.NewArray()
@@ -149,7 +149,7 @@ func (h *Handler) HKeys(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 		return toRespError(err)
 	}
 
-	if a, err := s.Rpdb().HKeys(s.DB(), iconvert(args)...); err != nil {
+	if a, err := s.Rpdb().HKeysContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		resp := redis.NewArray()
@@ -171,7 +171,7 @@ func (h *Handler) HVals(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 		return toRespError(err)
 	}
 
-	if a, err := s.Rpdb().HVals(s.DB(), iconvert(args)...); err != nil {
+	if a, err := s.Rpdb().HValsContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		resp := redis.NewArray()
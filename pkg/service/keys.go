@@ -43,7 +43,7 @@ func (h *Handler) Del(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 		return toRespError(err)
 	}
 
-	if n, err := s.Rpdb().Del(s.DB(), iconvert(args)...); err != nil {
+	if n, err := s.Rpdb().DelContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		return redis.NewInt(n), nil
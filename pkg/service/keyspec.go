@@ -0,0 +1,63 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+// keySpec tells where the keys are in the arguments of a command: from args[first]
+// to args[last] with the given step, a negative last counts from the end.
+type keySpec struct {
+	first, last, step int
+}
+
+var keySpecs = map[string]keySpec{
+	"del": {0, -1, 1}, "dump": {0, 0, 1}, "exists": {0, 0, 1}, "type": {0, 0, 1},
+	"ttl": {0, 0, 1}, "pttl": {0, 0, 1}, "persist": {0, 0, 1}, "expire": {0, 0, 1},
+	"pexpire": {0, 0, 1}, "expireat": {0, 0, 1}, "pexpireat": {0, 0, 1}, "restore": {0, 0, 1},
+
+	"get": {0, 0, 1}, "set": {0, 0, 1}, "setex": {0, 0, 1}, "psetex": {0, 0, 1},
+	"setnx": {0, 0, 1}, "getset": {0, 0, 1}, "append": {0, 0, 1}, "strlen": {0, 0, 1},
+	"incr": {0, 0, 1}, "decr": {0, 0, 1}, "incrby": {0, 0, 1}, "decrby": {0, 0, 1},
+	"incrbyfloat": {0, 0, 1}, "getbit": {0, 0, 1}, "setbit": {0, 0, 1}, "getrange": {0, 0, 1},
+	"setrange": {0, 0, 1}, "mget": {0, -1, 1}, "mset": {0, -1, 2}, "msetnx": {0, -1, 2},
+
+	"hget": {0, 0, 1}, "hset": {0, 0, 1}, "hsetnx": {0, 0, 1}, "hmget": {0, 0, 1},
+	"hmset": {0, 0, 1}, "hdel": {0, 0, 1}, "hexists": {0, 0, 1}, "hlen": {0, 0, 1},
+	"hkeys": {0, 0, 1}, "hvals": {0, 0, 1}, "hgetall": {0, 0, 1}, "hincrby": {0, 0, 1},
+	"hincrbyfloat": {0, 0, 1},
+
+	"lindex": {0, 0, 1}, "llen": {0, 0, 1}, "lrange": {0, 0, 1}, "lset": {0, 0, 1},
+	"ltrim": {0, 0, 1}, "lpop": {0, 0, 1}, "rpop": {0, 0, 1}, "lpush": {0, 0, 1},
+	"lpushx": {0, 0, 1}, "rpush": {0, 0, 1}, "rpushx": {0, 0, 1},
+
+	"sadd": {0, 0, 1}, "scard": {0, 0, 1}, "sismember": {0, 0, 1}, "smembers": {0, 0, 1},
+	"spop": {0, 0, 1}, "srandmember": {0, 0, 1}, "srem": {0, 0, 1},
+
+	"zadd": {0, 0, 1}, "zcard": {0, 0, 1}, "zrem": {0, 0, 1}, "zscore": {0, 0, 1},
+	"zincrby": {0, 0, 1}, "zgetall": {0, 0, 1},
+
+	"slotsrestore": {0, -1, 3}, "slotsmgrtone": {3, 3, 1}, "slotsmgrttagone": {3, 3, 1},
+}
+
+// keylessWrites are the writes that take no keys, a filter can't tell which
+// keys they write.
+var keylessWrites = map[string]bool{
+	"flushdb": true, "flushall": true, "slotsdel": true,
+	"slotsrestorechunk": true, "slotsrestorecommit": true, "slotsrestoreabort": true,
+}
+
+// commandKeys returns the keys accessed by a command, ok is false for the
+// commands that are unknown or do not take keys.
+func commandKeys(cmd string, args [][]byte) (keys [][]byte, ok bool) {
+	spec, ok := keySpecs[cmd]
+	if !ok {
+		return nil, false
+	}
+	last := spec.last
+	if last < 0 {
+		last += len(args)
+	}
+	for i := spec.first; i <= last && i < len(args); i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys, len(keys) != 0
+}
@@ -52,7 +52,7 @@ func (h *Handler) LRange(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 		return toRespError(err)
 	}
 
-	if a, err := s.Rpdb().LRange(s.DB(), iconvert(args)...); err != nil {
+	if a, err := s.Rpdb().LRangeContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		resp := redis.NewArray()
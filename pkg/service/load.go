@@ -0,0 +1,282 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/counter"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/io/ioutils"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/rdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+// loadRDB streams the entries of the rdb read from r into bl, restoring them
+// on GOMAXPROCS goroutines. The filter is optional, progress is called every
+// second and once the rdb is loaded with the bytes read and the keys restored.
+func loadRDB(r io.Reader, bl *rpdb.Rpdb, filter *syncFilter, progress func(nread, nkeys int64)) error {
+	cr := ioutils.NewCountReader(r, nil)
+	l := rdb.NewLoader(cr)
+	if err := l.Header(); err != nil {
+		return err
+	}
+
+	ncpu := runtime.GOMAXPROCS(0)
+	errs := make(chan error, ncpu)
+
+	var lock sync.Mutex
+	var flag counter.Int64
+	var nread, nkeys counter.Int64
+	loadNextEntry := func() (*rdb.BinEntry, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if flag.Get() != 0 {
+			return nil, nil
+		}
+		entry, err := l.NextBinEntry()
+		nread.Set(cr.Count())
+		if err != nil || entry == nil {
+			flag.Set(1)
+			return nil, err
+		}
+		return entry, nil
+	}
+
+	for i := 0; i < ncpu; i++ {
+		go func() {
+			defer flag.Set(1)
+			for {
+				entry, err := loadNextEntry()
+				if err != nil || entry == nil {
+					errs <- err
+					return
+				}
+				db, key, value := entry.DB, entry.Key, entry.Value
+				if filter != nil {
+					var ok bool
+					if db, key, ok = filter.entry(db, key); !ok {
+						continue
+					}
+				}
+				ttlms := int64(0)
+				if entry.ExpireAt != 0 {
+					if v, ok := rpdb.ExpireAtToTTLms(entry.ExpireAt); ok && v > 0 {
+						ttlms = v
+					} else {
+						ttlms = 1
+					}
+				}
+				if err := bl.SlotsRestore(db, key, ttlms, value); err != nil {
+					errs <- err
+					return
+				}
+				nkeys.Add(1)
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-time.After(time.Second):
+			progress(nread.Get(), nkeys.Get())
+		case err := <-errs:
+			for i := 1; i < cap(errs); i++ {
+				e := <-errs
+				if err == nil && e != nil {
+					err = e
+				}
+			}
+			if err != nil {
+				return err
+			}
+			if err := l.Footer(); err != nil {
+				return err
+			}
+			progress(cr.Count(), nkeys.Get())
+			return nil
+		}
+	}
+}
+
+func openRDBFile(path string) (*os.File, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, errors.Trace(err)
+	}
+	return f, fi.Size(), nil
+}
+
+// LoadRDBFile loads the rdb file at path into bl, the existing data is reset
+// first if replace is set. It is meant to be used before serving.
+func LoadRDBFile(bl *rpdb.Rpdb, path string, replace bool) error {
+	f, size, err := openRDBFile(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if replace {
+		if err := bl.Reset(); err != nil {
+			return err
+		}
+	}
+	log.Infof("load rdb file '%s', size = %d, replace = %t", path, size, replace)
+	return loadRDB(bufio.NewReaderSize(f, 1024*1024), bl, nil, func(nread, nkeys int64) {
+		log.Infof("load rdb file '%s', %d/%d bytes, %d keys", path, nread, size, nkeys)
+	})
+}
+
+// loadState tracks the rdb file being loaded by LOADRDB, and the result of
+// the last one.
+type loadState struct {
+	mu      sync.Mutex
+	running bool
+	path    string
+	since   time.Time
+	size    int64
+
+	nread counter.Int64
+	nkeys counter.Int64
+
+	lastStatus string
+}
+
+func (l *loadState) start(path string, size int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running {
+		return errors.Errorf("loadrdb is busy, path = %s", l.path)
+	}
+	l.running, l.path, l.since, l.size = true, path, time.Now(), size
+	l.nread.Set(0)
+	l.nkeys.Set(0)
+	return nil
+}
+
+func (l *loadState) finish(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running = false
+	if err != nil {
+		l.lastStatus = "err"
+		log.WarnErrorf(err, "load rdb file '%s' failed", l.path)
+	} else {
+		l.lastStatus = "ok"
+		log.Infof("load rdb file '%s' done, keys = %d", l.path, l.nkeys.Get())
+	}
+}
+
+func (l *loadState) info(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running {
+		nread := l.nread.Get()
+		fmt.Fprintf(w, "loading:1\n")
+		fmt.Fprintf(w, "loading_path:%s\n", l.path)
+		fmt.Fprintf(w, "loading_start_time:%d\n", l.since.Unix())
+		fmt.Fprintf(w, "loading_total_bytes:%d\n", l.size)
+		fmt.Fprintf(w, "loading_loaded_bytes:%d\n", nread)
+		fmt.Fprintf(w, "loading_loaded_keys:%d\n", l.nkeys.Get())
+		if l.size != 0 {
+			fmt.Fprintf(w, "loading_loaded_perc:%.2f\n", float64(nread)*100/float64(l.size))
+		}
+	} else {
+		fmt.Fprintf(w, "loading:0\n")
+	}
+	if l.lastStatus != "" {
+		fmt.Fprintf(w, "loading_last_status:%s\n", l.lastStatus)
+	}
+}
+
+// LOADRDB path [MERGE|REPLACE]
+func (h *Handler) LoadRDB(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return toRespErrorf("len(args) = %d, expect = 1 or 2", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	var replace bool
+	if len(args) == 2 {
+		switch opt := strings.ToLower(string(args[1])); opt {
+		default:
+			return toRespErrorf("unknown option %s", opt)
+		case "merge":
+		case "replace":
+			replace = true
+		}
+	}
+
+	path := string(args[0])
+	f, size, err := openRDBFile(path)
+	if err != nil {
+		return toRespError(err)
+	}
+	if err := h.load.start(path, size); err != nil {
+		f.Close()
+		return toRespError(err)
+	}
+	log.Infof("load rdb file '%s', size = %d, replace = %t", path, size, replace)
+
+	go func() {
+		defer f.Close()
+		h.load.finish(h.loadRDBFile(s.Rpdb(), f, replace))
+	}()
+	return redis.NewString("Background loading started"), nil
+}
+
+// loadRDBFile loads the rdb file f in background. Merged entries overwrite
+// the existing keys. With replace, the rdb is loaded into a staging database
+// that takes the place of the current data once complete, the current data
+// is served read-only meanwhile. Without staging support, the data is reset
+// and reloaded in place.
+func (h *Handler) loadRDBFile(bl *rpdb.Rpdb, f *os.File, replace bool) error {
+	r := bufio.NewReaderSize(f, 1024*1024)
+	progress := func(nread, nkeys int64) {
+		h.load.nread.Set(nread)
+		h.load.nkeys.Set(nkeys)
+	}
+	if !replace {
+		return loadRDB(r, bl, nil, progress)
+	}
+
+	staging, err := bl.NewStaging()
+	if err != nil {
+		if !errors.Equal(err, rpdb.ErrStagingDisabled) {
+			return err
+		}
+		if err := bl.Reset(); err != nil {
+			return err
+		}
+		return loadRDB(r, bl, nil, progress)
+	}
+
+	if err := loadRDB(r, staging, nil, progress); err != nil {
+		bl.DiscardStaging(staging)
+		return err
+	}
+	if err := bl.Replace(staging); err != nil {
+		return err
+	}
+	h.repl.reset()
+	return nil
+}
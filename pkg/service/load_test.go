@@ -0,0 +1,35 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestLoadRDBFile(t *testing.T) {
+	c := client(t)
+	k := random(t)
+	checkok(t, c, "reset")
+	const max = 100
+	for i := 0; i < max; i++ {
+		checkok(t, c, "set", k+strconv.Itoa(i), i)
+	}
+	path := "/tmp/testdb-load.rdb"
+	checkok(t, c, "bgsaveto", path)
+
+	checkok(t, c, "reset")
+	checkok(t, c, "set", k, "merged")
+	checkerror(t, LoadRDBFile(testbl, path, false), true)
+	checkstring(t, "merged", c, "get", k)
+	for i := 0; i < max; i++ {
+		checkstring(t, strconv.Itoa(i), c, "get", k+strconv.Itoa(i))
+	}
+
+	checkok(t, c, "set", k, "replaced")
+	checkerror(t, LoadRDBFile(testbl, path, true), true)
+	checkint(t, 0, c, "exists", k)
+	checkstring(t, "0", c, "get", k+"0")
+	checkok(t, c, "reset")
+}
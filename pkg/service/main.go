@@ -4,6 +4,7 @@
 package service
 
 import (
+	"context"
 	"io"
 	"net"
 
@@ -17,10 +18,11 @@ import (
 func Serve(config *Config, bl *rpdb.Rpdb) error {
 	h := &Handler{
 		config: config,
-		master: make(chan *conn, 0),
 		signal: make(chan int, 0),
 	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
 	defer func() {
+		h.cancel()
 		close(h.signal)
 	}()
 
@@ -30,10 +32,57 @@ func Serve(config *Config, bl *rpdb.Rpdb) error {
 	}
 	defer l.Close()
 
+	if err := h.setNotifyFlags(config.NotifyKeyspaceEvents); err != nil {
+		return err
+	}
+	rules, err := parseSaveRules(config.Save)
+	if err != nil {
+		return err
+	}
+	walsync, err := rpdb.ParseWALSync(config.WALFsync)
+	if err != nil {
+		return err
+	}
+
+	h.bgsave.init(bl.Writes())
+	bl.SetMigrateChunkSize(config.MigrateChunkSize)
+
+	if config.WALPath != "" {
+		w, err := rpdb.OpenWAL(config.WALPath, int64(config.WALFileSize), config.WALRetainFiles)
+		if err != nil {
+			return err
+		}
+		w.SetSync(walsync)
+		if err := redoWAL(bl, w); err != nil {
+			w.Close()
+			return err
+		}
+		if err := bl.SetWAL(w); err != nil {
+			w.Close()
+			return err
+		}
+		h.wal = w
+	}
+
+	if config.ClusterEnabled && config.ClusterTopology != "" {
+		if h.cluster, err = loadClusterTopology(config.ClusterTopology, h.clusterAddr()); err != nil {
+			return err
+		}
+	}
+
+	bl.OnCommit(h.notifyKeyspaceEvent)
+	bl.OnCommit(h.repl.feed)
+
 	if h.htable, err = redis.NewHandlerTable(h); err != nil {
 		return err
 	} else {
-		go h.daemonSyncMaster()
+		go h.daemonReplPing()
+		if h.wal != nil && walsync == rpdb.WALSyncEverySec {
+			go h.daemonSyncWAL()
+		}
+		if len(rules) != 0 {
+			go h.daemonSaveRules(bl, rules)
+		}
 	}
 
 	log.Infof("open listen address '%s' and start service", l.Addr())
@@ -46,7 +95,7 @@ func Serve(config *Config, bl *rpdb.Rpdb) error {
 			go func() {
 				h.counters.clients.Add(1)
 				defer h.counters.clients.Sub(1)
-				c := newConn(nc, bl, h.config.ConnTimeout)
+				c := newConn(h.ctx, nc, bl, h.config.ConnTimeout)
 				defer c.Close()
 				log.Infof("new connection: %s", c.summ)
 				if err := c.serve(h); err != nil {
@@ -67,28 +116,54 @@ type Session interface {
 	DB() uint32
 	SetDB(db uint32)
 	Rpdb() *rpdb.Rpdb
+
+	// Context is done once the command running should stop.
+	Context() context.Context
 }
 
 type Handler struct {
 	config *Config
 	htable redis.HandlerTable
 
-	syncto string
-	master chan *conn
 	signal chan int
 
+	// ctx is canceled on SHUTDOWN, it aborts the commands running
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	sources syncSources
+
+	pubsub pubsubHub
+	notify int32
+
+	repl replBacklog
+
+	bgsave bgsaveState
+	backup backupState
+	load   loadState
+	mgrt   mgrtState
+	wal    *rpdb.WAL
+
+	// cluster is the static topology of cluster_topology_file, if any
+	cluster *clusterTopology
+
 	counters struct {
 		bgsave          counter.Int64
 		clients         counter.Int64
 		clientsAccepted counter.Int64
 		commands        counter.Int64
 		commandsFailed  counter.Int64
-		syncRdbRemains  counter.Int64
-		syncTotalBytes  counter.Int64
-		syncCacheBytes  counter.Int64
 	}
 }
 
+// context returns the context canceled on SHUTDOWN.
+func (h *Handler) context() context.Context {
+	if h.ctx == nil {
+		return context.Background()
+	}
+	return h.ctx
+}
+
 func toRespError(err error) (redis.Resp, error) {
 	return redis.NewError(err), err
 }
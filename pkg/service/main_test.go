@@ -5,6 +5,7 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math"
 	"math/rand"
@@ -41,6 +42,10 @@ func (s *fakeSession) Rpdb() *rpdb.Rpdb {
 	return testbl
 }
 
+func (s *fakeSession) Context() context.Context {
+	return context.Background()
+}
+
 func reinit() {
 	if testbl != nil {
 		testbl.Close()
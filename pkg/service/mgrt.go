@@ -0,0 +1,330 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/counter"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+var (
+	ErrMgrtCanceled = errors.Static("slot migration has been canceled")
+)
+
+const (
+	mgrtDefaultBatch = 100
+	mgrtMaxRetries   = 10
+	mgrtRetryDelay   = time.Second
+)
+
+// mgrtJob migrates a range of slots to another server in the background, in
+// batches of keys. It is throttled to keysPerSec and bytesPerSec, 0 means no
+// limit, and it retries a failed batch up to mgrtMaxRetries times in a row.
+type mgrtJob struct {
+	addr    string
+	db      uint32
+	timeout time.Duration
+
+	first, last uint32
+	batch       int
+
+	keysPerSec  int64
+	bytesPerSec int64
+
+	since time.Time
+	slot  counter.Int64
+
+	keys   counter.Int64
+	bytes  counter.Int64
+	errors counter.Int64
+
+	mu      sync.Mutex
+	lastErr error
+	status  string
+
+	stop chan int
+	done chan int
+}
+
+// mgrtState tracks the running migration job, or the last one.
+type mgrtState struct {
+	mu  sync.Mutex
+	job *mgrtJob
+}
+
+func (m *mgrtState) start(job *mgrtJob) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j := m.job; j != nil {
+		select {
+		case <-j.done:
+		default:
+			return errors.Errorf("slot migration is busy, slots = [%d,%d]", j.first, j.last)
+		}
+	}
+	job.since, job.status = time.Now(), "running"
+	job.stop, job.done = make(chan int), make(chan int)
+	job.slot.Set(int64(job.first))
+	m.job = job
+	return nil
+}
+
+func (m *mgrtState) cancel() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.job == nil {
+		return false
+	}
+	select {
+	case <-m.job.done:
+		return false
+	case <-m.job.stop:
+	default:
+		close(m.job.stop)
+	}
+	return true
+}
+
+func (m *mgrtState) info(w io.Writer) {
+	m.mu.Lock()
+	job := m.job
+	m.mu.Unlock()
+	if job == nil {
+		fmt.Fprintf(w, "mgrt_status:none\n")
+		return
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	fmt.Fprintf(w, "mgrt_status:%s\n", job.status)
+	fmt.Fprintf(w, "mgrt_addr:%s\n", job.addr)
+	fmt.Fprintf(w, "mgrt_db:%d\n", job.db)
+	fmt.Fprintf(w, "mgrt_slots:%d-%d\n", job.first, job.last)
+	fmt.Fprintf(w, "mgrt_current_slot:%d\n", job.slot.Get())
+	fmt.Fprintf(w, "mgrt_start_time:%d\n", job.since.Unix())
+	fmt.Fprintf(w, "mgrt_keys:%d\n", job.keys.Get())
+	fmt.Fprintf(w, "mgrt_bytes:%d\n", job.bytes.Get())
+	fmt.Fprintf(w, "mgrt_errors:%d\n", job.errors.Get())
+	if job.lastErr != nil {
+		fmt.Fprintf(w, "mgrt_last_error:%s\n", strings.Replace(job.lastErr.Error(), "\n", " ", -1))
+	}
+}
+
+func (j *mgrtJob) setStatus(status string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if status != "" {
+		j.status = status
+	}
+	if err != nil {
+		j.lastErr = err
+	}
+}
+
+// run migrates the slots, it returns once they are empty, or ctx is done or
+// the job is canceled.
+func (j *mgrtJob) run(ctx context.Context, bl *rpdb.Rpdb) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-j.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	retries := 0
+	for slot := j.first; slot <= j.last; {
+		j.slot.Set(int64(slot))
+		n, nbytes, err := bl.MigrateSlotBatch(ctx, j.addr, j.timeout, j.db, slot, j.batch)
+		if err != nil {
+			if err := j.stopped(ctx); err != nil {
+				return err
+			}
+			j.errors.Incr()
+			j.setStatus("", err)
+			log.WarnErrorf(err, "migrate slot %d to %s failed, retries = %d", slot, j.addr, retries)
+			if retries++; retries > mgrtMaxRetries {
+				return err
+			}
+			if err := j.sleep(ctx, mgrtRetryDelay); err != nil {
+				return err
+			}
+			continue
+		}
+		retries = 0
+		if n == 0 {
+			slot++
+			continue
+		}
+		j.keys.Add(n)
+		j.bytes.Add(nbytes)
+		if err := j.sleep(ctx, j.throttle()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// throttle returns how long the job is ahead of its rate limits.
+func (j *mgrtJob) throttle() time.Duration {
+	var d time.Duration
+	if j.keysPerSec > 0 {
+		d = time.Duration(j.keys.Get() * int64(time.Second) / j.keysPerSec)
+	}
+	if j.bytesPerSec > 0 {
+		if v := time.Duration(j.bytes.Get() * int64(time.Second) / j.bytesPerSec); v > d {
+			d = v
+		}
+	}
+	return d - time.Since(j.since)
+}
+
+func (j *mgrtJob) sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return j.stopped(ctx)
+	}
+}
+
+// stopped returns the reason the job stops, if ctx is done.
+func (j *mgrtJob) stopped(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	select {
+	case <-j.stop:
+		return errors.Trace(ErrMgrtCanceled)
+	default:
+		return errors.Trace(ctx.Err())
+	}
+}
+
+func (h *Handler) startMgrt(bl *rpdb.Rpdb, job *mgrtJob) error {
+	if err := h.mgrt.start(job); err != nil {
+		return err
+	}
+	log.Infof("migrate slots [%d,%d] of db %d to %s", job.first, job.last, job.db, job.addr)
+	go func() {
+		defer close(job.done)
+		err := job.run(h.context(), bl)
+		switch {
+		case err == nil:
+			job.setStatus("done", nil)
+			log.Infof("migrate slots [%d,%d] to %s done, keys = %d, bytes = %d", job.first, job.last, job.addr, job.keys.Get(), job.bytes.Get())
+		case errors.Equal(err, ErrMgrtCanceled):
+			job.setStatus("canceled", nil)
+			log.Infof("migrate slots [%d,%d] to %s canceled", job.first, job.last, job.addr)
+		default:
+			job.setStatus("failed", err)
+			log.WarnErrorf(err, "migrate slots [%d,%d] to %s failed", job.first, job.last, job.addr)
+		}
+	}()
+	return nil
+}
+
+// SLOTSMGRTJOB START host port timeout slot endslot [KEYSPERSEC n] [BYTESPERSEC n] [BATCH n]
+// SLOTSMGRTJOB STATUS / SLOTSMGRTJOB CANCEL
+func (h *Handler) SlotsMgrtJob(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	sub, args := strings.ToLower(string(args[0])), args[1:]
+	switch sub {
+	default:
+		return toRespErrorf("unknown sub-command %s", sub)
+	case "status":
+		if len(args) != 0 {
+			return toRespErrorf("len(args) = %d, expect = 1", len(args)+1)
+		}
+		var b bytes.Buffer
+		h.mgrt.info(&b)
+		return redis.NewBulkBytes(b.Bytes()), nil
+	case "cancel":
+		if len(args) != 0 {
+			return toRespErrorf("len(args) = %d, expect = 1", len(args)+1)
+		}
+		if !h.mgrt.cancel() {
+			return toRespErrorf("no slot migration in progress")
+		}
+		return redis.NewString("OK"), nil
+	case "start":
+		if len(args) < 5 || len(args)%2 != 1 {
+			return toRespErrorf("len(args) = %d, expect = 6 or 8 or 10 or 12", len(args)+1)
+		}
+		job, err := parseMgrtJob(s.DB(), args)
+		if err != nil {
+			return toRespError(err)
+		}
+		if err := h.startMgrt(s.Rpdb(), job); err != nil {
+			return toRespError(err)
+		}
+		return redis.NewString("Background slot migration started"), nil
+	}
+}
+
+func parseMgrtJob(db uint32, args [][]byte) (*mgrtJob, error) {
+	var v [4]uint64
+	for i := range v {
+		x, err := rpdb.ParseUint(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		v[i] = x
+	}
+	job := &mgrtJob{
+		addr: fmt.Sprintf("%s:%d", args[0], v[0]), db: db,
+		timeout: time.Duration(v[1]) * time.Millisecond,
+		first:   uint32(v[2]), last: uint32(v[3]),
+		batch: mgrtDefaultBatch,
+	}
+	if job.timeout == 0 {
+		job.timeout = time.Second
+	}
+	if v[2] > v[3] || v[3] >= rpdb.MaxSlotNum {
+		return nil, errors.Errorf("invalid slots = [%d,%d]", v[2], v[3])
+	}
+	for i := 5; i < len(args); i += 2 {
+		x, err := rpdb.ParseUint(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		switch opt := strings.ToLower(string(args[i])); opt {
+		default:
+			return nil, errors.Errorf("unknown option %s", opt)
+		case "keyspersec":
+			job.keysPerSec = int64(x)
+		case "bytespersec":
+			job.bytesPerSec = int64(x)
+		case "batch":
+			if x == 0 {
+				return nil, errors.Errorf("invalid batch = %d", x)
+			}
+			job.batch = int(x)
+		}
+	}
+	return job, nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func mgrtstatus(t *testing.T, c Session) []byte {
+	rsp, err := server.Dispatch(c, request("slotsmgrtjob", "status"))
+	checkerror(t, err, rsp != nil)
+	x, ok := rsp.(*redis.BulkBytes)
+	checkerror(t, nil, ok)
+	return x.Value
+}
+
+func checkmgrtstatus(t *testing.T, c Session, expect string) {
+	for i := 0; i < 50; i++ {
+		b := mgrtstatus(t, c)
+		if bytes.Contains(b, []byte("mgrt_status:"+expect+"\n")) {
+			return
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	checkerror(t, nil, false)
+}
+
+func TestSlotsMgrtJob(t *testing.T) {
+	c := client(t)
+	k1 := "{mgrtjob}" + random(t)
+	k2 := "{mgrtjob}" + random(t)
+	checkok(t, c, "mset", k1, "1", k2, "2")
+	checkok(t, c, "sadd", k1+"set", "a", "b")
+
+	slot := rpdb.HashTagToSlot([]byte("mgrtjob"))
+	checkstring(t, "Background slot migration started", c, "slotsmgrtjob", "start", "127.0.0.1", port, 1000, slot, slot, "keyspersec", 1000, "batch", 2)
+	checkmgrtstatus(t, c, "done")
+
+	checkint(t, 0, c, "exists", k1)
+	checkint(t, 0, c, "exists", k2)
+	xcheck2(t, 0, k1, "1")
+	xcheck2(t, 0, k2, "2")
+	checkset(t, &fakeSession2{}, k1+"set", []string{"a", "b"})
+
+	b := mgrtstatus(t, c)
+	checkerror(t, nil, bytes.Contains(b, []byte("mgrt_keys:3\n")))
+	checkerror(t, nil, bytes.Contains(b, []byte("mgrt_errors:0\n")))
+}
@@ -12,8 +12,27 @@ import (
 	"github.com/wandoulabs/redis-port/pkg/redis"
 )
 
-// PING
+// PING [message]
 func (h *Handler) Ping(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) > 1 {
+		return toRespErrorf("len(args) = %d, expect <= 1", len(args))
+	}
+
+	_, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+	if c, ok := arg0.(*conn); ok && c.isSubscribed() {
+		return subscriberPing(args), nil
+	}
+	if len(args) != 0 {
+		return redis.NewBulkBytes(args[0]), nil
+	}
+	return redis.NewString("PONG"), nil
+}
+
+// QUIT
+func (h *Handler) Quit(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 	if len(args) != 0 {
 		return toRespErrorf("len(args) = %d, expect = 0", len(args))
 	}
@@ -22,7 +41,10 @@ func (h *Handler) Ping(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 	if err != nil {
 		return toRespError(err)
 	}
-	return redis.NewString("PONG"), nil
+	if c, ok := arg0.(*conn); ok {
+		c.quit = true
+	}
+	return redis.NewString("OK"), nil
 }
 
 // ECHO text
@@ -56,6 +78,29 @@ func (h *Handler) Reset(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 	}
 }
 
+// FLUSHALL
+func (h *Handler) FlushAll(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	return h.Reset(arg0, args)
+}
+
+// FLUSHDB
+func (h *Handler) FlushDB(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 0 {
+		return toRespErrorf("len(args) = %d, expect = 0", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if _, err := s.Rpdb().FlushDB(s.DB()); err != nil {
+		return toRespError(err)
+	} else {
+		return redis.NewString("OK"), nil
+	}
+}
+
 // COMPACTALL
 func (h *Handler) CompactAll(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 	if len(args) != 0 {
@@ -67,7 +112,7 @@ func (h *Handler) CompactAll(arg0 interface{}, args [][]byte) (redis.Resp, error
 		return toRespError(err)
 	}
 
-	if err := s.Rpdb().CompactAll(); err != nil {
+	if err := s.Rpdb().CompactAllContext(s.Context()); err != nil {
 		return toRespError(err)
 	} else {
 		return redis.NewString("OK"), nil
@@ -85,6 +130,10 @@ func (h *Handler) Shutdown(arg0 interface{}, args [][]byte) (redis.Resp, error)
 		return toRespError(err)
 	}
 
+	// abort the commands running, so that they release the rpdb lock
+	if h.cancel != nil {
+		h.cancel()
+	}
 	s.Rpdb().Close()
 	os.Exit(0)
 	return nil, nil
@@ -113,16 +162,57 @@ func (h *Handler) Info(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 		fmt.Fprintf(&b, "%s\n", h.config)
 		fmt.Fprintf(&b, "\n")
 
+		src := h.getSource(slaveOfSource)
+		if src == nil {
+			src = &syncSource{}
+		}
 		fmt.Fprintf(&b, "# Clients\n")
-		fmt.Fprintf(&b, "syncto:%s\n", h.syncto)
+		fmt.Fprintf(&b, "syncto:%s\n", src.addr)
 		fmt.Fprintf(&b, "bgsave:%d\n", h.counters.bgsave.Get())
 		fmt.Fprintf(&b, "clients:%d\n", h.counters.clients.Get())
 		fmt.Fprintf(&b, "clients_accepted:%d\n", h.counters.clientsAccepted.Get())
 		fmt.Fprintf(&b, "commands:%d\n", h.counters.commands.Get())
 		fmt.Fprintf(&b, "commands_failed:%d\n", h.counters.commandsFailed.Get())
-		fmt.Fprintf(&b, "sync_rdb_remains:%d\n", h.counters.syncRdbRemains.Get())
-		fmt.Fprintf(&b, "sync_total_bytes:%d\n", h.counters.syncTotalBytes.Get())
-		fmt.Fprintf(&b, "sync_cache_bytes:%d\n", h.counters.syncCacheBytes.Get())
+		fmt.Fprintf(&b, "sync_rdb_remains:%d\n", src.counters.rdbRemains.Get())
+		fmt.Fprintf(&b, "sync_total_bytes:%d\n", src.counters.totalBytes.Get())
+		fmt.Fprintf(&b, "sync_cache_bytes:%d\n", src.counters.cacheBytes.Get())
+		fmt.Fprintf(&b, "sync_apply_queue:%d\n", src.counters.applyQueue.Get())
+		fmt.Fprintf(&b, "sync_apply_lag_bytes:%d\n", src.counters.applyLagBytes.Get())
+		fmt.Fprintf(&b, "sync_apply_lag_ms:%d\n", src.counters.applyLagMs.Get())
+		fmt.Fprintf(&b, "\n")
+
+		fmt.Fprintf(&b, "# Sources\n")
+		for _, src := range h.listSources() {
+			fmt.Fprintf(&b, "source_%s:%s\n", src.name, src)
+		}
+		fmt.Fprintf(&b, "\n")
+
+		fmt.Fprintf(&b, "# Persistence\n")
+		h.bgsave.info(&b)
+		h.backup.info(&b)
+		h.load.info(&b)
+		h.infoWAL(&b)
+		fmt.Fprintf(&b, "\n")
+
+		fmt.Fprintf(&b, "# Replication\n")
+		h.infoReplication(&b)
+		fmt.Fprintf(&b, "\n")
+
+		fmt.Fprintf(&b, "# Migration\n")
+		h.mgrt.info(&b)
+		fmt.Fprintf(&b, "\n")
+
+		fmt.Fprintf(&b, "# PubSub\n")
+		fmt.Fprintf(&b, "pubsub_channels:%d\n", h.pubsub.numChannels())
+		fmt.Fprintf(&b, "pubsub_patterns:%d\n", h.pubsub.numPatterns())
+		fmt.Fprintf(&b, "\n")
+
+		fmt.Fprintf(&b, "# Cluster\n")
+		if h.clusterEnabled() {
+			fmt.Fprintf(&b, "cluster_enabled:1\n")
+		} else {
+			fmt.Fprintf(&b, "cluster_enabled:0\n")
+		}
 		fmt.Fprintf(&b, "\n")
 		return redis.NewString(b.String()), nil
 	}
@@ -145,14 +235,32 @@ func (h *Handler) Config(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 	default:
 		return toRespErrorf("unknown sub-command = %s", sub)
 	case "get":
-		if len(args) != 2 {
-			return toRespErrorf("len(args) = %d, expect = 2", len(args))
+		if len(args) != 1 {
+			return toRespErrorf("len(args) = %d, expect = 1", len(args))
 		}
-		switch e := strings.ToLower(string(args[1])); e {
+		switch e := strings.ToLower(string(args[0])); e {
 		default:
 			return toRespErrorf("unknown entry %s", e)
 		case "maxmemory":
 			return redis.NewString("0"), nil
+		case "notify-keyspace-events":
+			resp := redis.NewArray()
+			resp.AppendBulkBytes([]byte(e))
+			resp.AppendBulkBytes([]byte(formatNotifyFlags(h.getNotifyFlags())))
+			return resp, nil
+		}
+	case "set":
+		if len(args) != 2 {
+			return toRespErrorf("len(args) = %d, expect = 2", len(args))
+		}
+		switch e := strings.ToLower(string(args[0])); e {
+		default:
+			return toRespErrorf("unknown entry %s", e)
+		case "notify-keyspace-events":
+			if err := h.setNotifyFlags(string(args[1])); err != nil {
+				return toRespError(err)
+			}
+			return redis.NewString("OK"), nil
 		}
 	}
 }
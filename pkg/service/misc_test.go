@@ -8,6 +8,7 @@ import "testing"
 func TestPing(t *testing.T) {
 	c := client(t)
 	checkstring(t, "PONG", c, "ping")
+	checkbytes(t, []byte("hello"), c, "ping", "hello")
 }
 
 func TestEcho(t *testing.T) {
@@ -0,0 +1,179 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+)
+
+const (
+	notifyKeyspace = 1 << iota
+	notifyKeyevent
+	notifyGeneric
+	notifyString
+	notifyList
+	notifySet
+	notifyHash
+	notifyZSet
+	notifyExpired
+	notifyEvicted
+
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZSet | notifyExpired | notifyEvicted
+)
+
+func parseNotifyFlags(s string) (int32, error) {
+	var flags int32
+	for _, c := range s {
+		switch c {
+		case 'A':
+			flags |= notifyAll
+		case 'g':
+			flags |= notifyGeneric
+		case '$':
+			flags |= notifyString
+		case 'l':
+			flags |= notifyList
+		case 's':
+			flags |= notifySet
+		case 'h':
+			flags |= notifyHash
+		case 'z':
+			flags |= notifyZSet
+		case 'x':
+			flags |= notifyExpired
+		case 'e':
+			flags |= notifyEvicted
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		default:
+			return 0, errors.Errorf("invalid notify-keyspace-events flag '%c'", c)
+		}
+	}
+	return flags, nil
+}
+
+func formatNotifyFlags(flags int32) string {
+	var b bytes.Buffer
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	} else {
+		for _, x := range []struct {
+			flag int32
+			c    byte
+		}{
+			{notifyGeneric, 'g'}, {notifyString, '$'}, {notifyList, 'l'}, {notifySet, 's'},
+			{notifyHash, 'h'}, {notifyZSet, 'z'}, {notifyExpired, 'x'}, {notifyEvicted, 'e'},
+		} {
+			if flags&x.flag != 0 {
+				b.WriteByte(x.c)
+			}
+		}
+	}
+	if flags&notifyKeyspace != 0 {
+		b.WriteByte('K')
+	}
+	if flags&notifyKeyevent != 0 {
+		b.WriteByte('E')
+	}
+	return b.String()
+}
+
+func (h *Handler) setNotifyFlags(s string) error {
+	flags, err := parseNotifyFlags(s)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&h.notify, flags)
+	return nil
+}
+
+func (h *Handler) getNotifyFlags() int32 {
+	return atomic.LoadInt32(&h.notify)
+}
+
+func forwardEvent(fw *rpdb.Forward) (string, int32) {
+	switch fw.Op {
+	case "Del":
+		return "del", notifyGeneric
+	case "Expired":
+		return "expired", notifyExpired
+	case "PExpireAt":
+		return "expire", notifyGeneric
+	case "Persist":
+		return "persist", notifyGeneric
+	case "Restore", "SlotsRestore", "SlotsRestoreCommit":
+		return "restore", notifyGeneric
+	case "Set", "SetEX", "MSet":
+		return "set", notifyString
+	case "Append":
+		return "append", notifyString
+	case "IncrBy":
+		return "incrby", notifyString
+	case "IncrByFloat":
+		return "incrbyfloat", notifyString
+	case "SetBit":
+		return "setbit", notifyString
+	case "SetRange":
+		return "setrange", notifyString
+	case "HSet", "HMSet":
+		return "hset", notifyHash
+	case "HDel":
+		return "hdel", notifyHash
+	case "HIncrBy":
+		return "hincrby", notifyHash
+	case "HIncrByFloat":
+		return "hincrbyfloat", notifyHash
+	case "LPush":
+		return "lpush", notifyList
+	case "RPush":
+		return "rpush", notifyList
+	case "LPop":
+		return "lpop", notifyList
+	case "RPop":
+		return "rpop", notifyList
+	case "LSet":
+		return "lset", notifyList
+	case "LTrim":
+		return "ltrim", notifyList
+	case "SAdd":
+		return "sadd", notifySet
+	case "SRem":
+		return "srem", notifySet
+	case "ZAdd":
+		return "zadd", notifyZSet
+	case "ZRem":
+		return "zrem", notifyZSet
+	case "ZIncrBy":
+		return "zincr", notifyZSet
+	}
+	return "", 0
+}
+
+func (h *Handler) notifyKeyspaceEvent(fw *rpdb.Forward) {
+	flags := h.getNotifyFlags()
+	if flags&(notifyKeyspace|notifyKeyevent) == 0 {
+		return
+	}
+	event, class := forwardEvent(fw)
+	if flags&class == 0 {
+		return
+	}
+	for _, key := range fw.Keys() {
+		if flags&notifyKeyspace != 0 {
+			channel := fmt.Sprintf("__keyspace@%d__:%s", fw.DB, key)
+			h.pubsub.publish([]byte(channel), []byte(event))
+		}
+		if flags&notifyKeyevent != 0 {
+			channel := fmt.Sprintf("__keyevent@%d__:%s", fw.DB, event)
+			h.pubsub.publish([]byte(channel), key)
+		}
+	}
+}
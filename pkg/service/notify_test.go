@@ -0,0 +1,41 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+)
+
+func TestNotifyFlags(t *testing.T) {
+	for _, s := range []string{"", "AKE", "g$K", "lxE", "hE"} {
+		flags, err := parseNotifyFlags(s)
+		checkerror(t, err, formatNotifyFlags(flags) == s)
+	}
+	_, err := parseNotifyFlags("KQ")
+	checkerror(t, nil, err != nil)
+}
+
+func TestNotifyKeyspaceEvent(t *testing.T) {
+	h := newPubSubHandler(t)
+	checkerror(t, h.setNotifyFlags("KEA"), true)
+
+	c := newPubSubClient(t, h)
+	c.send(t, "subscribe", "__keyspace@0__:foo", "__keyevent@1__:expired")
+	c.expect(t, "subscribe", "__keyspace@0__:foo", "1")
+	c.expect(t, "subscribe", "__keyevent@1__:expired", "2")
+
+	h.notifyKeyspaceEvent(&rpdb.Forward{DB: 0, Op: "MSet", Args: []interface{}{"foo", "1", "bar", "2"}})
+	c.expect(t, "message", "__keyspace@0__:foo", "set")
+
+	h.notifyKeyspaceEvent(&rpdb.Forward{DB: 1, Op: "Expired", Args: []interface{}{"foo"}})
+	c.expect(t, "message", "__keyevent@1__:expired", "foo")
+
+	checkerror(t, h.setNotifyFlags("Kx"), true)
+	h.notifyKeyspaceEvent(&rpdb.Forward{DB: 0, Op: "HSet", Args: []interface{}{"foo", "f", "v"}})
+	h.notifyKeyspaceEvent(&rpdb.Forward{DB: 0, Op: "Del", Args: []interface{}{"foo"}})
+	h.notifyKeyspaceEvent(&rpdb.Forward{DB: 0, Op: "Expired", Args: []interface{}{"foo"}})
+	c.expect(t, "message", "__keyspace@0__:foo", "expired")
+}
@@ -0,0 +1,240 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"strings"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+// redirect checks the slots of the keys of a command against the ownership
+// table, it returns the MOVED, ASK or TRYAGAIN error to reply with, or nil if
+// the command is served here. asking tells if the client sent ASKING before.
+func (h *Handler) redirect(s Session, cmd string, args [][]byte, asking bool) redis.Resp {
+	if strings.HasPrefix(cmd, "slots") {
+		return nil
+	}
+	keys, ok := commandKeys(cmd, args)
+	if !ok {
+		return nil
+	}
+	if rsp := h.redirectCluster(keys); rsp != nil {
+		return rsp
+	}
+	bl := s.Rpdb()
+	var migrating, importing [][]byte
+	var owner rpdb.SlotOwner
+	for _, key := range keys {
+		_, slot := rpdb.HashKeyToSlot(key)
+		o, err := bl.SlotOwner(slot)
+		if err != nil {
+			return redis.NewError(err)
+		}
+		switch o.State {
+		case rpdb.SlotForeign:
+			return h.redirectError("MOVED", key, slot, o.Addr)
+		case rpdb.SlotImporting:
+			if !asking {
+				return h.redirectError("MOVED", key, slot, o.Addr)
+			}
+			importing = append(importing, key)
+		case rpdb.SlotMigrating:
+			migrating, owner = append(migrating, key), o
+		}
+	}
+
+	// a key is staged while its chunks are imported, it's never served then
+	for _, key := range importing {
+		if _, err := bl.Exists(s.DB(), key); err != nil {
+			return redirectExistsError(err)
+		}
+	}
+	if len(migrating) == 0 {
+		return nil
+	}
+
+	// the keys still here are served here, the others have been migrated, the
+	// commands check it again under the rpdb lock and fail with ErrKeyMigrated
+	var found int
+	for _, key := range migrating {
+		n, err := bl.Exists(s.DB(), key)
+		if err != nil && !errors.Equal(err, rpdb.ErrKeyMigrated) {
+			return redirectExistsError(err)
+		}
+		found += int(n)
+	}
+	switch found {
+	case len(migrating):
+		return nil
+	case 0:
+		_, slot := rpdb.HashKeyToSlot(migrating[0])
+		return h.redirectError("ASK", migrating[0], slot, owner.Addr)
+	default:
+		return redis.NewError(errors.Errorf("TRYAGAIN multiple keys request during migration"))
+	}
+}
+
+// redirectCluster checks the cluster slots of the keys against the static
+// topology, the ownership table is checked by the caller then.
+func (h *Handler) redirectCluster(keys [][]byte) redis.Resp {
+	if h.cluster == nil || !h.clusterEnabled() {
+		return nil
+	}
+	for _, key := range keys {
+		slot := clusterKeySlot(key)
+		switch n := h.cluster.slots[slot]; {
+		case n == nil:
+			return redis.NewError(errors.Errorf("CLUSTERDOWN Hash slot not served"))
+		case !n.self:
+			return redis.NewError(errors.Errorf("MOVED %d %s", slot, n.addr))
+		}
+	}
+	return nil
+}
+
+// redirectError formats the redirection of key, the slot is the cluster slot
+// of the key in cluster mode, which is what the cluster clients expect.
+func (h *Handler) redirectError(kind string, key []byte, slot uint32, addr string) redis.Resp {
+	if h.clusterEnabled() {
+		slot = clusterKeySlot(key)
+	}
+	return redis.NewError(errors.Errorf("%s %d %s", kind, slot, addr))
+}
+
+func redirectExistsError(err error) redis.Resp {
+	if errors.Equal(err, rpdb.ErrKeyRestoring) {
+		return redis.NewError(errors.Errorf("TRYAGAIN key is being migrated"))
+	}
+	return redis.NewError(err)
+}
+
+// ASKING
+func (h *Handler) Asking(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 0 {
+		return toRespErrorf("len(args) = %d, expect = 0", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if c, ok := s.(*conn); ok {
+		c.asking = true
+	}
+	return redis.NewString("OK"), nil
+}
+
+// SLOTSOWNER SET slot endslot OWNED|NODE addr|MIGRATING addr|IMPORTING addr
+// SLOTSOWNER GET slot / SLOTSOWNER LIST
+func (h *Handler) SlotsOwner(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+	bl := s.Rpdb()
+
+	sub, args := strings.ToLower(string(args[0])), args[1:]
+	switch sub {
+	default:
+		return toRespErrorf("unknown sub-command %s", sub)
+	case "get":
+		if len(args) != 1 {
+			return toRespErrorf("len(args) = %d, expect = 2", len(args)+1)
+		}
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return toRespError(err)
+		}
+		o, err := bl.SlotOwner(slot)
+		if err != nil {
+			return toRespError(err)
+		}
+		resp := redis.NewArray()
+		resp.AppendBulkBytes([]byte(o.State.String()))
+		resp.AppendBulkBytes([]byte(o.Addr))
+		return resp, nil
+	case "list":
+		if len(args) != 0 {
+			return toRespErrorf("len(args) = %d, expect = 1", len(args)+1)
+		}
+		owners, err := bl.SlotOwners()
+		if err != nil {
+			return toRespError(err)
+		}
+		resp := redis.NewArray()
+		for _, r := range slotOwnerRanges(owners) {
+			x := redis.NewArray()
+			x.AppendInt(int64(r.first))
+			x.AppendInt(int64(r.last))
+			x.AppendBulkBytes([]byte(r.owner.State.String()))
+			x.AppendBulkBytes([]byte(r.owner.Addr))
+			resp.Append(x)
+		}
+		return resp, nil
+	case "set":
+		if len(args) != 3 && len(args) != 4 {
+			return toRespErrorf("len(args) = %d, expect = 4 or 5", len(args)+1)
+		}
+		first, err := parseSlot(args[0])
+		if err != nil {
+			return toRespError(err)
+		}
+		last, err := parseSlot(args[1])
+		if err != nil {
+			return toRespError(err)
+		}
+		state, err := rpdb.ParseSlotState(strings.ToLower(string(args[2])))
+		if err != nil {
+			return toRespError(err)
+		}
+		o := rpdb.SlotOwner{State: state}
+		if len(args) == 4 {
+			o.Addr = string(args[3])
+		}
+		if (state == rpdb.SlotOwned) != (o.Addr == "") {
+			return toRespErrorf("slot state = %s, addr = '%s'", state, o.Addr)
+		}
+		if err := bl.SetSlotOwner(first, last, o); err != nil {
+			return toRespError(err)
+		}
+		return redis.NewString("OK"), nil
+	}
+}
+
+func parseSlot(arg []byte) (uint32, error) {
+	v, err := rpdb.ParseUint(arg)
+	if err != nil {
+		return 0, err
+	}
+	if v >= rpdb.MaxSlotNum {
+		return 0, errors.Errorf("invalid slot = %d", v)
+	}
+	return uint32(v), nil
+}
+
+type slotOwnerRange struct {
+	first, last uint32
+	owner       rpdb.SlotOwner
+}
+
+// slotOwnerRanges merges the consecutive slots with the same entry.
+func slotOwnerRanges(owners []rpdb.SlotOwner) []*slotOwnerRange {
+	var ranges []*slotOwnerRange
+	for i, o := range owners {
+		if n := len(ranges); n != 0 && ranges[n-1].owner == o {
+			ranges[n-1].last = uint32(i)
+		} else {
+			ranges = append(ranges, &slotOwnerRange{uint32(i), uint32(i), o})
+		}
+	}
+	return ranges
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func checkredirect(t *testing.T, h *Handler, c *conn, expect string, cmd string, args ...interface{}) {
+	rsp, err := c.dispatch(h, request(cmd, args...))
+	checkerror(t, err, rsp != nil)
+	x, ok := rsp.(*redis.Error)
+	checkerror(t, nil, ok && x.Value == expect)
+}
+
+func TestSlotsOwner(t *testing.T) {
+	nc1, nc2 := net.Pipe()
+	defer nc1.Close()
+	c := newConn(context.Background(), nc2, testbl, 0)
+	defer c.Close()
+
+	h := &Handler{config: NewDefaultConfig()}
+	htable, err := redis.NewHandlerTable(h)
+	checkerror(t, err, true)
+	h.htable = htable
+
+	k1 := "{owner}" + random(t)
+	k2 := "{owner}" + random(t)
+	slot := rpdb.HashTagToSlot([]byte("owner"))
+	checkok(t, c, "set", k1, "1")
+
+	checkok(t, c, "slotsowner", "set", slot, slot, "node", "127.0.0.1:7000")
+	checkredirect(t, h, c, fmt.Sprintf("MOVED %d 127.0.0.1:7000", slot), "get", k1)
+	checkredirect(t, h, c, fmt.Sprintf("MOVED %d 127.0.0.1:7000", slot), "mget", "other", k1)
+	rsp, err := c.dispatch(h, request("slotshashkey", k1))
+	checkerror(t, err, rsp != nil)
+	_, ok := rsp.(*redis.Array)
+	checkerror(t, nil, ok)
+
+	rsp, err = server.Dispatch(c, request("slotsowner", "get", slot))
+	checkerror(t, err, rsp != nil)
+	x, ok := rsp.(*redis.Array)
+	checkerror(t, nil, ok && len(x.Value) == 2)
+
+	checkok(t, c, "slotsowner", "set", slot, slot, "migrating", "127.0.0.1:7001")
+	rsp, err = c.dispatch(h, request("get", k1))
+	checkerror(t, err, rsp != nil)
+	_, ok = rsp.(*redis.BulkBytes)
+	checkerror(t, nil, ok)
+	checkredirect(t, h, c, fmt.Sprintf("ASK %d 127.0.0.1:7001", slot), "get", k2)
+	checkredirect(t, h, c, "TRYAGAIN multiple keys request during migration", "mget", k1, k2)
+
+	checkok(t, c, "slotsowner", "set", slot, slot, "importing", "127.0.0.1:7002")
+	checkredirect(t, h, c, fmt.Sprintf("MOVED %d 127.0.0.1:7002", slot), "get", k1)
+	rsp, err = c.dispatch(h, request("asking"))
+	checkerror(t, err, rsp != nil)
+	rsp, err = c.dispatch(h, request("get", k1))
+	checkerror(t, err, rsp != nil)
+	_, ok = rsp.(*redis.BulkBytes)
+	checkerror(t, nil, ok)
+	checkredirect(t, h, c, fmt.Sprintf("MOVED %d 127.0.0.1:7002", slot), "get", k1)
+
+	rsp, err = server.Dispatch(c, request("slotsowner", "list"))
+	checkerror(t, err, rsp != nil)
+	x, ok = rsp.(*redis.Array)
+	checkerror(t, nil, ok && len(x.Value) >= 2)
+
+	checkok(t, c, "slotsowner", "set", slot, slot, "owned")
+	rsp, err = c.dispatch(h, request("del", k1))
+	checkerror(t, err, rsp != nil)
+	checkint(t, 0, c, "exists", k1)
+}
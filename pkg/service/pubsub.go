@@ -0,0 +1,595 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/bytesize"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+var (
+	ErrSubscriberClosed = errors.Static("subscriber has been closed")
+	ErrSubscriberBuffer = errors.Static("subscriber output buffer overflow")
+)
+
+type pubsubHub struct {
+	mu sync.RWMutex
+
+	channels map[string]map[*subscriber]bool
+	patterns map[string]map[*subscriber]bool
+}
+
+func (p *pubsubHub) subscribe(s *subscriber, channel string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.channels == nil {
+		p.channels = make(map[string]map[*subscriber]bool)
+	}
+	m := p.channels[channel]
+	if m == nil {
+		m = make(map[*subscriber]bool)
+		p.channels[channel] = m
+	}
+	m[s] = true
+}
+
+func (p *pubsubHub) unsubscribe(s *subscriber, channel string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m := p.channels[channel]; m != nil {
+		delete(m, s)
+		if len(m) == 0 {
+			delete(p.channels, channel)
+		}
+	}
+}
+
+func (p *pubsubHub) psubscribe(s *subscriber, pattern string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.patterns == nil {
+		p.patterns = make(map[string]map[*subscriber]bool)
+	}
+	m := p.patterns[pattern]
+	if m == nil {
+		m = make(map[*subscriber]bool)
+		p.patterns[pattern] = m
+	}
+	m[s] = true
+}
+
+func (p *pubsubHub) punsubscribe(s *subscriber, pattern string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m := p.patterns[pattern]; m != nil {
+		delete(m, s)
+		if len(m) == 0 {
+			delete(p.patterns, pattern)
+		}
+	}
+}
+
+func (p *pubsubHub) publish(channel, message []byte) int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var n int64
+	if m := p.channels[string(channel)]; len(m) != 0 {
+		msg := redis.NewArray()
+		msg.AppendBulkBytes([]byte("message"))
+		msg.AppendBulkBytes(channel)
+		msg.AppendBulkBytes(message)
+		b, err := redis.EncodeToBytes(msg)
+		if err != nil {
+			log.WarnErrorf(err, "encode pubsub message failed")
+			return 0
+		}
+		for s := range m {
+			s.push(b)
+			n++
+		}
+	}
+	for pattern, m := range p.patterns {
+		if !matchPattern([]byte(pattern), channel) {
+			continue
+		}
+		msg := redis.NewArray()
+		msg.AppendBulkBytes([]byte("pmessage"))
+		msg.AppendBulkBytes([]byte(pattern))
+		msg.AppendBulkBytes(channel)
+		msg.AppendBulkBytes(message)
+		b, err := redis.EncodeToBytes(msg)
+		if err != nil {
+			log.WarnErrorf(err, "encode pubsub message failed")
+			continue
+		}
+		for s := range m {
+			s.push(b)
+			n++
+		}
+	}
+	return n
+}
+
+func (p *pubsubHub) numChannels() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return int64(len(p.channels))
+}
+
+func (p *pubsubHub) numPatterns() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var n int64
+	for _, m := range p.patterns {
+		n += int64(len(m))
+	}
+	return n
+}
+
+func (p *pubsubHub) numSubscribers(channel string) int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return int64(len(p.channels[channel]))
+}
+
+func (p *pubsubHub) listChannels(pattern []byte) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var channels []string
+	for channel := range p.channels {
+		if pattern == nil || matchPattern(pattern, []byte(channel)) {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+type subscriber struct {
+	c *conn
+
+	channels map[string]bool
+	patterns map[string]bool
+
+	mu     sync.Mutex
+	queue  list.List
+	size   int64
+	limit  int64
+	closed bool
+	notify chan int
+
+	// last is set once the last reply is queued, see quit
+	last bool
+	done chan int
+}
+
+func newSubscriber(c *conn, limit int64) *subscriber {
+	s := &subscriber{
+		c:        c,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		limit:    limit,
+		notify:   make(chan int, 1),
+		done:     make(chan int),
+	}
+	go s.daemonWriter()
+	return s
+}
+
+func (s *subscriber) count() int64 {
+	return int64(len(s.channels) + len(s.patterns))
+}
+
+func (s *subscriber) push(b []byte) error {
+	return s.pushLast(b, false)
+}
+
+func (s *subscriber) pushLast(b []byte, last bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.Trace(ErrSubscriberClosed)
+	}
+	s.last = last
+	if s.limit > 0 && s.size+int64(len(b)) > s.limit {
+		log.Warnf("subscriber output buffer overflow, conn = %s, size = %d, limit = %d", s.c.summ, s.size, s.limit)
+		s.closeLocked()
+		return errors.Trace(ErrSubscriberBuffer)
+	}
+	s.queue.PushBack(b)
+	s.size += int64(len(b))
+	select {
+	case s.notify <- 0:
+	default:
+	}
+	return nil
+}
+
+func (s *subscriber) pushResp(resp redis.Resp) error {
+	b, err := redis.EncodeToBytes(resp)
+	if err != nil {
+		return err
+	}
+	return s.push(b)
+}
+
+// quit queues the reply of QUIT, and returns once the replies queued are
+// written and s is closed.
+func (s *subscriber) quit(resp redis.Resp) error {
+	b, err := redis.EncodeToBytes(resp)
+	if err != nil {
+		return err
+	}
+	if err := s.pushLast(b, true); err != nil {
+		return err
+	}
+	<-s.done
+	return nil
+}
+
+// pop returns the replies queued, and whether the last one is among them.
+func (s *subscriber) pop() ([][]byte, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, false, false
+	}
+	var bufs [][]byte
+	for s.queue.Len() != 0 {
+		b := s.queue.Remove(s.queue.Front()).([]byte)
+		s.size -= int64(len(b))
+		bufs = append(bufs, b)
+	}
+	return bufs, s.last, true
+}
+
+func (s *subscriber) daemonWriter() {
+	defer close(s.done)
+	for _ = range s.notify {
+		bufs, last, ok := s.pop()
+		if !ok {
+			return
+		}
+		if err := s.write(bufs); err != nil {
+			log.InfoErrorf(err, "subscriber write failed, conn = %s", s.c.summ)
+			s.close()
+			return
+		}
+		if last {
+			s.close()
+			return
+		}
+	}
+}
+
+func (s *subscriber) write(bufs [][]byte) error {
+	c := s.c
+	if c.timeout != 0 {
+		deadline := time.Now().Add(c.timeout)
+		if err := c.nc.SetWriteDeadline(deadline); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for _, b := range bufs {
+		if _, err := c.w.Write(b); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(c.w.Flush())
+}
+
+func (s *subscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *subscriber) closeLocked() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.queue.Init()
+	s.size = 0
+	close(s.notify)
+	s.c.nc.Close()
+}
+
+func (h *Handler) subscriberOf(arg0 interface{}) (*subscriber, error) {
+	c, _ := arg0.(*conn)
+	if c == nil {
+		return nil, errors.New("pubsub requires a client connection")
+	}
+	if c.ps == nil {
+		limit := int64(bytesize.MB * 32)
+		if h.config != nil {
+			limit = int64(h.config.PubSubBuffSize)
+		}
+		c.ps = newSubscriber(c, limit)
+	}
+	return c.ps, nil
+}
+
+func (h *Handler) detachSubscriber(c *conn) {
+	s := c.ps
+	if s == nil {
+		return
+	}
+	for channel := range s.channels {
+		h.pubsub.unsubscribe(s, channel)
+	}
+	for pattern := range s.patterns {
+		h.pubsub.punsubscribe(s, pattern)
+	}
+	s.close()
+}
+
+func subscribeReply(kind string, name []byte, count int64) redis.Resp {
+	resp := redis.NewArray()
+	resp.AppendBulkBytes([]byte(kind))
+	resp.AppendBulkBytes(name)
+	resp.AppendInt(count)
+	return resp
+}
+
+func isSubscriberCommand(cmd string) bool {
+	switch cmd {
+	case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ping", "quit", "reset":
+		return true
+	}
+	return false
+}
+
+// subscriberPing answers PING in subscriber mode, with ["pong", message]
+// rather than a status.
+func subscriberPing(args [][]byte) redis.Resp {
+	resp := redis.NewArray()
+	resp.AppendBulkBytes([]byte("pong"))
+	if len(args) != 0 {
+		resp.AppendBulkBytes(args[0])
+	} else {
+		resp.AppendBulkBytes([]byte{})
+	}
+	return resp
+}
+
+// SUBSCRIBE channel [channel ...]
+func (h *Handler) Subscribe(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	s, err := h.subscriberOf(arg0)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	for _, channel := range args {
+		s.channels[string(channel)] = true
+		if err := s.pushResp(subscribeReply("subscribe", channel, s.count())); err != nil {
+			return toRespError(err)
+		}
+		h.pubsub.subscribe(s, string(channel))
+	}
+	return nil, nil
+}
+
+// UNSUBSCRIBE [channel ...]
+func (h *Handler) Unsubscribe(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	s, err := h.subscriberOf(arg0)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if len(args) == 0 {
+		for channel := range s.channels {
+			args = append(args, []byte(channel))
+		}
+		if len(args) == 0 {
+			return subscribeReply("unsubscribe", nil, s.count()), nil
+		}
+	}
+	for _, channel := range args {
+		h.pubsub.unsubscribe(s, string(channel))
+		delete(s.channels, string(channel))
+		if err := s.pushResp(subscribeReply("unsubscribe", channel, s.count())); err != nil {
+			return toRespError(err)
+		}
+	}
+	return nil, nil
+}
+
+// PSUBSCRIBE pattern [pattern ...]
+func (h *Handler) PSubscribe(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	s, err := h.subscriberOf(arg0)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	for _, pattern := range args {
+		s.patterns[string(pattern)] = true
+		if err := s.pushResp(subscribeReply("psubscribe", pattern, s.count())); err != nil {
+			return toRespError(err)
+		}
+		h.pubsub.psubscribe(s, string(pattern))
+	}
+	return nil, nil
+}
+
+// PUNSUBSCRIBE [pattern ...]
+func (h *Handler) PUnsubscribe(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	s, err := h.subscriberOf(arg0)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if len(args) == 0 {
+		for pattern := range s.patterns {
+			args = append(args, []byte(pattern))
+		}
+		if len(args) == 0 {
+			return subscribeReply("punsubscribe", nil, s.count()), nil
+		}
+	}
+	for _, pattern := range args {
+		h.pubsub.punsubscribe(s, string(pattern))
+		delete(s.patterns, string(pattern))
+		if err := s.pushResp(subscribeReply("punsubscribe", pattern, s.count())); err != nil {
+			return toRespError(err)
+		}
+	}
+	return nil, nil
+}
+
+// PUBLISH channel message
+func (h *Handler) Publish(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 2 {
+		return toRespErrorf("len(args) = %d, expect = 2", len(args))
+	}
+
+	_, err := session(arg0, args[:1])
+	if err != nil {
+		return toRespError(err)
+	}
+
+	return redis.NewInt(h.pubsub.publish(args[0], args[1])), nil
+}
+
+// PUBSUB CHANNELS [pattern] / NUMSUB [channel ...] / NUMPAT
+func (h *Handler) PubSub(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	_, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	sub, args := strings.ToLower(string(args[0])), args[1:]
+
+	switch sub {
+	default:
+		return toRespErrorf("unknown sub-command = %s", sub)
+	case "channels":
+		if len(args) > 1 {
+			return toRespErrorf("len(args) = %d, expect <= 1", len(args))
+		}
+		var pattern []byte
+		if len(args) != 0 {
+			pattern = args[0]
+		}
+		resp := redis.NewArray()
+		for _, channel := range h.pubsub.listChannels(pattern) {
+			resp.AppendBulkBytes([]byte(channel))
+		}
+		return resp, nil
+	case "numsub":
+		resp := redis.NewArray()
+		for _, channel := range args {
+			resp.AppendBulkBytes(channel)
+			resp.AppendInt(h.pubsub.numSubscribers(string(channel)))
+		}
+		return resp, nil
+	case "numpat":
+		if len(args) != 0 {
+			return toRespErrorf("len(args) = %d, expect = 0", len(args))
+		}
+		return redis.NewInt(h.pubsub.numPatterns()), nil
+	}
+}
+
+// matchPattern reports whether s matches the glob-style pattern, following
+// the rules of redis' stringmatch: '*', '?', '[...]' and '\' escaping.
+func matchPattern(pattern, s []byte) bool {
+	for len(pattern) != 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) != 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) != 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == s[0] {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if s[0] >= lo && s[0] <= hi {
+						match = true
+					}
+					pattern = pattern[2:]
+				default:
+					if pattern[0] == s[0] {
+						match = true
+					}
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return false
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
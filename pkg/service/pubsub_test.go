@@ -0,0 +1,148 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+type pubsubClient struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func newPubSubClient(t *testing.T, h *Handler) *pubsubClient {
+	nc1, nc2 := net.Pipe()
+	c := newConn(context.Background(), nc2, testbl, 0)
+	go func() {
+		defer c.Close()
+		c.serve(h)
+	}()
+	return &pubsubClient{r: bufio.NewReader(nc1), w: bufio.NewWriter(nc1)}
+}
+
+func (c *pubsubClient) send(t *testing.T, cmd string, args ...interface{}) {
+	checkerror(t, redis.Encode(c.w, request(cmd, args...)), true)
+	checkerror(t, c.w.Flush(), true)
+}
+
+func (c *pubsubClient) expect(t *testing.T, values ...string) {
+	rsp, err := redis.Decode(c.r)
+	checkerror(t, err, rsp != nil)
+	x, ok := rsp.(*redis.Array)
+	checkerror(t, nil, ok && len(x.Value) == len(values))
+	for i, v := range x.Value {
+		switch y := v.(type) {
+		case *redis.BulkBytes:
+			checkerror(t, nil, string(y.Value) == values[i])
+		case *redis.Int:
+			checkerror(t, nil, strconv.FormatInt(y.Value, 10) == values[i])
+		default:
+			checkerror(t, nil, false)
+		}
+	}
+}
+
+func newPubSubHandler(t *testing.T) *Handler {
+	h := &Handler{}
+	htable, err := redis.NewHandlerTable(h)
+	checkerror(t, err, true)
+	h.htable = htable
+	return h
+}
+
+func TestPubSubChannel(t *testing.T) {
+	h := newPubSubHandler(t)
+	c := newPubSubClient(t, h)
+	c.send(t, "subscribe", "news", "sports")
+	c.expect(t, "subscribe", "news", "1")
+	c.expect(t, "subscribe", "sports", "2")
+
+	s := client(t)
+	rsp, err := h.Publish(s, [][]byte{[]byte("news"), []byte("hello")})
+	checkerror(t, err, rsp.(*redis.Int).Value == 1)
+	c.expect(t, "message", "news", "hello")
+
+	c.send(t, "get", "news")
+	rsp2, err := redis.Decode(c.r)
+	checkerror(t, err, true)
+	_, ok := rsp2.(*redis.Error)
+	checkerror(t, nil, ok)
+
+	c.send(t, "unsubscribe")
+	c.expect(t, "unsubscribe", "news", "1")
+	c.expect(t, "unsubscribe", "sports", "0")
+	checkerror(t, nil, h.pubsub.numChannels() == 0)
+}
+
+func TestPubSubPattern(t *testing.T) {
+	h := newPubSubHandler(t)
+	c := newPubSubClient(t, h)
+	c.send(t, "psubscribe", "news.*")
+	c.expect(t, "psubscribe", "news.*", "1")
+	checkerror(t, nil, h.pubsub.numPatterns() == 1)
+
+	s := client(t)
+	rsp, err := h.Publish(s, [][]byte{[]byte("news.it"), []byte("hello")})
+	checkerror(t, err, rsp.(*redis.Int).Value == 1)
+	c.expect(t, "pmessage", "news.*", "news.it", "hello")
+
+	rsp, err = h.Publish(s, [][]byte{[]byte("sports"), []byte("hello")})
+	checkerror(t, err, rsp.(*redis.Int).Value == 0)
+
+	c.send(t, "punsubscribe", "news.*")
+	c.expect(t, "punsubscribe", "news.*", "0")
+	checkerror(t, nil, h.pubsub.numPatterns() == 0)
+}
+
+func TestPubSubPingQuit(t *testing.T) {
+	h := newPubSubHandler(t)
+	c := newPubSubClient(t, h)
+	c.send(t, "subscribe", "news")
+	c.expect(t, "subscribe", "news", "1")
+
+	c.send(t, "ping")
+	c.expect(t, "pong", "")
+	c.send(t, "ping", "hello")
+	c.expect(t, "pong", "hello")
+
+	c.send(t, "quit")
+	rsp, err := redis.Decode(c.r)
+	checkerror(t, err, true)
+	x, ok := rsp.(*redis.String)
+	checkerror(t, nil, ok && x.Value == "OK")
+	_, err = redis.Decode(c.r)
+	checkerror(t, nil, err != nil)
+}
+
+func TestMatchPattern(t *testing.T) {
+	var tests = []struct {
+		pattern, s string
+		expect     bool
+	}{
+		{"*", "", true},
+		{"*", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbb", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"__keyspace@*__:*", "__keyspace@0__:foo", true},
+	}
+	for _, x := range tests {
+		checkerror(t, nil, matchPattern([]byte(x.pattern), []byte(x.s)) == x.expect)
+	}
+}
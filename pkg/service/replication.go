@@ -0,0 +1,605 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/bytesize"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+var (
+	ErrReplicaClosed   = errors.Static("replica has been closed")
+	ErrBacklogOverflow = errors.Static("replica fell behind the replication backlog")
+)
+
+// replBacklog is a ring buffer holding the tail of the replication stream.
+// Replicas are fed straight from it, so a replica that falls more than the
+// backlog size behind is disconnected and has to resync.
+type replBacklog struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	replid string
+	buf    []byte
+	offset int64
+	seldb  int64
+
+	slaves map[*replSlave]bool
+}
+
+type replSlave struct {
+	c *conn
+
+	offset  int64
+	ack     int64
+	ackTime time.Time
+	state   string
+	closed  bool
+}
+
+// replSlaveInfo is the state of a replica reported by INFO and ROLE.
+type replSlaveInfo struct {
+	ip, port string
+	state    string
+	ack      int64
+	lag      int64
+}
+
+// replInfo is the state of the replication backlog reported by INFO and ROLE.
+type replInfo struct {
+	replid string
+	offset int64
+	first  int64
+	size   int64
+	slaves []replSlaveInfo
+}
+
+func newReplID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		log.PanicErrorf(err, "generate replication id failed")
+	}
+	return hex.EncodeToString(b)
+}
+
+func (r *replBacklog) init(size int) {
+	if r.buf != nil {
+		return
+	}
+	r.cond = sync.NewCond(&r.mu)
+	r.replid = newReplID()
+	r.buf = make([]byte, size)
+	r.seldb = -1
+	r.slaves = make(map[*replSlave]bool)
+	log.Infof("create replication backlog, replid = %s, size = %d", r.replid, size)
+}
+
+func (r *replBacklog) first() int64 {
+	if n := r.offset - int64(len(r.buf)); n > 0 {
+		return n
+	}
+	return 0
+}
+
+func (r *replBacklog) write(p []byte) {
+	for len(p) != 0 {
+		i := int(r.offset % int64(len(r.buf)))
+		n := copy(r.buf[i:], p)
+		r.offset += int64(n)
+		p = p[n:]
+	}
+}
+
+func (r *replBacklog) writeCommand(cmd [][]byte) {
+	resp := redis.NewArray()
+	for _, arg := range cmd {
+		resp.AppendBulkBytes(arg)
+	}
+	b, err := redis.EncodeToBytes(resp)
+	if err != nil {
+		log.ErrorErrorf(err, "encode replication command failed")
+		return
+	}
+	r.write(b)
+}
+
+func (r *replBacklog) feed(fw *rpdb.Forward) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buf == nil {
+		return
+	}
+	cmds := fw.Commands()
+	if len(cmds) == 0 {
+		return
+	}
+	if r.seldb != int64(fw.DB) {
+		r.writeCommand([][]byte{[]byte("SELECT"), rpdb.FormatUint(uint64(fw.DB))})
+		r.seldb = int64(fw.DB)
+	}
+	for _, cmd := range cmds {
+		r.writeCommand(cmd)
+	}
+	r.cond.Broadcast()
+}
+
+func (r *replBacklog) ping() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.slaves) == 0 {
+		return
+	}
+	r.writeCommand([][]byte{[]byte("PING")})
+	r.cond.Broadcast()
+}
+
+// fullsync registers a replica that is fed from the current offset on. It
+// must be called with the rpdb lock held, see Rpdb.NewSnapshotFunc.
+func (r *replBacklog) fullsync(c *conn, size int) (*replSlave, string, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.init(size)
+	r.seldb = -1
+	s := &replSlave{c: c, offset: r.offset, ackTime: time.Now(), state: "wait_bgsave"}
+	r.slaves[s] = true
+	return s, r.replid, r.offset
+}
+
+func (r *replBacklog) resume(c *conn, replid string, offset int64) *replSlave {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buf == nil || r.replid != replid {
+		return nil
+	}
+	if offset < r.first() || offset > r.offset {
+		return nil
+	}
+	s := &replSlave{c: c, offset: offset, ackTime: time.Now(), state: "online"}
+	r.slaves[s] = true
+	return s
+}
+
+// reset starts a new replication history after the data has been replaced
+// as a whole, so every replica has to do a full resync.
+func (r *replBacklog) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buf == nil {
+		return
+	}
+	r.replid = newReplID()
+	r.seldb = -1
+	for s := range r.slaves {
+		s.closed = true
+		s.c.Close()
+	}
+	r.slaves = make(map[*replSlave]bool)
+	r.cond.Broadcast()
+	log.Infof("reset replication backlog, replid = %s", r.replid)
+}
+
+func (r *replBacklog) detach(s *replSlave) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(r.slaves, s)
+	r.cond.Broadcast()
+}
+
+func (r *replBacklog) read(s *replSlave, p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for !s.closed && s.offset == r.offset {
+		r.cond.Wait()
+	}
+	if s.closed {
+		return 0, errors.Trace(ErrReplicaClosed)
+	}
+	if s.offset < r.first() {
+		return 0, errors.Trace(ErrBacklogOverflow)
+	}
+	i := int(s.offset % int64(len(r.buf)))
+	n := copy(p, r.buf[i:])
+	if remains := r.offset - s.offset; int64(n) > remains {
+		n = int(remains)
+	}
+	s.offset += int64(n)
+	return n, nil
+}
+
+func (r *replBacklog) setAck(s *replSlave, offset int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.ack, s.ackTime = offset, time.Now()
+}
+
+func (r *replBacklog) setState(s *replSlave, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s.state = state
+}
+
+func (r *replBacklog) info() *replInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v := &replInfo{replid: r.replid, offset: r.offset, size: int64(len(r.buf))}
+	if r.buf != nil {
+		v.first = r.first()
+	}
+	for s := range r.slaves {
+		x := replSlaveInfo{state: s.state, ack: s.ack}
+		x.ip, x.port, _ = net.SplitHostPort(s.c.nc.RemoteAddr().String())
+		if s.c.lport != "" {
+			x.port = s.c.lport
+		}
+		x.lag = int64(time.Since(s.ackTime) / time.Second)
+		v.slaves = append(v.slaves, x)
+	}
+	sort.Sort(replSlaveInfos(v.slaves))
+	return v
+}
+
+type replSlaveInfos []replSlaveInfo
+
+func (p replSlaveInfos) Len() int {
+	return len(p)
+}
+
+func (p replSlaveInfos) Less(i, j int) bool {
+	if p[i].ip != p[j].ip {
+		return p[i].ip < p[j].ip
+	}
+	return p[i].port < p[j].port
+}
+
+func (p replSlaveInfos) Swap(i, j int) {
+	p[i], p[j] = p[j], p[i]
+}
+
+func (r *replBacklog) numSlaves() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(len(r.slaves))
+}
+
+func (r *replBacklog) masterOffset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.offset
+}
+
+func (h *Handler) replBacklogSize() int {
+	if h.config != nil && h.config.ReplBacklogSize > 0 {
+		return h.config.ReplBacklogSize
+	}
+	return bytesize.MB * 32
+}
+
+func (h *Handler) daemonReplPing() {
+	for {
+		select {
+		case <-h.signal:
+			return
+		case <-time.After(time.Second * 10):
+			h.repl.ping()
+		}
+	}
+}
+
+func (h *Handler) detachReplica(c *conn) {
+	if s := c.slave; s != nil {
+		h.repl.detach(s)
+	}
+}
+
+func replicaConn(arg0 interface{}) (*conn, error) {
+	c, _ := arg0.(*conn)
+	if c == nil {
+		return nil, errors.New("sync requires a client connection")
+	}
+	if c.slave != nil || c.ps != nil {
+		return nil, errors.New("connection is busy")
+	}
+	return c, nil
+}
+
+func (h *Handler) syncReplica(c *conn, psync bool, replid string, offset int64) error {
+	if psync {
+		if s := h.repl.resume(c, replid, offset); s != nil {
+			c.slave = s
+			log.Infof("replica %s continue, replid = %s, offset = %d", c.summ, replid, offset)
+			if _, err := fmt.Fprintf(c.w, "+CONTINUE %s\r\n", replid); err != nil {
+				return errors.Trace(err)
+			}
+			if err := c.w.Flush(); err != nil {
+				return errors.Trace(err)
+			}
+			go h.daemonReplica(s)
+			return nil
+		}
+	}
+
+	var s *replSlave
+	sp, err := c.Rpdb().NewSnapshotFunc(func() {
+		s, replid, offset = h.repl.fullsync(c, h.replBacklogSize())
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Rpdb().ReleaseSnapshot(sp)
+
+	c.slave = s
+	log.Infof("replica %s full resync, replid = %s, offset = %d", c.summ, replid, offset)
+
+	if err := c.nc.SetWriteDeadline(time.Time{}); err != nil {
+		return errors.Trace(err)
+	}
+	if psync {
+		if _, err := fmt.Fprintf(c.w, "+FULLRESYNC %s %d\r\n", replid, offset); err != nil {
+			return errors.Trace(err)
+		}
+		if err := c.w.Flush(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	dir := ""
+	if h.config != nil {
+		dir = filepath.Dir(h.config.DumpPath)
+	}
+	f, err := ioutil.TempFile(dir, "sync-")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	// the dump stops once the replica is gone or on SHUTDOWN
+	ctx, cancel := context.WithCancel(c.ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- h.bgsaveTo(ctx, sp, path, nil)
+	}()
+	for wait := true; wait; {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			wait = false
+		case <-time.After(time.Second):
+			// keep the replica from timing out while the rdb is being dumped
+			c.w.WriteByte('\n')
+			if err := c.w.Flush(); err != nil {
+				cancel()
+				<-done
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Infof("replica %s send rdb file size = %d bytes", c.summ, fi.Size())
+	h.repl.setState(s, "send_bulk")
+
+	if _, err := fmt.Fprintf(c.w, "$%d\r\n", fi.Size()); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := io.Copy(c.w, f); err != nil {
+		return errors.Trace(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	go h.daemonReplica(s)
+	return nil
+}
+
+func (h *Handler) daemonReplica(s *replSlave) {
+	h.repl.setState(s, "online")
+	c := s.c
+	p := make([]byte, 64*1024)
+	for {
+		n, err := h.repl.read(s, p)
+		if err == nil {
+			err = c.writeBytes(p[:n])
+		}
+		if err != nil {
+			log.InfoErrorf(err, "stop replica: %s", c.summ)
+			c.Close()
+			return
+		}
+	}
+}
+
+func (h *Handler) infoReplication(w io.Writer) {
+	v := h.repl.info()
+	if src := h.getSource(slaveOfSource); src == nil {
+		fmt.Fprintf(w, "role:master\n")
+	} else {
+		host, port, _ := net.SplitHostPort(src.addr)
+		status := src.getStatus()
+		_, offset := src.state.get()
+		fmt.Fprintf(w, "role:slave\n")
+		fmt.Fprintf(w, "master_host:%s\n", host)
+		fmt.Fprintf(w, "master_port:%s\n", port)
+		if status == "connected" {
+			fmt.Fprintf(w, "master_link_status:up\n")
+		} else {
+			fmt.Fprintf(w, "master_link_status:down\n")
+		}
+		fmt.Fprintf(w, "master_last_io_seconds_ago:%d\n", src.lastIOSeconds())
+		if status == "sync" {
+			fmt.Fprintf(w, "master_sync_in_progress:1\n")
+			fmt.Fprintf(w, "master_sync_left_bytes:%d\n", src.counters.rdbRemains.Get())
+		} else {
+			fmt.Fprintf(w, "master_sync_in_progress:0\n")
+		}
+		fmt.Fprintf(w, "slave_repl_offset:%d\n", offset)
+		if n := src.linkDownSeconds(); n >= 0 {
+			fmt.Fprintf(w, "master_link_down_since_seconds:%d\n", n)
+		}
+		fmt.Fprintf(w, "slave_read_only:0\n")
+	}
+	fmt.Fprintf(w, "connected_slaves:%d\n", len(v.slaves))
+	for i, x := range v.slaves {
+		fmt.Fprintf(w, "slave%d:ip=%s,port=%s,state=%s,offset=%d,lag=%d\n", i, x.ip, x.port, x.state, x.ack, x.lag)
+	}
+	fmt.Fprintf(w, "master_replid:%s\n", v.replid)
+	fmt.Fprintf(w, "master_repl_offset:%d\n", v.offset)
+	if v.size != 0 {
+		fmt.Fprintf(w, "repl_backlog_active:1\n")
+	} else {
+		fmt.Fprintf(w, "repl_backlog_active:0\n")
+	}
+	fmt.Fprintf(w, "repl_backlog_size:%d\n", v.size)
+	fmt.Fprintf(w, "repl_backlog_first_byte_offset:%d\n", v.first+1)
+	fmt.Fprintf(w, "repl_backlog_histlen:%d\n", v.offset-v.first)
+}
+
+// ROLE
+func (h *Handler) Role(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 0 {
+		return toRespErrorf("len(args) = %d, expect = 0", len(args))
+	}
+
+	_, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	resp := redis.NewArray()
+	if src := h.getSource(slaveOfSource); src == nil {
+		v := h.repl.info()
+		resp.AppendBulkBytes([]byte("master"))
+		resp.AppendInt(v.offset)
+		slaves := redis.NewArray()
+		for _, x := range v.slaves {
+			slave := redis.NewArray()
+			slave.AppendBulkBytes([]byte(x.ip))
+			slave.AppendBulkBytes([]byte(x.port))
+			slave.AppendBulkBytes([]byte(strconv.FormatInt(x.ack, 10)))
+			slaves.Append(slave)
+		}
+		resp.Append(slaves)
+	} else {
+		host, port, _ := net.SplitHostPort(src.addr)
+		_, offset := src.state.get()
+		resp.AppendBulkBytes([]byte("slave"))
+		resp.AppendBulkBytes([]byte(host))
+		if n, err := strconv.ParseInt(port, 10, 64); err == nil {
+			resp.AppendInt(n)
+		} else {
+			resp.AppendBulkBytes([]byte(port))
+		}
+		resp.AppendBulkBytes([]byte(src.getStatus()))
+		resp.AppendInt(offset)
+	}
+	return resp, nil
+}
+
+// SYNC
+func (h *Handler) Sync(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 0 {
+		return toRespErrorf("len(args) = %d, expect = 0", len(args))
+	}
+
+	c, err := replicaConn(arg0)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if err := h.syncReplica(c, false, "", 0); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return nil, nil
+}
+
+// PSYNC replid offset
+func (h *Handler) PSync(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 2 {
+		return toRespErrorf("len(args) = %d, expect = 2", len(args))
+	}
+
+	c, err := replicaConn(arg0)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	replid := string(args[0])
+	offset, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return toRespErrorf("invalid offset = %s", args[1])
+	}
+
+	// replicas ask for the offset of the next byte, counting from 1
+	if err := h.syncReplica(c, true, replid, offset-1); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return nil, nil
+}
+
+// REPLCONF option value [option value ...]
+func (h *Handler) ReplConf(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return toRespErrorf("len(args) = %d, expect = even", len(args))
+	}
+
+	_, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	switch strings.ToLower(string(args[0])) {
+	case "ack":
+		if c, _ := arg0.(*conn); c != nil && c.slave != nil {
+			if offset, err := strconv.ParseInt(string(args[1]), 10, 64); err == nil {
+				h.repl.setAck(c.slave, offset)
+			}
+		}
+		return nil, nil
+	case "getack":
+		return nil, nil
+	case "listening-port":
+		if c, _ := arg0.(*conn); c != nil {
+			c.lport = string(args[1])
+		}
+	}
+	return redis.NewString("OK"), nil
+}
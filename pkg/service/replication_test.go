@@ -0,0 +1,128 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func (c *pubsubClient) readLine(t *testing.T) string {
+	for {
+		s, err := c.r.ReadString('\n')
+		checkerror(t, err, true)
+		if s != "\n" {
+			return strings.TrimSuffix(s, "\r\n")
+		}
+	}
+}
+
+func (c *pubsubClient) expectCommand(t *testing.T, values ...string) {
+	rsp, err := redis.Decode(c.r)
+	checkerror(t, err, true)
+	cmd, args, err := redis.ParseArgs(rsp)
+	checkerror(t, err, cmd == strings.ToLower(values[0]) && len(args) == len(values)-1)
+	for i, arg := range args {
+		checkerror(t, nil, string(arg) == values[i+1])
+	}
+}
+
+func TestReplBacklog(t *testing.T) {
+	var r replBacklog
+	r.mu.Lock()
+	r.init(16)
+	r.mu.Unlock()
+	s, _, offset := r.fullsync(nil, 16)
+	checkerror(t, nil, offset == 0)
+
+	r.write([]byte("0123456789"))
+	p := make([]byte, 32)
+	n, err := r.read(s, p)
+	checkerror(t, err, string(p[:n]) == "0123456789")
+
+	r.write([]byte("abcdefgh"))
+	n, err = r.read(s, p)
+	checkerror(t, err, string(p[:n]) == "abcdef")
+	n, err = r.read(s, p)
+	checkerror(t, err, string(p[:n]) == "gh")
+
+	r.write([]byte("abcdefghijklmnopq"))
+	_, err = r.read(s, p)
+	checkerror(t, nil, err != nil)
+}
+
+func TestPSync(t *testing.T) {
+	h := newPubSubHandler(t)
+	c := newPubSubClient(t, h)
+	c.send(t, "psync", "?", -1)
+
+	var replid string
+	var offset int64
+	n, err := fmt.Sscanf(c.readLine(t), "+FULLRESYNC %s %d", &replid, &offset)
+	checkerror(t, err, n == 2)
+
+	size, err := strconv.Atoi(strings.TrimPrefix(c.readLine(t), "$"))
+	checkerror(t, err, size > 0)
+	_, err = io.CopyN(ioutil.Discard, c.r, int64(size))
+	checkerror(t, err, true)
+
+	h.repl.feed(&rpdb.Forward{DB: 1, Op: "Set", Args: []interface{}{"a", "b"}})
+	c.expectCommand(t, "SELECT", "1")
+	c.expectCommand(t, "SET", "a", "b")
+
+	offset = h.repl.masterOffset()
+	h.repl.feed(&rpdb.Forward{DB: 1, Op: "Del", Args: []interface{}{"a"}})
+	c.expectCommand(t, "DEL", "a")
+
+	c2 := newPubSubClient(t, h)
+	c2.send(t, "psync", replid, offset+1)
+	checkerror(t, nil, c2.readLine(t) == "+CONTINUE "+replid)
+	c2.expectCommand(t, "DEL", "a")
+	checkerror(t, nil, h.repl.numSlaves() == 2)
+
+	var b bytes.Buffer
+	h.infoReplication(&b)
+	info := b.String()
+	checkerror(t, nil, strings.Contains(info, "role:master\n"))
+	checkerror(t, nil, strings.Contains(info, "connected_slaves:2\n"))
+	checkerror(t, nil, strings.Contains(info, "master_replid:"+replid+"\n"))
+}
+
+func TestInfoReplicationSlave(t *testing.T) {
+	h := newPubSubHandler(t)
+	src, err := h.newSyncSource(slaveOfSource, "127.0.0.1:6379", nil)
+	checkerror(t, err, true)
+	src.state.set("8e2d7f", 1024)
+	h.sources.m = map[string]*syncSource{src.name: src}
+
+	var b bytes.Buffer
+	h.infoReplication(&b)
+	info := b.String()
+	for _, line := range []string{"role:slave", "master_host:127.0.0.1", "master_port:6379",
+		"master_link_status:down", "master_sync_in_progress:0", "slave_repl_offset:1024"} {
+		checkerror(t, nil, strings.Contains(info, line+"\n"))
+	}
+
+	src.setStatus("sync")
+	src.counters.rdbRemains.Set(100)
+	b.Reset()
+	h.infoReplication(&b)
+	checkerror(t, nil, strings.Contains(b.String(), "master_sync_left_bytes:100\n"))
+
+	src.setStatus("connected")
+	src.touch()
+	b.Reset()
+	h.infoReplication(&b)
+	info = b.String()
+	checkerror(t, nil, strings.Contains(info, "master_link_status:up\n"))
+	checkerror(t, nil, strings.Contains(info, "master_last_io_seconds_ago:0\n"))
+}
@@ -0,0 +1,175 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+)
+
+const saveTimeFormat = "20060102-150405"
+
+// saveRule triggers a dump once at least writes writes have been committed
+// and secs seconds have passed since the last successful dump.
+type saveRule struct {
+	secs   int64
+	writes uint64
+}
+
+// parseSaveRules parses the save rules of the config, which are pairs of
+// seconds and writes, e.g. "900 1 300 10 60 10000".
+func parseSaveRules(s string) ([]saveRule, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, errors.Errorf("invalid save rules '%s'", s)
+	}
+	var rules []saveRule
+	for i := 0; i < len(fields); i += 2 {
+		secs, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil || secs <= 0 {
+			return nil, errors.Errorf("invalid save rules '%s', seconds = %s", s, fields[i])
+		}
+		writes, err := strconv.ParseUint(fields[i+1], 10, 64)
+		if err != nil || writes == 0 {
+			return nil, errors.Errorf("invalid save rules '%s', writes = %s", s, fields[i+1])
+		}
+		rules = append(rules, saveRule{secs: secs, writes: writes})
+	}
+	return rules, nil
+}
+
+// matchSaveRules tells if any rule is matched by the writes committed and the
+// seconds passed since the last successful dump.
+func matchSaveRules(rules []saveRule, writes uint64, secs int64) bool {
+	for _, r := range rules {
+		if writes >= r.writes && secs >= r.secs {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledDumpPath returns the path of a scheduled dump taken at t, which is
+// next to path and named after it, e.g. dump-20150102-150405.rdb.
+func scheduledDumpPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + t.Format(saveTimeFormat) + ext
+}
+
+// scheduledDumps returns the scheduled dumps of path and the time they were
+// taken, from the oldest to the newest.
+func scheduledDumps(path string) ([]string, []time.Time, error) {
+	dir, ext := filepath.Dir(path), filepath.Ext(path)
+	prefix := strings.TrimSuffix(filepath.Base(path), ext) + "-"
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		s := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if _, err := time.ParseInLocation(saveTimeFormat, s, time.Local); err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	paths := make([]string, len(names))
+	times := make([]time.Time, len(names))
+	for i, name := range names {
+		s := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		times[i], _ = time.ParseInLocation(saveTimeFormat, s, time.Local)
+		paths[i] = filepath.Join(dir, name)
+	}
+	return paths, times, nil
+}
+
+// pruneDumps removes the scheduled dumps of path beyond the newest count
+// ones, or older than age. Zero count or age means no limit.
+func pruneDumps(path string, count int, age time.Duration) error {
+	paths, times, err := scheduledDumps(path)
+	if err != nil {
+		return err
+	}
+	for i := range paths {
+		expired := age > 0 && time.Since(times[i]) > age
+		if (count > 0 && len(paths)-i > count) || expired {
+			log.Infof("remove scheduled dump '%s'", paths[i])
+			if err := os.Remove(paths[i]); err != nil && !os.IsNotExist(err) {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return nil
+}
+
+// daemonSaveRules dumps the database to a timestamped file when any of the
+// save rules is matched, and prunes the old dumps after every dump.
+func (h *Handler) daemonSaveRules(bl *rpdb.Rpdb, rules []saveRule) {
+	var job *bgsaveJob
+	var lastTry time.Time
+	for {
+		select {
+		case <-h.signal:
+			return
+		case <-time.After(time.Second):
+		}
+
+		if job != nil {
+			select {
+			case <-job.done:
+			default:
+				continue
+			}
+			if job.err == nil {
+				age := time.Duration(h.config.SaveRetainAge) * time.Second
+				if err := pruneDumps(h.config.DumpPath, h.config.SaveRetainCount, age); err != nil {
+					log.WarnErrorf(err, "prune scheduled dumps failed")
+				}
+			}
+			job = nil
+		}
+
+		h.bgsave.mu.Lock()
+		writes := bl.Writes() - h.bgsave.lastWrites
+		secs := int64(time.Since(h.bgsave.lastSave) / time.Second)
+		failed := h.bgsave.lastStatus == "err"
+		busy := h.bgsave.job != nil
+		h.bgsave.mu.Unlock()
+
+		if busy {
+			continue
+		}
+		// retry a failed dump after a while, not every second
+		if failed && time.Since(lastTry) < time.Second*5 {
+			continue
+		}
+		if !matchSaveRules(rules, writes, secs) {
+			continue
+		}
+
+		now := time.Now()
+		path := scheduledDumpPath(h.config.DumpPath, now)
+		j, err := h.startBgsave(bl, path)
+		if err != nil {
+			log.InfoErrorf(err, "scheduled bgsave to '%s' failed", path)
+			continue
+		}
+		log.Infof("scheduled bgsave to '%s', writes = %d, seconds = %d", path, writes, secs)
+		job, lastTry = j, now
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSaveRules(t *testing.T) {
+	rules, err := parseSaveRules("900 1 300 10 60 10000")
+	checkerror(t, err, len(rules) == 3)
+	checkerror(t, nil, rules[1].secs == 300 && rules[1].writes == 10)
+
+	rules, err = parseSaveRules("")
+	checkerror(t, err, len(rules) == 0)
+
+	_, err = parseSaveRules("900")
+	checkerror(t, nil, err != nil)
+	_, err = parseSaveRules("900 0")
+	checkerror(t, nil, err != nil)
+
+	rules, _ = parseSaveRules("900 1 60 100")
+	checkerror(t, nil, !matchSaveRules(rules, 0, 1000))
+	checkerror(t, nil, !matchSaveRules(rules, 99, 899))
+	checkerror(t, nil, matchSaveRules(rules, 100, 60))
+	checkerror(t, nil, matchSaveRules(rules, 1, 900))
+}
+
+func TestPruneDumps(t *testing.T) {
+	dir := "/tmp/testdb-save"
+	os.RemoveAll(dir)
+	checkerror(t, os.MkdirAll(dir, 0755), true)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dump.rdb")
+	now := time.Now()
+	checkerror(t, nil, scheduledDumpPath(path, now) == filepath.Join(dir, "dump-"+now.Format(saveTimeFormat)+".rdb"))
+
+	for _, name := range []string{"dump.rdb", "dump-x.rdb", "other-20150101-000000.rdb"} {
+		checkerror(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0600), true)
+	}
+	for i := 0; i < 5; i++ {
+		p := scheduledDumpPath(path, now.Add(-time.Hour*time.Duration(i)))
+		checkerror(t, ioutil.WriteFile(p, nil, 0600), true)
+	}
+	paths, _, err := scheduledDumps(path)
+	checkerror(t, err, len(paths) == 5)
+
+	checkerror(t, pruneDumps(path, 4, 0), true)
+	paths, _, err = scheduledDumps(path)
+	checkerror(t, err, len(paths) == 4)
+
+	checkerror(t, pruneDumps(path, 0, time.Minute*90), true)
+	paths, _, err = scheduledDumps(path)
+	checkerror(t, err, len(paths) == 2 && paths[1] == scheduledDumpPath(path, now))
+
+	infos, err := ioutil.ReadDir(dir)
+	checkerror(t, err, len(infos) == 5)
+}
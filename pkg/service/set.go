@@ -70,7 +70,7 @@ func (h *Handler) SMembers(arg0 interface{}, args [][]byte) (redis.Resp, error)
 		return toRespError(err)
 	}
 
-	if a, err := s.Rpdb().SMembers(s.DB(), iconvert(args)...); err != nil {
+	if a, err := s.Rpdb().SMembersContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		resp := redis.NewArray()
@@ -4,7 +4,11 @@
 package service
 
 import (
+	"sort"
+	"strings"
+
 	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
 	"github.com/wandoulabs/redis-port/pkg/redis"
 )
 
@@ -26,6 +30,60 @@ func (h *Handler) SlotsRestore(arg0 interface{}, args [][]byte) (redis.Resp, err
 	}
 }
 
+// SLOTSRESTORECHUNK key seq value
+func (h *Handler) SlotsRestoreChunk(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 3 {
+		return toRespErrorf("len(args) = %d, expect = 3", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if err := s.Rpdb().SlotsRestoreChunk(s.DB(), iconvert(args)...); err != nil {
+		return toRespError(err)
+	} else {
+		return redis.NewString("OK"), nil
+	}
+}
+
+// SLOTSRESTORECOMMIT key ttlms
+func (h *Handler) SlotsRestoreCommit(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 2 {
+		return toRespErrorf("len(args) = %d, expect = 2", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if err := s.Rpdb().SlotsRestoreCommit(s.DB(), iconvert(args)...); err != nil {
+		return toRespError(err)
+	} else {
+		return redis.NewString("OK"), nil
+	}
+}
+
+// SLOTSRESTOREABORT key
+func (h *Handler) SlotsRestoreAbort(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 1 {
+		return toRespErrorf("len(args) = %d, expect = 1", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if n, err := s.Rpdb().SlotsRestoreAbort(s.DB(), iconvert(args)...); err != nil {
+		return toRespError(err)
+	} else {
+		return redis.NewInt(n), nil
+	}
+}
+
 // SLOTSMGRTSLOT host port timeout slot
 func (h *Handler) SlotsMgrtSlot(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 	if len(args) != 4 {
@@ -37,7 +95,7 @@ func (h *Handler) SlotsMgrtSlot(arg0 interface{}, args [][]byte) (redis.Resp, er
 		return toRespError(err)
 	}
 
-	if n, err := s.Rpdb().SlotsMgrtSlot(s.DB(), iconvert(args)...); err != nil {
+	if n, err := s.Rpdb().SlotsMgrtSlotContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		resp := redis.NewArray()
@@ -62,7 +120,7 @@ func (h *Handler) SlotsMgrtTagSlot(arg0 interface{}, args [][]byte) (redis.Resp,
 		return toRespError(err)
 	}
 
-	if n, err := s.Rpdb().SlotsMgrtTagSlot(s.DB(), iconvert(args)...); err != nil {
+	if n, err := s.Rpdb().SlotsMgrtTagSlotContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		resp := redis.NewArray()
@@ -87,7 +145,7 @@ func (h *Handler) SlotsMgrtOne(arg0 interface{}, args [][]byte) (redis.Resp, err
 		return toRespError(err)
 	}
 
-	if n, err := s.Rpdb().SlotsMgrtOne(s.DB(), iconvert(args)...); err != nil {
+	if n, err := s.Rpdb().SlotsMgrtOneContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		return redis.NewInt(n), nil
@@ -105,7 +163,7 @@ func (h *Handler) SlotsMgrtTagOne(arg0 interface{}, args [][]byte) (redis.Resp,
 		return toRespError(err)
 	}
 
-	if n, err := s.Rpdb().SlotsMgrtTagOne(s.DB(), iconvert(args)...); err != nil {
+	if n, err := s.Rpdb().SlotsMgrtTagOneContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		return redis.NewInt(n), nil
@@ -140,6 +198,149 @@ func (h *Handler) SlotsInfo(arg0 interface{}, args [][]byte) (redis.Resp, error)
 	}
 }
 
+// SLOTSSTATS [start [count]]
+func (h *Handler) SlotsStats(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) > 2 {
+		return toRespErrorf("len(args) = %d, expect <= 2", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	if stats, err := s.Rpdb().SlotsStats(s.DB(), iconvert(args)...); err != nil {
+		return toRespError(err)
+	} else {
+		var a []*rpdb.SlotStats
+		for _, x := range stats {
+			if x.Keys != 0 {
+				a = append(a, x)
+			}
+		}
+		sort.Sort(slotStatsBySize(a))
+		resp := redis.NewArray()
+		for _, x := range a {
+			resp.Append(slotStatsResp(x))
+		}
+		return resp, nil
+	}
+}
+
+// slotStatsResp encodes the stats of a slot as [slot, keys, bytes].
+func slotStatsResp(x *rpdb.SlotStats) redis.Resp {
+	resp := redis.NewArray()
+	resp.AppendInt(int64(x.Slot))
+	resp.AppendInt(x.Keys)
+	resp.AppendInt(x.Bytes)
+	return resp
+}
+
+// slotStatsBySize sorts the slots from the largest to the smallest.
+type slotStatsBySize []*rpdb.SlotStats
+
+func (a slotStatsBySize) Len() int {
+	return len(a)
+}
+
+func (a slotStatsBySize) Less(i, j int) bool {
+	if a[i].Bytes != a[j].Bytes {
+		return a[i].Bytes > a[j].Bytes
+	}
+	if a[i].Keys != a[j].Keys {
+		return a[i].Keys > a[j].Keys
+	}
+	return a[i].Slot < a[j].Slot
+}
+
+func (a slotStatsBySize) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+// SLOTSSCAN slot cursor [COUNT count]
+func (h *Handler) SlotsScan(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) != 2 && len(args) != 4 {
+		return toRespErrorf("len(args) = %d, expect = 2 or 4", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	iargs := iconvert(args[:2])
+	if len(args) == 4 {
+		if opt := strings.ToLower(string(args[2])); opt != "count" {
+			return toRespErrorf("unknown option %s", opt)
+		}
+		iargs = append(iargs, args[3])
+	}
+
+	if cursor, keys, err := s.Rpdb().SlotsScan(s.DB(), iargs...); err != nil {
+		return toRespError(err)
+	} else {
+		a := redis.NewArray()
+		for _, key := range keys {
+			a.AppendBulkBytes(key)
+		}
+		resp := redis.NewArray()
+		resp.AppendBulkBytes(cursor)
+		resp.Append(a)
+		return resp, nil
+	}
+}
+
+// SLOTSDEL slot [slot ...]
+//
+// Like codis, it replies with the number of keys left in every slot once the
+// keys are deleted, which are the keys written to the slots meanwhile. The
+// keys are deleted in small batches, so the server is never blocked for long,
+// and command_timeout doesn't apply, it would leave the slots half deleted.
+func (h *Handler) SlotsDel(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	slots := make([]uint32, len(args))
+	for i, arg := range args {
+		v, err := rpdb.ParseUint(arg)
+		if err != nil {
+			return toRespError(err)
+		}
+		if v >= rpdb.MaxSlotNum {
+			return toRespErrorf("invalid slot = %d", v)
+		}
+		slots[i] = uint32(v)
+	}
+
+	bl, db := s.Rpdb(), s.DB()
+	log.Infof("delete slots %v of db %d", slots, db)
+	if n, err := bl.SlotsDelContext(s.Context(), db, iconvert(args)...); err != nil {
+		log.WarnErrorf(err, "delete slots %v of db %d failed, keys = %d", slots, db, n)
+		return toRespError(err)
+	} else {
+		log.Infof("delete slots %v of db %d done, keys = %d", slots, db, n)
+	}
+
+	resp := redis.NewArray()
+	for _, slot := range slots {
+		m, err := bl.SlotsInfo(db, slot, 1)
+		if err != nil {
+			return toRespError(err)
+		}
+		x := redis.NewArray()
+		x.AppendInt(int64(slot))
+		x.AppendInt(m[slot])
+		resp.Append(x)
+	}
+	return resp, nil
+}
+
 // SLOTSHASHKEY key [key...]
 func (h *Handler) SlotsHashKey(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 	if len(args) == 0 {
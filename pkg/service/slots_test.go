@@ -5,8 +5,10 @@ package service
 
 import (
 	"bufio"
+	"context"
 	"net"
 	"os"
+	"strconv"
 	"testing"
 
 	"github.com/wandoulabs/rpdb/pkg/rpdb"
@@ -36,6 +38,10 @@ func (s *fakeSession2) Rpdb() *rpdb.Rpdb {
 	return testbl2
 }
 
+func (s *fakeSession2) Context() context.Context {
+	return context.Background()
+}
+
 func init() {
 	const path = "/tmp/testdb2-rocksdb"
 	if err := os.RemoveAll(path); err != nil {
@@ -92,6 +98,54 @@ func TestSlotsHashKey(t *testing.T) {
 	checkintarray(t, []int64{579, 1017, 879}, c, "slotshashkey", "a", "b", "c")
 }
 
+func checkintarrays(t *testing.T, s Session, cmd string, args ...interface{}) [][]int64 {
+	rsp, err := server.Dispatch(s, request(cmd, args...))
+	checkerror(t, err, rsp != nil)
+	x, ok := rsp.(*redis.Array)
+	checkerror(t, nil, ok)
+	var stats [][]int64
+	for _, v := range x.Value {
+		a, ok := v.(*redis.Array)
+		checkerror(t, nil, ok)
+		var p []int64
+		for _, v := range a.Value {
+			i, ok := v.(*redis.Int)
+			checkerror(t, nil, ok)
+			p = append(p, i.Value)
+		}
+		stats = append(stats, p)
+	}
+	return stats
+}
+
+func TestSlotsStats(t *testing.T) {
+	c := client(t)
+	slot := int64(rpdb.HashTagToSlot([]byte("slotsstats")))
+	k1 := "{slotsstats}" + random(t)
+	k2 := "{slotsstats}" + random(t)
+	k3 := "{slotsstats}" + random(t)
+	checkok(t, c, "mset", k1, "1", k2, "2")
+	checkint(t, 1, c, "hset", k3, "field", "value")
+
+	stats := checkintarrays(t, c, "slotsinfo", slot, 1)
+	checkerror(t, nil, len(stats) == 1 && len(stats[0]) == 2 && stats[0][0] == slot && stats[0][1] == 3)
+	stats = checkintarrays(t, c, "slotsstats", slot, 1)
+	checkerror(t, nil, len(stats) == 1 && stats[0][0] == slot && stats[0][1] == 3)
+
+	stats = checkintarrays(t, c, "slotsstats")
+	for i := 1; i < len(stats); i++ {
+		checkerror(t, nil, stats[i-1][2] >= stats[i][2] && stats[i][1] != 0)
+	}
+
+	checkint(t, 2, c, "del", k1, k2)
+	stats = checkintarrays(t, c, "slotsinfo", slot, 1)
+	checkerror(t, nil, len(stats) == 1 && stats[0][1] == 1)
+
+	checkint(t, 1, c, "del", k3)
+	stats = checkintarrays(t, c, "slotsstats", slot, 1)
+	checkerror(t, nil, len(stats) == 0)
+}
+
 func TestSlotsMgrtOne(t *testing.T) {
 	c := client(t)
 	k1 := "{tag}" + random(t)
@@ -165,3 +219,66 @@ func TestSlotsMgrtTagSlot(t *testing.T) {
 	xcheck2(t, 0, k1, "0")
 	xcheck2(t, 0, k3, "100")
 }
+
+func TestSlotsMgrtChunks(t *testing.T) {
+	testbl.SetMigrateChunkSize(4)
+	defer testbl.SetMigrateChunkSize(0)
+
+	c := client(t)
+	k1 := "{tag}" + random(t)
+	k2 := "{tag}" + random(t)
+	hash := make(map[string]string)
+	args := []interface{}{k1}
+	for i := 0; i < 10; i++ {
+		f, v := strconv.Itoa(i), random(t)
+		hash[f] = v
+		args = append(args, f, v)
+	}
+	checkok(t, c, "hmset", args...)
+	checkint(t, 10, c, "rpush", k2, "0", "1", "2", "3", "4", "5", "6", "7", "8", "9")
+
+	checkint(t, 2, c, "slotsmgrttagone", "127.0.0.1", port, 1000, k1)
+	checkint(t, 0, c, "exists", k1)
+	checkint(t, 0, c, "exists", k2)
+
+	s := &fakeSession2{}
+	checkhash(t, s, k1, hash)
+	checklist(t, s, k2, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9"})
+}
+
+func TestSlotsScanDel(t *testing.T) {
+	c := client(t)
+	slot := int64(rpdb.HashTagToSlot([]byte("slotsdel")))
+	keys := make(map[string]bool)
+	for i := 0; i < 5; i++ {
+		key := "{slotsdel}" + random(t)
+		checkok(t, c, "set", key, "value")
+		keys[key] = true
+	}
+
+	cursor := "0"
+	for {
+		rsp, err := server.Dispatch(c, request("slotsscan", slot, cursor, "count", 2))
+		checkerror(t, err, rsp != nil)
+		x, ok := rsp.(*redis.Array)
+		checkerror(t, nil, ok && len(x.Value) == 2)
+		next, ok := x.Value[0].(*redis.BulkBytes)
+		checkerror(t, nil, ok)
+		a, ok := x.Value[1].(*redis.Array)
+		checkerror(t, nil, ok && len(a.Value) <= 2)
+		for _, v := range a.Value {
+			key, ok := v.(*redis.BulkBytes)
+			checkerror(t, nil, ok && keys[string(key.Value)])
+			delete(keys, string(key.Value))
+		}
+		if cursor = string(next.Value); cursor == "0" {
+			break
+		}
+	}
+	checkerror(t, nil, len(keys) == 0)
+
+	stats := checkintarrays(t, c, "slotsdel", slot)
+	checkerror(t, nil, len(stats) == 1 && stats[0][0] == slot && stats[0][1] == 0)
+	m, err := testbl.SlotsInfo(0, uint32(slot), 1)
+	checkerror(t, err, m[uint32(slot)] == 0)
+}
@@ -0,0 +1,293 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/counter"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+// slaveOfSource is the name of the source set by SLAVEOF.
+const slaveOfSource = "slaveof"
+
+// syncSource is a master replicated from. Every source has its own link, sync
+// pipe file, sync state and counters. The sources added by SYNCSOURCE are
+// loaded into a single target db, so a full resync of one of them only clears
+// that db.
+type syncSource struct {
+	name   string
+	addr   string
+	db     int64
+	filter *syncFilter
+	pipe   string
+	state  syncState
+
+	mu        sync.Mutex
+	status    string
+	downSince time.Time
+
+	lastIO   counter.Int64
+	counters syncCounters
+
+	stop chan int
+	done chan int
+}
+
+type syncCounters struct {
+	rdbRemains    counter.Int64
+	totalBytes    counter.Int64
+	cacheBytes    counter.Int64
+	applyQueue    counter.Int64
+	applyLagBytes counter.Int64
+	applyLagMs    counter.Int64
+}
+
+type syncSources struct {
+	mu sync.Mutex
+	m  map[string]*syncSource
+}
+
+// newSyncSource creates a source, the sync pipe file of the source is named
+// after it, except for the one set by SLAVEOF.
+func (h *Handler) newSyncSource(name, addr string, filter *syncFilter) (*syncSource, error) {
+	src := &syncSource{
+		name: name, addr: addr, db: -1, filter: filter,
+		status: "connecting", downSince: time.Now(),
+		stop: make(chan int), done: make(chan int),
+	}
+	if filter != nil && filter.into != nil {
+		src.db = int64(*filter.into)
+	}
+	if h.config != nil {
+		src.pipe = h.config.SyncFilePath
+	}
+	if name != slaveOfSource && src.pipe != "" {
+		src.pipe += "." + name
+	}
+	return src, nil
+}
+
+func (src *syncSource) setStatus(status string) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.status == "connected" && status != "connected" {
+		src.downSince = time.Now()
+	}
+	src.status = status
+}
+
+func (src *syncSource) getStatus() string {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	return src.status
+}
+
+// linkDownSeconds returns how long the link to the master has been down, or
+// -1 if it is up.
+func (src *syncSource) linkDownSeconds() int64 {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.status == "connected" {
+		return -1
+	}
+	return int64(time.Since(src.downSince) / time.Second)
+}
+
+func (src *syncSource) touch() {
+	src.lastIO.Set(time.Now().Unix())
+}
+
+// lastIOSeconds returns the seconds since the last data from the master, or
+// -1 if nothing has been received yet.
+func (src *syncSource) lastIOSeconds() int64 {
+	if t := src.lastIO.Get(); t != 0 {
+		return time.Now().Unix() - t
+	}
+	return -1
+}
+
+func (src *syncSource) saveState(bl *rpdb.Rpdb) {
+	if err := src.state.save(bl, src.name); err != nil {
+		log.WarnErrorf(err, "save sync state of source %s failed", src.name)
+	}
+}
+
+func (src *syncSource) close() {
+	close(src.stop)
+	<-src.done
+}
+
+func (src *syncSource) String() string {
+	replid, offset := src.state.get()
+	c := &src.counters
+	return fmt.Sprintf("addr=%s,db=%d,status=%s,replid=%s,offset=%d,rdb_remains=%d,total_bytes=%d,cache_bytes=%d,apply_queue=%d,apply_lag_bytes=%d,apply_lag_ms=%d",
+		src.addr, src.db, src.getStatus(), replid, offset,
+		c.rdbRemains.Get(), c.totalBytes.Get(), c.cacheBytes.Get(),
+		c.applyQueue.Get(), c.applyLagBytes.Get(), c.applyLagMs.Get())
+}
+
+// startSource starts to replicate from src with the connection c to its
+// master. A source set by SLAVEOF replaces the previous one, while the other
+// sources must have distinct names and target dbs. Mirroring a whole master
+// with SLAVEOF excludes any other source.
+func (h *Handler) startSource(src *syncSource, c *conn) error {
+	select {
+	case <-h.signal:
+		return errors.New("sync master has been closed")
+	default:
+	}
+
+	h.sources.mu.Lock()
+	if h.sources.m == nil {
+		h.sources.m = make(map[string]*syncSource)
+	}
+	old := h.sources.m[src.name]
+	for _, x := range h.sources.m {
+		if x == old {
+			continue
+		}
+		switch {
+		case x.name == slaveOfSource && x.filter == nil:
+			h.sources.mu.Unlock()
+			return errors.New("slaveof mirrors the whole database, no other source is allowed")
+		case src.name == slaveOfSource && src.filter == nil:
+			h.sources.mu.Unlock()
+			return errors.Errorf("source %s exists, slaveof can't mirror the whole database", x.name)
+		case src.db >= 0 && x.db == src.db:
+			h.sources.mu.Unlock()
+			return errors.Errorf("db %d is the target of source %s", src.db, x.name)
+		}
+	}
+	if old != nil && src.name != slaveOfSource {
+		h.sources.mu.Unlock()
+		return errors.Errorf("source %s exists", src.name)
+	}
+	h.sources.m[src.name] = src
+	h.sources.mu.Unlock()
+
+	if old != nil {
+		old.close()
+	}
+	go func() {
+		defer close(src.done)
+		h.doSyncLoop(src, c)
+	}()
+	log.Infof("start source %s, addr = %s, filter = [%s]", src.name, src.addr, src.filter)
+	return nil
+}
+
+func (h *Handler) stopSource(name string) bool {
+	h.sources.mu.Lock()
+	src := h.sources.m[name]
+	delete(h.sources.m, name)
+	h.sources.mu.Unlock()
+	if src == nil {
+		return false
+	}
+	src.close()
+	log.Infof("stop source %s, addr = %s", src.name, src.addr)
+	return true
+}
+
+func (h *Handler) getSource(name string) *syncSource {
+	h.sources.mu.Lock()
+	defer h.sources.mu.Unlock()
+	return h.sources.m[name]
+}
+
+func (h *Handler) listSources() []*syncSource {
+	h.sources.mu.Lock()
+	defer h.sources.mu.Unlock()
+	var names []string
+	for name := range h.sources.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	srcs := make([]*syncSource, len(names))
+	for i, name := range names {
+		srcs[i] = h.sources.m[name]
+	}
+	return srcs
+}
+
+// SYNCSOURCE ADD name host port db [options ...] / REMOVE name / LIST
+func (h *Handler) SyncSource(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) == 0 {
+		return toRespErrorf("len(args) = %d, expect != 0", len(args))
+	}
+
+	s, err := session(arg0, args)
+	if err != nil {
+		return toRespError(err)
+	}
+
+	sub, args := strings.ToLower(string(args[0])), args[1:]
+
+	switch sub {
+	default:
+		return toRespErrorf("unknown sub-command = %s", sub)
+	case "add":
+		if len(args) < 4 {
+			return toRespErrorf("len(args) = %d, expect >= 4", len(args))
+		}
+		name := string(args[0])
+		if name == slaveOfSource {
+			return toRespErrorf("source name %s is reserved for slaveof", name)
+		}
+		db, err := parseDB(args[3])
+		if err != nil {
+			return toRespError(err)
+		}
+		filter, err := parseSyncFilter(args[4:])
+		if err != nil {
+			return toRespError(err)
+		}
+		if filter == nil {
+			filter = &syncFilter{}
+		} else if len(filter.mapdb) != 0 {
+			return toRespErrorf("option mapdb conflicts with the target db")
+		}
+		filter.into = &db
+
+		src, err := h.newSyncSource(name, fmt.Sprintf("%s:%s", args[1], args[2]), filter)
+		if err != nil {
+			return toRespError(err)
+		}
+		c, err := dialMaster(src.addr, s.Rpdb())
+		if err != nil {
+			return toRespError(err)
+		}
+		if err := h.startSource(src, c); err != nil {
+			c.Close()
+			return toRespError(err)
+		}
+		return redis.NewString("OK"), nil
+	case "remove":
+		if len(args) != 1 {
+			return toRespErrorf("len(args) = %d, expect = 1", len(args))
+		}
+		if !h.stopSource(string(args[0])) {
+			return toRespErrorf("source %s doesn't exist", args[0])
+		}
+		return redis.NewString("OK"), nil
+	case "list":
+		if len(args) != 0 {
+			return toRespErrorf("len(args) = %d, expect = 0", len(args))
+		}
+		resp := redis.NewArray()
+		for _, src := range h.listSources() {
+			resp.AppendBulkBytes([]byte(fmt.Sprintf("%s:%s", src.name, src)))
+		}
+		return resp, nil
+	}
+}
@@ -5,61 +5,110 @@ package service
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
-	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/wandoulabs/rpdb/pkg/rpdb"
-	"github.com/wandoulabs/redis-port/pkg/libs/counter"
 	"github.com/wandoulabs/redis-port/pkg/libs/errors"
-	"github.com/wandoulabs/redis-port/pkg/libs/io/ioutils"
 	"github.com/wandoulabs/redis-port/pkg/libs/io/pipe"
 	"github.com/wandoulabs/redis-port/pkg/libs/log"
-	"github.com/wandoulabs/redis-port/pkg/rdb"
 	"github.com/wandoulabs/redis-port/pkg/redis"
 )
 
-// BGSAVE
-func (h *Handler) Bgsave(arg0 interface{}, args [][]byte) (redis.Resp, error) {
-	if len(args) != 0 {
-		return toRespErrorf("len(args) = %d, expect = 0", len(args))
-	}
+var (
+	ErrPSyncRejected  = errors.Static("psync rejected by master")
+	ErrSyncUnfiltered = errors.Static("sync command can't be applied under the filter")
+)
 
-	s, err := session(arg0, args)
+// syncState tracks the replication id and offset of the stream received from
+// the master, so a restarted or reconnected link can resume with psync. The
+// filter the stream was received with is kept as well, since a stream can't
+// be resumed under a different filter. The state is stored in the batches of
+// the writes applied from the stream, see rpdb.SyncView, so it's loaded from
+// the database and always agrees with the data.
+type syncState struct {
+	mu      sync.Mutex
+	replid  string
+	offset  int64
+	filter  string
+	applied map[uint32]int64
+}
+
+// load reads the state of the source name from bl, it is dropped if it was
+// received under another filter.
+func (s *syncState) load(bl *rpdb.Rpdb, name, filter string) error {
+	x, err := bl.SyncState(name)
 	if err != nil {
-		return toRespError(err)
+		return err
 	}
-
-	bg := h.counters.bgsave.Add(1)
-	defer h.counters.bgsave.Sub(1)
-
-	if bg != 1 {
-		return toRespErrorf("bgsave is busy: %d, should be 1")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if x.Filter != filter {
+		s.replid, s.offset, s.applied = "", 0, nil
+	} else {
+		s.replid, s.offset, s.applied = x.ReplID, x.Offset, x.Applied
 	}
+	s.filter = filter
+	return nil
+}
 
-	sp, err := s.Rpdb().NewSnapshot()
-	if err != nil {
-		return toRespError(err)
+// save stores the offset of the commands applied, the ones after the last
+// write, like PING or the commands filtered out, are not stored otherwise.
+func (s *syncState) save(bl *rpdb.Rpdb, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replid == "" {
+		return nil
 	}
-	defer s.Rpdb().ReleaseSnapshot(sp)
+	return bl.SetSyncState(name, &rpdb.SyncState{ReplID: s.replid, Offset: s.offset, Filter: s.filter})
+}
 
-	if err := h.bgsaveTo(sp, h.config.DumpPath); err != nil {
-		return toRespError(err)
-	} else {
-		return redis.NewString("OK"), nil
+// reset stores the state of a stream, right after its rdb is loaded into bl,
+// or drops it before bl is modified in place if replid is empty.
+func (s *syncState) reset(bl *rpdb.Rpdb, name string, replid string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	x := &rpdb.SyncState{ReplID: replid, Offset: offset, Filter: s.filter, Applied: make(map[uint32]int64)}
+	if err := bl.SetSyncState(name, x); err != nil {
+		return err
 	}
+	s.replid, s.offset, s.applied = replid, offset, nil
+	return nil
+}
+
+func (s *syncState) get() (string, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replid, s.offset
+}
+
+func (s *syncState) set(replid string, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replid, s.offset = replid, offset
+}
+
+// takeApplied returns the end offsets of the commands applied after offset
+// for every slot, once.
+func (s *syncState) takeApplied() map[uint32]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.applied
+	s.applied = nil
+	return m
 }
 
-// BGSAVETO path
-func (h *Handler) BgsaveTo(arg0 interface{}, args [][]byte) (redis.Resp, error) {
-	if len(args) != 1 {
-		return toRespErrorf("len(args) = %d, expect = 1", len(args))
+// SLAVEOF host port [DB db] [EXCLUDEDB db] [MATCH pattern] [EXCLUDE pattern] [MAPDB src dst] [PREFIX prefix]
+func (h *Handler) SlaveOf(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	if len(args) < 2 {
+		return toRespErrorf("len(args) = %d, expect >= 2", len(args))
 	}
 
 	s, err := session(arg0, args)
@@ -67,147 +116,96 @@ func (h *Handler) BgsaveTo(arg0 interface{}, args [][]byte) (redis.Resp, error)
 		return toRespError(err)
 	}
 
-	bg := h.counters.bgsave.Add(1)
-	defer h.counters.bgsave.Sub(1)
+	addr := fmt.Sprintf("%s:%s", string(args[0]), string(args[1]))
 
-	if bg != 1 {
-		return toRespErrorf("bgsave is busy: %d, should be 1", bg)
+	if strings.ToLower(addr) == "no:one" {
+		if len(args) != 2 {
+			return toRespErrorf("len(args) = %d, expect = 2", len(args))
+		}
+		log.Infof("set slave of no one")
+		h.stopSource(slaveOfSource)
+		return redis.NewString("OK"), nil
 	}
 
-	sp, err := s.Rpdb().NewSnapshot()
+	filter, err := parseSyncFilter(args[2:])
 	if err != nil {
 		return toRespError(err)
 	}
-	defer s.Rpdb().ReleaseSnapshot(sp)
-
-	if err := h.bgsaveTo(sp, string(args[0])); err != nil {
+	src, err := h.newSyncSource(slaveOfSource, addr, filter)
+	if err != nil {
 		return toRespError(err)
-	} else {
-		return redis.NewString("OK"), nil
 	}
-}
-
-func (h *Handler) bgsaveTo(sp *rpdb.RpdbSnapshot, path string) error {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	c, err := dialMaster(addr, s.Rpdb())
 	if err != nil {
-		return errors.Trace(err)
-	}
-	defer f.Close()
-
-	buf := bufio.NewWriterSize(f, 1024*1024)
-	enc := rdb.NewEncoder(buf)
-
-	if err := enc.EncodeHeader(); err != nil {
-		return err
-	}
-
-	ncpu := runtime.GOMAXPROCS(0)
-	cron := time.Millisecond * time.Duration(100)
-	for {
-		objs, more, err := sp.LoadObjCron(cron, ncpu, 1024)
-		if err != nil {
-			return err
-		} else {
-			for _, obj := range objs {
-				if err := enc.EncodeObject(obj.DB, obj.Key, obj.ExpireAt, obj.Value); err != nil {
-					return err
-				}
-			}
-		}
-		if !more {
-			break
-		}
-	}
-
-	if err := enc.EncodeFooter(); err != nil {
-		return err
+		return toRespError(err)
 	}
-
-	if err := errors.Trace(buf.Flush()); err != nil {
-		return err
+	if err := h.startSource(src, c); err != nil {
+		c.Close()
+		return toRespError(err)
 	}
-	return errors.Trace(f.Close())
+	log.Infof("set slave of %s, filter = [%s]", addr, filter)
+	return redis.NewString("OK"), nil
 }
 
-// SLAVEOF host port
-func (h *Handler) SlaveOf(arg0 interface{}, args [][]byte) (redis.Resp, error) {
-	if len(args) != 2 {
-		return toRespErrorf("len(args) = %d, expect = 2", len(args))
-	}
+// REPLICAOF host port [options ...]
+func (h *Handler) ReplicaOf(arg0 interface{}, args [][]byte) (redis.Resp, error) {
+	return h.SlaveOf(arg0, args)
+}
 
-	s, err := session(arg0, args)
+func dialMaster(addr string, bl *rpdb.Rpdb) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", addr, time.Second)
 	if err != nil {
-		return toRespError(err)
-	}
-
-	addr := fmt.Sprintf("%s:%s", string(args[0]), string(args[1]))
-	log.Infof("set slave of %s", addr)
-
-	var c *conn
-	if strings.ToLower(addr) != "no:one" {
-		if nc, err := net.DialTimeout("tcp", addr, time.Second); err != nil {
-			return toRespError(errors.Trace(err))
-		} else {
-			c = newConn(nc, s.Rpdb(), 0)
-			if err := c.ping(); err != nil {
-				c.Close()
-				return toRespError(err)
-			}
-		}
+		return nil, errors.Trace(err)
 	}
-	select {
-	case <-h.signal:
-		if c != nil {
-			c.Close()
-		}
-		return toRespErrorf("sync master has been closed")
-	case h.master <- c:
-		return redis.NewString("OK"), nil
+	c := newConn(context.Background(), nc, bl, 0)
+	if err := c.ping(); err != nil {
+		c.Close()
+		return nil, err
 	}
+	return c, nil
 }
 
-func (h *Handler) daemonSyncMaster() {
-	var last *conn
-	wait := make(chan int, 0)
-	for exit := false; !exit; {
-		var c *conn
-		select {
-		case <-wait:
-			last = nil
-		case <-h.signal:
-			exit = true
-		case c = <-h.master:
-		}
-		if last != nil {
-			last.Close()
-			<-wait
-		}
-		last = c
-		if c != nil {
-			go func() {
-				defer func() {
-					wait <- 0
-				}()
-				defer c.Close()
-				err := h.doSyncTo(c)
-				log.InfoErrorf(err, "stop sync: %s", c.summ)
-			}()
-			h.syncto = c.nc.RemoteAddr().String()
-			log.Infof("sync to %s", h.syncto)
-		} else {
-			h.syncto = ""
-			log.Infof("sync to no one")
+// doSyncLoop keeps replicating from the master of src, reconnecting after the
+// link is lost, until the source is stopped.
+func (h *Handler) doSyncLoop(src *syncSource, c *conn) {
+	bl := c.Rpdb()
+	for {
+		done := make(chan int)
+		go func(c *conn) {
+			select {
+			case <-src.stop:
+			case <-h.signal:
+			case <-done:
+			}
+			c.Close()
+		}(c)
+		err := h.doSyncTo(src, c)
+		close(done)
+		log.InfoErrorf(err, "stop sync of source %s: %s", src.name, c.summ)
+		src.setStatus("connecting")
+
+		for c = nil; c == nil; {
+			select {
+			case <-src.stop:
+				return
+			case <-h.signal:
+				return
+			case <-time.After(time.Second):
+			}
+			if c, err = dialMaster(src.addr, bl); err != nil {
+				log.InfoErrorf(err, "reconnect to master %s failed", src.addr)
+			}
 		}
 	}
 }
 
-func (h *Handler) doSyncTo(c *conn) error {
+func (h *Handler) doSyncTo(src *syncSource, c *conn) error {
 	defer func() {
-		h.counters.syncTotalBytes.Set(0)
-		h.counters.syncCacheBytes.Set(0)
+		src.counters.totalBytes.Set(0)
+		src.counters.cacheBytes.Set(0)
 	}()
 
-	filePath := h.config.SyncFilePath
+	filePath := src.pipe
 	fileSize := h.config.SyncFileSize
 	buffSize := h.config.SyncBuffSize
 
@@ -243,7 +241,8 @@ func (h *Handler) doSyncTo(c *conn) error {
 				pr.CloseWithError(err)
 				return
 			}
-			h.counters.syncTotalBytes.Add(int64(n))
+			src.counters.totalBytes.Add(int64(n))
+			src.touch()
 			s := p[:n]
 			for len(s) != 0 {
 				n, err := pw.Write(s)
@@ -265,102 +264,195 @@ func (h *Handler) doSyncTo(c *conn) error {
 			if err != nil {
 				return
 			}
-			h.counters.syncCacheBytes.Set(int64(n))
+			src.counters.cacheBytes.Set(int64(n))
 		}
 	}()
 
 	c.r = bufio.NewReader(pr)
 
-	size, err := c.presync()
-	if err != nil {
+	if err := src.state.load(c.Rpdb(), src.name, src.filter.String()); err != nil {
 		return err
 	}
-	log.Infof("sync rdb file size = %d bytes\n", size)
-
-	c.w = bufio.NewWriter(ioutil.Discard)
 
-	if err := c.Rpdb().Reset(); err != nil {
-		return err
+	replid, offset := src.state.get()
+	fullsync := true
+	if id, off, full, err := c.psync(replid, offset); err != nil {
+		if !errors.Equal(err, ErrPSyncRejected) {
+			return err
+		}
+		log.InfoErrorf(err, "psync rejected, fallback to sync")
+		if err := c.sendCommand("sync"); err != nil {
+			return err
+		}
+		replid, offset = "", 0
+	} else {
+		replid, offset, fullsync = id, off, full
 	}
 
-	if err := h.doSyncRDB(c, size); err != nil {
-		return err
+	if fullsync {
+		size, err := c.readBulkSize()
+		if err != nil {
+			return err
+		}
+		log.Infof("sync rdb file size = %d bytes\n", size)
+
+		c.w = bufio.NewWriter(ioutil.Discard)
+
+		src.setStatus("sync")
+		if err := h.doFullSync(src, c, size, replid, offset); err != nil {
+			return err
+		}
+		log.Infof("sync rdb done, replid = %s, offset = %d", replid, offset)
+	} else {
+		c.w = bufio.NewWriter(ioutil.Discard)
+		log.Infof("sync continue, replid = %s, offset = %d", replid, offset)
 	}
-	log.Infof("sync rdb done")
 
-	return c.serve(h)
+	src.state.set(replid, offset)
+	src.setStatus("connected")
+
+	done := make(chan int)
+	defer close(done)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer src.saveState(c.Rpdb())
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+			}
+			if replid != "" {
+				_, offset := src.state.get()
+				if err := c.sendAck(offset); err != nil {
+					log.InfoErrorf(err, "send replconf ack failed")
+				}
+			}
+			src.saveState(c.Rpdb())
+		}
+	}()
+
+	return h.doSyncApply(src, c, replid, offset)
 }
 
-func (h *Handler) doSyncRDB(c *conn, size int64) error {
-	defer h.counters.syncRdbRemains.Set(0)
-	h.counters.syncRdbRemains.Set(size)
+func (h *Handler) doSyncApply(src *syncSource, c *conn, replid string, offset int64) (err error) {
+	a := newApplier(h, src, offset, h.config.SyncApplyWorkers)
+	a.replid, a.skip = replid, src.state.takeApplied()
+	a.onApplied = func(offset int64) {
+		src.state.set(replid, offset)
+	}
+	defer func() {
+		a.close()
+		if errors.Equal(err, ErrSyncUnfiltered) {
+			// the commands before are applied, the next link resyncs
+			if err := src.state.reset(c.Rpdb(), src.name, "", 0); err != nil {
+				log.WarnErrorf(err, "drop sync state of source %s failed", src.name)
+			}
+		}
+	}()
 
-	r := ioutils.NewCountReader(c.r, nil)
-	l := rdb.NewLoader(r)
-	if err := l.Header(); err != nil {
-		return err
+	s := &applySession{bl: c.Rpdb()}
+	for {
+		request, err := redis.Decode(c.r)
+		if err != nil {
+			return err
+		}
+		b, err := redis.EncodeToBytes(request)
+		if err != nil {
+			return err
+		}
+		if err := a.dispatch(s, request, int64(len(b))); err != nil {
+			return err
+		}
 	}
+}
 
-	ncpu := runtime.GOMAXPROCS(0)
-	errs := make(chan error, ncpu)
+// doFullSync loads the rdb into a staging database while the current data is
+// still being served read-only, and switches to it once the rdb is complete. Without
+// staging support the data is reset and reloaded in place.
+//
+// A filtered rdb is loaded into a scratch database instead, and merged into
+// the current data once complete: the keys replicated under the filter are
+// replaced by the ones of the rdb. Without staging support the keys under the
+// filter are deleted, and the rdb is loaded in place.
+//
+// The sync state of the source, replid and offset, is stored with the loaded
+// data, and is dropped while the data is modified in place.
+func (h *Handler) doFullSync(src *syncSource, c *conn, size int64, replid string, offset int64) error {
+	if src.filter != nil {
+		return h.doFilteredSync(src, c, size, replid, offset)
+	}
 
-	var lock sync.Mutex
-	var flag counter.Int64
-	loadNextEntry := func() (*rdb.BinEntry, error) {
-		lock.Lock()
-		defer lock.Unlock()
-		if flag.Get() != 0 {
-			return nil, nil
+	staging, err := c.Rpdb().NewStaging()
+	if err != nil {
+		if !errors.Equal(err, rpdb.ErrStagingDisabled) {
+			return err
 		}
-		entry, err := l.NextBinEntry()
-		if err != nil || entry == nil {
-			flag.Set(1)
-			return nil, err
+		if err := c.Rpdb().Reset(); err != nil {
+			return err
+		}
+		if err := h.doSyncRDB(src, c, c.Rpdb(), size); err != nil {
+			return err
 		}
-		return entry, nil
+		return src.state.reset(c.Rpdb(), src.name, replid, offset)
 	}
 
-	for i := 0; i < ncpu; i++ {
-		go func() {
-			defer flag.Set(1)
-			for {
-				entry, err := loadNextEntry()
-				if err != nil || entry == nil {
-					errs <- err
-					return
-				}
-				db, key, value := entry.DB, entry.Key, entry.Value
-				ttlms := int64(0)
-				if entry.ExpireAt != 0 {
-					if v, ok := rpdb.ExpireAtToTTLms(entry.ExpireAt); ok && v > 0 {
-						ttlms = v
-					} else {
-						ttlms = 1
-					}
-				}
-				if err := c.Rpdb().SlotsRestore(db, key, ttlms, value); err != nil {
-					errs <- err
-					return
-				}
-			}
-		}()
+	if err := h.doSyncRDB(src, c, staging, size); err != nil {
+		c.Rpdb().DiscardStaging(staging)
+		return err
+	}
+	if err := src.state.reset(staging, src.name, replid, offset); err != nil {
+		c.Rpdb().DiscardStaging(staging)
+		return err
+	}
+	if err := c.Rpdb().Replace(staging); err != nil {
+		return err
 	}
+	h.repl.reset()
+	return nil
+}
 
-	for {
-		select {
-		case <-time.After(time.Second):
-			h.counters.syncRdbRemains.Set(size - r.Count())
-		case err := <-errs:
-			for i := 1; i < cap(errs); i++ {
-				e := <-errs
-				if err == nil && e != nil {
-					err = e
-				}
-			}
-			if err != nil {
-				return err
-			}
-			return l.Footer()
+// doFilteredSync is doFullSync for a filtered rdb.
+func (h *Handler) doFilteredSync(src *syncSource, c *conn, size int64, replid string, offset int64) error {
+	bl := c.Rpdb()
+	sp, err := bl.NewScratch(src.name)
+	if err != nil {
+		if !errors.Equal(err, rpdb.ErrStagingDisabled) {
+			return err
+		}
+		if err := src.state.reset(bl, src.name, "", 0); err != nil {
+			return err
+		}
+		if _, err := src.filter.flush(bl, nil); err != nil {
+			return err
+		}
+		if err := h.doSyncRDB(src, c, bl, size); err != nil {
+			return err
 		}
+		return src.state.reset(bl, src.name, replid, offset)
 	}
+
+	if err := h.doSyncRDB(src, c, sp, size); err != nil {
+		bl.DiscardStaging(sp)
+		return err
+	}
+	if err := src.state.reset(bl, src.name, "", 0); err != nil {
+		bl.DiscardStaging(sp)
+		return err
+	}
+	if err := bl.Merge(sp, src.filter.replicated); err != nil {
+		return err
+	}
+	return src.state.reset(bl, src.name, replid, offset)
+}
+
+func (h *Handler) doSyncRDB(src *syncSource, c *conn, bl *rpdb.Rpdb, size int64) error {
+	defer src.counters.rdbRemains.Set(0)
+	src.counters.rdbRemains.Set(size)
+
+	return loadRDB(c.r, bl, src.filter, func(nread, nkeys int64) {
+		src.counters.rdbRemains.Set(size - nread)
+	})
 }
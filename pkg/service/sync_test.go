@@ -4,12 +4,17 @@
 package service
 
 import (
+	"bufio"
+	"context"
+	"net"
 	"os"
 	"strconv"
 	"testing"
 
 	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
 	"github.com/wandoulabs/redis-port/pkg/rdb"
+	"github.com/wandoulabs/redis-port/pkg/redis"
 )
 
 func TestBgsaveTo(t *testing.T) {
@@ -48,3 +53,78 @@ func TestBgsaveTo(t *testing.T) {
 		checkerror(t, nil, string(x) == string(rpdb.FormatInt(int64(i))))
 	}
 }
+
+func TestSyncState(t *testing.T) {
+	name := random(t)
+	_, slot := rpdb.HashKeyToSlot([]byte(name))
+
+	var s1 syncState
+	checkerror(t, s1.load(testbl, name, ""), true)
+	replid, offset := s1.get()
+	checkerror(t, nil, replid == "" && offset == 0)
+	checkerror(t, s1.reset(testbl, name, "8e2d7f", 1024), true)
+
+	bl := testbl.SyncView(name, &rpdb.SyncPos{
+		ReplID: "8e2d7f", Resume: func() int64 { return 2048 },
+		Slots: []uint32{slot}, End: 4096,
+	})
+	checkerror(t, bl.Set(0, []byte(name), []byte("sync")), true)
+
+	var s2 syncState
+	checkerror(t, s2.load(testbl, name, ""), true)
+	replid, offset = s2.get()
+	checkerror(t, nil, replid == "8e2d7f" && offset == 2048)
+	m := s2.takeApplied()
+	checkerror(t, nil, len(m) == 1 && m[slot] == 4096 && s2.takeApplied() == nil)
+
+	s2.set("8e2d7f", 8192)
+	checkerror(t, s2.save(testbl, name), true)
+	var s3 syncState
+	checkerror(t, s3.load(testbl, name, ""), true)
+	replid, offset = s3.get()
+	checkerror(t, nil, replid == "8e2d7f" && offset == 8192 && len(s3.takeApplied()) == 1)
+
+	checkerror(t, s3.load(testbl, name, "db=1"), true)
+	replid, offset = s3.get()
+	checkerror(t, nil, replid == "" && offset == 0 && s3.takeApplied() == nil)
+
+	checkerror(t, s3.reset(testbl, name, "", 0), true)
+	x, err := testbl.SyncState(name)
+	checkerror(t, err, x.ReplID == "" && len(x.Applied) == 0)
+	_, err = testbl.Del(0, []byte(name))
+	checkerror(t, err, true)
+}
+
+func TestApplierSkipped(t *testing.T) {
+	a := &applier{skip: map[uint32]int64{1: 100, 2: 300, rpdb.SyncSerialSlot: 200}}
+	checkerror(t, nil, a.skipped([]uint32{1}, 100) && a.skipped([]uint32{1}, 150))
+	checkerror(t, nil, !a.skipped([]uint32{1}, 250) && a.skipped([]uint32{2}, 250))
+	checkerror(t, nil, a.skipped(nil, 250))
+	checkerror(t, nil, !a.skipped([]uint32{2}, 301) && a.skip == nil)
+}
+
+func TestPSyncResponse(t *testing.T) {
+	nc1, nc2 := net.Pipe()
+	defer nc1.Close()
+	c := newConn(context.Background(), nc2, testbl, 0)
+	defer c.Close()
+
+	go func() {
+		r := bufio.NewReader(nc1)
+		for _, rsp := range []string{"\n+FULLRESYNC 8e2d7f 100\r\n", "+CONTINUE\r\n", "+CONTINUE 9f3e80\r\n", "-ERR unknown command\r\n"} {
+			_, err := redis.Decode(r)
+			checkerror(t, err, true)
+			_, err = nc1.Write([]byte(rsp))
+			checkerror(t, err, true)
+		}
+	}()
+
+	replid, offset, full, err := c.psync("", 0)
+	checkerror(t, err, replid == "8e2d7f" && offset == 100 && full)
+	replid, offset, full, err = c.psync("8e2d7f", 200)
+	checkerror(t, err, replid == "8e2d7f" && offset == 200 && !full)
+	replid, offset, full, err = c.psync("8e2d7f", 300)
+	checkerror(t, err, replid == "9f3e80" && offset == 300 && !full)
+	_, _, _, err = c.psync("9f3e80", 300)
+	checkerror(t, nil, errors.Equal(err, ErrPSyncRejected))
+}
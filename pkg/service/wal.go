@@ -0,0 +1,127 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+	"github.com/wandoulabs/redis-port/pkg/libs/log"
+	"github.com/wandoulabs/redis-port/pkg/redis"
+)
+
+func (h *Handler) infoWAL(w io.Writer) {
+	if h.wal == nil {
+		fmt.Fprintf(w, "wal_enabled:0\n")
+		return
+	}
+	fmt.Fprintf(w, "wal_enabled:1\n")
+	fmt.Fprintf(w, "wal_path:%s\n", h.wal.Dir())
+	fmt.Fprintf(w, "wal_seq:%d\n", h.wal.Seq())
+	fmt.Fprintf(w, "wal_fsync:%s\n", h.config.WALFsync)
+	if err := h.wal.Err(); err != nil {
+		fmt.Fprintf(w, "wal_error:%s\n", err)
+	}
+}
+
+// daemonSyncWAL flushes the write ahead log to the disk every second, with
+// wal_fsync = everysec.
+func (h *Handler) daemonSyncWAL() {
+	for {
+		select {
+		case <-h.signal:
+			return
+		case <-time.After(time.Second):
+			if err := h.wal.Sync(); err != nil {
+				log.WarnErrorf(err, "wal sync failed")
+			}
+		}
+	}
+}
+
+// redoWAL replays the last records of w on bl, if they were written but their
+// writes were not committed before a crash.
+func redoWAL(bl *rpdb.Rpdb, w *rpdb.WAL) error {
+	seq, err := bl.WALSeq()
+	if err != nil {
+		return err
+	}
+	last := w.Seq()
+	if seq >= last {
+		return nil
+	}
+	log.Warnf("wal is ahead of the database, seq = %d, last = %d, redo it", seq, last)
+	_, err = ReplayWAL(bl, w.Dir(), 0, time.Time{})
+	return err
+}
+
+// ReplayWAL replays the write ahead log in dir on bl, from the record after
+// the last write of bl up to the sequence until or the time deadline, zero
+// means no limit. The position in the log is stored with the writes of every
+// command, so an interrupted replay can be started again, and no command is
+// replayed twice. It returns the sequence of the last record replayed.
+func ReplayWAL(bl *rpdb.Rpdb, dir string, until uint64, deadline time.Time) (uint64, error) {
+	h := &Handler{}
+	htable, err := redis.NewHandlerTable(h)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := bl.WALSeq()
+	if err != nil {
+		return 0, err
+	}
+	log.Infof("replay wal '%s' from seq = %d, until = %d, deadline = %v", dir, seq, until, deadline)
+
+	var n int64
+	err = rpdb.ReadWAL(dir, seq, func(r *rpdb.WALRecord) (bool, error) {
+		if until != 0 && r.Seq > until {
+			return false, nil
+		}
+		if !deadline.IsZero() && r.Time > deadline.UnixNano()/int64(time.Millisecond) {
+			return false, nil
+		}
+		if r.Op == "Replace" {
+			return false, errors.Errorf("wal can't be replayed past a replace of the data, seq = %d", r.Seq)
+		}
+		done, err := bl.WALReplayed(r.Seq)
+		if err != nil {
+			return false, err
+		}
+		cmds := r.Forward().Commands()
+		pos := &rpdb.WALStep{Seq: r.Seq, Steps: len(cmds)}
+		s := &applySession{db: r.DB, bl: bl.WALView(pos)}
+		for i, cmd := range cmds {
+			if i <= done {
+				continue
+			}
+			pos.Step = i
+			name := strings.ToLower(string(cmd[0]))
+			f := htable[name]
+			if f == nil {
+				return false, errors.Errorf("replay unknown command %s, seq = %d", name, r.Seq)
+			}
+			if _, err := f(s, cmd[1:]...); err != nil {
+				return false, errors.Errorf("replay command %s failed, seq = %d: %s", name, r.Seq, err)
+			}
+		}
+		// the last command stores the sequence, unless it wrote nothing
+		if err := bl.SetWALSeq(r.Seq); err != nil {
+			return false, err
+		}
+		seq = r.Seq
+		if n++; n%100000 == 0 {
+			log.Infof("replay wal, seq = %d, records = %d", seq, n)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return seq, err
+	}
+	log.Infof("replay wal done, seq = %d, records = %d", seq, n)
+	return seq, nil
+}
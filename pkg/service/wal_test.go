@@ -0,0 +1,98 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package service
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wandoulabs/rpdb/pkg/rpdb"
+	"github.com/wandoulabs/rpdb/pkg/store/rocksdb"
+)
+
+func TestReplayWAL(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-replay"
+	const dir = "/tmp/testdb-wal-replay"
+	os.RemoveAll(path)
+	os.RemoveAll(dir)
+
+	w, err := rpdb.OpenWAL(dir, 1024*1024, 0)
+	checkerror(t, err, true)
+	_, err = w.Append([]*rpdb.Forward{
+		{DB: 0, Op: "Set", Args: []interface{}{"a", "1"}},
+		{DB: 1, Op: "Set", Args: []interface{}{"b", "2"}},
+		{DB: 0, Op: "Del", Args: []interface{}{"a"}},
+	})
+	checkerror(t, err, true)
+	w.Commit()
+	w.Close()
+
+	db, err := rocksdb.Open(path, rocksdb.NewDefaultConfig(), true, false)
+	checkerror(t, err, true)
+	bl := rpdb.New(db)
+	defer bl.Close()
+
+	seq, err := ReplayWAL(bl, dir, 2, time.Time{})
+	checkerror(t, err, seq == 2)
+	v, err := bl.Get(0, "a")
+	checkerror(t, err, string(v) == "1")
+	v, err = bl.Get(1, "b")
+	checkerror(t, err, string(v) == "2")
+
+	seq, err = ReplayWAL(bl, dir, 0, time.Time{})
+	checkerror(t, err, seq == 3)
+	v, err = bl.Get(0, "a")
+	checkerror(t, err, v == nil)
+	seq, err = bl.WALSeq()
+	checkerror(t, err, seq == 3)
+
+	checkerror(t, bl.SetWALSeq(2), true)
+	w, err = rpdb.OpenWAL(dir, 1024*1024, 0)
+	checkerror(t, err, bl.SetWAL(w) != nil)
+	checkerror(t, redoWAL(bl, w), bl.SetWAL(w) == nil)
+	seq, err = bl.WALSeq()
+	checkerror(t, err, seq == 3)
+}
+
+func TestReplayWALInterrupted(t *testing.T) {
+	const path = "/tmp/testdb-rocksdb-replay-interrupted"
+	const dir = "/tmp/testdb-wal-replay-interrupted"
+	os.RemoveAll(path)
+	os.RemoveAll(dir)
+
+	expireat := uint64(time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond))
+	w, err := rpdb.OpenWAL(dir, 1024*1024, 0)
+	checkerror(t, err, true)
+	_, err = w.Append([]*rpdb.Forward{
+		{DB: 0, Op: "Set", Args: []interface{}{"a", "1"}},
+		{DB: 0, Op: "IncrBy", Args: []interface{}{"a", int64(2)}},
+		{DB: 0, Op: "SetEXAt", Args: []interface{}{"b", expireat, "x"}},
+	})
+	checkerror(t, err, true)
+	w.Commit()
+	w.Close()
+
+	db, err := rocksdb.Open(path, rocksdb.NewDefaultConfig(), true, false)
+	checkerror(t, err, true)
+	bl := rpdb.New(db)
+	defer bl.Close()
+
+	seq, err := ReplayWAL(bl, dir, 2, time.Time{})
+	checkerror(t, err, seq == 2)
+
+	// the SET of the last record is committed, its PEXPIREAT is not
+	checkerror(t, bl.WALView(&rpdb.WALStep{Seq: 3, Steps: 2}).Set(0, "b", "y"), true)
+	seq, err = ReplayWAL(bl, dir, 0, time.Time{})
+	checkerror(t, err, seq == 3)
+	v, err := bl.Get(0, "b")
+	checkerror(t, err, string(v) == "y")
+	ttl, err := bl.PTTL(0, "b")
+	checkerror(t, err, ttl > 0)
+
+	seq, err = ReplayWAL(bl, dir, 0, time.Time{})
+	checkerror(t, err, seq == 3)
+	v, err = bl.Get(0, "a")
+	checkerror(t, err, string(v) == "3")
+}
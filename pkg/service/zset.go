@@ -19,7 +19,7 @@ func (h *Handler) ZGetAll(arg0 interface{}, args [][]byte) (redis.Resp, error) {
 		return toRespError(err)
 	}
 
-	if a, err := s.Rpdb().ZGetAll(s.DB(), iconvert(args)...); err != nil {
+	if a, err := s.Rpdb().ZGetAllContext(s.Context(), s.DB(), iconvert(args)...); err != nil {
 		return toRespError(err)
 	} else {
 		resp := redis.NewArray()
@@ -0,0 +1,88 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package store
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+)
+
+// CopyDir copies the files under the directory src to dst, which must not
+// exist.
+func CopyDir(src, dst string) error {
+	return errors.Trace(filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.Mkdir(target, 0700)
+		}
+		return copyFile(path, target)
+	}))
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// ReplaceDir replaces the directory dst with a copy of src. The copy is made
+// next to dst first, so dst is left untouched if copying fails.
+func ReplaceDir(src, dst string) error {
+	if _, err := os.Stat(src); err != nil {
+		return errors.Trace(err)
+	}
+	tmp := dst + ".restore"
+	if err := os.RemoveAll(tmp); err != nil {
+		return errors.Trace(err)
+	}
+	if err := CopyDir(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.RemoveAll(dst); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.Rename(tmp, dst))
+}
+
+// RenameDir moves the directory src to dst, the old dst is removed only after
+// src is in place.
+func RenameDir(src, dst string) error {
+	old := dst + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return errors.Trace(err)
+	}
+	if err := os.Rename(dst, old); err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		os.Rename(old, dst)
+		return errors.Trace(err)
+	}
+	return errors.Trace(os.RemoveAll(old))
+}
@@ -0,0 +1,35 @@
+package boltdb
+
+import (
+	"os"
+	"path"
+
+	"github.com/boltdb/bolt"
+	"github.com/wandoulabs/rpdb/pkg/store"
+)
+
+// Backup copies the database file within a read transaction into the
+// directory dir, replacing the previous backup there once the copy is
+// complete.
+func (db *BoltDB) Backup(dir string) error {
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path.Join(tmp, "rpdb_bolt.db"), 0600)
+	})
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return store.RenameDir(tmp, dir)
+}
+
+// Restore replaces the database at dbPath with the backup taken by Backup.
+func Restore(backup, dbPath string) error {
+	return store.ReplaceDir(backup, dbPath)
+}
@@ -3,6 +3,8 @@
 
 package store
 
+import "time"
+
 type Database interface {
 	Close()
 	Clear() error
@@ -12,4 +14,54 @@ type Database interface {
 	Compact(start, limit []byte) error
 	Get(key []byte) ([]byte, error)
 	Stats() string
+
+	// Backup takes a consistent backup of the database into the directory
+	// path, which the Restore function of the same engine accepts.
+	Backup(path string) error
+}
+
+// BackupInfo is the manifest of a backup kept in a backup directory.
+type BackupInfo struct {
+	ID        uint32
+	Timestamp int64
+	Sequence  uint64
+	Size      int64
+	Files     []BackupFile
+}
+
+// BackupFile is a file of a backup, the name is relative to the backup
+// directory and the checksum is a crc32c of the content.
+type BackupFile struct {
+	Name     string
+	Size     int64
+	Checksum uint32
+}
+
+// BackupManager is implemented by the engines that keep incremental backups
+// in a backup directory, where the unchanged files are shared between them.
+type BackupManager interface {
+	// ListBackups returns the backups in path, from the oldest to the newest.
+	ListBackups(path string) ([]*BackupInfo, error)
+
+	// VerifyBackups checks the checksum of every file of the backups ids in
+	// path, or of all the backups if ids is empty.
+	VerifyBackups(path string, ids []uint32) error
+
+	// PurgeBackups deletes the backups in path beyond the newest keep ones,
+	// or older than age, but never the newest one. Zero keep or age means
+	// no limit.
+	PurgeBackups(path string, keep int, age time.Duration) error
+}
+
+// Range is the keys from Start up to, but not including, Limit.
+type Range struct {
+	Start, Limit []byte
+}
+
+// SizeEstimator is implemented by the engines that estimate the space used
+// on disk by ranges of keys, without reading them.
+type SizeEstimator interface {
+	// ApproximateSizes returns the approximate size in bytes of each of the
+	// ranges, the writes not flushed to the disk yet may not be counted.
+	ApproximateSizes(ranges []Range) []uint64
 }
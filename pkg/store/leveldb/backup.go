@@ -0,0 +1,80 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package leveldb
+
+import (
+	"os"
+
+	"github.com/wandoulabs/rpdb/extern/levigo"
+	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+)
+
+const backupBatchSize = 4 * 1024 * 1024
+
+// Backup copies a snapshot of the database into a new leveldb database at
+// path, replacing the previous backup there once the copy is complete.
+func (db *LevelDB) Backup(path string) error {
+	tmp := path + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return errors.Trace(err)
+	}
+	if err := db.backupTo(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return store.RenameDir(tmp, path)
+}
+
+func (db *LevelDB) backupTo(path string) error {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	opts.SetErrorIfExists(true)
+	opts.SetCompression(levigo.SnappyCompression)
+
+	bk, err := levigo.Open(path, opts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer bk.Close()
+
+	snap := db.lvdb.NewSnapshot()
+	defer db.lvdb.ReleaseSnapshot(snap)
+	ropt := levigo.NewReadOptions()
+	defer ropt.Close()
+	ropt.SetFillCache(false)
+	ropt.SetSnapshot(snap)
+
+	wopt := levigo.NewWriteOptions()
+	defer wopt.Close()
+	wb := levigo.NewWriteBatch()
+	defer wb.Close()
+
+	it := db.lvdb.NewIterator(ropt)
+	defer it.Close()
+
+	var size int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		key, value := it.Key(), it.Value()
+		wb.Put(key, value)
+		if size += len(key) + len(value); size >= backupBatchSize {
+			if err := bk.Write(wopt, wb); err != nil {
+				return errors.Trace(err)
+			}
+			wb.Clear()
+			size = 0
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return errors.Trace(err)
+	}
+	wopt.SetSync(true)
+	return errors.Trace(bk.Write(wopt, wb))
+}
+
+// Restore replaces the database at path with the backup taken by Backup.
+func Restore(backup, path string) error {
+	return store.ReplaceDir(backup, path)
+}
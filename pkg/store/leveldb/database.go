@@ -143,6 +143,17 @@ func (db *LevelDB) Compact(start, limit []byte) error {
 	return nil
 }
 
+func (db *LevelDB) ApproximateSizes(ranges []store.Range) []uint64 {
+	if len(ranges) == 0 {
+		return nil
+	}
+	rs := make([]levigo.Range, len(ranges))
+	for i, r := range ranges {
+		rs[i] = levigo.Range{r.Start, r.Limit}
+	}
+	return db.lvdb.GetApproximateSizes(rs)
+}
+
 func (db *LevelDB) Stats() string {
 	var b bytes.Buffer
 	for _, s := range []string{"leveldb.stats", "leveldb.sstables"} {
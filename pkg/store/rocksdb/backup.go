@@ -0,0 +1,216 @@
+// Copyright 2014 Wandoujia Inc. All Rights Reserved.
+// Licensed under the MIT (MIT-LICENSE.txt) license.
+
+package rocksdb
+
+import (
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wandoulabs/rpdb/extern/gorocks"
+	"github.com/wandoulabs/rpdb/pkg/store"
+	"github.com/wandoulabs/redis-port/pkg/libs/errors"
+)
+
+// Backup adds a new backup of the database to the backup directory path with
+// the rocksdb backup engine. The memtables are flushed first, and the table
+// files already in path are shared rather than copied again.
+func (db *RocksDB) Backup(path string) error {
+	be, err := gorocks.OpenBackupEngine(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer be.Close()
+	return errors.Trace(be.CreateNewBackup(db.rkdb, true))
+}
+
+func (db *RocksDB) ListBackups(path string) ([]*store.BackupInfo, error) {
+	return ListBackups(path)
+}
+
+func (db *RocksDB) VerifyBackups(path string, ids []uint32) error {
+	return VerifyBackups(path, ids)
+}
+
+func (db *RocksDB) PurgeBackups(path string, keep int, age time.Duration) error {
+	return PurgeBackups(path, keep, age)
+}
+
+// Restore replaces the database at path with the latest backup in the backup
+// directory backup.
+func Restore(backup, path string) error {
+	be, err := gorocks.OpenBackupEngine(backup)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer be.Close()
+	return errors.Trace(be.RestoreDBFromLatestBackup(path, path))
+}
+
+// ListBackups reads the manifests of the backups in path, which are the meta
+// files written by the backup engine, without opening the engine. So it is
+// safe to call it while a backup is running.
+func ListBackups(path string) ([]*store.BackupInfo, error) {
+	ids, err := backupIDs(path)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*store.BackupInfo, 0, len(ids))
+	for _, id := range ids {
+		info, err := loadBackupMeta(path, id)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func backupIDs(path string) ([]uint32, error) {
+	fis, err := ioutil.ReadDir(filepath.Join(path, "meta"))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var ids []uint32
+	for _, fi := range fis {
+		if id, err := strconv.ParseUint(fi.Name(), 10, 32); err == nil && !fi.IsDir() {
+			ids = append(ids, uint32(id))
+		}
+	}
+	sort.Sort(uint32s(ids))
+	return ids, nil
+}
+
+type uint32s []uint32
+
+func (s uint32s) Len() int           { return len(s) }
+func (s uint32s) Less(i, j int) bool { return s[i] < s[j] }
+func (s uint32s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// loadBackupMeta parses the meta file of the backup id, which is
+//   <timestamp>
+//   <sequence>
+//   <number of files>
+//   <file> crc32 <checksum>
+//   ...
+// A missing file is reported with size -1.
+func loadBackupMeta(path string, id uint32) (*store.BackupInfo, error) {
+	name := filepath.Join(path, "meta", strconv.FormatUint(uint64(id), 10))
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) < 3 {
+		return nil, errors.Errorf("invalid backup meta file '%s'", name)
+	}
+	info := &store.BackupInfo{ID: id}
+	if info.Timestamp, err = strconv.ParseInt(lines[0], 10, 64); err != nil {
+		return nil, errors.Errorf("invalid backup meta file '%s', timestamp = %s", name, lines[0])
+	}
+	if info.Sequence, err = strconv.ParseUint(lines[1], 10, 64); err != nil {
+		return nil, errors.Errorf("invalid backup meta file '%s', sequence = %s", name, lines[1])
+	}
+	n, err := strconv.Atoi(lines[2])
+	if err != nil || n != len(lines)-3 {
+		return nil, errors.Errorf("invalid backup meta file '%s', files = %s", name, lines[2])
+	}
+	for _, line := range lines[3:] {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[1] != "crc32" {
+			return nil, errors.Errorf("invalid backup meta file '%s', line = %s", name, line)
+		}
+		checksum, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid backup meta file '%s', line = %s", name, line)
+		}
+		f := store.BackupFile{Name: fields[0], Size: -1, Checksum: uint32(checksum)}
+		if fi, err := os.Stat(filepath.Join(path, f.Name)); err == nil {
+			f.Size = fi.Size()
+			info.Size += f.Size
+		}
+		info.Files = append(info.Files, f)
+	}
+	return info, nil
+}
+
+// VerifyBackups checks the files of the backups ids in path against their
+// manifests, the files shared by several backups are read only once.
+func VerifyBackups(path string, ids []uint32) error {
+	if len(ids) == 0 {
+		var err error
+		if ids, err = backupIDs(path); err != nil {
+			return err
+		}
+	}
+	verified := make(map[string]bool)
+	for _, id := range ids {
+		info, err := loadBackupMeta(path, id)
+		if err != nil {
+			return err
+		}
+		for _, f := range info.Files {
+			if verified[f.Name] {
+				continue
+			}
+			checksum, err := checksumFile(filepath.Join(path, f.Name))
+			if err != nil {
+				return errors.Errorf("backup %d is corrupted, file %s: %s", id, f.Name, err)
+			}
+			if checksum != f.Checksum {
+				return errors.Errorf("backup %d is corrupted, file %s: crc32 = %d, expect = %d", id, f.Name, checksum, f.Checksum)
+			}
+			verified[f.Name] = true
+		}
+	}
+	return nil
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksumFile(name string) (uint32, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer f.Close()
+	h := crc32.New(castagnoli)
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return h.Sum32(), nil
+}
+
+// PurgeBackups deletes the old backups in path with the backup engine, the
+// shared files no longer used by any backup are deleted as well. It must not
+// run concurrently with a backup to the same path.
+func PurgeBackups(path string, keep int, age time.Duration) error {
+	be, err := gorocks.OpenBackupEngine(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer be.Close()
+
+	infos := be.GetBackupInfo()
+	if age > 0 {
+		expire := time.Now().Add(-age).Unix()
+		for i := 0; i < len(infos)-1; i++ {
+			if infos[i].Timestamp < expire {
+				if err := be.DeleteBackup(infos[i].ID); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+	}
+	if keep > 0 {
+		return errors.Trace(be.PurgeOldBackups(uint32(keep)))
+	}
+	return nil
+}
@@ -176,6 +176,17 @@ func (db *RocksDB) Compact(start, limit []byte) error {
 	return nil
 }
 
+func (db *RocksDB) ApproximateSizes(ranges []store.Range) []uint64 {
+	if len(ranges) == 0 {
+		return nil
+	}
+	rs := make([]gorocks.Range, len(ranges))
+	for i, r := range ranges {
+		rs[i] = gorocks.Range{r.Start, r.Limit}
+	}
+	return db.rkdb.GetApproximateSizes(rs)
+}
+
 func (db *RocksDB) Stats() string {
 	var b bytes.Buffer
 	for _, s := range []string{"rocksdb.stats", "rocksdb.sstables"} {